@@ -184,6 +184,7 @@ func (c *Client) Discover(ctx context.Context) (Directory, error) {
 		Revoke    string `json:"revokeCert"`
 		Nonce     string `json:"newNonce"`
 		KeyChange string `json:"keyChange"`
+		RenewInfo string `json:"renewalInfo"`
 		Meta      struct {
 			Terms        string   `json:"termsOfService"`
 			Website      string   `json:"website"`
@@ -204,6 +205,7 @@ func (c *Client) Discover(ctx context.Context) (Directory, error) {
 		RevokeURL:               v.Revoke,
 		NonceURL:                v.Nonce,
 		KeyChangeURL:            v.KeyChange,
+		RenewalInfoURL:          v.RenewInfo,
 		Terms:                   v.Meta.Terms,
 		Website:                 v.Meta.Website,
 		CAA:                     v.Meta.CAA,
@@ -0,0 +1,318 @@
+package acmetest
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/internal/jose"
+)
+
+// account is an ACME account registered with the CAServer.
+type account struct {
+	Status  string   `json:"status"`
+	Contact []string `json:"contact,omitempty"`
+	Orders  string   `json:"orders"`
+
+	id         int
+	url        string
+	key        crypto.PublicKey
+	thumbprint string // JWK thumbprint of key
+}
+
+// request is a POST request authenticated by its JWS signature.
+type request struct {
+	header  *jose.Header
+	payload []byte           // empty for POST-as-GET requests
+	key     crypto.PublicKey // key which signed the request
+	account *account         // nil if signed with a JWK
+}
+
+// decode decodes the JSON payload of the request into v,
+// leaving v unchanged for POST-as-GET requests.
+func (r *request) decode(v any) error {
+	if len(r.payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.payload, v)
+}
+
+// problem is an ACME error response, see RFC 8555, Section 6.7.
+type problem struct {
+	Type        string       `json:"type"`
+	Detail      string       `json:"detail"`
+	Status      int          `json:"status,omitempty"`
+	Subproblems []subproblem `json:"subproblems,omitempty"`
+}
+
+// subproblem is a problem specific to one identifier of a request,
+// see RFC 8555, Section 6.7.1.
+type subproblem struct {
+	Type       string      `json:"type"`
+	Detail     string      `json:"detail"`
+	Identifier *identifier `json:"identifier,omitempty"`
+}
+
+// newProblem returns a problem with the given status code and the
+// ACME error type typ, such as "malformed".
+func newProblem(status int, typ, format string, a ...any) *problem {
+	return &problem{
+		Type:   "urn:ietf:params:acme:error:" + typ,
+		Detail: fmt.Sprintf(format, a...),
+		Status: status,
+	}
+}
+
+func (p *problem) Error() string {
+	return fmt.Sprintf("%d %s: %s", p.Status, p.Type, p.Detail)
+}
+
+// writeProblem writes the problem p as the response. Unlike httpErrorf,
+// it doesn't fail the test: clients are expected to handle these errors.
+func (ca *CAServer) writeProblem(w http.ResponseWriter, p *problem) {
+	ca.t.Logf("problem: %v", p)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		panic(fmt.Sprintf("problem response: %v", err))
+	}
+}
+
+// verifyRequest authenticates the JWS of the POST request r,
+// signed either with a JWK or by an account.
+func (ca *CAServer) verifyRequest(r *http.Request) (*request, *problem) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "%v", err)
+	}
+	jws, header, payload, err := jose.Parse(body)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "%v", err)
+	}
+	if header.URL != ca.server.URL+r.URL.Path {
+		return nil, newProblem(http.StatusUnauthorized, "unauthorized", "JWS url %q doesn't match the request URL", header.URL)
+	}
+	req := &request{header: header, payload: payload}
+	switch {
+	case len(header.JWK) > 0 && header.KID != "":
+		return nil, newProblem(http.StatusBadRequest, "malformed", "JWS has both jwk and kid")
+	case len(header.JWK) > 0:
+		req.key, err = jose.ParseJWK(header.JWK)
+		if err != nil {
+			return nil, newProblem(http.StatusBadRequest, "malformed", "%v", err)
+		}
+	case header.KID != "":
+		ca.mu.Lock()
+		a := ca.accountByURL(header.KID)
+		var status string
+		if a != nil {
+			req.key, status = a.key, a.Status
+		}
+		ca.mu.Unlock()
+		if a == nil {
+			return nil, newProblem(http.StatusBadRequest, "accountDoesNotExist", "no account %s", header.KID)
+		}
+		if status != acme.StatusValid {
+			return nil, newProblem(http.StatusUnauthorized, "unauthorized", "account %s is %s", header.KID, status)
+		}
+		req.account = a
+	default:
+		return nil, newProblem(http.StatusBadRequest, "malformed", "JWS has neither jwk nor kid")
+	}
+	if err := jws.Verify(header.Alg, req.key); err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "%v", err)
+	}
+	return req, nil
+}
+
+// accountByURL returns the account with the given URL, or nil if there's none.
+// It requires ca.mu to be locked.
+func (ca *CAServer) accountByURL(url string) *account {
+	id, err := strconv.Atoi(strings.TrimPrefix(url, ca.serverURL("/accounts/")))
+	if err != nil || id < 1 || id > len(ca.accounts) {
+		return nil
+	}
+	return ca.accounts[id-1]
+}
+
+// handleNewAccount registers the key of req, or finds its account.
+// See RFC 8555, Section 7.3.
+func (ca *CAServer) handleNewAccount(w http.ResponseWriter, req *request) {
+	var payload struct {
+		Contact                []string
+		OnlyReturnExisting     bool
+		ExternalAccountBinding json.RawMessage
+	}
+	if err := req.decode(&payload); err != nil {
+		ca.httpErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	thumbprint, err := acme.JWKThumbprint(req.key)
+	if err != nil {
+		ca.httpErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if a, ok := ca.accountKeys[thumbprint]; ok {
+		w.Header().Set("Location", a.url)
+		if err := json.NewEncoder(w).Encode(a); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if payload.OnlyReturnExisting {
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "accountDoesNotExist", "no account for the key"))
+		return
+	}
+	if ca.eabRequired && len(payload.ExternalAccountBinding) == 0 {
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "externalAccountRequired", "registration failed: no JWS for EAB"))
+		return
+	}
+
+	a := &account{
+		Status:     acme.StatusValid,
+		Contact:    payload.Contact,
+		id:         len(ca.accounts) + 1,
+		key:        req.key,
+		thumbprint: thumbprint,
+	}
+	a.url = ca.serverURL("/accounts/%d", a.id)
+	a.Orders = a.url + "/orders"
+	ca.accounts = append(ca.accounts, a)
+	ca.accountKeys[thumbprint] = a
+	w.Header().Set("Location", a.url)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(a); err != nil {
+		panic(err)
+	}
+}
+
+// handleKeyChange rolls the key of the account of req over to the key
+// which signed the inner JWS of the request. See RFC 8555, Section 7.3.5.
+func (ca *CAServer) handleKeyChange(w http.ResponseWriter, req *request) {
+	jws, header, payload, err := jose.Parse(req.payload)
+	if err != nil {
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "malformed", "inner %v", err))
+		return
+	}
+	if len(header.JWK) == 0 || header.KID != "" {
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "malformed", "inner JWS must be signed with a JWK"))
+		return
+	}
+	if header.URL != req.header.URL {
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "malformed", "inner JWS url %q doesn't match the outer one", header.URL))
+		return
+	}
+	newKey, err := jose.ParseJWK(header.JWK)
+	if err == nil {
+		err = jws.Verify(header.Alg, newKey)
+	}
+	if err != nil {
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "malformed", "inner %v", err))
+		return
+	}
+	var p struct {
+		Account string          `json:"account"`
+		OldKey  json.RawMessage `json:"oldKey"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "malformed", "inner JWS payload: %v", err))
+		return
+	}
+	oldKey, err := jose.ParseJWK(p.OldKey)
+	if err != nil {
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "malformed", "oldKey: %v", err))
+		return
+	}
+	oldThumbprint, _ := acme.JWKThumbprint(oldKey)
+	newThumbprint, err := acme.JWKThumbprint(newKey)
+	if err != nil {
+		ca.httpErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	a := req.account
+	if p.Account != a.url || oldThumbprint != a.thumbprint {
+		ca.writeProblem(w, newProblem(http.StatusUnauthorized, "unauthorized", "account and oldKey don't match the signer of the request"))
+		return
+	}
+	if other, ok := ca.accountKeys[newThumbprint]; ok {
+		w.Header().Set("Location", other.url)
+		ca.writeProblem(w, newProblem(http.StatusConflict, "malformed", "the new key is already in use by %s", other.url))
+		return
+	}
+	delete(ca.accountKeys, a.thumbprint)
+	a.key = newKey
+	a.thumbprint = newThumbprint
+	ca.accountKeys[newThumbprint] = a
+	ca.t.Logf("account %d key rolled over", a.id)
+	if err := json.NewEncoder(w).Encode(a); err != nil {
+		panic(err)
+	}
+}
+
+// handleAccount updates or deactivates the account at url,
+// or returns it for POST-as-GET requests. See RFC 8555, Section 7.3.2.
+func (ca *CAServer) handleAccount(w http.ResponseWriter, req *request, url string) {
+	var payload struct {
+		Contact []string
+		Status  string
+	}
+	if err := req.decode(&payload); err != nil {
+		ca.httpErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	a := req.account
+	if a.url != url {
+		ca.writeProblem(w, newProblem(http.StatusForbidden, "unauthorized", "the account belongs to another key"))
+		return
+	}
+	switch payload.Status {
+	case "":
+	case acme.StatusDeactivated:
+		a.Status = acme.StatusDeactivated
+		ca.t.Logf("account %d is now %s", a.id, a.Status)
+	default:
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "malformed", "invalid account status %q", payload.Status))
+		return
+	}
+	if payload.Contact != nil {
+		a.Contact = payload.Contact
+	}
+	w.Header().Set("Location", a.url)
+	if err := json.NewEncoder(w).Encode(a); err != nil {
+		panic(err)
+	}
+}
+
+// handleAccountOrders lists the orders of the account at url.
+// See RFC 8555, Section 7.1.2.1.
+func (ca *CAServer) handleAccountOrders(w http.ResponseWriter, req *request, url string) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if req.account.url != url {
+		ca.writeProblem(w, newProblem(http.StatusForbidden, "unauthorized", "the account belongs to another key"))
+		return
+	}
+	resp := struct {
+		Orders []string `json:"orders"`
+	}{Orders: []string{}}
+	for i, o := range ca.orders {
+		if o.account == req.account.id {
+			resp.Orders = append(resp.Orders, ca.serverURL("/orders/%d", i))
+		}
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		panic(err)
+	}
+}
@@ -2,18 +2,25 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package acmetest provides types for testing acme and autocert packages.
+// Package acmetest provides an in-process ACME CA for testing ACME clients,
+// such as the acme and certmgr packages, without network access.
 //
-// TODO: Consider moving this to x/crypto/acme/internal/acmetest for acme tests as well.
+// The CA implements the RFC 8555 flow with multiple accounts: requests are
+// authenticated with their JWS signatures, and challenges are validated
+// against the key authorizations of the accounts. The addresses of the
+// identifiers and the TXT records of dns-01 challenges are resolved with
+// hooks instead of the DNS.
 package acmetest
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -28,6 +35,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -42,34 +50,66 @@ type CAServer struct {
 	rootKey      crypto.Signer
 	rootCert     []byte // DER encoding
 	rootTemplate *x509.Certificate
+	altRoots     [][]byte // DER encoding of the roots of the alternate chains
 
-	t              *testing.T
+	t              testing.TB
 	server         *httptest.Server
 	issuer         pkix.Name
 	challengeTypes []string
 	url            string
 	roots          *x509.CertPool
 	eabRequired    bool
+	caaIdentities  []string
+	renewalWindow  *acme.RenewalWindow // suggested ARI window, if enabled
+	renewalInfo    bool                // whether the ARI endpoint is enabled
+	altChains      int                 // number of alternate chains
 
 	mu             sync.Mutex
 	certCount      int                           // number of issued certs
-	acctRegistered bool                          // set once an account has been registered
+	accounts       []*account                    // index+1 is used as account ID
+	accountKeys    map[string]*account           // accounts by JWK thumbprint of their key
 	domainAddr     map[string]string             // domain name to addr:port resolution
 	domainGetCert  map[string]getCertificateFunc // domain name to GetCertificate function
 	domainHandler  map[string]http.Handler       // domain name to Handle function
-	validAuthz     map[string]*authorization     // valid authz, keyed by domain name
+	lookupTXT      lookupTXTFunc                 // resolves dns-01 challenge records
+	validAuthz     map[string]*authorization     // valid authz, keyed by account ID and domain name
 	authorizations []*authorization              // all authz, index is used as ID
 	orders         []*order                      // index is used as order ID
-	errors         []error                       // encountered client errors
+	replaces       []string                      // ARI cert IDs sent in new orders
+	issued         []IssuedCert                  // issued certs, in order of issuance
+
+	// Scripted failures and time control, see faults.go.
+	badNonces        int               // POST requests to reject with badNonce
+	rateLimits       []*rateLimit      // requests to answer with 429
+	invalidOrders    int               // finalized orders to make invalid
+	orderSubproblems []acme.Subproblem // subproblems of the invalid orders
+	processingDelay  time.Duration     // time finalized orders are processing
+	latency          time.Duration     // delay of every response
+	certValidity     time.Duration     // validity of the issued certs, if not zero
+	clock            func() time.Time  // current time, if not nil
+	errors           []error           // encountered client errors
 }
 
 type getCertificateFunc func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
 
+type lookupTXTFunc func(ctx context.Context, name string) ([]string, error)
+
+// IssuedCert is a certificate issued by the CAServer for an order.
+type IssuedCert struct {
+	Account     string // URL of the account which placed the order
+	Order       string // URL of the order
+	Certificate *x509.Certificate
+
+	Revoked          bool // whether the certificate has been revoked
+	RevocationReason acme.CRLReasonCode
+}
+
 // NewCAServer creates a new ACME test server. The returned CAServer issues
 // certs signed with the CA roots available in the Roots field.
-func NewCAServer(t *testing.T) *CAServer {
+func NewCAServer(t testing.TB) *CAServer {
 	ca := &CAServer{t: t,
 		challengeTypes: []string{"fake-01", "tls-alpn-01", "http-01"},
+		accountKeys:    make(map[string]*account),
 		domainAddr:     make(map[string]string),
 		domainGetCert:  make(map[string]getCertificateFunc),
 		domainHandler:  make(map[string]http.Handler),
@@ -116,7 +156,22 @@ func (ca *CAServer) generateRoot() {
 	ca.roots.AddCert(cert)
 	ca.rootKey = key
 	ca.rootCert = der
-	ca.rootTemplate = tmpl
+	// Use the parsed cert, which has a generated subject key ID,
+	// so that leaf certs carry an authority key ID for ARI.
+	ca.rootTemplate = cert
+
+	// The alternate roots have the same name and key,
+	// like cross-signed versions of the root.
+	for i := range ca.altChains {
+		alt := *tmpl
+		alt.SerialNumber = big.NewInt(int64(i + 2))
+		alt.NotAfter = tmpl.NotAfter.Add(time.Duration(i+1) * 24 * time.Hour)
+		der, err := x509.CreateCertificate(rand.Reader, &alt, &alt, &key.PublicKey, key)
+		if err != nil {
+			panic(fmt.Sprintf("x509.CreateCertificate: %v", err))
+		}
+		ca.altRoots = append(ca.altRoots, der)
+	}
 }
 
 // IssuerName sets the name of the issuing CA.
@@ -162,6 +217,63 @@ func (ca *CAServer) ExternalAccountRequired() *CAServer {
 	return ca
 }
 
+// CAAIdentities sets the CAA identities advertised in the directory.
+func (ca *CAServer) CAAIdentities(ids ...string) *CAServer {
+	if ca.url != "" {
+		panic("CAAIdentities must be called before Start")
+	}
+	ca.caaIdentities = ids
+	return ca
+}
+
+// RenewalWindow enables the ACME Renewal Information endpoint,
+// which suggests the given window for every certificate.
+func (ca *CAServer) RenewalWindow(start, end time.Time) *CAServer {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.renewalInfo = true
+	ca.renewalWindow = &acme.RenewalWindow{Start: start, End: end}
+	return ca
+}
+
+// RenewalInfo enables the ACME Renewal Information endpoint, which
+// suggests renewing the issued certificates during the second half of
+// the last third of their validity, and right away once revoked.
+// Unlike RenewalWindow, it only knows the certificates issued for orders.
+func (ca *CAServer) RenewalInfo() *CAServer {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.renewalInfo = true
+	return ca
+}
+
+// AlternateChains makes the CA offer n alternate chains for the issued
+// certificates, advertised with Link headers. The alternate chains end
+// with other versions of the root, of the same name and key.
+func (ca *CAServer) AlternateChains(n int) *CAServer {
+	if ca.url != "" {
+		panic("AlternateChains must be called before Start")
+	}
+	ca.altChains = n
+	return ca
+}
+
+// Replaces returns the ARI certificate IDs that clients sent
+// in the replaces field of new orders.
+func (ca *CAServer) Replaces() []string {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return append([]string(nil), ca.replaces...)
+}
+
+// IssuedCerts returns the certificates issued for orders so far,
+// in order of issuance.
+func (ca *CAServer) IssuedCerts() []IssuedCert {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return slices.Clone(ca.issued)
+}
+
 // Start starts serving requests. The server address becomes available in the
 // URL field.
 func (ca *CAServer) Start() *CAServer {
@@ -221,6 +333,15 @@ func (ca *CAServer) ResolveGetCertificate(domain string, f getCertificateFunc) {
 	ca.domainGetCert[domain] = f
 }
 
+// LookupTXT sets the function used to resolve the TXT records
+// of dns-01 challenges, in place of a real DNS resolver. The name
+// is fully qualified, such as "_acme-challenge.example.org.".
+func (ca *CAServer) LookupTXT(f func(ctx context.Context, name string) ([]string, error)) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.lookupTXT = f
+}
+
 // ResolveHandler redirects HTTP requests for domain to f when
 // validating challenges for the domain authorization.
 func (ca *CAServer) ResolveHandler(domain string, h http.Handler) {
@@ -234,12 +355,16 @@ type discovery struct {
 	NewAccount string `json:"newAccount"`
 	NewOrder   string `json:"newOrder"`
 	NewAuthz   string `json:"newAuthz"`
+	RevokeCert string `json:"revokeCert"`
+	KeyChange  string `json:"keyChange"`
+	RenewInfo  string `json:"renewalInfo,omitempty"`
 
 	Meta discoveryMeta `json:"meta,omitempty"`
 }
 
 type discoveryMeta struct {
-	ExternalAccountRequired bool `json:"externalAccountRequired,omitempty"`
+	ExternalAccountRequired bool     `json:"externalAccountRequired,omitempty"`
+	CAA                     []string `json:"caaIdentities,omitempty"`
 }
 
 type challenge struct {
@@ -249,11 +374,33 @@ type challenge struct {
 }
 
 type authorization struct {
+	Identifier identifier  `json:"identifier"`
 	Status     string      `json:"status"`
 	Challenges []challenge `json:"challenges"`
+	Wildcard   bool        `json:"wildcard,omitempty"`
+
+	domain  string
+	id      int
+	account int // ID of the account the authz belongs to
+}
 
-	domain string
-	id     int
+// key returns the key of the authorization in CAServer.validAuthz: the ID
+// of its account and the identifier value of the authorization request,
+// which keeps wildcards apart from their base domain.
+func (a *authorization) key() string {
+	if a.Wildcard {
+		return validAuthzKey(a.account, "*."+a.domain)
+	}
+	return validAuthzKey(a.account, a.domain)
+}
+
+func validAuthzKey(account int, identifier string) string {
+	return strconv.Itoa(account) + " " + identifier
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
 }
 
 type order struct {
@@ -262,13 +409,40 @@ type order struct {
 	FinalizeURL string   `json:"finalize"`    // CSR submit URL
 	CertURL     string   `json:"certificate"` // already issued cert
 
-	leaf []byte // issued cert in DER format
+	Error *problem `json:"error,omitempty"`
+
+	leaf    []byte    // issued cert in DER format
+	account int       // ID of the account which placed the order
+	readyAt time.Time // end of the processing state
 }
 
 func (ca *CAServer) handle(w http.ResponseWriter, r *http.Request) {
 	ca.t.Logf("%s %s", r.Method, r.URL)
 	w.Header().Set("Replay-Nonce", "nonce")
 	// TODO: Verify nonce header for all POST requests.
+	if ca.injectFault(w, r) {
+		return
+	}
+
+	// All POST requests are authenticated with their JWS signature.
+	// Only new-account requests, and revocation requests authorized by the key
+	// of the certificate, are signed with a JWK rather than by an account.
+	var req *request
+	if r.Method == "POST" {
+		var p *problem
+		if req, p = ca.verifyRequest(r); p != nil {
+			ca.writeProblem(w, p)
+			return
+		}
+		switch {
+		case r.URL.Path == "/new-account" && req.account != nil:
+			ca.writeProblem(w, newProblem(http.StatusBadRequest, "malformed", "new-account requests must be signed with a JWK"))
+			return
+		case r.URL.Path != "/new-account" && r.URL.Path != "/revoke-cert" && req.account == nil:
+			ca.writeProblem(w, newProblem(http.StatusBadRequest, "malformed", "requests must be signed with the key ID of an account"))
+			return
+		}
+	}
 
 	switch {
 	default:
@@ -280,14 +454,26 @@ func (ca *CAServer) handle(w http.ResponseWriter, r *http.Request) {
 			NewNonce:   ca.serverURL("/new-nonce"),
 			NewAccount: ca.serverURL("/new-account"),
 			NewOrder:   ca.serverURL("/new-order"),
+			RevokeCert: ca.serverURL("/revoke-cert"),
+			KeyChange:  ca.serverURL("/key-change"),
 			Meta: discoveryMeta{
 				ExternalAccountRequired: ca.eabRequired,
+				CAA:                     ca.caaIdentities,
 			},
 		}
+		ca.mu.Lock()
+		if ca.renewalInfo {
+			resp.RenewInfo = ca.serverURL("/renewal-info")
+		}
+		ca.mu.Unlock()
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
 			panic(fmt.Sprintf("discovery response: %v", err))
 		}
 
+	// Renewal information requests.
+	case strings.HasPrefix(r.URL.Path, "/renewal-info/"):
+		ca.handleRenewalInfo(w, strings.TrimPrefix(r.URL.Path, "/renewal-info/"))
+
 	// Nonce requests.
 	case r.URL.Path == "/new-nonce":
 		// Nonce values are always set. Nothing else to do.
@@ -295,47 +481,46 @@ func (ca *CAServer) handle(w http.ResponseWriter, r *http.Request) {
 
 	// Client key registration request.
 	case r.URL.Path == "/new-account":
-		ca.mu.Lock()
-		defer ca.mu.Unlock()
-		if ca.acctRegistered {
-			ca.httpErrorf(w, http.StatusServiceUnavailable, "multiple accounts are not implemented")
-			return
-		}
-		ca.acctRegistered = true
+		ca.handleNewAccount(w, req)
 
-		var req struct {
-			ExternalAccountBinding json.RawMessage
-		}
+	// Account key rollover request.
+	case r.URL.Path == "/key-change":
+		ca.handleKeyChange(w, req)
 
-		if err := decodePayload(&req, r.Body); err != nil {
-			ca.httpErrorf(w, http.StatusBadRequest, "%v", err)
-			return
-		}
+	// Certificate revocation request.
+	case r.URL.Path == "/revoke-cert":
+		ca.handleRevokeCert(w, req)
 
-		if ca.eabRequired && len(req.ExternalAccountBinding) == 0 {
-			ca.httpErrorf(w, http.StatusBadRequest, "registration failed: no JWS for EAB")
-			return
-		}
+	// All the other requests are made by accounts.
+	case req == nil:
+		ca.writeProblem(w, newProblem(http.StatusMethodNotAllowed, "malformed", "%s requires a POST request", r.URL.Path))
 
-		// TODO: Check the user account key against a ca.accountKeys?
-		w.Header().Set("Location", ca.serverURL("/accounts/1"))
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte("{}"))
+	// Account orders list requests.
+	case strings.HasPrefix(r.URL.Path, "/accounts/") && strings.HasSuffix(r.URL.Path, "/orders"):
+		ca.handleAccountOrders(w, req, strings.TrimSuffix(ca.serverURL("%s", r.URL.Path), "/orders"))
+
+	// Account update and deactivation requests.
+	case strings.HasPrefix(r.URL.Path, "/accounts/"):
+		ca.handleAccount(w, req, ca.serverURL("%s", r.URL.Path))
 
 	// New order request.
 	case r.URL.Path == "/new-order":
-		var req struct {
+		var payload struct {
 			Identifiers []struct{ Value string }
+			Replaces    string
 		}
-		if err := decodePayload(&req, r.Body); err != nil {
+		if err := req.decode(&payload); err != nil {
 			ca.httpErrorf(w, http.StatusBadRequest, "%v", err)
 			return
 		}
 		ca.mu.Lock()
 		defer ca.mu.Unlock()
-		o := &order{Status: acme.StatusPending}
-		for _, id := range req.Identifiers {
-			z := ca.authz(id.Value)
+		if payload.Replaces != "" {
+			ca.replaces = append(ca.replaces, payload.Replaces)
+		}
+		o := &order{Status: acme.StatusPending, account: req.account.id}
+		for _, id := range payload.Identifiers {
+			z := ca.authz(req.account.id, id.Value)
 			o.AuthzURLs = append(o.AuthzURLs, ca.serverURL("/authz/%d", z.id))
 		}
 		orderID := len(ca.orders)
@@ -355,6 +540,12 @@ func (ca *CAServer) handle(w http.ResponseWriter, r *http.Request) {
 			ca.httpErrorf(w, http.StatusBadRequest, "%v", err)
 			return
 		}
+		if !ca.owns(w, req, o.account) {
+			return
+		}
+		if o.Status == acme.StatusProcessing {
+			w.Header().Set("Retry-After", retryAfter(o.readyAt.Sub(ca.now())))
+		}
 		if err := json.NewEncoder(w).Encode(o); err != nil {
 			panic(err)
 		}
@@ -364,12 +555,7 @@ func (ca *CAServer) handle(w http.ResponseWriter, r *http.Request) {
 		parts := strings.Split(r.URL.Path, "/")
 		typ, id := parts[len(parts)-2], parts[len(parts)-1]
 		ca.mu.Lock()
-		supported := false
-		for _, suppTyp := range ca.challengeTypes {
-			if suppTyp == typ {
-				supported = true
-			}
-		}
+		supported := slices.Contains(ca.challengeTypes, typ)
 		a, err := ca.storedAuthz(id)
 		ca.mu.Unlock()
 		if !supported {
@@ -380,14 +566,17 @@ func (ca *CAServer) handle(w http.ResponseWriter, r *http.Request) {
 			ca.httpErrorf(w, http.StatusBadRequest, "challenge accept: %v", err)
 			return
 		}
+		if !ca.owns(w, req, a.account) {
+			return
+		}
 		ca.validateChallenge(a, typ)
 		w.Write([]byte("{}"))
 
 	// Get authorization status requests.
 	case strings.HasPrefix(r.URL.Path, "/authz/"):
-		var req struct{ Status string }
-		decodePayload(&req, r.Body)
-		deactivate := req.Status == "deactivated"
+		var payload struct{ Status string }
+		req.decode(&payload)
+		deactivate := payload.Status == "deactivated"
 		ca.mu.Lock()
 		defer ca.mu.Unlock()
 		authz, err := ca.storedAuthz(strings.TrimPrefix(r.URL.Path, "/authz/"))
@@ -395,6 +584,9 @@ func (ca *CAServer) handle(w http.ResponseWriter, r *http.Request) {
 			ca.httpErrorf(w, http.StatusNotFound, "%v", err)
 			return
 		}
+		if !ca.owns(w, req, authz.account) {
+			return
+		}
 		if deactivate {
 			// Note we don't invalidate authorized orders as we should.
 			authz.Status = "deactivated"
@@ -415,30 +607,59 @@ func (ca *CAServer) handle(w http.ResponseWriter, r *http.Request) {
 			ca.httpErrorf(w, http.StatusBadRequest, "%v", err)
 			return
 		}
+		if !ca.owns(w, req, o.account) {
+			return
+		}
 		if o.Status != acme.StatusReady {
 			ca.httpErrorf(w, http.StatusForbidden, "order status: %s", o.Status)
 			return
 		}
 		// Validate CSR request.
-		var req struct {
+		var payload struct {
 			CSR string `json:"csr"`
 		}
-		decodePayload(&req, r.Body)
-		b, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		req.decode(&payload)
+		b, _ := base64.RawURLEncoding.DecodeString(payload.CSR)
 		csr, err := x509.ParseCertificateRequest(b)
 		if err != nil {
 			ca.httpErrorf(w, http.StatusBadRequest, "%v", err)
 			return
 		}
+		w.Header().Set("Location", ca.serverURL("/orders/%s", orderID))
+		if ca.invalidOrders > 0 {
+			ca.invalidOrders--
+			o.Status = acme.StatusInvalid
+			o.Error = orderProblem(ca.orderSubproblems)
+			ca.t.Logf("order %s is now invalid", orderID)
+			if err := json.NewEncoder(w).Encode(o); err != nil {
+				panic(err)
+			}
+			return
+		}
 		// Issue the certificate.
 		der, err := ca.leafCert(csr)
 		if err != nil {
 			ca.httpErrorf(w, http.StatusBadRequest, "new-cert response: ca.leafCert: %v", err)
 			return
 		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			panic(fmt.Sprintf("x509.ParseCertificate: %v", err))
+		}
+		ca.issued = append(ca.issued, IssuedCert{
+			Account:     req.account.url,
+			Order:       ca.serverURL("/orders/%s", orderID),
+			Certificate: cert,
+		})
 		o.leaf = der
 		o.CertURL = ca.serverURL("/issued-cert/%s", orderID)
 		o.Status = acme.StatusValid
+		if ca.processingDelay > 0 {
+			// The certificate is only available once the order is valid.
+			o.Status = acme.StatusProcessing
+			o.readyAt = ca.now().Add(ca.processingDelay)
+			w.Header().Set("Retry-After", retryAfter(ca.processingDelay))
+		}
 		if err := json.NewEncoder(w).Encode(o); err != nil {
 			panic(err)
 		}
@@ -447,21 +668,55 @@ func (ca *CAServer) handle(w http.ResponseWriter, r *http.Request) {
 	case strings.HasPrefix(r.URL.Path, "/issued-cert/"):
 		ca.mu.Lock()
 		defer ca.mu.Unlock()
-		o, err := ca.storedOrder(strings.TrimPrefix(r.URL.Path, "/issued-cert/"))
+		// The alternate chains are at /issued-cert/<order>/<n>, n starting at 1.
+		orderID, alt, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/issued-cert/"), "/")
+		o, err := ca.storedOrder(orderID)
 		if err != nil {
 			ca.httpErrorf(w, http.StatusBadRequest, "%v", err)
 			return
 		}
+		if !ca.owns(w, req, o.account) {
+			return
+		}
 		if o.Status != acme.StatusValid {
 			ca.httpErrorf(w, http.StatusForbidden, "order status: %s", o.Status)
 			return
 		}
+		root, n := ca.rootCert, 0
+		if alt != "" {
+			n, err = strconv.Atoi(alt)
+			if err != nil || n < 1 || n > len(ca.altRoots) {
+				ca.httpErrorf(w, http.StatusNotFound, "no alternate chain %q", alt)
+				return
+			}
+			root = ca.altRoots[n-1]
+		}
+		// Link every chain to the other ones, see RFC 8555, Section 7.4.2.
+		for i := 0; i <= len(ca.altRoots); i++ {
+			switch {
+			case i == n:
+			case i == 0:
+				w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="alternate"`, o.CertURL))
+			default:
+				w.Header().Add("Link", fmt.Sprintf(`<%s/%d>;rel="alternate"`, o.CertURL, i))
+			}
+		}
 		w.Header().Set("Content-Type", "application/pem-certificate-chain")
 		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: o.leaf})
-		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.rootCert})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: root})
 	}
 }
 
+// owns reports whether the account of req is the account with the given ID,
+// the owner of the requested resource, and writes an error response if not.
+func (ca *CAServer) owns(w http.ResponseWriter, req *request, id int) bool {
+	if req.account.id != id {
+		ca.writeProblem(w, newProblem(http.StatusForbidden, "unauthorized", "the resource belongs to another account"))
+		return false
+	}
+	return true
+}
+
 // storedOrder retrieves a previously created order at index i.
 // It requires ca.mu to be locked.
 func (ca *CAServer) storedOrder(i string) (*order, error) {
@@ -496,18 +751,33 @@ func (ca *CAServer) storedAuthz(i string) (*authorization, error) {
 	return ca.authorizations[idx], nil
 }
 
-// authz returns an existing valid authorization for the identifier or creates a
-// new one. It requires ca.mu to be locked.
-func (ca *CAServer) authz(identifier string) *authorization {
-	authz, ok := ca.validAuthz[identifier]
+// authz returns an existing valid authorization of the account for the
+// identifier or creates a new one. It requires ca.mu to be locked.
+func (ca *CAServer) authz(account int, identifier string) *authorization {
+	authz, ok := ca.validAuthz[validAuthzKey(account, identifier)]
 	if !ok {
 		authzId := len(ca.authorizations)
 		authz = &authorization{
-			id:     authzId,
-			domain: identifier,
-			Status: acme.StatusPending,
+			id:      authzId,
+			domain:  identifier,
+			account: account,
+			Status:  acme.StatusPending,
+		}
+		// Wildcard authorizations are for the base domain
+		// and can only be satisfied with dns-01.
+		if base, ok := strings.CutPrefix(identifier, "*."); ok {
+			authz.domain = base
+			authz.Wildcard = true
 		}
+		authz.Identifier.Type = "dns"
+		if net.ParseIP(authz.domain) != nil {
+			authz.Identifier.Type = "ip"
+		}
+		authz.Identifier.Value = authz.domain
 		for _, typ := range ca.challengeTypes {
+			if authz.Wildcard && typ != "dns-01" {
+				continue
+			}
 			authz.Challenges = append(authz.Challenges, challenge{
 				Type:  typ,
 				URI:   ca.serverURL("/challenge/%s/%d", typ, authzId),
@@ -522,18 +792,23 @@ func (ca *CAServer) authz(identifier string) *authorization {
 // leafCert issues a new certificate.
 // It requires ca.mu to be locked.
 func (ca *CAServer) leafCert(csr *x509.CertificateRequest) (der []byte, err error) {
+	validity := ca.certValidity
+	if validity <= 0 {
+		validity = defaultCertValidity
+	}
 	ca.certCount++ // next leaf cert serial number
 	leaf := &x509.Certificate{
 		SerialNumber:          big.NewInt(int64(ca.certCount)),
 		Subject:               pkix.Name{Organization: []string{"Test Acme Co"}},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(90 * 24 * time.Hour),
+		NotBefore:             ca.now(),
+		NotAfter:              ca.now().Add(validity),
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
 		BasicConstraintsValid: true,
 	}
-	if len(csr.DNSNames) == 0 {
+	if len(csr.DNSNames) == 0 && len(csr.IPAddresses) == 0 {
 		leaf.DNSNames = []string{csr.Subject.CommonName}
 	}
 	return x509.CreateCertificate(rand.Reader, leaf, ca.rootTemplate, csr.PublicKey, ca.rootKey)
@@ -551,7 +826,7 @@ func (ca *CAServer) LeafCert(name, keyType string, notBefore, notAfter time.Time
 	switch keyType {
 	case "RSA":
 		var err error
-		pk, err = rsa.GenerateKey(rand.Reader, 1024)
+		pk, err = rsa.GenerateKey(rand.Reader, 2048)
 		if err != nil {
 			ca.t.Fatal(err)
 		}
@@ -586,12 +861,15 @@ func (ca *CAServer) LeafCert(name, keyType string, notBefore, notAfter time.Time
 }
 
 func (ca *CAServer) validateChallenge(authz *authorization, typ string) {
+	keyAuth := ca.keyAuthorization(authz, typ)
 	var err error
 	switch typ {
 	case "tls-alpn-01":
-		err = ca.verifyALPNChallenge(authz)
+		err = ca.verifyALPNChallenge(authz, keyAuth)
 	case "http-01":
-		err = ca.verifyHTTPChallenge(authz)
+		err = ca.verifyHTTPChallenge(authz, keyAuth)
+	case "dns-01":
+		err = ca.verifyDNSChallenge(authz, keyAuth)
 	default:
 		panic(fmt.Sprintf("validation of %q is not implemented", typ))
 	}
@@ -601,7 +879,7 @@ func (ca *CAServer) validateChallenge(authz *authorization, typ string) {
 		authz.Status = "invalid"
 	} else {
 		authz.Status = "valid"
-		ca.validAuthz[authz.domain] = authz
+		ca.validAuthz[authz.key()] = authz
 	}
 	ca.t.Logf("validated %q for %q, err: %v", typ, authz.domain, err)
 	ca.t.Logf("authz %d is now %s", authz.id, authz.Status)
@@ -609,12 +887,27 @@ func (ca *CAServer) validateChallenge(authz *authorization, typ string) {
 	ca.updatePendingOrders()
 }
 
+// keyAuthorization returns the expected key authorization of the challenge
+// of type typ of authz, with the current key of its account.
+// See RFC 8555, Section 8.1.
+func (ca *CAServer) keyAuthorization(authz *authorization, typ string) string {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	token := challengeToken(authz.domain, typ, authz.id)
+	return token + "." + ca.accounts[authz.account-1].thumbprint
+}
+
 func (ca *CAServer) updatePendingOrders() {
-	// Update all pending orders.
+	// Update all pending and processing orders.
 	// An order becomes "ready" if all authorizations are "valid".
 	// An order becomes "invalid" if any authorization is "invalid".
 	// Status changes: https://tools.ietf.org/html/rfc8555#section-7.1.6
+	// A processing order becomes "valid" once its processing delay is over.
 	for i, o := range ca.orders {
+		if o.Status == acme.StatusProcessing && !ca.now().Before(o.readyAt) {
+			o.Status = acme.StatusValid
+			ca.t.Logf("order %d is now valid", i)
+		}
 		if o.Status != acme.StatusPending {
 			continue
 		}
@@ -650,7 +943,7 @@ func (ca *CAServer) validateAuthzURLs(urls []string, orderNum int) (countValid,
 	return countValid, countInvalid
 }
 
-func (ca *CAServer) verifyALPNChallenge(a *authorization) error {
+func (ca *CAServer) verifyALPNChallenge(a *authorization, keyAuth string) error {
 	const acmeALPNProto = "acme-tls/1"
 
 	addr, haveAddr := ca.addr(a.domain)
@@ -662,11 +955,17 @@ func (ca *CAServer) verifyALPNChallenge(a *authorization) error {
 		return fmt.Errorf("overlapping resolution information for %q", a.domain)
 	}
 
+	// IP addresses are validated with their reverse DNS name (RFC 8738, Section 6).
+	serverName := a.domain
+	if ip := net.ParseIP(a.domain); ip != nil {
+		serverName = reverseName(ip)
+	}
+
 	var crt *x509.Certificate
 	switch {
 	case haveAddr:
 		conn, err := tls.Dial("tcp", addr, &tls.Config{
-			ServerName:         a.domain,
+			ServerName:         serverName,
 			InsecureSkipVerify: true,
 			NextProtos:         []string{acmeALPNProto},
 			MinVersion:         tls.VersionTLS12,
@@ -683,7 +982,7 @@ func (ca *CAServer) verifyALPNChallenge(a *authorization) error {
 		crt = conn.ConnectionState().PeerCertificates[0]
 	case haveGetCert:
 		hello := &tls.ClientHelloInfo{
-			ServerName: a.domain,
+			ServerName: serverName,
 			// TODO: support selecting ECDSA.
 			CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305},
 			SupportedProtos:   []string{acme.ALPNProto},
@@ -704,16 +1003,23 @@ func (ca *CAServer) verifyALPNChallenge(a *authorization) error {
 	}
 	// See RFC 8737, Section 6.1.
 	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+	sum := sha256.Sum256([]byte(keyAuth))
+	want, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return err
+	}
 	for _, x := range crt.Extensions {
 		if x.Id.Equal(oid) {
-			// TODO: check the token.
+			if !bytes.Equal(x.Value, want) {
+				return fmt.Errorf("verifyTokenCert: id-pe-acmeIdentifier = %x; want %x", x.Value, want)
+			}
 			return nil
 		}
 	}
 	return fmt.Errorf("verifyTokenCert: no id-pe-acmeIdentifier extension found")
 }
 
-func (ca *CAServer) verifyHTTPChallenge(a *authorization) error {
+func (ca *CAServer) verifyHTTPChallenge(a *authorization, keyAuth string) error {
 	addr, haveAddr := ca.addr(a.domain)
 	handler, haveHandler := ca.getHandler(a.domain)
 	if !haveAddr && !haveHandler {
@@ -761,22 +1067,47 @@ func (ca *CAServer) verifyHTTPChallenge(a *authorization) error {
 		body = w.Body.String()
 	}
 
-	if !strings.HasPrefix(body, token) {
-		return fmt.Errorf("http token value = %q; want 'token-http-01.' prefix", body)
+	if strings.TrimSpace(body) != keyAuth {
+		return fmt.Errorf("http token value = %q; want %q", body, keyAuth)
 	}
 	return nil
 }
 
-func decodePayload(v interface{}, r io.Reader) error {
-	var req struct{ Payload string }
-	if err := json.NewDecoder(r).Decode(&req); err != nil {
-		return err
+func (ca *CAServer) verifyDNSChallenge(a *authorization, keyAuth string) error {
+	ca.mu.Lock()
+	lookup := ca.lookupTXT
+	ca.mu.Unlock()
+	if lookup == nil {
+		return fmt.Errorf("no TXT resolution information for %q", a.domain)
 	}
-	payload, err := base64.RawURLEncoding.DecodeString(req.Payload)
+
+	name := "_acme-challenge." + a.domain + "."
+	values, err := lookup(context.Background(), name)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(payload, v)
+	// The record value is the base64url-encoded SHA-256 digest
+	// of the key authorization.
+	sum := sha256.Sum256([]byte(keyAuth))
+	if slices.Contains(values, base64.RawURLEncoding.EncodeToString(sum[:])) {
+		return nil
+	}
+	return fmt.Errorf("dns token: no valid TXT record at %q in %q", name, values)
+}
+
+// reverseName returns the reverse DNS name of ip.
+func reverseName(ip net.IP) string {
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip4[i])
+		}
+		return b.String() + "in-addr.arpa"
+	}
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[i]&0xf, ip[i]>>4)
+	}
+	return b.String() + "ip6.arpa"
 }
 
 func challengeToken(domain, challType string, authzID int) string {
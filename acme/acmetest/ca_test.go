@@ -0,0 +1,340 @@
+package acmetest
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/internal/jose"
+)
+
+func newKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func register(t *testing.T, ca *CAServer, key crypto.Signer) *acme.Client {
+	client := &acme.Client{Key: key, DirectoryURL: ca.URL()}
+	if _, err := client.Register(context.Background(), &acme.Account{}, acme.AcceptTOS); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	return client
+}
+
+// txtRecords is a LookupTXT function answering from the records
+// provisioned by the tests.
+type txtRecords struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func (r *txtRecords) add(name, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.records == nil {
+		r.records = make(map[string][]string)
+	}
+	r.records[name] = append(r.records[name], value)
+}
+
+func (r *txtRecords) lookup(ctx context.Context, name string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.records[name], nil
+}
+
+// authorize orders a certificate for domain, solving dns-01 challenges
+// with the records, and returns the ready order.
+func authorize(t *testing.T, client *acme.Client, records *txtRecords, domain string) *acme.Order {
+	ctx := context.Background()
+	o, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		t.Fatalf("AuthorizeOrder: %v", err)
+	}
+	for _, u := range o.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			t.Fatalf("GetAuthorization: %v", err)
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == "dns-01" {
+				chal = c
+			}
+		}
+		if chal == nil {
+			t.Fatalf("no dns-01 challenge in %+v", z)
+		}
+		v, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records.add("_acme-challenge."+z.Identifier.Value+".", v)
+		if _, err := client.Accept(ctx, chal); err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		if _, err := client.WaitAuthorization(ctx, z.URI); err != nil {
+			t.Fatalf("WaitAuthorization: %v", err)
+		}
+	}
+	uri := o.URI
+	o, err = client.WaitOrder(ctx, uri)
+	if err != nil {
+		t.Fatalf("WaitOrder: %v", err)
+	}
+	o.URI = uri // not returned by WaitOrder
+	return o
+}
+
+// finalize submits a CSR for domain to the ready order o.
+func finalize(ctx context.Context, t *testing.T, client *acme.Client, o *acme.Order, domain string) ([][]byte, error) {
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	return chain, err
+}
+
+// issue orders a certificate for domain, solving dns-01 challenges
+// with the records, and returns the issued chain.
+func issue(t *testing.T, client *acme.Client, records *txtRecords, domain string) [][]byte {
+	chain, err := finalize(context.Background(), t, client, authorize(t, client, records, domain), domain)
+	if err != nil {
+		t.Fatalf("CreateOrderCert: %v", err)
+	}
+	return chain
+}
+
+func TestAccounts(t *testing.T) {
+	ca := NewCAServer(t).Start()
+	ctx := context.Background()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := register(t, ca, newKey(t))
+	c2 := register(t, ca, rsaKey)
+	a1, err := c1.GetReg(ctx, "")
+	if err != nil {
+		t.Fatalf("GetReg: %v", err)
+	}
+	a2, err := c2.GetReg(ctx, "")
+	if err != nil {
+		t.Fatalf("GetReg: %v", err)
+	}
+	if a1.URI == a2.URI {
+		t.Errorf("both accounts are %s", a1.URI)
+	}
+
+	// Registering the same key again returns the existing account.
+	c := &acme.Client{Key: c1.Key, DirectoryURL: ca.URL()}
+	_, err = c.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	if !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		t.Errorf("Register: %v; want ErrAccountAlreadyExists", err)
+	}
+
+	c = &acme.Client{Key: newKey(t), DirectoryURL: ca.URL()}
+	if _, err := c.GetReg(ctx, ""); !errors.Is(err, acme.ErrNoAccount) {
+		t.Errorf("GetReg: %v; want ErrNoAccount", err)
+	}
+
+	// An account can't use the authorizations of another one.
+	o, err := c1.AuthorizeOrder(ctx, acme.DomainIDs("example.org"))
+	if err != nil {
+		t.Fatalf("AuthorizeOrder: %v", err)
+	}
+	_, err = c2.GetAuthorization(ctx, o.AuthzURLs[0])
+	var e *acme.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusForbidden {
+		t.Errorf("GetAuthorization: %v; want 403 error", err)
+	}
+}
+
+func TestDNS01(t *testing.T) {
+	ca := NewCAServer(t).ChallengeTypes("dns-01").Start()
+	records := new(txtRecords)
+	ca.LookupTXT(records.lookup)
+	c1 := register(t, ca, newKey(t))
+	c2 := register(t, ca, newKey(t))
+
+	issue(t, c1, records, "example.org")
+	issue(t, c2, records, "*.example.org")
+	certs := ca.IssuedCerts()
+	if len(certs) != 2 {
+		t.Fatalf("%d issued certs; want 2", len(certs))
+	}
+	for i, c := range []*acme.Client{c1, c2} {
+		a, err := c.GetReg(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if certs[i].Account != a.URI {
+			t.Errorf("cert %d issued to %s; want %s", i, certs[i].Account, a.URI)
+		}
+	}
+	if names := certs[1].Certificate.DNSNames; len(names) != 1 || names[0] != "*.example.org" {
+		t.Errorf("DNSNames = %q; want *.example.org", names)
+	}
+	if _, err := certs[0].Certificate.Verify(x509.VerifyOptions{Roots: ca.Roots(), DNSName: "example.org"}); err != nil {
+		t.Error(err)
+	}
+
+	// The record of another account doesn't validate the challenge.
+	ctx := context.Background()
+	o, err := c2.AuthorizeOrder(ctx, acme.DomainIDs("www.example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := c2.GetAuthorization(ctx, o.AuthzURLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c1.DNS01ChallengeRecord(z.Challenges[0].Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records.add("_acme-challenge.www.example.org.", v)
+	if _, err := c2.Accept(ctx, z.Challenges[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.WaitAuthorization(ctx, z.URI); err == nil {
+		t.Error("WaitAuthorization: authorization is valid with the record of another account")
+	}
+}
+
+func TestKeyRollover(t *testing.T) {
+	ca := NewCAServer(t).ChallengeTypes("dns-01").Start()
+	records := new(txtRecords)
+	ca.LookupTXT(records.lookup)
+	ctx := context.Background()
+	client := register(t, ca, newKey(t))
+	a, err := client.GetReg(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldKey := client.Key
+	if err := client.AccountKeyRollover(ctx, newKey(t)); err != nil {
+		t.Fatalf("AccountKeyRollover: %v", err)
+	}
+	// The challenges are validated with the new key.
+	issue(t, client, records, "example.org")
+
+	c := &acme.Client{Key: client.Key, DirectoryURL: ca.URL()}
+	if got, err := c.GetReg(ctx, ""); err != nil || got.URI != a.URI {
+		t.Errorf("GetReg with the new key = %v, %v; want %s", got, err, a.URI)
+	}
+	c = &acme.Client{Key: oldKey, DirectoryURL: ca.URL()}
+	if _, err := c.GetReg(ctx, ""); !errors.Is(err, acme.ErrNoAccount) {
+		t.Errorf("GetReg with the old key: %v; want ErrNoAccount", err)
+	}
+
+	// The key of another account can't be taken over.
+	other := register(t, ca, newKey(t))
+	err = client.AccountKeyRollover(ctx, other.Key)
+	var e *acme.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusConflict || !strings.HasSuffix(e.Header.Get("Location"), "/accounts/2") {
+		t.Errorf("AccountKeyRollover: %v; want 409 error with the other account", err)
+	}
+}
+
+// postAsGet makes a POST-as-GET request to url, signed by the account
+// of client, for the resources the acme package has no method for.
+func postAsGet(t *testing.T, client *acme.Client, kid, url string) *http.Response {
+	key := client.Key.(*ecdsa.PrivateKey)
+	enc := base64.RawURLEncoding.EncodeToString
+	protected := enc(fmt.Appendf(nil, `{"alg":"ES256","kid":%q,"nonce":"nonce","url":%q}`, kid, url))
+	digest := sha256.Sum256([]byte(protected + "."))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	body, err := json.Marshal(jose.JSONWebSignature{Protected: protected, Signature: enc(sig)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Post(url, "application/jose+json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func TestUpdateAccount(t *testing.T) {
+	ca := NewCAServer(t).ChallengeTypes("dns-01").Start()
+	records := new(txtRecords)
+	ca.LookupTXT(records.lookup)
+	ctx := context.Background()
+	client := register(t, ca, newKey(t))
+
+	a, err := client.UpdateReg(ctx, &acme.Account{Contact: []string{"mailto:admin@example.org"}})
+	if err != nil {
+		t.Fatalf("UpdateReg: %v", err)
+	}
+	if !slices.Equal(a.Contact, []string{"mailto:admin@example.org"}) {
+		t.Errorf("Contact = %q; want mailto:admin@example.org", a.Contact)
+	}
+
+	// The orders list only has the orders of the account.
+	issue(t, client, records, "example.org")
+	other := register(t, ca, newKey(t))
+	issue(t, other, records, "example.com")
+	issue(t, client, records, "example.net")
+	res := postAsGet(t, client, a.URI, a.OrdersURL)
+	var list struct{ Orders []string }
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	certs := ca.IssuedCerts()
+	if want := []string{certs[0].Order, certs[2].Order}; !slices.Equal(list.Orders, want) {
+		t.Errorf("orders = %q; want %q", list.Orders, want)
+	}
+	o, err := other.GetReg(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := postAsGet(t, client, a.URI, o.OrdersURL); res.StatusCode != http.StatusForbidden {
+		t.Errorf("orders of another account: status %d; want 403", res.StatusCode)
+	}
+
+	// A deactivated account can't be used anymore.
+	if err := client.DeactivateReg(ctx); err != nil {
+		t.Fatalf("DeactivateReg: %v", err)
+	}
+	if a, err := client.GetReg(ctx, ""); err != nil || a.Status != acme.StatusDeactivated {
+		t.Errorf("GetReg = %v, %v; want deactivated account", a, err)
+	}
+	_, err = client.AuthorizeOrder(ctx, acme.DomainIDs("example.org"))
+	var e *acme.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("AuthorizeOrder: %v; want 401 error", err)
+	}
+}
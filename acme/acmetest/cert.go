@@ -0,0 +1,127 @@
+package acmetest
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+)
+
+// renewalInfoRetryAfter is the delay after which clients
+// are asked to poll the renewal information again.
+const renewalInfoRetryAfter = 6 * time.Hour
+
+// issuedCert returns the index in ca.issued of the certificate matching f,
+// or -1 if there's none. It requires ca.mu to be locked.
+func (ca *CAServer) issuedCert(f func(c *IssuedCert) bool) int {
+	for i := range ca.issued {
+		if f(&ca.issued[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleRevokeCert revokes a certificate issued for an order, on behalf
+// of the account which placed the order or of the holder of the key of
+// the certificate. See RFC 8555, Section 7.6.
+func (ca *CAServer) handleRevokeCert(w http.ResponseWriter, req *request) {
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if err := req.decode(&payload); err != nil {
+		ca.httpErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "malformed", "invalid certificate: %v", err))
+		return
+	}
+	// The reason codes of RFC 5280, Section 5.3.1, but removeFromCRL.
+	if payload.Reason < 0 || payload.Reason > 10 || payload.Reason == 7 {
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "badRevocationReason", "invalid revocation reason %d", payload.Reason))
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	i := ca.issuedCert(func(c *IssuedCert) bool { return bytes.Equal(c.Certificate.Raw, der) })
+	if i < 0 {
+		ca.writeProblem(w, newProblem(http.StatusNotFound, "malformed", "unknown certificate"))
+		return
+	}
+	c := &ca.issued[i]
+	var authorized bool
+	if req.account != nil {
+		authorized = c.Account == req.account.url
+	} else {
+		k, ok := c.Certificate.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		authorized = ok && k.Equal(req.key)
+	}
+	if !authorized {
+		ca.writeProblem(w, newProblem(http.StatusForbidden, "unauthorized", "the request isn't authorized to revoke the certificate"))
+		return
+	}
+	if c.Revoked {
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "alreadyRevoked", "the certificate is already revoked"))
+		return
+	}
+	c.Revoked = true
+	c.RevocationReason = acme.CRLReasonCode(payload.Reason)
+	ca.t.Logf("certificate %s is now revoked", c.Certificate.SerialNumber)
+}
+
+// handleRenewalInfo returns the ACME Renewal Information of the
+// certificate of the given ARI certificate ID. See RFC 9773.
+func (ca *CAServer) handleRenewalInfo(w http.ResponseWriter, certID string) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if !ca.renewalInfo {
+		ca.httpErrorf(w, http.StatusNotFound, "renewal info is not enabled")
+		return
+	}
+	var window acme.RenewalWindow
+	if ca.renewalWindow != nil {
+		window = *ca.renewalWindow
+	} else {
+		i := ca.issuedCert(func(c *IssuedCert) bool {
+			id, err := acme.RenewalInfoCertID(c.Certificate)
+			return err == nil && id == certID
+		})
+		if i < 0 {
+			ca.writeProblem(w, newProblem(http.StatusNotFound, "malformed", "unknown certificate %s", certID))
+			return
+		}
+		c := ca.issued[i]
+		if c.Revoked {
+			// Renew right away.
+			now := ca.now()
+			window = acme.RenewalWindow{Start: now.Add(-time.Hour), End: now}
+		} else {
+			third := c.Certificate.NotAfter.Sub(c.Certificate.NotBefore) / 3
+			window = acme.RenewalWindow{
+				Start: c.Certificate.NotAfter.Add(-third),
+				End:   c.Certificate.NotAfter.Add(-third / 2),
+			}
+		}
+	}
+	resp := struct {
+		SuggestedWindow struct {
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+		} `json:"suggestedWindow"`
+	}{}
+	resp.SuggestedWindow.Start = window.Start
+	resp.SuggestedWindow.End = window.End
+	w.Header().Set("Retry-After", retryAfter(renewalInfoRetryAfter))
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		panic(fmt.Sprintf("renewal info response: %v", err))
+	}
+}
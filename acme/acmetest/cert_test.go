@@ -0,0 +1,169 @@
+package acmetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+)
+
+func TestRevokeCert(t *testing.T) {
+	ca := NewCAServer(t).ChallengeTypes("dns-01").Start()
+	records := new(txtRecords)
+	ca.LookupTXT(records.lookup)
+	ctx := context.Background()
+	client := register(t, ca, newKey(t))
+	other := register(t, ca, newKey(t))
+
+	// Revocation by the account which ordered the certificate.
+	chain := issue(t, client, records, "example.org")
+	var e *acme.Error
+	err := other.RevokeCert(ctx, nil, chain[0], acme.CRLReasonKeyCompromise)
+	if !errors.As(err, &e) || e.StatusCode != http.StatusForbidden {
+		t.Errorf("RevokeCert by another account: %v; want 403 error", err)
+	}
+	if err := client.RevokeCert(ctx, nil, chain[0], acme.CRLReasonKeyCompromise); err != nil {
+		t.Fatalf("RevokeCert: %v", err)
+	}
+	// Revoking the certificate again is not an error for the client.
+	if err := client.RevokeCert(ctx, nil, chain[0], acme.CRLReasonKeyCompromise); err != nil {
+		t.Errorf("RevokeCert again: %v", err)
+	}
+	certs := ca.IssuedCerts()
+	if !certs[0].Revoked || certs[0].RevocationReason != acme.CRLReasonKeyCompromise {
+		t.Errorf("issued cert: revoked %v with reason %d; want keyCompromise", certs[0].Revoked, certs[0].RevocationReason)
+	}
+
+	// Revocation with the key of the certificate.
+	key := newKey(t)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"example.com"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := authorize(t, client, records, "example.com")
+	chain, _, err = client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if err != nil {
+		t.Fatalf("CreateOrderCert: %v", err)
+	}
+	err = other.RevokeCert(ctx, newKey(t), chain[0], acme.CRLReasonUnspecified)
+	if !errors.As(err, &e) || e.StatusCode != http.StatusForbidden {
+		t.Errorf("RevokeCert with another key: %v; want 403 error", err)
+	}
+	err = other.RevokeCert(ctx, key, chain[0], 7)
+	if !errors.As(err, &e) || e.ProblemType != "urn:ietf:params:acme:error:badRevocationReason" {
+		t.Errorf("RevokeCert with reason removeFromCRL: %v; want badRevocationReason error", err)
+	}
+	if err := other.RevokeCert(ctx, key, chain[0], acme.CRLReasonSuperseded); err != nil {
+		t.Fatalf("RevokeCert with the key of the cert: %v", err)
+	}
+	if certs := ca.IssuedCerts(); !certs[1].Revoked || certs[1].RevocationReason != acme.CRLReasonSuperseded {
+		t.Errorf("issued cert: revoked %v with reason %d; want superseded", certs[1].Revoked, certs[1].RevocationReason)
+	}
+}
+
+func TestAlternateChains(t *testing.T) {
+	ca := NewCAServer(t).ChallengeTypes("dns-01").AlternateChains(2).Start()
+	records := new(txtRecords)
+	ca.LookupTXT(records.lookup)
+	ctx := context.Background()
+	client := register(t, ca, newKey(t))
+
+	chain := issue(t, client, records, "example.org")
+	url := ca.IssuedCerts()[0].Order
+	o, err := client.GetOrder(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alts, err := client.ListCertAlternates(ctx, o.CertURL)
+	if err != nil {
+		t.Fatalf("ListCertAlternates: %v", err)
+	}
+	if len(alts) != 2 {
+		t.Fatalf("%d alternate chains; want 2", len(alts))
+	}
+	roots := [][]byte{chain[1]}
+	for _, u := range alts {
+		alt, err := client.FetchCert(ctx, u, true)
+		if err != nil {
+			t.Fatalf("FetchCert(%s): %v", u, err)
+		}
+		if !bytes.Equal(alt[0], chain[0]) {
+			t.Errorf("alternate chain %s has another leaf", u)
+		}
+		for _, r := range roots {
+			if bytes.Equal(alt[1], r) {
+				t.Errorf("alternate chain %s has the root of another chain", u)
+			}
+		}
+		roots = append(roots, alt[1])
+		// Every chain links to the other ones.
+		if links, err := client.ListCertAlternates(ctx, u); err != nil || len(links) != 2 {
+			t.Errorf("ListCertAlternates(%s) = %q, %v; want 2 chains", u, links, err)
+		}
+
+		leaf, err := x509.ParseCertificate(alt[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := x509.ParseCertificate(alt[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(root)
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "example.org"}); err != nil {
+			t.Errorf("alternate chain %s: %v", u, err)
+		}
+	}
+}
+
+func TestRenewalInfo(t *testing.T) {
+	ca := NewCAServer(t).ChallengeTypes("dns-01").CertValidity(90 * 24 * time.Hour).Start()
+	records := new(txtRecords)
+	ca.LookupTXT(records.lookup)
+	ctx := context.Background()
+	client := register(t, ca, newKey(t))
+
+	chain := issue(t, client, records, "example.org")
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetRenewalInfo(ctx, cert); !errors.Is(err, acme.ErrRenewalInfoNotSupported) {
+		t.Errorf("GetRenewalInfo without ARI: %v; want ErrRenewalInfoNotSupported", err)
+	}
+
+	ca.RenewalInfo()
+	client = &acme.Client{Key: client.Key, DirectoryURL: ca.URL()} // discover ARI
+	ri, err := client.GetRenewalInfo(ctx, cert)
+	if err != nil {
+		t.Fatalf("GetRenewalInfo: %v", err)
+	}
+	if want := cert.NotAfter.Add(-30 * 24 * time.Hour); !ri.SuggestedWindow.Start.Equal(want) {
+		t.Errorf("window start = %s; want %s", ri.SuggestedWindow.Start, want)
+	}
+	if want := cert.NotAfter.Add(-15 * 24 * time.Hour); !ri.SuggestedWindow.End.Equal(want) {
+		t.Errorf("window end = %s; want %s", ri.SuggestedWindow.End, want)
+	}
+	if ri.RetryAfter != 6*time.Hour {
+		t.Errorf("RetryAfter = %s; want 6h", ri.RetryAfter)
+	}
+
+	// A revoked certificate is to be renewed right away.
+	if err := client.RevokeCert(ctx, nil, chain[0], acme.CRLReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	ri, err = client.GetRenewalInfo(ctx, cert)
+	if err != nil {
+		t.Fatalf("GetRenewalInfo: %v", err)
+	}
+	if ri.SuggestedWindow.Start.After(time.Now()) {
+		t.Errorf("window of the revoked cert starts at %s; want now", ri.SuggestedWindow.Start)
+	}
+}
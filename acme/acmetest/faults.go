@@ -0,0 +1,164 @@
+package acmetest
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+)
+
+// defaultCertValidity is the validity period of the issued certificates,
+// unless configured otherwise with CertValidity.
+const defaultCertValidity = 90 * 24 * time.Hour
+
+// The methods below script failures and control time, so that the retry
+// and renewal code paths of clients can be tested. They can be called
+// before or after Start, and apply to the requests received afterwards.
+
+// BadNonces makes the CA reject the next n POST requests
+// with a badNonce error. See RFC 8555, Section 6.5.
+func (ca *CAServer) BadNonces(n int) *CAServer {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.badNonces = n
+	return ca
+}
+
+// rateLimit is a 429 response scripted with RateLimit.
+type rateLimit struct {
+	path       string
+	n          int
+	retryAfter time.Duration
+}
+
+// RateLimit makes the CA answer the next n requests whose URL path starts
+// with path, such as "/new-order", with a rateLimited error and a 429 status.
+// An empty path matches all the requests. The responses suggest clients
+// retry after the retryAfter delay, rounded up to the second.
+func (ca *CAServer) RateLimit(path string, n int, retryAfter time.Duration) *CAServer {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.rateLimits = append(ca.rateLimits, &rateLimit{path, n, retryAfter})
+	return ca
+}
+
+// InvalidOrders makes the next n finalized orders invalid instead of
+// issuing their certificates. The error of the orders lists subproblems.
+func (ca *CAServer) InvalidOrders(n int, subproblems ...acme.Subproblem) *CAServer {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.invalidOrders = n
+	ca.orderSubproblems = subproblems
+	return ca
+}
+
+// ProcessingDelay keeps the finalized orders in the processing state
+// for d before they become valid, as measured by the clock of the CA.
+// A long delay leaves the orders stuck in processing.
+func (ca *CAServer) ProcessingDelay(d time.Duration) *CAServer {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.processingDelay = d
+	return ca
+}
+
+// Latency delays every response by d, or until the request is canceled.
+func (ca *CAServer) Latency(d time.Duration) *CAServer {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.latency = d
+	return ca
+}
+
+// CertValidity sets the validity period of the certificates issued
+// for orders. It defaults to 90 days.
+func (ca *CAServer) CertValidity(d time.Duration) *CAServer {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.certValidity = d
+	return ca
+}
+
+// Clock sets the function returning the current time of the CA, used
+// for the validity of the issued certificates and the processing of orders.
+// It defaults to time.Now.
+func (ca *CAServer) Clock(now func() time.Time) *CAServer {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.clock = now
+	return ca
+}
+
+// now returns the current time of the CA.
+// It requires ca.mu to be locked.
+func (ca *CAServer) now() time.Time {
+	if ca.clock != nil {
+		return ca.clock()
+	}
+	return time.Now()
+}
+
+// injectFault writes the response of the failure scripted for r, if any,
+// after the scripted latency. It reports whether r has been answered.
+func (ca *CAServer) injectFault(w http.ResponseWriter, r *http.Request) bool {
+	ca.mu.Lock()
+	latency := ca.latency
+	ca.mu.Unlock()
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			return true
+		}
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	for i, l := range ca.rateLimits {
+		if !strings.HasPrefix(r.URL.Path, l.path) {
+			continue
+		}
+		if l.n--; l.n <= 0 {
+			ca.rateLimits = append(ca.rateLimits[:i], ca.rateLimits[i+1:]...)
+		}
+		w.Header().Set("Retry-After", retryAfter(l.retryAfter))
+		ca.writeProblem(w, newProblem(http.StatusTooManyRequests, "rateLimited", "too many requests to %s", r.URL.Path))
+		return true
+	}
+	if r.Method == "POST" && ca.badNonces > 0 {
+		ca.badNonces--
+		ca.writeProblem(w, newProblem(http.StatusBadRequest, "badNonce", "JWS has an invalid anti-replay nonce"))
+		return true
+	}
+	return false
+}
+
+// retryAfter formats d as the value of a Retry-After header,
+// in seconds rounded up.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int((max(d, 0) + time.Second - 1) / time.Second))
+}
+
+// orderProblem returns the error of an order made invalid by InvalidOrders.
+func orderProblem(subproblems []acme.Subproblem) *problem {
+	p := &problem{
+		Type:   "urn:ietf:params:acme:error:serverInternal",
+		Detail: "the order failed",
+	}
+	if len(subproblems) > 0 {
+		p.Type = "urn:ietf:params:acme:error:compound"
+		p.Detail = "the order failed for some of its identifiers"
+	}
+	for _, sp := range subproblems {
+		s := subproblem{Type: sp.Type, Detail: sp.Detail}
+		if sp.Identifier != nil {
+			s.Identifier = &identifier{Type: sp.Identifier.Type, Value: sp.Identifier.Value}
+		}
+		p.Subproblems = append(p.Subproblems, s)
+	}
+	return p
+}
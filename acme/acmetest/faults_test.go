@@ -0,0 +1,167 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+)
+
+// retries is a Client.RetryBackoff function recording the retried responses.
+type retries struct {
+	mu        sync.Mutex
+	responses []*http.Response
+	stop      bool // don't retry
+}
+
+func (r *retries) backoff(n int, req *http.Request, res *http.Response) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responses = append(r.responses, res)
+	if r.stop {
+		return 0
+	}
+	return time.Millisecond
+}
+
+func (r *retries) headers(key string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var v []string
+	for _, res := range r.responses {
+		v = append(v, res.Header.Get(key))
+	}
+	return v
+}
+
+// fakeClock is a controllable Clock.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestBadNonces(t *testing.T) {
+	ca := NewCAServer(t).BadNonces(2).Start()
+	r := new(retries)
+	client := &acme.Client{Key: newKey(t), DirectoryURL: ca.URL(), RetryBackoff: r.backoff}
+	if _, err := client.Register(context.Background(), &acme.Account{}, acme.AcceptTOS); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if n := len(r.responses); n != 2 {
+		t.Errorf("%d retries; want 2", n)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ca := NewCAServer(t).Start()
+	r := new(retries)
+	client := register(t, ca, newKey(t))
+	client.RetryBackoff = r.backoff
+	ctx := context.Background()
+
+	ca.RateLimit("/new-order", 2, 2500*time.Millisecond)
+	if _, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.org")); err != nil {
+		t.Fatalf("AuthorizeOrder: %v", err)
+	}
+	if got, want := r.headers("Retry-After"), []string{"3", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Retry-After = %q; want %q", got, want)
+	}
+
+	ca.RateLimit("", 1, time.Minute)
+	r.stop = true
+	_, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.org"))
+	if d, ok := acme.RateLimit(err); !ok || d != time.Minute {
+		t.Errorf("AuthorizeOrder: %v; want rate limit error for 1m", err)
+	}
+}
+
+func TestInvalidOrders(t *testing.T) {
+	sp := acme.Subproblem{
+		Type:       "urn:ietf:params:acme:error:rejectedIdentifier",
+		Detail:     "policy forbids issuing for example.org",
+		Identifier: &acme.AuthzID{Type: "dns", Value: "example.org"},
+	}
+	ca := NewCAServer(t).ChallengeTypes("dns-01").InvalidOrders(1, sp).Start()
+	records := new(txtRecords)
+	ca.LookupTXT(records.lookup)
+	client := register(t, ca, newKey(t))
+
+	o := authorize(t, client, records, "example.org")
+	_, err := finalize(context.Background(), t, client, o, "example.org")
+	var oe *acme.OrderError
+	if !errors.As(err, &oe) || oe.Status != acme.StatusInvalid {
+		t.Fatalf("CreateOrderCert: %v; want invalid order", err)
+	}
+	if oe.Problem == nil || !reflect.DeepEqual(oe.Problem.Subproblems, []acme.Subproblem{sp}) {
+		t.Errorf("order problem = %+v; want subproblem %+v", oe.Problem, sp)
+	}
+	if n := len(ca.IssuedCerts()); n != 0 {
+		t.Errorf("%d issued certs; want none", n)
+	}
+
+	// Only the first order fails.
+	issue(t, client, records, "example.org")
+}
+
+func TestProcessingDelay(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ca := NewCAServer(t).ChallengeTypes("dns-01").
+		Clock(clock.Now).
+		CertValidity(time.Hour).
+		ProcessingDelay(24 * time.Hour).
+		Start()
+	records := new(txtRecords)
+	ca.LookupTXT(records.lookup)
+	client := register(t, ca, newKey(t))
+
+	o := authorize(t, client, records, "example.org")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := finalize(ctx, t, client, o, "example.org"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("CreateOrderCert: %v; want the order stuck in processing", err)
+	}
+
+	clock.Advance(24 * time.Hour)
+	o, err := client.WaitOrder(context.Background(), o.URI)
+	if err != nil {
+		t.Fatalf("WaitOrder: %v", err)
+	}
+	if o.Status != acme.StatusValid {
+		t.Fatalf("order status = %s; want valid", o.Status)
+	}
+	cert := ca.IssuedCerts()[0].Certificate
+	if !cert.NotBefore.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) || cert.NotAfter.Sub(cert.NotBefore) != time.Hour {
+		t.Errorf("certificate valid from %v to %v; want 1h from the clock", cert.NotBefore, cert.NotAfter)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	ca := NewCAServer(t).Latency(time.Second).Start()
+	client := &acme.Client{Key: newKey(t), DirectoryURL: ca.URL()}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Discover(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Discover: %v; want deadline exceeded", err)
+	}
+	ca.Latency(0)
+	if _, err := client.Discover(context.Background()); err != nil {
+		t.Errorf("Discover: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package acme
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RenewalInfoCertID returns the ARI certificate identifier of cert, as defined
+// in https://www.rfc-editor.org/rfc/rfc9773#section-4.1.
+// The identifier is used to query the renewal information of the certificate
+// and to mark a new order as its replacement with WithOrderReplaces.
+//
+// It returns an error if cert has no Authority Key Identifier extension.
+func RenewalInfoCertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", errors.New("acme: certificate has no authority key identifier")
+	}
+	if cert.SerialNumber == nil || cert.SerialNumber.Sign() <= 0 {
+		return "", errors.New("acme: certificate has an invalid serial number")
+	}
+	// The serial is the content octets of the DER-encoded INTEGER,
+	// so a leading zero byte is needed when the high bit is set.
+	serial := cert.SerialNumber.Bytes()
+	if serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	aki := base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId)
+	return aki + "." + base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// GetRenewalInfo retrieves the ACME Renewal Information of cert,
+// which tells when the CA suggests the certificate to be renewed.
+// The request is not authenticated so it doesn't require c.Key.
+//
+// Clients should poll the renewal information again after the returned
+// RetryAfter duration, since the CA may change the suggested window
+// at any time, for example ahead of a mass revocation event.
+//
+// It returns ErrRenewalInfoNotSupported if the CA directory has no
+// renewalInfo endpoint.
+func (c *Client) GetRenewalInfo(ctx context.Context, cert *x509.Certificate) (*RenewalInfo, error) {
+	dir, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dir.RenewalInfoURL == "" {
+		return nil, ErrRenewalInfoNotSupported
+	}
+	certID, err := RenewalInfoCertID(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimSuffix(dir.RenewalInfoURL, "/") + "/" + certID
+	res, err := c.get(ctx, url, wantStatus(http.StatusOK))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var v struct {
+		SuggestedWindow struct {
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+		} `json:"suggestedWindow"`
+		ExplanationURL string `json:"explanationURL"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("acme: invalid renewal info response: %v", err)
+	}
+	if v.SuggestedWindow.Start.IsZero() || !v.SuggestedWindow.End.After(v.SuggestedWindow.Start) {
+		return nil, fmt.Errorf("acme: invalid suggested renewal window %s - %s",
+			v.SuggestedWindow.Start, v.SuggestedWindow.End)
+	}
+	return &RenewalInfo{
+		SuggestedWindow: RenewalWindow{
+			Start: v.SuggestedWindow.Start,
+			End:   v.SuggestedWindow.End,
+		},
+		ExplanationURL: v.ExplanationURL,
+		RetryAfter:     retryAfter(res.Header.Get("Retry-After")),
+	}, nil
+}
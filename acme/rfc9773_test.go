@@ -0,0 +1,137 @@
+package acme
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenewalInfoCertID(t *testing.T) {
+	// Example from RFC 9773, Section 4.1.
+	aki, _ := hex.DecodeString("69885B6B87464041E1B37B847BA0AE2CDE01C8D4")
+	serial, _ := new(big.Int).SetString("0087654321", 16)
+	cert := &x509.Certificate{AuthorityKeyId: aki, SerialNumber: serial}
+	id, err := RenewalInfoCertID(cert)
+	if err != nil {
+		t.Fatalf("RenewalInfoCertID: %v", err)
+	}
+	if want := "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"; id != want {
+		t.Errorf("RenewalInfoCertID = %q; want %q", id, want)
+	}
+
+	cert = &x509.Certificate{AuthorityKeyId: aki, SerialNumber: big.NewInt(0x1234)}
+	id, err = RenewalInfoCertID(cert)
+	if err != nil {
+		t.Fatalf("RenewalInfoCertID: %v", err)
+	}
+	if want := "aYhba4dGQEHhs3uEe6CuLN4ByNQ.EjQ"; id != want {
+		t.Errorf("RenewalInfoCertID = %q; want %q", id, want)
+	}
+
+	if _, err := RenewalInfoCertID(&x509.Certificate{SerialNumber: serial}); err == nil {
+		t.Error("RenewalInfoCertID: expected error for missing authority key identifier")
+	}
+}
+
+func TestRFC_GetRenewalInfo(t *testing.T) {
+	aki, _ := hex.DecodeString("69885B6B87464041E1B37B847BA0AE2CDE01C8D4")
+	serial, _ := new(big.Int).SetString("0087654321", 16)
+	cert := &x509.Certificate{AuthorityKeyId: aki, SerialNumber: serial}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `{"newOrder": "/new-order", "renewalInfo": "http://%s/renewal-info"}`, r.Host)
+		case "/renewal-info/aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE":
+			if r.Method != "GET" {
+				t.Errorf("r.Method = %q; want GET", r.Method)
+			}
+			w.Header().Set("Retry-After", "21600")
+			w.Write([]byte(`{
+				"suggestedWindow": {
+					"start": "2025-01-02T04:00:00Z",
+					"end": "2025-01-03T04:00:00Z"
+				},
+				"explanationURL": "https://acme.example.com/docs/ari"
+			}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "unexpected path %q", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	cl := &Client{DirectoryURL: ts.URL}
+	dir, err := cl.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ts.URL + "/renewal-info"; dir.RenewalInfoURL != want {
+		t.Errorf("dir.RenewalInfoURL = %q; want %q", dir.RenewalInfoURL, want)
+	}
+	ri, err := cl.GetRenewalInfo(context.Background(), cert)
+	if err != nil {
+		t.Fatalf("GetRenewalInfo: %v", err)
+	}
+	start := time.Date(2025, 1, 2, 4, 0, 0, 0, time.UTC)
+	end := time.Date(2025, 1, 3, 4, 0, 0, 0, time.UTC)
+	if !ri.SuggestedWindow.Start.Equal(start) || !ri.SuggestedWindow.End.Equal(end) {
+		t.Errorf("SuggestedWindow = %+v; want %v - %v", ri.SuggestedWindow, start, end)
+	}
+	if ri.ExplanationURL != "https://acme.example.com/docs/ari" {
+		t.Errorf("ExplanationURL = %q", ri.ExplanationURL)
+	}
+	if ri.RetryAfter != 6*time.Hour {
+		t.Errorf("RetryAfter = %v; want %v", ri.RetryAfter, 6*time.Hour)
+	}
+}
+
+func TestRFC_GetRenewalInfoNotSupported(t *testing.T) {
+	cl := newTestClient()
+	cert := &x509.Certificate{AuthorityKeyId: []byte{1}, SerialNumber: big.NewInt(1)}
+	_, err := cl.GetRenewalInfo(context.Background(), cert)
+	if !errors.Is(err, ErrRenewalInfoNotSupported) {
+		t.Errorf("GetRenewalInfo: %v; want ErrRenewalInfoNotSupported", err)
+	}
+}
+
+func TestRFC_AuthorizeOrderReplaces(t *testing.T) {
+	s := newACMEServer()
+	s.handle("/acme/new-account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", s.url("/accounts/1"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status": "valid"}`))
+	})
+	s.handle("/acme/new-order", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Replaces string `json:"replaces"`
+		}
+		decodeJWSRequest(t, &req, r.Body)
+		if want := "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"; req.Replaces != want {
+			t.Errorf("req.Replaces = %q; want %q", req.Replaces, want)
+		}
+		w.Header().Set("Location", s.url("/orders/1"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status": "pending"}`))
+	})
+	s.start()
+	defer s.close()
+
+	cl := &Client{Key: testKeyEC, DirectoryURL: s.url("/")}
+	o, err := cl.AuthorizeOrder(context.Background(), DomainIDs("example.org"),
+		WithOrderReplaces("aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(o.URI, "/orders/1") {
+		t.Errorf("o.URI = %q", o.URI)
+	}
+}
@@ -57,6 +57,10 @@ var (
 	// ErrNoAccount indicates that the Client's key has not been registered with the CA.
 	ErrNoAccount = errors.New("acme: account does not exist")
 
+	// ErrRenewalInfoNotSupported indicates that the CA doesn't provide
+	// ACME Renewal Information. It is returned by GetRenewalInfo method.
+	ErrRenewalInfoNotSupported = errors.New("acme: renewal information is not supported")
+
 	// errPreAuthorizationNotSupported indicates that the server does not
 	// support pre-authorization of identifiers.
 	errPreAuthorizationNotSupported = errors.New("acme: pre-authorization is not supported")
@@ -296,6 +300,11 @@ type Directory struct {
 	// KeyChangeURL allows to perform account key rollover flow.
 	KeyChangeURL string
 
+	// RenewalInfoURL is the base URL of the ACME Renewal Information (ARI)
+	// endpoint. Empty string indicates the CA doesn't support ARI.
+	// See https://www.rfc-editor.org/rfc/rfc9773 for more details.
+	RenewalInfoURL string
+
 	// Terms is a URI identifying the current terms of service.
 	Terms string
 
@@ -391,6 +400,14 @@ func WithOrderProfile(profile string) OrderOption {
 	return orderProfileOpt(profile)
 }
 
+// WithOrderReplaces sets order's Replaces field, marking the order as a
+// replacement of the certificate identified by certID.
+// The certID value is typically obtained with RenewalInfoCertID.
+// See https://www.rfc-editor.org/rfc/rfc9773#section-5 for more details.
+func WithOrderReplaces(certID string) OrderOption {
+	return orderReplacesOpt(certID)
+}
+
 type orderNotBeforeOpt time.Time
 
 func (orderNotBeforeOpt) privateOrderOpt() {}
@@ -403,6 +420,35 @@ type orderProfileOpt string
 
 func (orderProfileOpt) privateOrderOpt() {}
 
+type orderReplacesOpt string
+
+func (orderReplacesOpt) privateOrderOpt() {}
+
+// RenewalInfo is the ACME Renewal Information of a certificate,
+// as returned by Client's GetRenewalInfo method.
+// See https://www.rfc-editor.org/rfc/rfc9773#section-4.2 for more details.
+type RenewalInfo struct {
+	// SuggestedWindow is the time window during which the CA
+	// wants the certificate to be renewed.
+	SuggestedWindow RenewalWindow
+
+	// ExplanationURL optionally points to a page explaining why
+	// the suggested window has its current value, for example
+	// an announcement of a mass revocation event.
+	ExplanationURL string
+
+	// RetryAfter is the duration after which the client should poll
+	// the renewal information again, as indicated by the "Retry-After"
+	// header of the CA response. It is zero if the header is absent.
+	RetryAfter time.Duration
+}
+
+// RenewalWindow is a time window suggested by the CA for a certificate renewal.
+type RenewalWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
 // Authorization encodes an authorization response.
 type Authorization struct {
 	// URI uniquely identifies a authorization.
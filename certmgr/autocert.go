@@ -27,6 +27,8 @@ import (
 	"net"
 	"net/http"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -76,7 +78,9 @@ type HostPolicy func(ctx context.Context, host string) error
 func HostWhitelist(hosts ...string) HostPolicy {
 	whitelist := make(map[string]bool, len(hosts))
 	for _, h := range hosts {
-		if h, err := idna.Lookup.ToASCII(h); err == nil {
+		if ip, ok := parseIP(h); ok {
+			whitelist[ip] = true
+		} else if h, err := idna.Lookup.ToASCII(h); err == nil {
 			whitelist[h] = true
 		}
 	}
@@ -133,14 +137,32 @@ type Manager struct {
 	HostPolicy HostPolicy
 
 	// RenewBefore optionally specifies how early certificates should
-	// be renewed before they expire.
+	// be renewed before they expire. It overrides RenewalRatio.
 	//
-	// If zero, they're renewed 1 day before expiration.
+	// If zero, certificates are renewed according to RenewalRatio.
+	//
+	// If the CA supports ACME Renewal Information (RFC 9773), certificates
+	// are instead renewed at a random time within the window suggested
+	// by the CA, which is polled again as often as the CA asks for.
+	// RenewBefore is only used when the CA doesn't provide that information.
 	RenewBefore time.Duration
 
+	// RenewalRatio optionally specifies the fraction of the validity period
+	// of certificates which remains when they are renewed, computed from
+	// their NotBefore and NotAfter. For instance, with a ratio of 1/3,
+	// a 90-day certificate is renewed 30 days before it expires
+	// and a 6-day one 2 days before.
+	//
+	// If zero or not less than 1, a third of the validity period is used.
+	RenewalRatio float64
+
 	// Client is used to perform low-level operations, such as account registration
 	// and requesting new certificates.
 	//
+	// Client, Email and ExternalAccountBinding configure the ACME CA used
+	// when Issuers is empty. Use an ACMEIssuer in Issuers instead to
+	// configure more CAs.
+	//
 	// If Client is nil, a zero-value acme.Client is used with DefaultACMEDirectory
 	// as the directory endpoint.
 	// If the Client.Key is nil, a new ECDSA P-256 key is generated and,
@@ -176,6 +198,103 @@ type Manager struct {
 	// See RFC 8555, Section 7.3.4 for more details.
 	ExternalAccountBinding *acme.ExternalAccountBinding
 
+	// LocalCA optionally makes the Manager issue certificates from a local CA
+	// instead of ordering them from the ACME CA of Client. No challenges are
+	// solved, so Client, Email, ExternalAccountBinding and the challenge
+	// settings are not used, while HostPolicy, Cache and the renewal
+	// of the certificates work as usual.
+	//
+	// LocalCA is ignored if Issuers is not empty.
+	LocalCA *LocalCA
+
+	// Issuers optionally lists the issuers of the certificates, such as
+	// ACMEIssuer for several ACME CAs and LocalCA, in order of preference.
+	// If an issuer fails to issue a certificate, the next one is tried.
+	// The ID of the issuer of each certificate is stored in Cache, so that
+	// renewals are marked as replacing the certificates of the same CA.
+	//
+	// If empty, the Manager uses LocalCA if set, or else an ACME CA
+	// configured by Client, Email and ExternalAccountBinding.
+	// The issuers must have distinct IDs: give a Name to the ACMEIssuers
+	// using the same CA with different accounts.
+	//
+	// Mutating the field after the first call of GetCertificate method will have no effect.
+	Issuers []Issuer
+
+	// DNSProvider optionally provisions the TXT records of dns-01 challenges.
+	// If not nil, the Manager prefers the dns-01 challenge type, which
+	// doesn't require the host to be reachable by the CA on port 80 or 443.
+	DNSProvider DNSProvider
+
+	// CAACheck configures the check of the CAA records of the domains
+	// before ordering their certificates.
+	CAACheck CAACheck
+
+	// SelfCheck configures the check that the responses to the http-01
+	// and tls-alpn-01 challenges are reachable before accepting them.
+	SelfCheck SelfCheck
+
+	// ChallengeSolvers optionally registers solvers keyed by challenge type,
+	// such as "http-01". They replace the default solver of the same type,
+	// and their types are preferred over the other ones.
+	//
+	// By default, the Manager solves tls-alpn-01 challenges in GetCertificate,
+	// http-01 challenges in the handler returned by HTTPHandler once it is
+	// called, and dns-01 challenges with DNSProvider if set.
+	ChallengeSolvers map[string]ChallengeSolver
+
+	// DNSPropagation optionally enables and configures the check that
+	// the TXT records of dns-01 challenges are served by the nameservers
+	// of their zones before the challenges are accepted.
+	//
+	// Its nameservers are also asked for the CNAME records delegating
+	// the challenge names, whether or not the check is enabled.
+	DNSPropagation DNSPropagation
+
+	// DNSDelegations optionally maps domain names to the fully qualified
+	// names at which DNSProvider presents their dns-01 records, such as
+	// "example.com" to "example-com.acme.example.net.", instead of
+	// "_acme-challenge.example.com.". The challenge name must be a CNAME
+	// record pointing to the delegated name, so the CA finds the record.
+	//
+	// The challenge names of other domains are looked up for a chain of
+	// CNAME records, whose final target is used. An empty delegated name
+	// disables the lookup for its domain.
+	DNSDelegations map[string]string
+
+	// KeyPolicy optionally specifies the types and sizes of certificate
+	// private keys. Certificates with different keys are cached apart.
+	KeyPolicy KeyPolicy
+
+	// KeyRotation optionally specifies when the private key of a certificate
+	// is replaced with a new one upon renewal. The age of each key and the
+	// number of renewals it went through are stored in Cache next to
+	// the certificate.
+	//
+	// If zero, the private key of a certificate is kept across renewals.
+	KeyRotation KeyRotation
+
+	// Wildcards optionally lists wildcard names, such as "*.example.org",
+	// in ASCII form. Wildcard certificates can only be obtained over dns-01,
+	// so DNSProvider or a dns-01 solver in ChallengeSolvers must be set as well.
+	//
+	// GetCertificate serves the wildcard certificate for any single-label
+	// subdomain, such as "www.example.org", that doesn't have a certificate
+	// of its own, without consulting HostPolicy. This way the subdomains
+	// don't each trigger a new order.
+	Wildcards []string
+
+	// Groups optionally declares named certificate groups. Each group
+	// is a list of DNS names and IP addresses sharing one certificate,
+	// which is obtained with a single order and cached under the group name.
+	// Group names must be safe to use as file names.
+	//
+	// GetCertificate serves the group certificate for every name
+	// in the group, without consulting HostPolicy.
+	//
+	// Mutating the field after the first call of GetCertificate method will have no effect.
+	Groups map[string][]string
+
 	// BeforeVerify is used to set a hook before verifyRFC.
 	BeforeVerify func(ctx context.Context) error
 
@@ -186,8 +305,19 @@ type Manager struct {
 	// was created, but it needs to wait for CT sync.
 	OnCreateCert func(cert *tls.Certificate)
 
-	clientMu sync.Mutex
-	client   *acme.Client // initialized by acmeClient method
+	// OnRotateKey is used to notice the private key of the certificate
+	// for name, a domain or a group name, was rotated upon renewal.
+	OnRotateKey func(name string, cert *tls.Certificate)
+
+	clientMu   sync.Mutex
+	acmeIssuer *ACMEIssuer // initialized by issuers method
+
+	issuersOnce sync.Once
+	issuersErr  error // invalid Issuers configuration
+
+	groupsOnce sync.Once
+	groups     map[string]certKey // group certKey by member name, built from Groups
+	groupsErr  error              // invalid Groups configuration
 
 	stateMu sync.Mutex
 	state   map[certKey]*certState
@@ -196,7 +326,8 @@ type Manager struct {
 	renewalMu sync.Mutex
 	renewal   map[certKey]*domainRenewal
 
-	// challengeMu guards tryHTTP01, certTokens and httpTokens.
+	// challengeMu guards tryHTTP01, certTokens, httpTokens, dnsTokens
+	// and dnsTargets.
 	challengeMu sync.RWMutex
 	// tryHTTP01 indicates whether the Manager should try "http-01" challenge type
 	// during the authorization flow.
@@ -210,6 +341,15 @@ type Manager struct {
 	// and is keyed by the domain name which matches the ClientHello server name.
 	// The entries are stored for the duration of the authorization flow.
 	certTokens map[string]*tls.Certificate
+	// dnsTokens contains the TXT record values of dns-01 challenges presented
+	// with the provider returned by LocalDNSProvider, and is keyed by
+	// the lower case fully qualified name of the records.
+	// The entries are stored for the duration of the authorization flow.
+	dnsTokens map[string][]string
+	// dnsTargets contains the fully qualified names at which the records
+	// of dns-01 challenges were presented, keyed by challenge token.
+	// The entries are stored for the duration of the authorization flow.
+	dnsTargets map[string]string
 
 	// nowFunc, if not nil, returns the current time. This may be set for
 	// testing purposes.
@@ -222,16 +362,52 @@ type certKey struct {
 	isRSA   bool   // RSA cert for legacy clients (as opposed to default ECDSA)
 	isToken bool   // tls-based challenge token cert; key type is undefined regardless of isRSA
 	isIP    bool   // is an ip address
+	group   string // comma separated names of a certificate group, named by domain
+	keySize int    // non-default key size in bits, see KeyPolicy
 }
 
 func (c certKey) String() string {
+	name := c.domain
+	switch {
+	case c.group != "":
+		// Group names are chosen freely, so keep them apart from host names.
+		name = "_group." + name
+	case c.isWildcard():
+		// "*" is not allowed in file names on some platforms,
+		// while "_" never appears in names converted by idna.Lookup.
+		name = "_wildcard" + name[1:]
+	case strings.Contains(name, ":"):
+		// IPv6 addresses are the only names with ":", which is not
+		// allowed in file names either, and they never contain "-".
+		name = strings.ReplaceAll(name, ":", "-")
+	}
 	if c.isToken {
-		return c.domain + "+token"
+		return name + "+token"
 	}
 	if c.isRSA {
-		return c.domain + "+rsa"
+		name += "+rsa"
+		if c.keySize != 0 {
+			name += strconv.Itoa(c.keySize)
+		}
+		return name
+	}
+	if c.keySize != 0 {
+		name += "+p" + strconv.Itoa(c.keySize)
 	}
-	return c.domain
+	return name
+}
+
+// isWildcard reports whether the key is for a wildcard certificate.
+func (c certKey) isWildcard() bool {
+	return c.group == "" && strings.HasPrefix(c.domain, "*.")
+}
+
+// names returns the DNS names and IP addresses the certificate is for.
+func (c certKey) names() []string {
+	if c.group != "" {
+		return strings.Split(c.group, ",")
+	}
+	return []string{c.domain}
 }
 
 // TLSConfig creates a new TLS config suitable for net/http.Server servers,
@@ -264,12 +440,17 @@ func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate,
 	}
 
 	name := hello.ServerName
+	if name == "" {
+		name = localIP(hello)
+	}
 	if name == "" {
 		return nil, errors.New("acme/autocert: missing server name")
 	}
 
-	var isIP bool
-	if net.ParseIP(name) == nil {
+	ip, isIP := parseIP(name)
+	if isIP {
+		name = ip
+	} else {
 		if !strings.Contains(strings.Trim(name, "."), ".") {
 			return nil, errors.New("acme/autocert: server name component count invalid")
 		}
@@ -287,8 +468,6 @@ func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate,
 		if err != nil {
 			return nil, errors.New("acme/autocert: server name contains invalid character")
 		}
-	} else {
-		isIP = true
 	}
 
 	// In the worst-case scenario, the timeout needs to account for caching, host policy,
@@ -298,6 +477,10 @@ func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate,
 
 	// Check whether this is a token cert requested for TLS-ALPN challenge.
 	if wantsTokenCert(hello) {
+		// Token certs of IP addresses are requested by their reverse DNS name.
+		if ip, ok := reverseNameIP(name); ok {
+			name = ip
+		}
 		m.challengeMu.RLock()
 		defer m.challengeMu.RUnlock()
 		if cert := m.certTokens[name]; cert != nil {
@@ -310,16 +493,40 @@ func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate,
 		return nil, fmt.Errorf("acme/autocert: no token cert for %q", name)
 	}
 
-	// regular domain
-	if err := m.hostPolicy()(ctx, name); err != nil {
+	isRSA := !supportsECDSA(hello, m.KeyPolicy.Curve)
+	keySize, err := m.KeyPolicy.keySize(isRSA)
+	if err != nil {
 		return nil, err
 	}
-
 	ck := certKey{
-		domain: strings.TrimSuffix(name, "."), // golang.org/issue/18114
-		isRSA:  !supportsECDSA(hello),
-		isIP:   isIP,
+		domain:  strings.TrimSuffix(name, "."), // golang.org/issue/18114
+		isRSA:   isRSA,
+		isIP:    isIP,
+		keySize: keySize,
+	}
+
+	group, ok, err := m.groupFor(ck.domain)
+	if err != nil {
+		return nil, err
 	}
+	if ok {
+		group.isRSA, group.keySize = ck.isRSA, ck.keySize
+		ck = group
+	} else if wildcard, ok := m.wildcardFor(ck.domain); ok && !isIP {
+		// A subdomain with a certificate of its own keeps using it.
+		cert, err := m.cert(ctx, ck)
+		if err == nil {
+			return cert, nil
+		}
+		if err != ErrCacheMiss {
+			return nil, err
+		}
+		ck = certKey{domain: wildcard, isRSA: ck.isRSA, keySize: ck.keySize}
+	} else if err := m.hostPolicy()(ctx, name); err != nil {
+		// regular domain
+		return nil, err
+	}
+
 	cert, err := m.cert(ctx, ck)
 	if err == nil {
 		return cert, nil
@@ -347,19 +554,26 @@ func wantsTokenCert(hello *tls.ClientHelloInfo) bool {
 	return false
 }
 
-func supportsECDSA(hello *tls.ClientHelloInfo) bool {
+// supportsECDSA reports whether the client supports ECDSA certificates
+// whose keys are on the given curve, the KeyPolicy one. A nil curve is P-256.
+func supportsECDSA(hello *tls.ClientHelloInfo, curve elliptic.Curve) bool {
+	tlsCurve, tlsScheme := tls.CurveP256, tls.ECDSAWithP256AndSHA256
+	switch curve {
+	case elliptic.P384():
+		tlsCurve, tlsScheme = tls.CurveP384, tls.ECDSAWithP384AndSHA384
+	case elliptic.P521():
+		tlsCurve, tlsScheme = tls.CurveP521, tls.ECDSAWithP521AndSHA512
+	}
+
 	// The "signature_algorithms" extension, if present, limits the key exchange
 	// algorithms allowed by the cipher suites. See RFC 5246, section 7.4.1.4.1.
 	if hello.SignatureSchemes != nil {
 		ecdsaOK := false
-	schemeLoop:
 		for _, scheme := range hello.SignatureSchemes {
 			const tlsECDSAWithSHA1 tls.SignatureScheme = 0x0203 // constant added in Go 1.10
-			switch scheme {
-			case tlsECDSAWithSHA1, tls.ECDSAWithP256AndSHA256,
-				tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512:
+			if scheme == tlsScheme || scheme == tlsECDSAWithSHA1 {
 				ecdsaOK = true
-				break schemeLoop
+				break
 			}
 		}
 		if !ecdsaOK {
@@ -368,8 +582,8 @@ func supportsECDSA(hello *tls.ClientHelloInfo) bool {
 	}
 	if hello.SupportedCurves != nil {
 		ecdsaOK := false
-		for _, curve := range hello.SupportedCurves {
-			if curve == tls.CurveP256 {
+		for _, c := range hello.SupportedCurves {
+			if c == tlsCurve {
 				ecdsaOK = true
 				break
 			}
@@ -484,7 +698,7 @@ func (m *Manager) cert(ctx context.Context, ck certKey) (*tls.Certificate, error
 		leaf: cert.Leaf,
 	}
 	m.state[ck] = s
-	m.startRenew(ck, s.key, s.leaf.NotAfter)
+	m.startRenew(ck, s.key, s.leaf)
 	return cert, nil
 }
 
@@ -610,7 +824,7 @@ func (m *Manager) createCert(ctx context.Context, ck certKey) (*tls.Certificate,
 	defer state.Unlock()
 	state.locked = false
 
-	der, leaf, err := m.authorizedCert(ctx, state.key, ck)
+	der, leaf, issuer, err := m.authorizedCert(ctx, state.key, ck, nil)
 	if err != nil {
 		// Remove the failed state after some time,
 		// making the manager call createCert again on the following TLS hello.
@@ -634,7 +848,10 @@ func (m *Manager) createCert(ctx context.Context, ck certKey) (*tls.Certificate,
 	}
 	state.cert = der
 	state.leaf = leaf
-	m.startRenew(ck, state.key, state.leaf.NotAfter)
+	state.issuer = issuer
+	m.putKeyInfo(ctx, ck, &keyInfo{Created: m.now()})
+	m.putCertIssuer(ctx, ck, issuer)
+	m.startRenew(ck, state.key, state.leaf)
 	return state.tlscert()
 }
 
@@ -653,15 +870,7 @@ func (m *Manager) certState(ck certKey) (*certState, error) {
 	}
 
 	// new locked state
-	var (
-		err error
-		key crypto.Signer
-	)
-	if ck.isRSA {
-		key, err = rsa.GenerateKey(rand.Reader, 2048)
-	} else {
-		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	}
+	key, err := generateKey(ck)
 	if err != nil {
 		return nil, err
 	}
@@ -675,79 +884,112 @@ func (m *Manager) certState(ck certKey) (*certState, error) {
 	return state, nil
 }
 
-// authorizedCert starts the domain ownership verification process and requests a new cert upon success.
+// authorizedCert requests a new cert from the issuers of the Manager, starting the
+// domain ownership verification process with the ACME CAs.
 // The key argument is the certificate private key.
-func (m *Manager) authorizedCert(ctx context.Context, key crypto.Signer, ck certKey) (der [][]byte, leaf *x509.Certificate, err error) {
-	csr, err := certRequest(key, ck.domain, m.ExtraExtensions)
+// If replaces is not nil, the new order is marked as its replacement
+// when the CA supports ACME Renewal Information.
+// The returned issuer is the ID of the issuer of the new cert.
+func (m *Manager) authorizedCert(ctx context.Context, key crypto.Signer, ck certKey, replaces *x509.Certificate) (der [][]byte, leaf *x509.Certificate, issuer string, err error) {
+	csr, err := certRequest(key, ck.names(), m.ExtraExtensions)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
-
-	client, err := m.acmeClient(ctx)
-	if err != nil {
-		return nil, nil, err
+	var replacesIssuer string
+	if replaces != nil {
+		replacesIssuer = m.certIssuer(ctx, ck)
 	}
+	return m.issue(ctx, key, ck, csr, replaces, replacesIssuer)
+}
+
+// orderCert orders the certificate of req from the ACME CA of client.
+func (m *Manager) orderCert(ctx context.Context, client *acme.Client, req *IssueRequest) ([][]byte, error) {
 	dir, err := client.Discover(ctx)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	if dir.OrderURL == "" {
-		return nil, nil, errPreRFC
-	}
-
-	o, err := m.verifyRFC(ctx, client, ck)
-	if err != nil {
-		return nil, nil, err
+		return nil, errPreRFC
 	}
-	chain, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
-	if err != nil {
-		return nil, nil, err
+	var certID string
+	if req.Replaces != nil && dir.RenewalInfoURL != "" {
+		// The certificate can still be renewed without the replaces field,
+		// so the error is ignored.
+		certID, _ = acme.RenewalInfoCertID(req.Replaces)
 	}
 
-	leaf, err = validCert(ck, chain, key, m.now())
+	o, err := m.verifyRFC(ctx, client, req.ck, certID)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return chain, leaf, nil
+	chain, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, req.CSR, true)
+	return chain, err
 }
 
 // verifyRFC runs the identifier (domain) order-based authorization flow for RFC compliant CAs
 // using each applicable ACME challenge type.
-func (m *Manager) verifyRFC(ctx context.Context, client *acme.Client, ck certKey) (*acme.Order, error) {
+// The replaces argument is the ARI certificate identifier of the certificate
+// being renewed, or empty.
+func (m *Manager) verifyRFC(ctx context.Context, client *acme.Client, ck certKey, replaces string) (*acme.Order, error) {
+	// Don't start anything for an order which the CAA records forbid.
+	challengeTypes := m.supportedChallengeTypes()
+	caa, err := m.checkCAA(ctx, client, ck.names(), challengeTypes)
+	if err != nil {
+		return nil, err
+	}
 	if m.BeforeVerify != nil {
 		err := m.BeforeVerify(ctx)
 		if err != nil {
 			return nil, err
 		}
 	}
-	defer func() { _ = m.AfterVerify(ctx) }()
+	if m.AfterVerify != nil {
+		defer func() { _ = m.AfterVerify(ctx) }()
+	}
 
 	// Try each supported challenge type starting with a new order each time.
 	// The nextTyp index of the next challenge type to try is shared across
 	// all order authorizations: if we've tried a challenge type once and it didn't work,
 	// it will most likely not work on another order's authorization either.
-	challengeTypes := m.supportedChallengeTypes()
-	nextTyp := 0 // challengeTypes index
+	nextTyp := 0      // challengeTypes index
+	var lastErr error // of the last challenge type which failed
 AuthorizeOrderLoop:
 	for {
 		var (
 			id   []acme.AuthzID
 			opts []acme.OrderOption
 		)
-		if ck.isIP {
-			id = acme.IPIDs(ck.domain)
+		var hasIP bool
+		for _, name := range ck.names() {
+			if ck.isIP || net.ParseIP(name) != nil {
+				id = append(id, acme.IPIDs(name)...)
+				hasIP = true
+			} else {
+				id = append(id, acme.DomainIDs(name)...)
+			}
+		}
+		if hasIP {
+			// CAs only issue IP address certificates with a short lifetime,
+			// whatever the other names of the certificate.
 			opts = append(opts, acme.WithOrderProfile("shortlived"))
-		} else {
-			id = acme.DomainIDs(ck.domain)
+		}
+		if replaces != "" {
+			opts = append(opts, acme.WithOrderReplaces(replaces))
 		}
 		o, err := client.AuthorizeOrder(ctx, id, opts...)
 		if err != nil {
+			if replaces != "" && isAlreadyReplaced(err) {
+				// Another order has already replaced the certificate,
+				// e.g. by another instance sharing the same cache.
+				replaces = ""
+				continue
+			}
 			return nil, err
 		}
 		// Remove all hanging authorizations to reduce rate limit quotas
 		// after we're done.
 		defer func(urls []string) {
-			go m.deactivatePendingAuthz(urls)
+			go m.deactivatePendingAuthz(client, urls)
 		}(o.AuthzURLs)
 
 		// Check if there's actually anything we need to do.
@@ -762,6 +1004,7 @@ AuthorizeOrderLoop:
 		}
 
 		// Satisfy all pending authorizations.
+		used := nextTyp // highest challengeTypes index used by the order
 		for _, zurl := range o.AuthzURLs {
 			z, err := client.GetAuthorization(ctx, zurl)
 			if err != nil {
@@ -772,24 +1015,56 @@ AuthorizeOrderLoop:
 				continue
 			}
 			// Pick the next preferred challenge.
+			// The index only moves past a type once it failed, since
+			// the other authorizations of the order may need it as well.
 			var chal *acme.Challenge
-			for chal == nil && nextTyp < len(challengeTypes) {
-				chal = pickChallenge(challengeTypes[nextTyp], z.Challenges)
-				nextTyp++
+			typ := nextTyp
+			for ; typ < len(challengeTypes); typ++ {
+				if !caa.allows(z, challengeTypes[typ]) {
+					continue
+				}
+				if chal = pickChallenge(challengeTypes[typ], z.Challenges); chal != nil {
+					break
+				}
 			}
 			if chal == nil {
-				return nil, fmt.Errorf("acme/autocert: unable to satisfy %q for domain %q: no viable challenge type found", z.URI, ck.domain)
+				err := fmt.Errorf("acme/autocert: unable to satisfy %q for domain %q: no viable challenge type found", z.URI, ck.domain)
+				if lastErr != nil {
+					err = fmt.Errorf("%w; last error: %v", err, lastErr)
+				}
+				return nil, err
 			}
+			used = max(used, typ)
 			// Respond to the challenge and wait for validation result.
-			cleanup, err := m.fulfill(ctx, client, chal, ck.domain)
+			// The identifier of a wildcard authorization is the base domain.
+			domain := z.Identifier.Value
+			if domain == "" {
+				domain = ck.domain
+			}
+			cleanup, err := m.fulfill(ctx, client, chal, domain)
 			if err != nil {
+				nextTyp, lastErr = typ+1, err
 				continue AuthorizeOrderLoop
 			}
 			defer cleanup()
+			if chal.Type == "dns-01" {
+				// Don't let the CA see a stale nameserver.
+				if err := m.checkPropagation(ctx, client, chal, domain); err != nil {
+					nextTyp, lastErr = typ+1, err
+					continue AuthorizeOrderLoop
+				}
+			}
+			// Don't waste an authorization on an unreachable response.
+			if err := m.selfCheck(ctx, client, chal, domain); err != nil {
+				nextTyp, lastErr = typ+1, err
+				continue AuthorizeOrderLoop
+			}
 			if _, err := client.Accept(ctx, chal); err != nil {
+				nextTyp, lastErr = typ+1, err
 				continue AuthorizeOrderLoop
 			}
 			if _, err := client.WaitAuthorization(ctx, z.URI); err != nil {
+				nextTyp, lastErr = typ+1, err
 				continue AuthorizeOrderLoop
 			}
 		}
@@ -798,6 +1073,9 @@ AuthorizeOrderLoop:
 		// Wait for the CA to update the order status.
 		o, err = client.WaitOrder(ctx, o.URI)
 		if err != nil {
+			if nextTyp = used + 1; nextTyp >= len(challengeTypes) {
+				return nil, err
+			}
 			continue AuthorizeOrderLoop
 		}
 		return o, nil
@@ -813,14 +1091,11 @@ func pickChallenge(typ string, chal []*acme.Challenge) *acme.Challenge {
 	return nil
 }
 
-func (m *Manager) supportedChallengeTypes() []string {
-	m.challengeMu.RLock()
-	defer m.challengeMu.RUnlock()
-	typ := []string{"tls-alpn-01"}
-	if m.tryHTTP01 {
-		typ = append(typ, "http-01")
-	}
-	return typ
+// isAlreadyReplaced reports whether err is the ACME error returned by CAs
+// when an order replaces a certificate that has already been replaced.
+func isAlreadyReplaced(err error) bool {
+	var e *acme.Error
+	return errors.As(err, &e) && e.ProblemType == "urn:ietf:params:acme:error:alreadyReplaced"
 }
 
 // deactivatePendingAuthz relinquishes all authorizations identified by the elements
@@ -830,13 +1105,9 @@ func (m *Manager) supportedChallengeTypes() []string {
 // deactivatePendingAuthz takes no context argument and instead runs with its own
 // "detached" context because deactivations are done in a goroutine separate from
 // that of the main issuance or renewal flow.
-func (m *Manager) deactivatePendingAuthz(uri []string) {
+func (m *Manager) deactivatePendingAuthz(client *acme.Client, uri []string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
-	client, err := m.acmeClient(ctx)
-	if err != nil {
-		return
-	}
 	for _, u := range uri {
 		z, err := client.GetAuthorization(ctx, u)
 		if err == nil && z.Status == acme.StatusPending {
@@ -845,29 +1116,6 @@ func (m *Manager) deactivatePendingAuthz(uri []string) {
 	}
 }
 
-// fulfill provisions a response to the challenge chal.
-// The cleanup is non-nil only if provisioning succeeded.
-func (m *Manager) fulfill(ctx context.Context, client *acme.Client, chal *acme.Challenge, domain string) (cleanup func(), err error) {
-	switch chal.Type {
-	case "tls-alpn-01":
-		cert, err := client.TLSALPN01ChallengeCert(chal.Token, domain)
-		if err != nil {
-			return nil, err
-		}
-		m.putCertToken(ctx, domain, &cert)
-		return func() { go m.deleteCertToken(domain) }, nil
-	case "http-01":
-		resp, err := client.HTTP01ChallengeResponse(chal.Token)
-		if err != nil {
-			return nil, err
-		}
-		p := client.HTTP01ChallengePath(chal.Token)
-		m.putHTTPToken(ctx, p, resp)
-		return func() { go m.deleteHTTPToken(p) }, nil
-	}
-	return nil, fmt.Errorf("acme/autocert: unknown challenge type %q", chal.Type)
-}
-
 // putCertToken stores the token certificate with the specified name
 // in both m.certTokens map and m.Cache.
 func (m *Manager) putCertToken(ctx context.Context, name string, cert *tls.Certificate) {
@@ -949,8 +1197,8 @@ func httpTokenCacheKey(tokenPath string) string {
 // - a new cert was created by m.createCert
 //
 // The key argument is a certificate private key.
-// The exp argument is the cert expiration time (NotAfter).
-func (m *Manager) startRenew(ck certKey, key crypto.Signer, exp time.Time) {
+// The leaf argument is the current certificate.
+func (m *Manager) startRenew(ck certKey, key crypto.Signer, leaf *x509.Certificate) {
 	m.renewalMu.Lock()
 	defer m.renewalMu.Unlock()
 	if m.renewal[ck] != nil {
@@ -962,7 +1210,7 @@ func (m *Manager) startRenew(ck certKey, key crypto.Signer, exp time.Time) {
 	}
 	dr := &domainRenewal{m: m, ck: ck, key: key}
 	m.renewal[ck] = dr
-	dr.start(exp)
+	dr.start(leaf)
 }
 
 // stopRenew stops all currently running cert renewal timers.
@@ -976,9 +1224,9 @@ func (m *Manager) stopRenew() {
 	}
 }
 
-func (m *Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
-	const keyName = "acme_account"
-
+// accountKey returns the ACME account key stored in the cache under keyName,
+// generating it if there is none yet.
+func (m *Manager) accountKey(ctx context.Context, keyName string) (crypto.Signer, error) {
 	genKey := func() (*ecdsa.PrivateKey, error) {
 		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	}
@@ -1013,48 +1261,91 @@ func (m *Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
 	return parsePrivateKey(priv.Bytes)
 }
 
-func (m *Manager) acmeClient(ctx context.Context) (*acme.Client, error) {
-	m.clientMu.Lock()
-	defer m.clientMu.Unlock()
-	if m.client != nil {
-		return m.client, nil
+// isAccountAlreadyExist reports whether the err, as returned from acme.Client.Register,
+// indicates the account has already been registered.
+func isAccountAlreadyExist(err error) bool {
+	if err == acme.ErrAccountAlreadyExists {
+		return true
 	}
+	ae, ok := err.(*acme.Error)
+	return ok && ae.StatusCode == http.StatusConflict
+}
 
-	client := m.Client
-	if client == nil {
-		client = &acme.Client{DirectoryURL: DefaultACMEDirectory}
+// groupFor returns the key of the certificate group which the name belongs to, if any.
+func (m *Manager) groupFor(name string) (certKey, bool, error) {
+	m.groupsOnce.Do(func() {
+		m.groups, m.groupsErr = buildGroups(m.Groups)
+	})
+	if m.groupsErr != nil {
+		return certKey{}, false, m.groupsErr
 	}
-	if client.Key == nil {
-		var err error
-		client.Key, err = m.accountKey(ctx)
-		if err != nil {
-			return nil, err
-		}
+	if ip, ok := parseIP(name); ok {
+		ck, ok := m.groups[ip]
+		return ck, ok, nil
 	}
-	if client.UserAgent == "" {
-		client.UserAgent = "autocert"
+	if ck, ok := m.groups[name]; ok {
+		return ck, true, nil
 	}
-	var contact []string
-	if m.Email != "" {
-		contact = []string{"mailto:" + m.Email}
+	// A group may contain wildcard names as well.
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		ck, ok := m.groups["*"+name[i:]]
+		return ck, ok, nil
 	}
-	a := &acme.Account{Contact: contact, ExternalAccountBinding: m.ExternalAccountBinding}
-	_, err := client.Register(ctx, a, m.Prompt)
-	if err == nil || isAccountAlreadyExist(err) {
-		m.client = client
-		err = nil
+	return certKey{}, false, nil
+}
+
+// buildGroups maps each name in groups to the key of its certificate group.
+// The names are converted the same way as GetCertificate does for server names.
+func buildGroups(groups map[string][]string) (map[string]certKey, error) {
+	keys := make(map[string]certKey)
+	for group, names := range groups {
+		if group == "" || strings.ContainsAny(group, `/\:*?"<>|`) {
+			return nil, fmt.Errorf("acme/autocert: invalid certificate group name %q", group)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("acme/autocert: certificate group %q is empty", group)
+		}
+		canonical := make([]string, 0, len(names))
+		for _, name := range names {
+			if ip, ok := parseIP(name); ok {
+				canonical = append(canonical, ip)
+				continue
+			}
+			base, wildcard := strings.CutPrefix(strings.TrimSuffix(name, "."), "*.")
+			n, err := idna.Lookup.ToASCII(base)
+			if err != nil || !strings.Contains(n, ".") {
+				return nil, fmt.Errorf("acme/autocert: invalid name %q in certificate group %q", name, group)
+			}
+			if wildcard {
+				n = "*." + n
+			}
+			canonical = append(canonical, n)
+		}
+		ck := certKey{domain: group, group: strings.Join(canonical, ",")}
+		for _, name := range canonical {
+			if other, ok := keys[name]; ok && other.domain != group {
+				return nil, fmt.Errorf("acme/autocert: %q is in certificate groups %q and %q", name, other.domain, group)
+			}
+			keys[name] = ck
+		}
 	}
-	return m.client, err
+	return keys, nil
 }
 
-// isAccountAlreadyExist reports whether the err, as returned from acme.Client.Register,
-// indicates the account has already been registered.
-func isAccountAlreadyExist(err error) bool {
-	if err == acme.ErrAccountAlreadyExists {
-		return true
+// wildcardFor returns the name from m.Wildcards which covers the domain,
+// if any. Only the leftmost label of the domain is matched by the wildcard.
+func (m *Manager) wildcardFor(domain string) (string, bool) {
+	i := strings.IndexByte(domain, '.')
+	if i <= 0 {
+		return "", false
+	}
+	wildcard := "*" + domain[i:]
+	for _, w := range m.Wildcards {
+		if strings.EqualFold(strings.TrimSuffix(w, "."), wildcard) {
+			return wildcard, true
+		}
 	}
-	ae, ok := err.(*acme.Error)
-	return ok && ae.StatusCode == http.StatusConflict
+	return "", false
 }
 
 func (m *Manager) hostPolicy() HostPolicy {
@@ -1064,11 +1355,16 @@ func (m *Manager) hostPolicy() HostPolicy {
 	return defaultHostPolicy
 }
 
-func (m *Manager) renewBefore() time.Duration {
+// renewBefore returns how early the leaf should be renewed before it expires.
+func (m *Manager) renewBefore(leaf *x509.Certificate) time.Duration {
 	if m.RenewBefore > renewJitter {
 		return m.RenewBefore
 	}
-	return 24 * time.Hour // 1 day
+	ratio := m.RenewalRatio
+	if ratio <= 0 || ratio >= 1 {
+		ratio = defaultRenewalRatio
+	}
+	return time.Duration(float64(leaf.NotAfter.Sub(leaf.NotBefore)) * ratio)
 }
 
 func (m *Manager) now() time.Time {
@@ -1085,6 +1381,7 @@ type certState struct {
 	key    crypto.Signer     // private key for cert
 	cert   [][]byte          // DER encoding
 	leaf   *x509.Certificate // parsed cert[0]; always non-nil if cert != nil
+	issuer string            // ID of the issuer of cert, if known
 }
 
 // tlscert creates a tls.Certificate from s.key and s.cert.
@@ -1104,12 +1401,21 @@ func (s *certState) tlscert() (*tls.Certificate, error) {
 }
 
 // certRequest generates a CSR for the given common name.
-func certRequest(key crypto.Signer, name string, ext []pkix.Extension) ([]byte, error) {
+func certRequest(key crypto.Signer, names []string, ext []pkix.Extension) ([]byte, error) {
 	req := &x509.CertificateRequest{
-		Subject:         pkix.Name{CommonName: name},
-		DNSNames:        []string{name},
 		ExtraExtensions: ext,
 	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			// IP addresses are not allowed in the common name.
+			req.IPAddresses = append(req.IPAddresses, ip)
+			continue
+		}
+		if req.Subject.CommonName == "" {
+			req.Subject.CommonName = name
+		}
+		req.DNSNames = append(req.DNSNames, name)
+	}
 	return x509.CreateCertificateRequest(rand.Reader, req, key)
 }
 
@@ -1167,8 +1473,15 @@ func validCert(ck certKey, der [][]byte, key crypto.Signer, now time.Time) (leaf
 	if now.After(leaf.NotAfter) {
 		return nil, errors.New("acme/autocert: expired certificate")
 	}
-	if err := leaf.VerifyHostname(ck.domain); err != nil {
-		return nil, err
+	for _, name := range ck.names() {
+		if strings.HasPrefix(name, "*.") {
+			// VerifyHostname doesn't accept wildcard names.
+			if !slices.Contains(leaf.DNSNames, name) {
+				return nil, fmt.Errorf("acme/autocert: certificate is not valid for %q", name)
+			}
+		} else if err := leaf.VerifyHostname(name); err != nil {
+			return nil, err
+		}
 	}
 	// renew certificates revoked by Let's Encrypt in January 2022
 	if isRevokedLetsEncrypt(leaf) {
@@ -1187,6 +1500,13 @@ func validCert(ck certKey, der [][]byte, key crypto.Signer, now time.Time) (leaf
 		if !ck.isRSA && !ck.isToken {
 			return nil, errors.New("acme/autocert: key type does not match expected value")
 		}
+		size := ck.keySize
+		if size == 0 {
+			size = 2048 // default RSA key size
+		}
+		if !ck.isToken && pub.N.BitLen() != size {
+			return nil, errors.New("acme/autocert: key size does not match expected value")
+		}
 	case *ecdsa.PublicKey:
 		prv, ok := key.(*ecdsa.PrivateKey)
 		if !ok {
@@ -1198,6 +1518,13 @@ func validCert(ck certKey, der [][]byte, key crypto.Signer, now time.Time) (leaf
 		if ck.isRSA && !ck.isToken {
 			return nil, errors.New("acme/autocert: key type does not match expected value")
 		}
+		size := ck.keySize
+		if size == 0 {
+			size = 256 // default P-256 curve
+		}
+		if !ck.isToken && pub.Curve.Params().BitSize != size {
+			return nil, errors.New("acme/autocert: key size does not match expected value")
+		}
 	default:
 		return nil, errors.New("acme/autocert: unknown public key algorithm")
 	}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -28,7 +29,7 @@ import (
 	"time"
 
 	"github.com/For-ACGN/autocert/acme"
-	"github.com/For-ACGN/autocert/certmgr/internal/acmetest"
+	"github.com/For-ACGN/autocert/acme/acmetest"
 )
 
 var (
@@ -102,8 +103,10 @@ func (m *memCache) numCerts() int {
 
 	res := 0
 	for key := range m.keyData {
-		if strings.HasSuffix(key, "+token") ||
+		if strings.HasPrefix(key, "acme_account") || key == "local_ca" ||
+			strings.HasSuffix(key, "+token") ||
 			strings.HasSuffix(key, "+key") ||
+			strings.HasSuffix(key, "+issuer") ||
 			strings.HasSuffix(key, "+http-01") {
 			continue
 		}
@@ -194,6 +197,62 @@ func TestGetCertificate(t *testing.T) {
 			domain:      "example.org",
 			disableALPN: true,
 		},
+		{
+			name:   "DNS",
+			hello:  clientHelloInfo("example.org", algECDSA),
+			domain: "example.org",
+			prepare: func(t *testing.T, man *Manager, s *acmetest.CAServer) {
+				dns := newFakeDNS()
+				man.DNSProvider = dns
+				useEmptyDNS(t, man)
+				s.ChallengeTypes("tls-alpn-01", "dns-01").LookupTXT(dns.LookupTXT)
+			},
+			// Break the server to check that dns-01 is preferred.
+			disableALPN: true, disableHTTP: true,
+		},
+		{
+			name:   "keyPolicyECDSA",
+			hello:  clientHelloInfo("example.org", algECDSA),
+			domain: "example.org",
+			prepare: func(t *testing.T, man *Manager, s *acmetest.CAServer) {
+				man.KeyPolicy = KeyPolicy{Curve: elliptic.P384(), RSABits: 3072}
+			},
+			verify: func(t *testing.T, man *Manager, leaf *x509.Certificate) {
+				pub, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+				if !ok || pub.Curve != elliptic.P384() {
+					t.Errorf("leaf key is not a P-384 ECDSA key")
+				}
+				if _, err := man.Cache.Get(context.Background(), "example.org+p384"); err != nil {
+					t.Errorf("certificate not cached under its key type: %v", err)
+				}
+			},
+		},
+		{
+			name:   "keyPolicyRSA",
+			hello:  clientHelloInfo("example.org", algRSA),
+			domain: "example.org",
+			prepare: func(t *testing.T, man *Manager, s *acmetest.CAServer) {
+				man.KeyPolicy = KeyPolicy{Curve: elliptic.P384(), RSABits: 3072}
+			},
+			verify: func(t *testing.T, man *Manager, leaf *x509.Certificate) {
+				pub, ok := leaf.PublicKey.(*rsa.PublicKey)
+				if !ok || pub.N.BitLen() != 3072 {
+					t.Errorf("leaf key is not a 3072-bit RSA key")
+				}
+				if _, err := man.Cache.Get(context.Background(), "example.org+rsa3072"); err != nil {
+					t.Errorf("certificate not cached under its key type: %v", err)
+				}
+			},
+		},
+		{
+			name:   "badKeyPolicy",
+			hello:  clientHelloInfo("example.org", algECDSA),
+			domain: "example.org",
+			prepare: func(t *testing.T, man *Manager, s *acmetest.CAServer) {
+				man.KeyPolicy = KeyPolicy{Curve: elliptic.P224()}
+			},
+			expectError: "unsupported ECDSA curve P-224",
+		},
 		{
 			name:   "nilPrompt",
 			hello:  clientHelloInfo("example.org", algECDSA),
@@ -561,9 +620,9 @@ func TestHTTPHandlerDefaultFallback(t *testing.T) {
 		{"GET", "http://example.org/foo?a=b", 302, "https://example.org/foo?a=b"},
 		{"GET", "http://example.org:80/foo?a=b", 302, "https://example.org:443/foo?a=b"},
 		{"GET", "http://example.org:80/foo%20bar", 302, "https://example.org:443/foo%20bar"},
-		{"GET", "http://[2602:d1:xxxx::c60a]:1234", 302, "https://[2602:d1:xxxx::c60a]:443/"},
-		{"GET", "http://[2602:d1:xxxx::c60a]", 302, "https://[2602:d1:xxxx::c60a]/"},
-		{"GET", "http://[2602:d1:xxxx::c60a]/foo?a=b", 302, "https://[2602:d1:xxxx::c60a]/foo?a=b"},
+		{"GET", "http://[2602:d1:abcd::c60a]:1234", 302, "https://[2602:d1:abcd::c60a]:443/"},
+		{"GET", "http://[2602:d1:abcd::c60a]", 302, "https://[2602:d1:abcd::c60a]/"},
+		{"GET", "http://[2602:d1:abcd::c60a]/foo?a=b", 302, "https://[2602:d1:abcd::c60a]/foo?a=b"},
 		{"HEAD", "http://example.org", 302, "https://example.org/"},
 		{"HEAD", "http://example.org/foo", 302, "https://example.org/foo"},
 		{"HEAD", "http://example.org/foo/bar/", 302, "https://example.org/foo/bar/"},
@@ -592,11 +651,11 @@ func TestHTTPHandlerDefaultFallback(t *testing.T) {
 func TestAccountKeyCache(t *testing.T) {
 	m := Manager{Cache: newMemCache(t)}
 	ctx := context.Background()
-	k1, err := m.accountKey(ctx)
+	k1, err := m.accountKey(ctx, accountKeyName)
 	if err != nil {
 		t.Fatal(err)
 	}
-	k2, err := m.accountKey(ctx)
+	k2, err := m.accountKey(ctx, accountKeyName)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -619,7 +678,7 @@ func TestCache(t *testing.T) {
 		PrivateKey:  ecdsaKey,
 	}
 
-	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -661,7 +720,7 @@ func TestCache(t *testing.T) {
 }
 
 func TestHostWhitelist(t *testing.T) {
-	policy := HostWhitelist("example.com", "EXAMPLE.ORG", "*.example.net", "éÉ.com")
+	policy := HostWhitelist("example.com", "EXAMPLE.ORG", "*.example.net", "éÉ.com", "2001:DB8:0::1")
 	tt := []struct {
 		host  string
 		allow bool
@@ -673,6 +732,8 @@ func TestHostWhitelist(t *testing.T) {
 		{"two.example.org", false},
 		{"three.example.net", false},
 		{"dummy", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
 	}
 	for i, test := range tt {
 		err := policy(nil, test.host)
@@ -694,7 +755,11 @@ func TestValidCert(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	key3, err := rsa.GenerateKey(rand.Reader, 1024)
+	key3, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key4, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -710,6 +775,10 @@ func TestValidCert(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	cert4, err := dummyCert(key4.Public(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
 	now := time.Now()
 	early, err := dateDummyCert(key1.Public(), now.Add(time.Hour), now.Add(2*time.Hour), "example.org")
 	if err != nil {
@@ -719,6 +788,10 @@ func TestValidCert(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	wildcard, err := dummyCert(key1.Public(), "*.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	tt := []struct {
 		ck   certKey
@@ -740,6 +813,13 @@ func TestValidCert(t *testing.T) {
 		{certKey{domain: "example.org"}, key1, [][]byte{expired}, false},
 		{certKey{domain: "example.org", isRSA: true}, key1, [][]byte{cert1}, false},
 		{certKey{domain: "example.org"}, key3, [][]byte{cert3}, false},
+		{certKey{domain: "*.example.org"}, key1, [][]byte{wildcard}, true},
+		{certKey{domain: "example.org", keySize: 384}, key1, [][]byte{cert1}, false},
+		{certKey{domain: "example.org", isRSA: true, keySize: 3072}, key3, [][]byte{cert3}, false},
+		{certKey{domain: "example.org", keySize: 384}, key4, [][]byte{cert4}, true},
+		{certKey{domain: "example.org"}, key4, [][]byte{cert4}, false},
+		{certKey{domain: "*.example.org"}, key1, [][]byte{cert1}, false},
+		{certKey{domain: "example.org"}, key1, [][]byte{wildcard}, false},
 	}
 	for i, test := range tt {
 		leaf, err := validCert(test.ck, test.cert, test.key, now)
@@ -809,7 +889,7 @@ func TestCertRequest(t *testing.T) {
 		Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1},
 		Value: []byte("dummy"),
 	}
-	b, err := certRequest(key, "example.org", []pkix.Extension{ext})
+	b, err := certRequest(key, []string{"example.org"}, []pkix.Extension{ext})
 	if err != nil {
 		t.Fatalf("certRequest: %v", err)
 	}
@@ -881,7 +961,35 @@ func TestSupportsECDSA(t *testing.T) {
 			CipherSuites:     tt.CipherSuites,
 			SignatureSchemes: tt.SignatureSchemes,
 			SupportedCurves:  tt.SupportedCurves,
-		})
+		}, nil)
+		if result != tt.ecdsaOk {
+			t.Errorf("%d: supportsECDSA = %v; want %v", i, result, tt.ecdsaOk)
+		}
+	}
+}
+
+func TestSupportsECDSACurve(t *testing.T) {
+	suites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	tests := []struct {
+		curve   elliptic.Curve
+		schemes []tls.SignatureScheme
+		curves  []tls.CurveID
+		ecdsaOk bool
+	}{
+		{elliptic.P384(), []tls.SignatureScheme{tls.ECDSAWithP384AndSHA384}, []tls.CurveID{tls.CurveP384}, true},
+		{elliptic.P384(), []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}, []tls.CurveID{tls.CurveP384}, false},
+		{elliptic.P384(), []tls.SignatureScheme{tls.ECDSAWithP384AndSHA384}, []tls.CurveID{tls.CurveP256}, false},
+		{elliptic.P521(), []tls.SignatureScheme{tls.ECDSAWithP521AndSHA512}, []tls.CurveID{tls.CurveP521}, true},
+		{elliptic.P521(), []tls.SignatureScheme{tls.ECDSAWithP384AndSHA384}, []tls.CurveID{tls.CurveP521}, false},
+		{elliptic.P256(), []tls.SignatureScheme{tls.ECDSAWithP384AndSHA384}, []tls.CurveID{tls.CurveP256}, false},
+		{elliptic.P256(), []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}, []tls.CurveID{tls.CurveP256}, true},
+	}
+	for i, tt := range tests {
+		result := supportsECDSA(&tls.ClientHelloInfo{
+			CipherSuites:     suites,
+			SignatureSchemes: tt.schemes,
+			SupportedCurves:  tt.curves,
+		}, tt.curve)
 		if result != tt.ecdsaOk {
 			t.Errorf("%d: supportsECDSA = %v; want %v", i, result, tt.ecdsaOk)
 		}
@@ -994,3 +1102,62 @@ func TestEndToEndHTTP(t *testing.T) {
 		t.Errorf("user server response: %q; want 'OK'", v)
 	}
 }
+
+func TestGetCertificateGroup(t *testing.T) {
+	man := testManager(t)
+	man.Groups = map[string][]string{
+		"web": {"example.org", "WWW.example.org.", "127.0.0.1"},
+	}
+	ca := acmetest.NewCAServer(t)
+	for _, name := range []string{"example.org", "www.example.org", "127.0.0.1"} {
+		ca.ResolveHandler(name, man.HTTPHandler(nil))
+	}
+	ca.ChallengeTypes("http-01").Start()
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+
+	www, err := man.GetCertificate(clientHelloInfo("www.example.org", algECDSA))
+	if err != nil {
+		t.Fatalf("GetCertificate(www): %v", err)
+	}
+	if want := []string{"example.org", "www.example.org"}; !reflect.DeepEqual(www.Leaf.DNSNames, want) {
+		t.Errorf("DNSNames = %q; want %q", www.Leaf.DNSNames, want)
+	}
+	if len(www.Leaf.IPAddresses) != 1 || !www.Leaf.IPAddresses[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("IPAddresses = %v; want [127.0.0.1]", www.Leaf.IPAddresses)
+	}
+	for _, name := range []string{"example.org", "127.0.0.1"} {
+		cert, err := man.GetCertificate(clientHelloInfo(name, algECDSA))
+		if err != nil {
+			t.Fatalf("GetCertificate(%s): %v", name, err)
+		}
+		if cert.Leaf.SerialNumber.Cmp(www.Leaf.SerialNumber) != 0 {
+			t.Errorf("%s was not served the group certificate", name)
+		}
+	}
+	if _, err := man.Cache.Get(context.Background(), "_group.web"); err != nil {
+		t.Errorf("group certificate not cached: %v", err)
+	}
+	if numCerts := man.Cache.(*memCache).numCerts(); numCerts != 1 {
+		t.Errorf("found %d certificates in cache; want 1", numCerts)
+	}
+}
+
+func TestBuildGroups(t *testing.T) {
+	tt := []struct {
+		name   string
+		groups map[string][]string
+		ok     bool
+	}{
+		{"valid", map[string][]string{"a": {"example.org", "*.example.org", "::1"}}, true},
+		{"badGroupName", map[string][]string{"a/b": {"example.org"}}, false},
+		{"empty", map[string][]string{"a": {}}, false},
+		{"badName", map[string][]string{"a": {"exa mple.org"}}, false},
+		{"overlap", map[string][]string{"a": {"example.org"}, "b": {"EXAMPLE.org"}}, false},
+	}
+	for _, test := range tt {
+		_, err := buildGroups(test.groups)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: err = %v; want ok = %v", test.name, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package certmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/certmgr/internal/dnsutil"
+)
+
+// CAARecord is a DNS Certification Authority Authorization record,
+// see RFC 8659.
+type CAARecord struct {
+	Flags uint8
+	Tag   string // such as "issue", "issuewild" or "iodef"
+	Value string
+}
+
+// critical reports whether the Issuer Critical Flag of the record is set.
+func (r CAARecord) critical() bool {
+	return r.Flags&0x80 != 0
+}
+
+// CAACheck configures the check of the CAA records (RFC 8659) of the domains
+// before a certificate is ordered. If the records don't allow the CA to issue
+// certificates to the Manager's account, with one of the challenge types
+// the Manager can solve, the order would fail validation anyway and count
+// against the rate limits, so the Manager fails fast with a descriptive error.
+//
+// The records are compared against the CAA identities advertised in the
+// Directory of the CA, the account URI and the validation methods of the
+// RFC 8657 parameters. The check is skipped if the CA advertises no
+// CAA identities, and for the names whose records can't be resolved,
+// leaving the decision to the CA.
+//
+// Once enabled, the check queries the recursive resolvers
+// of /etc/resolv.conf by default.
+type CAACheck struct {
+	// Enable enables the check, which is disabled by default.
+	Enable bool
+
+	// Nameservers optionally lists the addresses of the recursive
+	// resolvers queried for the CAA records, such as "192.0.2.53:53".
+	// If empty, the ones of /etc/resolv.conf are used, and the check
+	// is skipped if there's none.
+	Nameservers []string
+
+	// Dial optionally specifies the dial function used to connect
+	// to the nameservers. If nil, a net.Dialer is used.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// LookupCAA optionally replaces the DNS queries. It returns the CAA
+	// records at exactly name, following CNAME records, and no error if
+	// there's none. The Manager walks up the tree of the names itself.
+	LookupCAA func(ctx context.Context, name string) ([]CAARecord, error)
+}
+
+// lookup returns the CAA records at exactly name. It returns
+// a nil function if there's no way to look them up.
+func (c *CAACheck) lookup() func(ctx context.Context, name string) ([]CAARecord, error) {
+	if c.LookupCAA != nil {
+		return c.LookupCAA
+	}
+	servers := c.Nameservers
+	if len(servers) == 0 {
+		servers = dnsutil.SystemNameservers()
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, name string) ([]CAARecord, error) {
+		var errs []error
+		for _, addr := range servers {
+			qctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+			msg, err := dnsutil.Query(qctx, c.Dial, addr, name, dnsutil.TypeCAA, true)
+			cancel()
+			switch {
+			case err != nil:
+				errs = append(errs, fmt.Errorf("%s: %v", addr, err))
+				continue
+			case msg.RCode == dnsmessage.RCodeNameError:
+				return nil, nil
+			case msg.RCode != dnsmessage.RCodeSuccess:
+				errs = append(errs, fmt.Errorf("%s: %s", addr, dnsutil.RCodeName(uint16(msg.RCode))))
+				continue
+			}
+			var records []CAARecord
+			for _, rr := range msg.Answers {
+				body, ok := rr.Body.(*dnsmessage.UnknownResource)
+				if !ok || body.Type != dnsutil.TypeCAA {
+					continue
+				}
+				r, err := parseCAARecord(body.Data)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", rr.Header.Name, err)
+				}
+				records = append(records, r)
+			}
+			return records, nil
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// parseCAARecord parses the RDATA of a CAA record.
+func parseCAARecord(data []byte) (CAARecord, error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) || data[1] == 0 {
+		return CAARecord{}, errors.New("malformed CAA record")
+	}
+	n := 2 + int(data[1])
+	return CAARecord{
+		Flags: data[0],
+		Tag:   string(data[2:n]),
+		Value: string(data[n:]),
+	}, nil
+}
+
+// parseCAAValue splits the value of an issue or issuewild property
+// into the issuer domain name, empty if issuance is forbidden,
+// and the parameters keyed by lower case name.
+func parseCAAValue(v string) (issuer string, params map[string]string) {
+	parts := strings.Split(v, ";")
+	issuer = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(parts[0]), "."))
+	params = make(map[string]string)
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if k = strings.TrimSpace(k); k != "" {
+			params[strings.ToLower(k)] = strings.TrimSpace(v)
+		}
+	}
+	return issuer, params
+}
+
+// relevantCAA returns the relevant CAA record set of the domain: the first
+// one found walking up the tree of the domain, which is empty if there's none.
+func relevantCAA(ctx context.Context, lookup func(context.Context, string) ([]CAARecord, error), domain string) (name string, records []CAARecord, err error) {
+	name = strings.TrimSuffix(domain, ".")
+	for {
+		records, err = lookup(ctx, name+".")
+		if err != nil || len(records) > 0 {
+			return name, records, err
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return name, nil, nil
+		}
+		name = name[i+1:]
+	}
+}
+
+// caaMethods is the result of the CAA check of an order:
+// the challenge types allowed by the CAA records of the identifiers
+// which restrict them, keyed by domain name, with the "*." prefix
+// for the wildcard authorizations.
+type caaMethods map[string][]string
+
+// allows reports whether the CAA records allow the validation
+// of the authorization z with the challenge type typ.
+func (c caaMethods) allows(z *acme.Authorization, typ string) bool {
+	name := z.Identifier.Value
+	if z.Wildcard {
+		name = "*." + name
+	}
+	methods, ok := c[name]
+	return !ok || slices.Contains(methods, typ)
+}
+
+// checkCAA checks the CAA records of the names of the certificate
+// against the CAA identities of the CA, the account URI and the given
+// challenge types. See CAACheck for details.
+func (m *Manager) checkCAA(ctx context.Context, client *acme.Client, names []string, types []string) (caaMethods, error) {
+	if !m.CAACheck.Enable {
+		return nil, nil
+	}
+	dir, err := client.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(dir.CAA) == 0 {
+		return nil, nil
+	}
+	lookup := m.CAACheck.lookup()
+	if lookup == nil {
+		return nil, nil
+	}
+
+	var account string // URI, fetched when needed
+	accountURI := func() (string, error) {
+		if account == "" {
+			a, err := client.GetReg(ctx, "")
+			if err != nil {
+				return "", err
+			}
+			account = a.URI
+		}
+		return account, nil
+	}
+	methods := make(caaMethods)
+	for _, name := range names {
+		if net.ParseIP(name) != nil {
+			// no CAA records for IP addresses
+			continue
+		}
+		domain, wildcard := strings.CutPrefix(name, "*.")
+		at, records, err := relevantCAA(ctx, lookup, domain)
+		if err != nil || len(records) == 0 {
+			continue
+		}
+
+		tag := "issue"
+		for _, r := range records {
+			t := strings.ToLower(r.Tag)
+			if r.critical() && t != "issue" && t != "issuewild" && t != "iodef" {
+				return nil, fmt.Errorf("acme/autocert: CAA records at %s forbid issuance for %s: unknown critical property %q", at, name, r.Tag)
+			}
+			if wildcard && t == "issuewild" {
+				tag = "issuewild"
+			}
+		}
+		var (
+			allowed  []string // by the validationmethods parameters
+			matched  bool     // an issuer domain name of the CA with a matching account
+			anyTypes bool     // a matching record without validationmethods
+			reasons  []string
+		)
+		for _, r := range records {
+			if !strings.EqualFold(r.Tag, tag) {
+				continue
+			}
+			issuer, params := parseCAAValue(r.Value)
+			if issuer == "" {
+				reasons = append(reasons, fmt.Sprintf("%s %q forbids any issuance", r.Tag, r.Value))
+				continue
+			}
+			if !slices.Contains(dir.CAA, issuer) {
+				reasons = append(reasons, fmt.Sprintf("%s %q is for another CA", r.Tag, r.Value))
+				continue
+			}
+			if uri, ok := params["accounturi"]; ok {
+				acct, err := accountURI()
+				if err != nil {
+					return nil, err
+				}
+				if uri != acct {
+					reasons = append(reasons, fmt.Sprintf("%s %q is for another account than %s", r.Tag, r.Value, acct))
+					continue
+				}
+			}
+			matched = true
+			vm, ok := params["validationmethods"]
+			if !ok {
+				anyTypes = true
+				continue
+			}
+			for _, t := range strings.Split(vm, ",") {
+				allowed = append(allowed, strings.TrimSpace(t))
+			}
+		}
+		switch {
+		case !matched && len(reasons) == 0:
+			// no issue or issuewild property: any CA is allowed
+			continue
+		case !matched:
+			return nil, fmt.Errorf("acme/autocert: CAA records at %s don't allow %s to issue certificates for %s: %s",
+				at, strings.Join(dir.CAA, ", "), name, strings.Join(reasons, "; "))
+		case anyTypes:
+			continue
+		}
+		var usable []string
+		for _, t := range types {
+			if slices.Contains(allowed, t) {
+				usable = append(usable, t)
+			}
+		}
+		if len(usable) == 0 {
+			return nil, fmt.Errorf("acme/autocert: CAA records at %s only allow the validation methods %s for %s, but the Manager can solve %s",
+				at, strings.Join(allowed, ", "), name, strings.Join(types, ", "))
+		}
+		methods[name] = usable
+	}
+	return methods, nil
+}
+
+// CAARecords returns the CAA records, in zone file format, allowing
+// the CAs of the Manager's ACME issuers to issue certificates for domain
+// only to the Manager's accounts and with the challenge types the Manager
+// can solve, as recommended by RFC 8657. Each CA must advertise its CAA
+// identities in its Directory.
+//
+// The returned records allow wildcard certificates as well.
+func (m *Manager) CAARecords(ctx context.Context, domain string) ([]string, error) {
+	methods := strings.Join(m.supportedChallengeTypes(), ",")
+	name := dnsutil.Fqdn(strings.TrimPrefix(domain, "*."))
+	var records []string
+	for _, iss := range m.issuers() {
+		a, ok := iss.(*ACMEIssuer)
+		if !ok {
+			continue
+		}
+		client, err := a.acmeClient(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		dir, err := client.Discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(dir.CAA) == 0 {
+			return nil, fmt.Errorf("acme/autocert: CA %s doesn't advertise its CAA identities", client.DirectoryURL)
+		}
+		acct, err := client.GetReg(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, issuer := range dir.CAA {
+			records = append(records, fmt.Sprintf("%s CAA 0 issue \"%s; accounturi=%s; validationmethods=%s\"",
+				name, issuer, acct.URI, methods))
+		}
+	}
+	if len(records) == 0 {
+		return nil, errors.New("acme/autocert: no ACME issuer configured")
+	}
+	return records, nil
+}
@@ -0,0 +1,259 @@
+package certmgr
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/acme/acmetest"
+	"github.com/For-ACGN/autocert/certmgr/internal/dnstest"
+)
+
+// caaZone is a LookupCAA function answering from a map of records by name.
+type caaZone map[string][]CAARecord
+
+func (z caaZone) lookup(ctx context.Context, name string) ([]CAARecord, error) {
+	if name == "error.example.org." {
+		return nil, errors.New("SERVFAIL")
+	}
+	return z[name], nil
+}
+
+func issue(value string) CAARecord {
+	return CAARecord{Tag: "issue", Value: value}
+}
+
+func TestParseCAAValue(t *testing.T) {
+	tt := []struct {
+		value  string
+		issuer string
+		params map[string]string
+	}{
+		{"ca.example", "ca.example", map[string]string{}},
+		{";", "", map[string]string{}},
+		{" CA.example. ; accounturi=https://ca.example/acct/1 ;validationmethods=dns-01,http-01",
+			"ca.example", map[string]string{
+				"accounturi":        "https://ca.example/acct/1",
+				"validationmethods": "dns-01,http-01",
+			}},
+	}
+	for _, test := range tt {
+		issuer, params := parseCAAValue(test.value)
+		if issuer != test.issuer || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("parseCAAValue(%q) = %q, %v; want %q, %v", test.value, issuer, params, test.issuer, test.params)
+		}
+	}
+}
+
+func TestCheckCAA(t *testing.T) {
+	ca := acmetest.NewCAServer(t).CAAIdentities("ca.example", "ca.example.net").Start()
+	man := testManager(t)
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+	client, err := man.acmeClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := ca.URL() + "/accounts/1"
+	types := []string{"tls-alpn-01", "http-01"}
+
+	tt := []struct {
+		name    string
+		names   []string
+		zone    caaZone
+		want    caaMethods
+		wantErr string
+	}{
+		{name: "none", names: []string{"example.org"}},
+		{
+			name:  "issue",
+			names: []string{"example.org"},
+			zone:  caaZone{"example.org.": {issue("other.example"), issue("ca.example.net")}},
+		},
+		{
+			name:    "other CA",
+			names:   []string{"www.example.org"},
+			zone:    caaZone{"example.org.": {issue("other.example")}},
+			wantErr: `CAA records at example.org don't allow ca.example, ca.example.net to issue certificates for www.example.org: issue "other.example" is for another CA`,
+		},
+		{
+			name:    "forbidden",
+			names:   []string{"example.org"},
+			zone:    caaZone{"example.org.": {issue(";")}},
+			wantErr: `issue ";" forbids any issuance`,
+		},
+		{
+			name:  "closest",
+			names: []string{"www.example.org"},
+			zone: caaZone{
+				"www.example.org.": {issue("ca.example")},
+				"example.org.":     {issue(";")},
+			},
+		},
+		{
+			name:  "iodef only",
+			names: []string{"example.org"},
+			zone:  caaZone{"example.org.": {{Tag: "iodef", Value: "mailto:security@example.org"}}},
+		},
+		{
+			name:    "critical",
+			names:   []string{"example.org"},
+			zone:    caaZone{"example.org.": {issue("ca.example"), {Flags: 128, Tag: "tbs", Value: "x"}}},
+			wantErr: `unknown critical property "tbs"`,
+		},
+		{
+			name:  "account",
+			names: []string{"example.org"},
+			zone:  caaZone{"example.org.": {issue("ca.example; accounturi=" + account)}},
+		},
+		{
+			name:    "other account",
+			names:   []string{"example.org"},
+			zone:    caaZone{"example.org.": {issue("ca.example; accounturi=" + account + "2")}},
+			wantErr: "is for another account than " + account,
+		},
+		{
+			name:  "validation methods",
+			names: []string{"example.org", "example.com"},
+			zone: caaZone{
+				"example.org.": {issue("ca.example; validationmethods=dns-01,http-01")},
+				"example.com.": {issue("ca.example; validationmethods=dns-01"), issue("ca.example")},
+			},
+			want: caaMethods{"example.org": {"http-01"}},
+		},
+		{
+			name:    "unsupported validation methods",
+			names:   []string{"example.org"},
+			zone:    caaZone{"example.org.": {issue("ca.example; validationmethods=dns-01")}},
+			wantErr: "only allow the validation methods dns-01 for example.org, but the Manager can solve tls-alpn-01, http-01",
+		},
+		{
+			name:  "issuewild",
+			names: []string{"*.example.org", "example.org"},
+			zone: caaZone{"example.org.": {
+				issue("ca.example"),
+				{Tag: "issuewild", Value: "ca.example; validationmethods=tls-alpn-01"},
+			}},
+			want: caaMethods{"*.example.org": {"tls-alpn-01"}},
+		},
+		{
+			name:    "issuewild forbidden",
+			names:   []string{"*.example.org"},
+			zone:    caaZone{"example.org.": {issue("ca.example"), {Tag: "issuewild", Value: ";"}}},
+			wantErr: "for *.example.org",
+		},
+		{name: "lookup error", names: []string{"error.example.org"}},
+		{name: "IP address", names: []string{"192.0.2.1"}, zone: caaZone{"1.2.0.192.": {issue(";")}}},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			man.CAACheck = CAACheck{Enable: true, LookupCAA: test.zone.lookup}
+			got, err := man.checkCAA(context.Background(), client, test.names, types)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("checkCAA: %v; want error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkCAA: %v", err)
+			}
+			if len(got) != 0 || len(test.want) != 0 {
+				if !reflect.DeepEqual(got, test.want) {
+					t.Errorf("checkCAA = %v; want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckCAANameservers(t *testing.T) {
+	ca := acmetest.NewCAServer(t).CAAIdentities("ca.example").Start()
+	man := testManager(t)
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+	client, err := man.acmeClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns := dnstest.NewServer(t)
+	dns.AddCAA("example.org", 0, "issue", "other.example")
+	dns.AddCAA("example.org", 0, "iodef", "mailto:security@example.org")
+	dns.AddCAA("example.net", 0, "issue", "ca.example")
+	man.CAACheck = CAACheck{Enable: true, Nameservers: []string{dns.Addr()}}
+
+	_, err = man.checkCAA(context.Background(), client, []string{"www.example.org"}, []string{"http-01"})
+	if err == nil || !strings.Contains(err.Error(), `issue "other.example" is for another CA`) {
+		t.Errorf("checkCAA: %v; want CAA error", err)
+	}
+	_, err = man.checkCAA(context.Background(), client, []string{"www.example.net"}, []string{"http-01"})
+	if err != nil {
+		t.Errorf("checkCAA: %v", err)
+	}
+
+	// The check is disabled by default.
+	man.CAACheck.Enable = false
+	_, err = man.checkCAA(context.Background(), client, []string{"www.example.org"}, []string{"http-01"})
+	if err != nil {
+		t.Errorf("checkCAA: %v", err)
+	}
+}
+
+func TestGetCertificateCAA(t *testing.T) {
+	ca := acmetest.NewCAServer(t).CAAIdentities("ca.example").Start()
+	man := testManager(t)
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+	var started bool
+	man.BeforeVerify = func(ctx context.Context) error {
+		started = true
+		return nil
+	}
+	man.CAACheck = CAACheck{Enable: true, LookupCAA: caaZone{"example.org.": {issue("other.example")}}.lookup}
+
+	_, err := man.GetCertificate(clientHelloInfo("example.org", algECDSA))
+	if err == nil || !strings.Contains(err.Error(), "CAA records at example.org") {
+		t.Fatalf("GetCertificate: %v; want CAA error", err)
+	}
+	if started {
+		t.Error("verification started despite the CAA records")
+	}
+
+	records, err := man.CAARecords(context.Background(), "*.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`example.org. CAA 0 issue "ca.example; accounturi=` + ca.URL() + `/accounts/1; validationmethods=tls-alpn-01"`}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("CAARecords = %q; want %q", records, want)
+	}
+
+	// The printed records allow the Manager to get its certificate.
+	man.CAACheck.LookupCAA = caaZone{"example.org.": {issue("ca.example; accounturi=" + ca.URL() + "/accounts/1; validationmethods=tls-alpn-01")}}.lookup
+	ca.ResolveGetCertificate("www.example.org", man.GetCertificate)
+	if _, err := man.GetCertificate(clientHelloInfo("www.example.org", algECDSA)); err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+}
+
+func TestCAARecordsIssuers(t *testing.T) {
+	ca1 := acmetest.NewCAServer(t).CAAIdentities("ca1.example").Start()
+	ca2 := acmetest.NewCAServer(t).CAAIdentities("ca2.example").Start()
+	man := testManager(t)
+	man.Issuers = []Issuer{
+		&ACMEIssuer{Client: &acme.Client{DirectoryURL: ca1.URL()}},
+		&ACMEIssuer{Client: &acme.Client{DirectoryURL: ca2.URL()}},
+	}
+
+	records, err := man.CAARecords(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`example.org. CAA 0 issue "ca1.example; accounturi=` + ca1.URL() + `/accounts/1; validationmethods=tls-alpn-01"`,
+		`example.org. CAA 0 issue "ca2.example; accounturi=` + ca2.URL() + `/accounts/1; validationmethods=tls-alpn-01"`,
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("CAARecords = %q; want %q", records, want)
+	}
+}
@@ -0,0 +1,167 @@
+package certmgr
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/certmgr/internal/dnsutil"
+)
+
+// maxCNAMEChain is the maximum number of CNAME records followed
+// from the dns-01 challenge name of a domain.
+const maxCNAMEChain = 8
+
+// DNSProvider provisions the TXT records used by the dns-01 challenge.
+// See RFC 8555, Section 8.4 for more details.
+//
+// Implementations must be safe for concurrent use, since the Manager
+// may authorize several domains at the same time.
+type DNSProvider interface {
+	// Present creates a TXT record with the given value at fqdn,
+	// such as "_acme-challenge.example.org.", or the name it is
+	// delegated to with a CNAME record.
+	// A name may have several TXT records at the same time,
+	// so Present must not remove the existing ones.
+	Present(ctx context.Context, fqdn, value string) error
+
+	// CleanUp removes the TXT record previously created by Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// dns01ChallengeFQDN returns the fully qualified name at which the dns-01
+// challenge record is expected to be provisioned for the domain.
+func dns01ChallengeFQDN(domain string) string {
+	return "_acme-challenge." + strings.TrimSuffix(domain, ".") + "."
+}
+
+// dns01Target returns the fully qualified name at which the dns-01 challenge
+// record of the domain is presented. It is the challenge name, unless
+// it is delegated to another name with m.DNSDelegations or a CNAME chain.
+//
+// The CNAME chain is looked up with the nameservers of m.DNSPropagation,
+// whether or not the propagation check is enabled. A name without a CNAME
+// record, or which doesn't exist, ends the chain; any other lookup failure
+// is returned, rather than presenting the record at an undelegated name.
+func (m *Manager) dns01Target(ctx context.Context, domain string) (string, error) {
+	fqdn := dns01ChallengeFQDN(domain)
+	for host, target := range m.DNSDelegations {
+		if dnsutil.EqualNames(host, domain) {
+			if target == "" {
+				return fqdn, nil
+			}
+			return strings.ToLower(dnsutil.Fqdn(target)), nil
+		}
+	}
+
+	name := fqdn
+	seen := map[string]bool{name: true}
+	for range maxCNAMEChain {
+		next, err := m.DNSPropagation.lookupCNAME(ctx, name)
+		if err != nil {
+			return "", fmt.Errorf("acme/autocert: CNAME lookup of %s: %v", name, err)
+		}
+		if next == "" {
+			return name, nil
+		}
+		if seen[next] {
+			return "", fmt.Errorf("acme/autocert: CNAME loop at %s for %s", next, fqdn)
+		}
+		seen[next] = true
+		name = next
+	}
+	return "", fmt.Errorf("acme/autocert: CNAME chain of %s longer than %d records", fqdn, maxCNAMEChain)
+}
+
+// dns01Solver is the solver of the dns-01 challenge type
+// provisioning the TXT records with the Manager's DNSProvider.
+type dns01Solver struct {
+	m *Manager
+}
+
+func (s dns01Solver) Present(ctx context.Context, client *acme.Client, identifier string, chal *acme.Challenge) error {
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn, err := s.m.dns01Target(ctx, identifier)
+	if err != nil {
+		return err
+	}
+	s.m.challengeMu.Lock()
+	if s.m.dnsTargets == nil {
+		s.m.dnsTargets = make(map[string]string)
+	}
+	s.m.dnsTargets[chal.Token] = fqdn
+	s.m.challengeMu.Unlock()
+	return s.m.DNSProvider.Present(ctx, fqdn, value)
+}
+
+// CleanUp removes the record at the name it was presented at by Present,
+// which isn't looked up again since the delegation may have changed since.
+func (s dns01Solver) CleanUp(ctx context.Context, client *acme.Client, identifier string, chal *acme.Challenge) error {
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	s.m.challengeMu.Lock()
+	fqdn, ok := s.m.dnsTargets[chal.Token]
+	delete(s.m.dnsTargets, chal.Token)
+	s.m.challengeMu.Unlock()
+	if !ok {
+		// nothing was presented
+		return nil
+	}
+	return s.m.DNSProvider.CleanUp(ctx, fqdn, value)
+}
+
+// LocalDNSProvider returns a DNSProvider keeping the TXT records in memory,
+// along with the responses to the other challenge types, instead of
+// provisioning them in a DNS zone. They are meant to be served by a DNS
+// server of the program, answering with DNSToken, to which the challenge
+// names are delegated with NS records.
+func (m *Manager) LocalDNSProvider() DNSProvider {
+	return localDNSProvider{m}
+}
+
+// DNSToken returns the values of the TXT records currently presented
+// at the fully qualified name fqdn with the provider returned by
+// LocalDNSProvider. Names are compared case-insensitively.
+func (m *Manager) DNSToken(fqdn string) []string {
+	m.challengeMu.RLock()
+	defer m.challengeMu.RUnlock()
+	return slices.Clone(m.dnsTokens[strings.ToLower(dnsutil.Fqdn(fqdn))])
+}
+
+// localDNSProvider is the DNSProvider returned by Manager.LocalDNSProvider.
+type localDNSProvider struct {
+	m *Manager
+}
+
+func (p localDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	p.m.challengeMu.Lock()
+	defer p.m.challengeMu.Unlock()
+	if p.m.dnsTokens == nil {
+		p.m.dnsTokens = make(map[string][]string)
+	}
+	name := strings.ToLower(dnsutil.Fqdn(fqdn))
+	if !slices.Contains(p.m.dnsTokens[name], value) {
+		p.m.dnsTokens[name] = append(p.m.dnsTokens[name], value)
+	}
+	return nil
+}
+
+func (p localDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	p.m.challengeMu.Lock()
+	defer p.m.challengeMu.Unlock()
+	name := strings.ToLower(dnsutil.Fqdn(fqdn))
+	values := slices.DeleteFunc(p.m.dnsTokens[name], func(v string) bool { return v == value })
+	if len(values) == 0 {
+		delete(p.m.dnsTokens, name)
+	} else {
+		p.m.dnsTokens[name] = values
+	}
+	return nil
+}
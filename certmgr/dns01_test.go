@@ -0,0 +1,320 @@
+package certmgr
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/acme/acmetest"
+	"github.com/For-ACGN/autocert/certmgr/internal/dnstest"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS is a DNSProvider which keeps TXT records in memory.
+type fakeDNS struct {
+	mu  sync.Mutex
+	txt map[string][]string
+}
+
+func newFakeDNS() *fakeDNS {
+	return &fakeDNS{txt: make(map[string][]string)}
+}
+
+func (d *fakeDNS) Present(ctx context.Context, fqdn, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.txt[fqdn] = append(d.txt[fqdn], value)
+	return nil
+}
+
+func (d *fakeDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, v := range d.txt[fqdn] {
+		if v == value {
+			d.txt[fqdn] = append(d.txt[fqdn][:i], d.txt[fqdn][i+1:]...)
+			break
+		}
+	}
+	if len(d.txt[fqdn]) == 0 {
+		delete(d.txt, fqdn)
+	}
+	return nil
+}
+
+func (d *fakeDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.txt[name]
+	if !ok {
+		return nil, fmt.Errorf("no TXT records at %q", name)
+	}
+	return append([]string(nil), v...), nil
+}
+
+// useFakeDNS starts an in-process DNS server and configures man to present
+// the dns-01 records in it and to check their propagation against it.
+func useFakeDNS(t *testing.T, man *Manager) *dnstest.Server {
+	dns := dnstest.NewServer(t)
+	man.DNSProvider = dns
+	man.DNSPropagation = DNSPropagation{
+		Enable:      true,
+		Nameservers: []string{dns.Addr()},
+		Interval:    10 * time.Millisecond,
+	}
+	return dns
+}
+
+// useEmptyDNS points the CNAME lookups of the dns-01 challenge names of man
+// to an in-process DNS server without records, so nothing is delegated.
+func useEmptyDNS(t *testing.T, man *Manager) {
+	man.DNSPropagation.Nameservers = []string{dnstest.NewServer(t).Addr()}
+}
+
+func TestDNS01ChallengeFQDN(t *testing.T) {
+	tt := []struct{ domain, want string }{
+		{"example.org", "_acme-challenge.example.org."},
+		{"example.org.", "_acme-challenge.example.org."},
+		{"sub.example.org", "_acme-challenge.sub.example.org."},
+	}
+	for _, test := range tt {
+		if got := dns01ChallengeFQDN(test.domain); got != test.want {
+			t.Errorf("dns01ChallengeFQDN(%q) = %q; want %q", test.domain, got, test.want)
+		}
+	}
+}
+
+func TestSupportedChallengeTypesDNS(t *testing.T) {
+	man := &Manager{DNSProvider: newFakeDNS()}
+	man.HTTPHandler(nil)
+	want := []string{"dns-01", "tls-alpn-01", "http-01"}
+	if got := man.supportedChallengeTypes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("supportedChallengeTypes = %q; want %q", got, want)
+	}
+}
+
+func TestGetCertificateWildcard(t *testing.T) {
+	dns := newFakeDNS()
+	ca := acmetest.NewCAServer(t).ChallengeTypes("tls-alpn-01", "dns-01")
+	ca.LookupTXT(dns.LookupTXT)
+	ca.Start()
+
+	man := testManager(t)
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+	man.HostPolicy = HostWhitelist(exampleDomain)
+	man.DNSProvider = dns
+	useEmptyDNS(t, man)
+	man.Wildcards = []string{"*.EXAMPLE.org."}
+
+	// A subdomain with its own certificate keeps using it.
+	own := ca.LeafCert("own.example.org", "ECDSA", time.Now(), time.Now().Add(90*24*time.Hour))
+	if err := man.cachePut(context.Background(), certKey{domain: "own.example.org"}, own); err != nil {
+		t.Fatal(err)
+	}
+
+	www, err := man.GetCertificate(clientHelloInfo("www.example.org", algECDSA))
+	if err != nil {
+		t.Fatalf("GetCertificate(www): %v", err)
+	}
+	if want := []string{"*.example.org"}; !reflect.DeepEqual(www.Leaf.DNSNames, want) {
+		t.Errorf("www DNSNames = %q; want %q", www.Leaf.DNSNames, want)
+	}
+	api, err := man.GetCertificate(clientHelloInfo("api.example.org", algECDSA))
+	if err != nil {
+		t.Fatalf("GetCertificate(api): %v", err)
+	}
+	if api.Leaf.SerialNumber.Cmp(www.Leaf.SerialNumber) != 0 {
+		t.Error("api.example.org was not served the wildcard certificate")
+	}
+	if _, err := man.Cache.Get(context.Background(), "_wildcard.example.org"); err != nil {
+		t.Errorf("wildcard certificate not cached: %v", err)
+	}
+
+	cert, err := man.GetCertificate(clientHelloInfo("own.example.org", algECDSA))
+	if err != nil {
+		t.Fatalf("GetCertificate(own): %v", err)
+	}
+	if cert.Leaf.DNSNames[0] != "own.example.org" {
+		t.Errorf("own.example.org was served a certificate for %q", cert.Leaf.DNSNames)
+	}
+
+	// Only a single label is covered by the wildcard.
+	if _, err := man.GetCertificate(clientHelloInfo("a.b.example.org", algECDSA)); err == nil {
+		t.Error("a.b.example.org: expected host policy error")
+	}
+}
+
+func TestDNS01Target(t *testing.T) {
+	dns := dnstest.NewServer(t)
+	dns.AddCNAME("_acme-challenge.customer.com", "customer-com.acme.example.net")
+	dns.AddCNAME("_acme-challenge.chain.com", "_acme-challenge.customer.com")
+	dns.AddCNAME("_acme-challenge.loop.com", "a.loop.com")
+	dns.AddCNAME("a.loop.com", "_acme-challenge.loop.com")
+	name := "_acme-challenge.long.com"
+	for i := range maxCNAMEChain + 1 {
+		next := fmt.Sprintf("%d.long.com", i)
+		dns.AddCNAME(name, next)
+		name = next
+	}
+
+	man := &Manager{
+		DNSPropagation: DNSPropagation{Enable: true, Nameservers: []string{dns.Addr()}},
+		DNSDelegations: map[string]string{
+			"static.com":   "Static-Com.acme.example.net",
+			"disabled.com": "",
+		},
+	}
+	tt := []struct {
+		domain string
+		want   string
+		err    string
+	}{
+		{"example.org", "_acme-challenge.example.org.", ""},
+		{"customer.com", "customer-com.acme.example.net.", ""},
+		{"chain.com", "customer-com.acme.example.net.", ""},
+		{"static.com", "static-com.acme.example.net.", ""},
+		{"disabled.com", "_acme-challenge.disabled.com.", ""},
+		{"loop.com", "", "CNAME loop"},
+		{"long.com", "", "CNAME chain"},
+	}
+	for _, test := range tt {
+		got, err := man.dns01Target(context.Background(), test.domain)
+		switch {
+		case test.err != "":
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("dns01Target(%q): %v; want error containing %q", test.domain, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("dns01Target(%q): %v", test.domain, err)
+		case got != test.want:
+			t.Errorf("dns01Target(%q) = %q; want %q", test.domain, got, test.want)
+		}
+	}
+}
+
+func TestDNS01TargetLookup(t *testing.T) {
+	dns := dnstest.NewServer(t)
+	dns.AddCNAME("_acme-challenge.customer.com", "customer-com.acme.example.net")
+
+	// The delegation is followed without the propagation check.
+	man := &Manager{
+		DNSPropagation: DNSPropagation{Nameservers: []string{dns.Addr()}},
+	}
+	got, err := man.dns01Target(context.Background(), "customer.com")
+	if err != nil {
+		t.Fatalf("dns01Target: %v", err)
+	}
+	if want := "customer-com.acme.example.net."; got != want {
+		t.Errorf("dns01Target = %q; want %q", got, want)
+	}
+
+	// A failed lookup isn't taken as the absence of delegation.
+	man.DNSPropagation.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	}
+	if got, err := man.dns01Target(context.Background(), "customer.com"); err == nil {
+		t.Errorf("dns01Target with unreachable nameserver = %q; want error", got)
+	}
+}
+
+func TestDNS01SolverCleanUp(t *testing.T) {
+	dns := dnstest.NewServer(t)
+	dns.AddCNAME("_acme-challenge.example.org", "example-org.acme.example.net")
+
+	fake := newFakeDNS()
+	man := &Manager{
+		DNSProvider:    fake,
+		DNSPropagation: DNSPropagation{Nameservers: []string{dns.Addr()}},
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{Key: key}
+	chal := &acme.Challenge{Type: "dns-01", Token: "token"}
+	s := dns01Solver{man}
+	if err := s.Present(context.Background(), client, exampleDomain, chal); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+
+	// The record is removed where it was presented,
+	// even though the delegation has changed since.
+	dns.Remove("_acme-challenge.example.org", &dnsmessage.CNAMEResource{
+		CNAME: dnsmessage.MustNewName("example-org.acme.example.net."),
+	})
+	if err := s.CleanUp(context.Background(), client, exampleDomain, chal); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	if len(fake.txt) != 0 {
+		t.Errorf("records left after CleanUp: %v", fake.txt)
+	}
+	if len(man.dnsTargets) != 0 {
+		t.Errorf("dnsTargets = %v; want empty", man.dnsTargets)
+	}
+}
+
+func TestGetCertificateDNSDelegation(t *testing.T) {
+	man := testManager(t)
+	dns := useFakeDNS(t, man)
+	dns.AddCNAME("_acme-challenge.example.org", "example-org.acme.example.net")
+	ca := acmetest.NewCAServer(t).ChallengeTypes("dns-01")
+	ca.LookupTXT(dns.LookupTXT)
+	ca.Start()
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+
+	var presented []string
+	man.DNSProvider = presentFunc(func(ctx context.Context, fqdn, value string) error {
+		presented = append(presented, fqdn)
+		return dns.Present(ctx, fqdn, value)
+	})
+	if _, err := man.GetCertificate(clientHelloInfo(exampleDomain, algECDSA)); err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if want := []string{"example-org.acme.example.net."}; !reflect.DeepEqual(presented, want) {
+		t.Errorf("presented at %q; want %q", presented, want)
+	}
+}
+
+func TestLocalDNSProvider(t *testing.T) {
+	man := &Manager{}
+	p := man.LocalDNSProvider()
+	ctx := context.Background()
+	p.Present(ctx, "_acme-challenge.Example.org.", "v1")
+	p.Present(ctx, "_acme-challenge.example.org", "v2")
+	p.Present(ctx, "_acme-challenge.example.org.", "v2")
+	if got, want := man.DNSToken("_ACME-challenge.example.org"), []string{"v1", "v2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DNSToken = %q; want %q", got, want)
+	}
+	p.CleanUp(ctx, "_acme-challenge.example.org.", "v1")
+	if got, want := man.DNSToken("_acme-challenge.example.org."), []string{"v2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DNSToken = %q; want %q", got, want)
+	}
+	p.CleanUp(ctx, "_acme-challenge.example.org.", "v2")
+	if got := man.DNSToken("_acme-challenge.example.org."); got != nil {
+		t.Errorf("DNSToken = %q; want none", got)
+	}
+	if len(man.dnsTokens) != 0 {
+		t.Errorf("dnsTokens = %v; want empty", man.dnsTokens)
+	}
+}
+
+// presentFunc is a DNSProvider which never cleans up.
+type presentFunc func(ctx context.Context, fqdn, value string) error
+
+func (f presentFunc) Present(ctx context.Context, fqdn, value string) error {
+	return f(ctx, fqdn, value)
+}
+
+func (f presentFunc) CleanUp(ctx context.Context, fqdn, value string) error {
+	return nil
+}
@@ -0,0 +1,210 @@
+package dnsprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/For-ACGN/autocert/certmgr"
+)
+
+// ACMEDNS presents the dns-01 records with an acme-dns server
+// (https://github.com/joohoi/acme-dns), which serves them in its own zone.
+// The challenge name of each domain, such as "_acme-challenge.example.org.",
+// must be a CNAME record pointing to the full domain of its acme-dns account.
+//
+// The account of a domain is looked up in Accounts, then in AccountsFile
+// and finally in Cache. The accounts are matched either by domain or
+// by full domain, since the Manager presents the records at the target
+// of the CNAME records.
+type ACMEDNS struct {
+	// Server is the URL of the acme-dns server,
+	// such as "https://auth.acme-dns.io".
+	Server string
+
+	// Accounts optionally maps domain names to their accounts.
+	Accounts map[string]ACMEDNSAccount
+
+	// AccountsFile optionally is the path of a JSON file mapping domain
+	// names to their accounts, in the format used by acme-dns clients.
+	// It is read every time an account is looked up.
+	AccountsFile string
+
+	// Cache optionally stores accounts, such as the ones registered
+	// by ACMEDNS. The account of a domain is stored at the key
+	// "<domain>+acme-dns" as well as "<full domain>+acme-dns".
+	Cache certmgr.Cache
+
+	// Register enables the registration of a new account for the domains
+	// without one. Present then fails until the challenge name of the domain
+	// is made a CNAME record pointing to the full domain of the account.
+	Register bool
+
+	// AllowFrom optionally lists the networks, in CIDR notation,
+	// from which the registered accounts can be updated.
+	AllowFrom []string
+
+	// HTTPClient optionally specifies the client used to call the server.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Timeout is the maximum amount of time waiting for each
+	// response of Server. If zero, 10 seconds is used.
+	Timeout time.Duration
+
+	mu         sync.Mutex
+	registered map[string]*ACMEDNSAccount // by domain, without Cache
+}
+
+// ACMEDNSAccount is the account of a domain on an acme-dns server.
+type ACMEDNSAccount struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	FullDomain string   `json:"fulldomain"`
+	Subdomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom,omitempty"`
+}
+
+// Present updates the TXT record of the account of fqdn with the given value.
+func (p *ACMEDNS) Present(ctx context.Context, fqdn, value string) error {
+	acct, err := p.account(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	req := struct {
+		Subdomain string `json:"subdomain"`
+		TXT       string `json:"txt"`
+	}{acct.Subdomain, value}
+	header := func(h http.Header) {
+		h.Set("X-Api-User", acct.Username)
+		h.Set("X-Api-Key", acct.Password)
+	}
+	return doJSON(ctx, p.HTTPClient, "POST", p.url("/update"), header, req, nil)
+}
+
+// CleanUp does nothing: acme-dns keeps the two most recent TXT records
+// of each account, which is enough for a wildcard and its base domain.
+func (p *ACMEDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	return nil
+}
+
+// account returns the account of fqdn, which is either a challenge name
+// or the full domain of an account. If there's none, it registers a new
+// account if enabled, and returns an error explaining the CNAME record
+// to create.
+func (p *ACMEDNS) account(ctx context.Context, fqdn string) (*ACMEDNSAccount, error) {
+	name := strings.ToLower(strings.TrimSuffix(fqdn, "."))
+	domain, isChallenge := strings.CutPrefix(name, "_acme-challenge.")
+	match := func(d string, acct *ACMEDNSAccount) bool {
+		if isChallenge && strings.EqualFold(strings.TrimSuffix(d, "."), domain) {
+			return true
+		}
+		return strings.EqualFold(strings.TrimSuffix(acct.FullDomain, "."), name)
+	}
+
+	for d, acct := range p.Accounts {
+		if match(d, &acct) {
+			return &acct, nil
+		}
+	}
+	if p.AccountsFile != "" {
+		data, err := os.ReadFile(p.AccountsFile)
+		if err != nil {
+			return nil, err
+		}
+		var accounts map[string]*ACMEDNSAccount
+		if err := json.Unmarshal(data, &accounts); err != nil {
+			return nil, fmt.Errorf("dnsprovider: invalid acme-dns accounts file %s: %v", p.AccountsFile, err)
+		}
+		for d, acct := range accounts {
+			if match(d, acct) {
+				return acct, nil
+			}
+		}
+	}
+	p.mu.Lock()
+	for d, acct := range p.registered {
+		if match(d, acct) {
+			p.mu.Unlock()
+			return acct, nil
+		}
+	}
+	p.mu.Unlock()
+	if p.Cache != nil {
+		data, err := p.Cache.Get(ctx, name+"+acme-dns")
+		if isChallenge && errors.Is(err, certmgr.ErrCacheMiss) {
+			data, err = p.Cache.Get(ctx, domain+"+acme-dns")
+		}
+		switch {
+		case err == nil:
+			acct := new(ACMEDNSAccount)
+			if err := json.Unmarshal(data, acct); err != nil {
+				return nil, fmt.Errorf("dnsprovider: invalid cached acme-dns account of %s: %v", name, err)
+			}
+			return acct, nil
+		case !errors.Is(err, certmgr.ErrCacheMiss):
+			return nil, err
+		}
+	}
+
+	if !p.Register || !isChallenge {
+		return nil, fmt.Errorf("dnsprovider: no acme-dns account for %s", name)
+	}
+	acct, err := p.register(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("dnsprovider: registered acme-dns account for %s; create a CNAME record at %s pointing to %s and try again",
+		domain, fqdn, acct.FullDomain)
+}
+
+// register registers a new account for the domain and stores it.
+func (p *ACMEDNS) register(ctx context.Context, domain string) (*ACMEDNSAccount, error) {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	var req any
+	if len(p.AllowFrom) > 0 {
+		req = struct {
+			AllowFrom []string `json:"allowfrom"`
+		}{p.AllowFrom}
+	}
+	acct := new(ACMEDNSAccount)
+	if err := doJSON(ctx, p.HTTPClient, "POST", p.url("/register"), nil, req, acct); err != nil {
+		return nil, err
+	}
+	if acct.FullDomain == "" || acct.Subdomain == "" {
+		return nil, errors.New("dnsprovider: acme-dns registration returned an incomplete account")
+	}
+
+	if p.Cache == nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.registered == nil {
+			p.registered = make(map[string]*ACMEDNSAccount)
+		}
+		p.registered[domain] = acct
+		return acct, nil
+	}
+	data, err := json.Marshal(acct)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{domain, strings.ToLower(strings.TrimSuffix(acct.FullDomain, "."))} {
+		if err := p.Cache.Put(ctx, name+"+acme-dns", data); err != nil {
+			return nil, err
+		}
+	}
+	return acct, nil
+}
+
+func (p *ACMEDNS) url(path string) string {
+	return strings.TrimSuffix(p.Server, "/") + path
+}
@@ -0,0 +1,218 @@
+package dnsprovider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/For-ACGN/autocert/certmgr"
+)
+
+var _ certmgr.DNSProvider = (*ACMEDNS)(nil)
+
+// acmeDNSServer is a stand-in for an acme-dns server.
+type acmeDNSServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	accounts map[string]ACMEDNSAccount // by username
+	txt      map[string][]string       // by subdomain
+	allow    []string                  // allowfrom of the last registration
+}
+
+func startACMEDNSServer(t *testing.T) *acmeDNSServer {
+	s := &acmeDNSServer{
+		accounts: make(map[string]ACMEDNSAccount),
+		txt:      make(map[string][]string),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *acmeDNSServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/register":
+		var req struct {
+			AllowFrom []string `json:"allowfrom"`
+		}
+		if r.ContentLength > 0 {
+			json.NewDecoder(r.Body).Decode(&req)
+		}
+		s.allow = req.AllowFrom
+		n := len(s.accounts) + 1
+		sub := strings.Repeat("a", n) + "-sub"
+		acct := ACMEDNSAccount{
+			Username:   strings.Repeat("u", n),
+			Password:   "secret",
+			Subdomain:  sub,
+			FullDomain: sub + ".auth.example.net",
+			AllowFrom:  req.AllowFrom,
+		}
+		s.accounts[acct.Username] = acct
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(acct)
+	case "/update":
+		acct, ok := s.accounts[r.Header.Get("X-Api-User")]
+		if !ok || acct.Password != r.Header.Get("X-Api-Key") {
+			http.Error(w, `{"error": "forbidden"}`, http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Subdomain string `json:"subdomain"`
+			TXT       string `json:"txt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Subdomain != acct.Subdomain {
+			http.Error(w, `{"error": "bad_subdomain"}`, http.StatusBadRequest)
+			return
+		}
+		// Keep the two most recent records.
+		s.txt[req.Subdomain] = append(s.txt[req.Subdomain], req.TXT)
+		if n := len(s.txt[req.Subdomain]); n > 2 {
+			s.txt[req.Subdomain] = s.txt[req.Subdomain][n-2:]
+		}
+		json.NewEncoder(w).Encode(map[string]string{"txt": req.TXT})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *acmeDNSServer) records(sub string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.txt[sub]...)
+}
+
+func (s *acmeDNSServer) addAccount(acct ACMEDNSAccount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts[acct.Username] = acct
+}
+
+var testACMEDNSAccount = ACMEDNSAccount{
+	Username:   "user",
+	Password:   "secret",
+	Subdomain:  "sub",
+	FullDomain: "sub.auth.example.net",
+}
+
+func TestACMEDNS(t *testing.T) {
+	s := startACMEDNSServer(t)
+	s.addAccount(testACMEDNSAccount)
+
+	file := filepath.Join(t.TempDir(), "acmedns.json")
+	data, _ := json.Marshal(map[string]ACMEDNSAccount{"example.org": testACMEDNSAccount})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cache := certmgr.DirCache(t.TempDir())
+	data, _ = json.Marshal(testACMEDNSAccount)
+	if err := cache.Put(context.Background(), "example.org+acme-dns", data); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name string
+		p    *ACMEDNS
+	}{
+		{"accounts", &ACMEDNS{Server: s.URL, Accounts: map[string]ACMEDNSAccount{"Example.org.": testACMEDNSAccount}}},
+		{"file", &ACMEDNS{Server: s.URL, AccountsFile: file}},
+		{"cache", &ACMEDNS{Server: s.URL, Cache: cache}},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := test.p.Present(ctx, "_acme-challenge.example.org.", test.name); err != nil {
+				t.Fatalf("Present: %v", err)
+			}
+			if err := test.p.CleanUp(ctx, "_acme-challenge.example.org.", test.name); err != nil {
+				t.Fatalf("CleanUp: %v", err)
+			}
+			if got := s.records("sub"); got[len(got)-1] != test.name {
+				t.Errorf("records = %q; want %q last", got, test.name)
+			}
+		})
+	}
+
+	// The Manager presents the record at the target of the CNAME
+	// record of the challenge name, which is the full domain.
+	p := &ACMEDNS{Server: s.URL, AccountsFile: file}
+	if err := p.Present(context.Background(), "sub.auth.example.net.", "target"); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if got := s.records("sub"); got[len(got)-1] != "target" {
+		t.Errorf("records = %q; want %q last", got, "target")
+	}
+
+	p = &ACMEDNS{Server: s.URL, Accounts: map[string]ACMEDNSAccount{"example.com": testACMEDNSAccount}}
+	if err := p.Present(context.Background(), "_acme-challenge.example.org.", "value"); err == nil {
+		t.Error("Present: expected error for domain without account")
+	}
+	bad := testACMEDNSAccount
+	bad.Password = "wrong"
+	p = &ACMEDNS{Server: s.URL, Accounts: map[string]ACMEDNSAccount{"example.org": bad}}
+	err := p.Present(context.Background(), "_acme-challenge.example.org.", "value")
+	if err == nil || !strings.Contains(err.Error(), "forbidden") {
+		t.Errorf("Present: %v; want error with the response body", err)
+	}
+}
+
+func TestACMEDNSRegister(t *testing.T) {
+	for _, withCache := range []bool{false, true} {
+		name := "memory"
+		if withCache {
+			name = "cache"
+		}
+		t.Run(name, func(t *testing.T) {
+			s := startACMEDNSServer(t)
+			p := &ACMEDNS{
+				Server:    s.URL,
+				Register:  true,
+				AllowFrom: []string{"192.0.2.0/24"},
+			}
+			if withCache {
+				p.Cache = certmgr.DirCache(t.TempDir())
+			}
+			ctx := context.Background()
+			err := p.Present(ctx, "_acme-challenge.example.org.", "value1")
+			if err == nil || !strings.Contains(err.Error(), "a-sub.auth.example.net") {
+				t.Fatalf("Present: %v; want error asking for a CNAME record", err)
+			}
+			if len(s.allow) != 1 || s.allow[0] != "192.0.2.0/24" {
+				t.Errorf("allowfrom = %q", s.allow)
+			}
+
+			// Once the CNAME record exists, the Manager presents
+			// the record at its target.
+			if err := p.Present(ctx, "a-sub.auth.example.net.", "value2"); err != nil {
+				t.Fatalf("Present: %v", err)
+			}
+			if err := p.Present(ctx, "_acme-challenge.example.org.", "value3"); err != nil {
+				t.Fatalf("Present: %v", err)
+			}
+			if got := s.records("a-sub"); len(got) != 2 || got[1] != "value3" {
+				t.Errorf("records = %q; want [value2 value3]", got)
+			}
+			if len(s.accounts) != 1 {
+				t.Errorf("%d accounts registered; want 1", len(s.accounts))
+			}
+			if withCache {
+				if _, err := p.Cache.Get(ctx, "example.org+acme-dns"); err != nil {
+					t.Errorf("account not cached: %v", err)
+				}
+			}
+		})
+	}
+}
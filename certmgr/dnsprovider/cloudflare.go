@@ -0,0 +1,185 @@
+package dnsprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultCloudflareURL is the base URL of the Cloudflare API,
+// unless configured otherwise.
+const defaultCloudflareURL = "https://api.cloudflare.com/client/v4"
+
+// cloudflareIdenticalRecord is the error code of the Cloudflare API
+// for a record which already exists.
+const cloudflareIdenticalRecord = 81058
+
+// Cloudflare adds and removes the dns-01 TXT records with the
+// Cloudflare v4 API, authenticated with an API token.
+//
+// The token needs the Zone:Read permission, to find the zone
+// of each record, and the DNS:Edit permission on the zones.
+type Cloudflare struct {
+	// APIToken is the Cloudflare API token.
+	APIToken string
+
+	// ZoneID optionally is the ID of the zone containing the records.
+	// If empty, the zone of each record is found by name.
+	ZoneID string
+
+	// TTL is the TTL of the records. If zero, one minute is used,
+	// the minimum allowed by Cloudflare.
+	TTL time.Duration
+
+	// BaseURL optionally is the base URL of the API.
+	// If empty, "https://api.cloudflare.com/client/v4" is used.
+	BaseURL string
+
+	// HTTPClient optionally specifies the client used to call the API.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Timeout is the maximum amount of time waiting for each
+	// response of the API. If zero, 10 seconds is used.
+	Timeout time.Duration
+
+	zones zoneCache
+}
+
+// cloudflareRecord is a DNS record of the Cloudflare API.
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+}
+
+// cloudflareResponse is the envelope of the responses of the Cloudflare API.
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// Present creates a TXT record with the given value at fqdn.
+func (p *Cloudflare) Present(ctx context.Context, fqdn, value string) error {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	ttl := p.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	rec := cloudflareRecord{
+		Type:    "TXT",
+		Name:    strings.TrimSuffix(fqdn, "."),
+		Content: value,
+		TTL:     int(ttl / time.Second),
+	}
+	err = p.do(ctx, "POST", "/zones/"+url.PathEscape(zone)+"/dns_records", rec, nil)
+	var herr *httpError
+	if errors.As(err, &herr) {
+		var resp cloudflareResponse
+		if json.Unmarshal(herr.body, &resp) == nil {
+			for _, e := range resp.Errors {
+				if e.Code == cloudflareIdenticalRecord {
+					return nil
+				}
+			}
+		}
+	}
+	return err
+}
+
+// CleanUp removes the TXT records with the given value at fqdn.
+func (p *Cloudflare) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	q := url.Values{
+		"type":     {"TXT"},
+		"name":     {strings.TrimSuffix(fqdn, ".")},
+		"per_page": {"100"},
+	}
+	path := "/zones/" + url.PathEscape(zone) + "/dns_records"
+	var recs []cloudflareRecord
+	if err := p.do(ctx, "GET", path+"?"+q.Encode(), nil, &recs); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		// the API may return the content of TXT records quoted
+		if rec.Content != value && rec.Content != `"`+value+`"` {
+			continue
+		}
+		if err := p.do(ctx, "DELETE", path+"/"+url.PathEscape(rec.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zone returns the ID of the zone of the record name fqdn.
+func (p *Cloudflare) zone(ctx context.Context, fqdn string) (string, error) {
+	if p.ZoneID != "" {
+		return p.ZoneID, nil
+	}
+	return p.zones.find(ctx, fqdn, func(ctx context.Context, zone string) (string, error) {
+		var zones []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}
+		q := url.Values{"name": {strings.TrimSuffix(zone, ".")}}
+		if err := p.do(ctx, "GET", "/zones?"+q.Encode(), nil, &zones); err != nil {
+			return "", err
+		}
+		for _, z := range zones {
+			if strings.EqualFold(z.Name+".", zone) {
+				return z.ID, nil
+			}
+		}
+		return "", nil
+	})
+}
+
+// do calls the API and decodes the result of the response into out,
+// unless out is nil.
+func (p *Cloudflare) do(ctx context.Context, method, path string, in, out any) error {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	base := p.BaseURL
+	if base == "" {
+		base = defaultCloudflareURL
+	}
+	header := func(h http.Header) {
+		h.Set("Authorization", "Bearer "+p.APIToken)
+	}
+	var resp cloudflareResponse
+	if err := doJSON(ctx, p.HTTPClient, method, strings.TrimSuffix(base, "/")+path, header, in, &resp); err != nil {
+		return err
+	}
+	if !resp.Success {
+		var msg []string
+		for _, e := range resp.Errors {
+			msg = append(msg, fmt.Sprintf("%d: %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("dnsprovider: Cloudflare %s %s failed: %s", method, path, strings.Join(msg, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, out); err != nil {
+		return fmt.Errorf("dnsprovider: Cloudflare %s %s: invalid result: %v", method, path, err)
+	}
+	return nil
+}
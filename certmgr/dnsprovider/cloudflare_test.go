@@ -0,0 +1,194 @@
+package dnsprovider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/For-ACGN/autocert/certmgr"
+)
+
+var _ certmgr.DNSProvider = (*Cloudflare)(nil)
+
+// cloudflareServer imitates the zones and dns_records endpoints
+// of the Cloudflare v4 API.
+type cloudflareServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	zones   map[string]string // name by ID
+	records map[string]cloudflareRecord
+	lastID  int
+	lookups int // of zones by name
+}
+
+func startCloudflareServer(t *testing.T) *cloudflareServer {
+	s := &cloudflareServer{
+		zones:   map[string]string{"zone1": "example.org", "zone2": "sub.example.org"},
+		records: make(map[string]cloudflareRecord),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *cloudflareServer) reply(w http.ResponseWriter, code int, result any, errCode int, msg string) {
+	resp := map[string]any{"success": errCode == 0, "errors": []any{}, "result": result}
+	if errCode != 0 {
+		resp["errors"] = []any{map[string]any{"code": errCode, "message": msg}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *cloudflareServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" {
+		s.reply(w, http.StatusForbidden, nil, 9109, "Invalid access token")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "zones":
+		s.lookups++
+		zones := []map[string]string{}
+		for id, name := range s.zones {
+			if name == r.URL.Query().Get("name") {
+				zones = append(zones, map[string]string{"id": id, "name": name})
+			}
+		}
+		s.reply(w, http.StatusOK, zones, 0, "")
+		return
+	case len(parts) < 3 || parts[0] != "zones" || parts[2] != "dns_records":
+		http.NotFound(w, r)
+		return
+	}
+	zone, ok := s.zones[parts[1]]
+	if !ok {
+		s.reply(w, http.StatusNotFound, nil, 7003, "Could not route to /zones/"+parts[1])
+		return
+	}
+	switch {
+	case r.Method == "POST" && len(parts) == 3:
+		var rec cloudflareRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		if rec.Name != zone && !strings.HasSuffix(rec.Name, "."+zone) {
+			s.reply(w, http.StatusBadRequest, nil, 9005, "Content for record is invalid")
+			return
+		}
+		for _, old := range s.records {
+			if old.Name == rec.Name && old.Content == `"`+rec.Content+`"` {
+				s.reply(w, http.StatusBadRequest, nil, cloudflareIdenticalRecord, "An identical record already exists.")
+				return
+			}
+		}
+		s.lastID++
+		rec.ID = fmt.Sprint(s.lastID)
+		rec.Content = `"` + rec.Content + `"` // as returned by the API
+		s.records[rec.ID] = rec
+		s.reply(w, http.StatusOK, rec, 0, "")
+	case r.Method == "GET" && len(parts) == 3:
+		q := r.URL.Query()
+		recs := []cloudflareRecord{}
+		for _, rec := range s.records {
+			if rec.Type == q.Get("type") && rec.Name == q.Get("name") {
+				recs = append(recs, rec)
+			}
+		}
+		s.reply(w, http.StatusOK, recs, 0, "")
+	case r.Method == "DELETE" && len(parts) == 4:
+		if _, ok := s.records[parts[3]]; !ok {
+			s.reply(w, http.StatusNotFound, nil, 81044, "Record does not exist.")
+			return
+		}
+		delete(s.records, parts[3])
+		s.reply(w, http.StatusOK, map[string]string{"id": parts[3]}, 0, "")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *cloudflareServer) contents(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var v []string
+	for _, rec := range s.records {
+		if rec.Name == name {
+			v = append(v, rec.Content)
+		}
+	}
+	return v
+}
+
+func TestCloudflare(t *testing.T) {
+	s := startCloudflareServer(t)
+	p := &Cloudflare{APIToken: "token", BaseURL: s.URL}
+	ctx := context.Background()
+
+	const fqdn = "_acme-challenge.example.org."
+	for _, v := range []string{"v1", "v2", "v2"} {
+		if err := p.Present(ctx, fqdn, v); err != nil {
+			t.Fatalf("Present(%q): %v", v, err)
+		}
+	}
+	if got := s.contents("_acme-challenge.example.org"); len(got) != 2 {
+		t.Errorf("records = %q; want 2", got)
+	}
+	if err := p.CleanUp(ctx, fqdn, "v1"); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	if got, want := s.contents("_acme-challenge.example.org"), []string{`"v2"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q; want %q", got, want)
+	}
+	// the zone was looked up once, from the record name down to example.org
+	s.mu.Lock()
+	if s.lookups != 2 {
+		t.Errorf("%d zone lookups; want 2", s.lookups)
+	}
+	s.mu.Unlock()
+
+	// the closest enclosing zone is used
+	if err := p.Present(ctx, "_acme-challenge.www.sub.example.org.", "v3"); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if got := s.contents("_acme-challenge.www.sub.example.org"); len(got) != 1 {
+		t.Errorf("records = %q; want 1", got)
+	}
+
+	p = &Cloudflare{APIToken: "token", BaseURL: s.URL, ZoneID: "zone1"}
+	if err := p.CleanUp(ctx, fqdn, "v2"); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	if got := s.contents("_acme-challenge.example.org"); len(got) != 0 {
+		t.Errorf("records = %q; want none", got)
+	}
+}
+
+func TestCloudflareErrors(t *testing.T) {
+	s := startCloudflareServer(t)
+	ctx := context.Background()
+
+	p := &Cloudflare{APIToken: "wrong", BaseURL: s.URL}
+	err := p.Present(ctx, "_acme-challenge.example.org.", "v")
+	if err == nil || !strings.Contains(err.Error(), "Invalid access token") {
+		t.Errorf("Present: %v; want error with the response body", err)
+	}
+	p = &Cloudflare{APIToken: "token", BaseURL: s.URL}
+	err = p.Present(ctx, "_acme-challenge.example.com.", "v")
+	if err == nil || !strings.Contains(err.Error(), "no zone found") {
+		t.Errorf("Present: %v; want zone error", err)
+	}
+	p = &Cloudflare{APIToken: "token", BaseURL: s.URL, ZoneID: "zone1"}
+	err = p.Present(ctx, "_acme-challenge.example.com.", "v")
+	if err == nil || !strings.Contains(err.Error(), "Content for record is invalid") {
+		t.Errorf("Present: %v; want error with the response body", err)
+	}
+}
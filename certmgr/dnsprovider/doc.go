@@ -0,0 +1,7 @@
+// Package dnsprovider provides implementations of certmgr.DNSProvider,
+// which provision the TXT records of dns-01 challenges with various
+// DNS servers and hosting services.
+//
+// Every provider is configured with the exported fields of its type
+// and is safe for concurrent use once configured.
+package dnsprovider
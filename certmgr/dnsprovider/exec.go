@@ -0,0 +1,84 @@
+package dnsprovider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Actions of the Exec and Webhook providers.
+const (
+	ActionPresent = "present"
+	ActionCleanUp = "cleanup"
+)
+
+// defaultExecTimeout is the maximum amount of time a command of Exec
+// may run, unless configured otherwise.
+const defaultExecTimeout = time.Minute
+
+// Exec presents the dns-01 records by running a command, such as a script
+// calling the API of an internal DNS system.
+//
+// The command is run with the arguments Args followed by the action,
+// which is ActionPresent or ActionCleanUp, the fully qualified name of the
+// record and its value. They are also set in its environment as ACME_ACTION,
+// ACME_FQDN and ACME_VALUE. The command must exit with status 0 once it's done.
+type Exec struct {
+	// Command is the name or the path of the command.
+	Command string
+
+	// Args optionally lists the arguments passed before the action.
+	Args []string
+
+	// Env optionally lists environment variables, in the form "key=value",
+	// set in addition to the ones of the current process.
+	Env []string
+
+	// Timeout is the maximum amount of time the command may run,
+	// after which it is killed. If zero, one minute is used.
+	Timeout time.Duration
+}
+
+// Present runs the command with ActionPresent.
+func (p *Exec) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, ActionPresent, fqdn, value)
+}
+
+// CleanUp runs the command with ActionCleanUp.
+func (p *Exec) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, ActionCleanUp, fqdn, value)
+}
+
+func (p *Exec) run(ctx context.Context, action, fqdn, value string) error {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	args := append(append([]string(nil), p.Args...), action, fqdn, value)
+	cmd := exec.CommandContext(ctx, p.Command, args...)
+	cmd.Env = append(os.Environ(), p.Env...)
+	cmd.Env = append(cmd.Env, "ACME_ACTION="+action, "ACME_FQDN="+fqdn, "ACME_VALUE="+value)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	// Don't wait for grandchildren holding stderr once the command is killed.
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("%v (%v)", err, ctx.Err())
+	}
+	msg := stderr.Bytes()
+	if len(msg) > maxErrorBody {
+		msg = msg[len(msg)-maxErrorBody:]
+	}
+	return fmt.Errorf("dnsprovider: %s %s %s: %v: %s", p.Command, action, fqdn, err, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,98 @@
+package dnsprovider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/For-ACGN/autocert/certmgr"
+)
+
+var _ certmgr.DNSProvider = (*Exec)(nil)
+
+// TestHelperProcess isn't a real test. It's the command run by Exec
+// in the other tests, which behaves according to its first argument.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("DNSPROVIDER_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	args = args[1:]
+	switch args[0] {
+	case "record":
+		// Append the arguments and the environment to a file.
+		action, fqdn, value := args[2], args[3], args[4]
+		env := os.Getenv("ACME_ACTION") + " " + os.Getenv("ACME_FQDN") + " " + os.Getenv("ACME_VALUE")
+		f, err := os.OpenFile(args[1], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		fmt.Fprintf(f, "%s %s %s|%s|%s\n", action, fqdn, value, env, os.Getenv("EXTRA"))
+		f.Close()
+	case "fail":
+		fmt.Fprintln(os.Stderr, "zone example.org is locked")
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+	}
+	os.Exit(0)
+}
+
+func helperExec(timeout time.Duration, args ...string) *Exec {
+	return &Exec{
+		Command: os.Args[0],
+		Args:    append([]string{"-test.run=^TestHelperProcess$", "--"}, args...),
+		Env:     []string{"DNSPROVIDER_HELPER_PROCESS=1", "EXTRA=extra"},
+		Timeout: timeout,
+	}
+}
+
+func TestExec(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	p := helperExec(0, "record", out)
+	ctx := context.Background()
+	if err := p.Present(ctx, "_acme-challenge.example.org.", "value"); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if err := p.CleanUp(ctx, "_acme-challenge.example.org.", "value"); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "present _acme-challenge.example.org. value|present _acme-challenge.example.org. value|extra\n" +
+		"cleanup _acme-challenge.example.org. value|cleanup _acme-challenge.example.org. value|extra\n"
+	if string(b) != want {
+		t.Errorf("command calls:\n%s\nwant:\n%s", b, want)
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	err := helperExec(0, "fail").Present(context.Background(), "_acme-challenge.example.org.", "value")
+	if err == nil || !strings.Contains(err.Error(), "zone example.org is locked") {
+		t.Errorf("Present: %v; want error with stderr", err)
+	}
+
+	start := time.Now()
+	err = helperExec(100*time.Millisecond, "hang").Present(context.Background(), "_acme-challenge.example.org.", "value")
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("Present: %v; want timeout error", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Present took %v after the timeout", d)
+	}
+
+	p := &Exec{Command: filepath.Join(t.TempDir(), "missing")}
+	if err := p.Present(context.Background(), "_acme-challenge.example.org.", "value"); err == nil {
+		t.Error("Present: expected error for missing command")
+	}
+}
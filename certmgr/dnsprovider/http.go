@@ -0,0 +1,95 @@
+package dnsprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxErrorBody is the maximum size of the body of an error response
+// included in the returned error.
+const maxErrorBody = 1 << 10
+
+// doJSON sends an HTTP request with the JSON encoding of in as its body,
+// unless in is nil, and decodes the JSON response into out, unless out is nil.
+// The header function, if not nil, sets the headers of the request.
+// Responses with a status code other than 2xx are returned as errors,
+// which include the beginning of their body.
+func doJSON(ctx context.Context, client *http.Client, method, url string, header func(http.Header), in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if header != nil {
+		header(req.Header)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return newHTTPError(req, resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("dnsprovider: %s %s: invalid response: %v", method, url, err)
+	}
+	return nil
+}
+
+// httpError is the error returned for a response with a status code
+// other than 2xx.
+type httpError struct {
+	method     string
+	url        string
+	status     string
+	statusCode int
+	body       []byte // beginning of the body
+}
+
+func newHTTPError(req *http.Request, resp *http.Response) *httpError {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &httpError{
+		method:     req.Method,
+		url:        req.URL.String(),
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+		body:       b,
+	}
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("dnsprovider: %s %s: %s: %s", e.method, e.url, e.status, strings.TrimSpace(string(e.body)))
+}
+
+// withTimeout returns a copy of ctx which expires after timeout,
+// or after defaultTimeout if timeout is not positive.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,193 @@
+package dnsprovider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/For-ACGN/autocert/certmgr/internal/dnsutil"
+)
+
+const (
+	opUpdate  = dnsmessage.OpCode(5)
+	classNONE = dnsmessage.Class(254)
+)
+
+// defaultTTL is the TTL of the challenge records, unless configured otherwise.
+const defaultTTL = time.Minute
+
+// defaultTimeout is the maximum amount of time waiting for a response
+// of a DNS server or an API, unless configured otherwise.
+const defaultTimeout = 10 * time.Second
+
+// RFC2136 adds and removes the dns-01 TXT records with dynamic DNS
+// updates (RFC 2136) signed with TSIG (RFC 8945), as supported by
+// BIND, Knot DNS and PowerDNS among others.
+type RFC2136 struct {
+	// Server is the address of the primary authoritative server
+	// accepting the updates, such as "ns1.example.org:53".
+	// If the port is omitted, 53 is used.
+	Server string
+
+	// Zone is the zone containing the records, such as "example.org.".
+	// If empty, it is found by asking Server for the SOA record
+	// of each record name.
+	Zone string
+
+	// KeyName is the name of the TSIG key, such as "acme-update.".
+	// If empty, the updates are not signed, which only works
+	// if Server allows updates by IP address.
+	KeyName string
+
+	// KeyAlgorithm is the algorithm of the TSIG key,
+	// HMACSHA256 or HMACSHA512. If empty, HMACSHA256 is used.
+	KeyAlgorithm string
+
+	// Secret is the base64 encoded secret of the TSIG key,
+	// as printed by tsig-keygen or keymgr.
+	Secret string
+
+	// TTL is the TTL of the records. If zero, one minute is used.
+	TTL time.Duration
+
+	// Timeout is the maximum amount of time waiting for each
+	// response of Server. If zero, 10 seconds is used.
+	Timeout time.Duration
+}
+
+// Present adds a TXT record with the given value at fqdn.
+func (p *RFC2136) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+// CleanUp removes the TXT record with the given value at fqdn.
+func (p *RFC2136) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+// update adds or deletes the TXT record with the given value at fqdn.
+func (p *RFC2136) update(ctx context.Context, fqdn, value string, add bool) error {
+	var key *tsigKey
+	if p.KeyName != "" {
+		var err error
+		key, err = newTSIGKey(p.KeyName, p.KeyAlgorithm, p.Secret)
+		if err != nil {
+			return err
+		}
+	}
+	fqdn = canonicalName(fqdn)
+	zone := p.Zone
+	if zone == "" {
+		var err error
+		zone, err = p.findZone(ctx, fqdn)
+		if err != nil {
+			return err
+		}
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return err
+	}
+	zoneName, err := dnsmessage.NewName(canonicalName(zone))
+	if err != nil {
+		return err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:     dnsutil.NewID(),
+		OpCode: opUpdate,
+	})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  zoneName,
+		Type:  dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+	})
+	// The update section is the authority section of the message.
+	b.StartAuthorities()
+	h := dnsmessage.ResourceHeader{
+		Name:  name,
+		Type:  dnsmessage.TypeTXT,
+		Class: dnsmessage.ClassINET,
+		TTL:   uint32(p.ttl() / time.Second),
+	}
+	if !add {
+		// Delete an RR from an RRset (RFC 2136, Section 2.5.4).
+		h.Class, h.TTL = classNONE, 0
+	}
+	if err := b.TXTResource(h, dnsmessage.TXTResource{TXT: []string{value}}); err != nil {
+		return err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	var mac []byte
+	if key != nil {
+		msg, mac = key.sign(msg, nil, time.Now())
+	}
+
+	resp, err := p.exchange(ctx, msg)
+	if err != nil {
+		return err
+	}
+	var hdr dnsmessage.Header
+	if hdr, err = new(dnsmessage.Parser).Start(resp); err != nil {
+		return err
+	}
+	if rcode := uint16(hdr.RCode); rcode != 0 {
+		// A failed TSIG verification is detailed in the TSIG record.
+		if _, t, _, err := parseTSIG(resp); err == nil && t.error != 0 {
+			rcode = t.error
+		}
+		return fmt.Errorf("dnsprovider: %s refused the update of %s: %s", p.server(), fqdn, dnsutil.RCodeName(rcode))
+	}
+	if key != nil {
+		if _, err := key.verify(resp, mac, time.Now()); err != nil {
+			return fmt.Errorf("dnsprovider: response of %s: %v", p.server(), err)
+		}
+	}
+	return nil
+}
+
+// findZone asks Server for the SOA record of fqdn and returns the zone
+// containing it, which is the owner of the SOA record in the answer
+// or the authority section of the response.
+func (p *RFC2136) findZone(ctx context.Context, fqdn string) (string, error) {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	m, err := dnsutil.Query(ctx, nil, p.server(), fqdn, dnsmessage.TypeSOA, false)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range append(m.Answers, m.Authorities...) {
+		if rr.Header.Type == dnsmessage.TypeSOA {
+			return rr.Header.Name.String(), nil
+		}
+	}
+	return "", fmt.Errorf("dnsprovider: %s returned no SOA record for %s: %s", p.server(), fqdn, dnsutil.RCodeName(uint16(m.RCode)))
+}
+
+// exchange sends the DNS message msg to Server and returns the response.
+func (p *RFC2136) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	return dnsutil.Exchange(ctx, nil, p.server(), msg)
+}
+
+func (p *RFC2136) server() string {
+	if _, _, err := net.SplitHostPort(p.Server); err == nil {
+		return p.Server
+	}
+	return net.JoinHostPort(p.Server, "53")
+}
+
+func (p *RFC2136) ttl() time.Duration {
+	if p.TTL <= 0 {
+		return defaultTTL
+	}
+	return p.TTL
+}
@@ -0,0 +1,320 @@
+package dnsprovider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/For-ACGN/autocert/certmgr"
+)
+
+var _ certmgr.DNSProvider = (*RFC2136)(nil)
+
+var testSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+// updateServer is an in-process authoritative DNS server for a single zone
+// which accepts RFC 2136 updates of TXT records signed with a TSIG key.
+type updateServer struct {
+	t    *testing.T
+	zone string
+	key  *tsigKey
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	txt     map[string][]string
+	updates int
+}
+
+func startUpdateServer(t *testing.T, zone, algorithm string) *updateServer {
+	key, err := newTSIGKey("acme-update.", algorithm, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &updateServer{
+		t:    t,
+		zone: zone,
+		key:  key,
+		conn: conn,
+		txt:  make(map[string][]string),
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *updateServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *updateServer) records(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.txt[name])
+}
+
+func (s *updateServer) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := s.handle(slices.Clone(buf[:n]))
+		if resp != nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *updateServer) handle(req []byte) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(req); err != nil {
+		s.t.Logf("unpack: %v", err)
+		return nil
+	}
+	hdr := dnsmessage.Header{ID: m.ID, Response: true, OpCode: m.OpCode}
+	if m.OpCode != opUpdate {
+		return s.query(hdr, m.Questions[0])
+	}
+
+	_, t, _, err := parseTSIG(req)
+	if err == nil {
+		t, err = s.key.verify(req, nil, time.Now())
+	}
+	if err != nil {
+		s.t.Logf("verify: %v", err)
+		hdr.RCode = 9 // NOTAUTH
+		b := dnsmessage.NewBuilder(nil, hdr)
+		resp, _ := b.Finish()
+		// Errors are reported with an unsigned TSIG record.
+		return s.key.appendRecord(resp, &tsigRecord{
+			algorithm:  s.key.algorithm,
+			timeSigned: uint64(time.Now().Unix()),
+			fudge:      tsigFudge,
+			origID:     m.ID,
+			error:      16, // BADSIG
+		})
+	}
+	if !strings.EqualFold(m.Questions[0].Name.String(), s.zone) {
+		hdr.RCode = 9 // NOTAUTH
+	} else {
+		s.mu.Lock()
+		s.updates++
+		for _, rr := range m.Authorities {
+			name := strings.ToLower(rr.Header.Name.String())
+			value := rr.Body.(*dnsmessage.TXTResource).TXT[0]
+			switch rr.Header.Class {
+			case dnsmessage.ClassINET:
+				s.txt[name] = append(s.txt[name], value)
+			case classNONE:
+				s.txt[name] = slices.DeleteFunc(s.txt[name], func(v string) bool { return v == value })
+				if len(s.txt[name]) == 0 {
+					delete(s.txt, name)
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+	b := dnsmessage.NewBuilder(nil, hdr)
+	resp, _ := b.Finish()
+	resp, _ = s.key.sign(resp, t.mac, time.Now())
+	return resp
+}
+
+// query answers the SOA queries of the zone lookup.
+func (s *updateServer) query(hdr dnsmessage.Header, q dnsmessage.Question) []byte {
+	hdr.Authoritative = true
+	b := dnsmessage.NewBuilder(nil, hdr)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAuthorities()
+	zone := dnsmessage.MustNewName(s.zone)
+	b.SOAResource(dnsmessage.ResourceHeader{
+		Name:  zone,
+		Class: dnsmessage.ClassINET,
+		TTL:   3600,
+	}, dnsmessage.SOAResource{
+		NS:   dnsmessage.MustNewName("ns1." + s.zone),
+		MBox: dnsmessage.MustNewName("hostmaster." + s.zone),
+	})
+	resp, _ := b.Finish()
+	return resp
+}
+
+func TestRFC2136(t *testing.T) {
+	for _, alg := range []string{HMACSHA256, HMACSHA512} {
+		t.Run(alg, func(t *testing.T) {
+			s := startUpdateServer(t, "example.org.", alg)
+			p := &RFC2136{
+				Server:       s.addr(),
+				Zone:         "example.org",
+				KeyName:      "acme-update",
+				KeyAlgorithm: alg,
+				Secret:       testSecret,
+			}
+			ctx := context.Background()
+			const fqdn = "_acme-challenge.www.example.org."
+			if err := p.Present(ctx, fqdn, "value1"); err != nil {
+				t.Fatalf("Present: %v", err)
+			}
+			if err := p.Present(ctx, fqdn, "value2"); err != nil {
+				t.Fatalf("Present: %v", err)
+			}
+			if got, want := s.records(fqdn), []string{"value1", "value2"}; !slices.Equal(got, want) {
+				t.Errorf("records = %q; want %q", got, want)
+			}
+			if err := p.CleanUp(ctx, fqdn, "value1"); err != nil {
+				t.Fatalf("CleanUp: %v", err)
+			}
+			if got, want := s.records(fqdn), []string{"value2"}; !slices.Equal(got, want) {
+				t.Errorf("records = %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRFC2136FindZone(t *testing.T) {
+	s := startUpdateServer(t, "example.org.", HMACSHA256)
+	p := &RFC2136{
+		Server:  s.addr(),
+		KeyName: "acme-update.",
+		Secret:  testSecret,
+	}
+	const fqdn = "_acme-challenge.example.org."
+	if err := p.Present(context.Background(), fqdn, "value"); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if got := s.records(fqdn); !slices.Equal(got, []string{"value"}) {
+		t.Errorf("records = %q; want [value]", got)
+	}
+}
+
+func TestRFC2136Errors(t *testing.T) {
+	s := startUpdateServer(t, "example.org.", HMACSHA256)
+	badSecret := base64.StdEncoding.EncodeToString([]byte("not the secret"))
+	tt := []struct {
+		name string
+		p    *RFC2136
+		want string
+	}{
+		{
+			"badSecret",
+			&RFC2136{Server: s.addr(), Zone: "example.org.", KeyName: "acme-update.", Secret: badSecret},
+			"BADSIG",
+		},
+		{
+			"badZone",
+			&RFC2136{Server: s.addr(), Zone: "example.net.", KeyName: "acme-update.", Secret: testSecret},
+			"NOTAUTH",
+		},
+		{
+			"badAlgorithm",
+			&RFC2136{Server: s.addr(), KeyName: "acme-update.", KeyAlgorithm: "hmac-md5", Secret: testSecret},
+			"unsupported TSIG algorithm",
+		},
+		{
+			"timeout",
+			&RFC2136{Server: "127.0.0.1:1", Zone: "example.org.", Timeout: 100 * time.Millisecond},
+			"",
+		},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.p.Present(context.Background(), "_acme-challenge.example.org.", "value")
+			if err == nil {
+				t.Fatal("Present: expected error")
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Present: %v; want error containing %q", err, test.want)
+			}
+		})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.updates != 0 {
+		t.Errorf("%d updates applied; want 0", s.updates)
+	}
+}
+
+func TestTSIG(t *testing.T) {
+	key, err := newTSIGKey("Key.Example.", "HMAC-SHA512", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x1234})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("example.org."),
+		Type:  dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+	})
+	msg, _ := b.Finish()
+
+	now := time.Now()
+	signed, mac := key.sign(msg, nil, now)
+	if len(mac) != 64 {
+		t.Errorf("len(mac) = %d; want 64", len(mac))
+	}
+	if _, err := key.verify(signed, nil, now); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	if _, err := key.verify(signed, nil, now.Add(time.Hour)); err == nil {
+		t.Error("verify: expected error for expired signature")
+	}
+	tampered := slices.Clone(signed)
+	tampered[len(msg)-1] ^= 1 // question class
+	if _, err := key.verify(tampered, nil, now); err == nil {
+		t.Error("verify: expected error for tampered message")
+	}
+	if _, err := key.verify(msg, nil, now); err == nil {
+		t.Error("verify: expected error for unsigned message")
+	}
+}
+
+// TestTSIGKnownAnswer checks the MACs against values computed
+// independently from RFC 8945, Section 4.3.3, for the SOA query
+// of example.org with ID 0x1234, and its response.
+func TestTSIGKnownAnswer(t *testing.T) {
+	query, _ := hex.DecodeString("123400000001000000000000076578616d706c65036f72670000060001")
+	response, _ := hex.DecodeString("123484000001000000000000076578616d706c65036f72670000060001")
+	now := time.Unix(1700000000, 0)
+	tt := []struct {
+		algorithm string
+		msg       []byte
+		request   string // MAC of the request, in hex
+		want      string
+	}{
+		{HMACSHA256, query, "", "f28f74f0d58e6cef05a0d635f2cfec95bdf26569df3f4d0bfb56ca74bfe3ddd9"},
+		{HMACSHA256, response, "f28f74f0d58e6cef05a0d635f2cfec95bdf26569df3f4d0bfb56ca74bfe3ddd9", "546e9db0a67dd339821602fdf2506c45988448cd5c4090f453aa79e70121cbe5"},
+		{HMACSHA512, query, "", "bc5bde55daf329896559932722476d74a121609c9d7ff19ad93b863cd5c58bc7a26be1b47d60cf9582daf31694af5f7a7572183cb49fc9d8f0e14f899d88faf9"},
+	}
+	for _, test := range tt {
+		key, err := newTSIGKey("Key.Example", test.algorithm, testSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var requestMAC []byte
+		if test.request != "" {
+			requestMAC, _ = hex.DecodeString(test.request)
+		}
+		signed, mac := key.sign(test.msg, requestMAC, now)
+		if got := hex.EncodeToString(mac); got != test.want {
+			t.Errorf("%s: MAC = %s; want %s", test.algorithm, got, test.want)
+		}
+		if _, err := key.verify(signed, requestMAC, now); err != nil {
+			t.Errorf("%s: verify: %v", test.algorithm, err)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package dnsprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRoute53Endpoint is the endpoint of the Route53 API,
+	// unless configured otherwise.
+	defaultRoute53Endpoint = "https://route53.amazonaws.com"
+
+	// defaultRoute53Region is the region signing the requests to
+	// the Route53 API, unless configured otherwise.
+	defaultRoute53Region = "us-east-1"
+
+	// route53Version is the version of the Route53 API, prefixing the paths.
+	route53Version = "/2013-04-01"
+
+	// route53Namespace is the XML namespace of the Route53 API.
+	route53Namespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+
+	// defaultPollInterval is the interval between two checks of the status
+	// of a change, unless configured otherwise.
+	defaultPollInterval = 2 * time.Second
+
+	// defaultWaitTimeout is the maximum amount of time waiting for a change
+	// to be applied, unless configured otherwise.
+	defaultWaitTimeout = 2 * time.Minute
+)
+
+// Route53 adds and removes the dns-01 TXT records in AWS Route53 hosted
+// zones with the ChangeResourceRecordSets API, and waits for the changes
+// to be applied to all the Route53 nameservers.
+//
+// The credentials need the route53:ListHostedZonesByName,
+// route53:ListResourceRecordSets, route53:ChangeResourceRecordSets
+// and route53:GetChange permissions.
+type Route53 struct {
+	// AccessKeyID, SecretAccessKey and SessionToken are the AWS credentials.
+	// If AccessKeyID is empty, they are read from the environment variables
+	// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// HostedZoneID optionally is the ID of the hosted zone containing
+	// the records. If empty, the public hosted zone of each record
+	// is found by name.
+	HostedZoneID string
+
+	// TTL is the TTL of the records. If zero, one minute is used.
+	TTL time.Duration
+
+	// Endpoint optionally is the endpoint of the API.
+	// If empty, "https://route53.amazonaws.com" is used.
+	Endpoint string
+
+	// Region optionally is the region signing the requests.
+	// If empty, "us-east-1" is used, as required by the global endpoint.
+	Region string
+
+	// HTTPClient optionally specifies the client used to call the API.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Timeout is the maximum amount of time waiting for each
+	// response of the API. If zero, 10 seconds is used.
+	Timeout time.Duration
+
+	// PollInterval is the interval between two checks of the status
+	// of a change. If zero, 2 seconds is used.
+	PollInterval time.Duration
+
+	// WaitTimeout is the maximum amount of time waiting for a change
+	// to be applied. If zero, 2 minutes is used.
+	WaitTimeout time.Duration
+
+	zones zoneCache
+
+	// mu serializes the changes, since the TXT records at a name
+	// form a single record set, which is replaced as a whole.
+	mu sync.Mutex
+}
+
+type route53RecordSet struct {
+	Name            string         `xml:"Name"`
+	Type            string         `xml:"Type"`
+	TTL             int64          `xml:"TTL"`
+	ResourceRecords []route53Value `xml:"ResourceRecords>ResourceRecord"`
+}
+
+type route53Value struct {
+	Value string `xml:"Value"`
+}
+
+type route53ChangeInfo struct {
+	ID     string `xml:"Id"`
+	Status string `xml:"Status"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"ChangeResourceRecordSetsRequest"`
+	XMLNS   string          `xml:"xmlns,attr"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53Change struct {
+	Action            string           `xml:"Action"`
+	ResourceRecordSet route53RecordSet `xml:"ResourceRecordSet"`
+}
+
+type route53ChangeResponse struct {
+	ChangeInfo route53ChangeInfo `xml:"ChangeInfo"`
+}
+
+type route53Error struct {
+	Type    string `xml:"Error>Type"`
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// Present adds a TXT record with the given value at fqdn.
+func (p *Route53) Present(ctx context.Context, fqdn, value string) error {
+	return p.change(ctx, fqdn, value, true)
+}
+
+// CleanUp removes the TXT record with the given value at fqdn.
+func (p *Route53) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.change(ctx, fqdn, value, false)
+}
+
+// change adds or removes the TXT record with the given value at fqdn,
+// and waits for the change to be applied.
+func (p *Route53) change(ctx context.Context, fqdn, value string, add bool) error {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	name := strings.ToLower(strings.TrimSuffix(fqdn, ".")) + "."
+	quoted := `"` + value + `"`
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, err := p.recordSet(ctx, zone, name)
+	if err != nil {
+		return err
+	}
+	set := route53RecordSet{Name: name, Type: "TXT", TTL: int64(p.ttl() / time.Second)}
+	if old != nil {
+		set.TTL = old.TTL
+		set.ResourceRecords = slices.DeleteFunc(slices.Clone(old.ResourceRecords), func(v route53Value) bool {
+			return v.Value == quoted
+		})
+	}
+	var c route53Change
+	switch {
+	case add:
+		set.ResourceRecords = append(set.ResourceRecords, route53Value{quoted})
+		c = route53Change{Action: "UPSERT", ResourceRecordSet: set}
+	case old == nil || len(set.ResourceRecords) == len(old.ResourceRecords):
+		// nothing to remove
+		return nil
+	case len(set.ResourceRecords) == 0:
+		// the deleted record set must match the existing one
+		c = route53Change{Action: "DELETE", ResourceRecordSet: *old}
+	default:
+		c = route53Change{Action: "UPSERT", ResourceRecordSet: set}
+	}
+
+	req := route53ChangeRequest{XMLNS: route53Namespace, Changes: []route53Change{c}}
+	var resp route53ChangeResponse
+	path := "/hostedzone/" + url.PathEscape(zone) + "/rrset"
+	if err := p.do(ctx, "POST", path, nil, req, &resp); err != nil {
+		return err
+	}
+	return p.wait(ctx, resp.ChangeInfo)
+}
+
+// recordSet returns the TXT record set at name in the hosted zone,
+// or nil if there's none.
+func (p *Route53) recordSet(ctx context.Context, zone, name string) (*route53RecordSet, error) {
+	var resp struct {
+		ResourceRecordSets []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}
+	q := url.Values{"name": {name}, "type": {"TXT"}, "maxitems": {"1"}}
+	path := "/hostedzone/" + url.PathEscape(zone) + "/rrset"
+	if err := p.do(ctx, "GET", path, q, nil, &resp); err != nil {
+		return nil, err
+	}
+	// the record sets are listed from name onwards
+	for _, set := range resp.ResourceRecordSets {
+		if strings.EqualFold(set.Name, name) && set.Type == "TXT" {
+			return &set, nil
+		}
+	}
+	return nil, nil
+}
+
+// wait polls the status of the change until it is applied.
+func (p *Route53) wait(ctx context.Context, info route53ChangeInfo) error {
+	timeout := p.WaitTimeout
+	if timeout <= 0 {
+		timeout = defaultWaitTimeout
+	}
+	interval := p.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	id := strings.TrimPrefix(info.ID, "/change/")
+	for info.Status != "INSYNC" {
+		var resp route53ChangeResponse
+		err := sleep(ctx, interval)
+		if err == nil {
+			err = p.do(ctx, "GET", "/change/"+url.PathEscape(id), nil, nil, &resp)
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("dnsprovider: Route53 change %s still %s: %v", id, info.Status, ctx.Err())
+		}
+		if err != nil {
+			return err
+		}
+		info = resp.ChangeInfo
+	}
+	return nil
+}
+
+// zone returns the ID of the hosted zone of the record name fqdn.
+func (p *Route53) zone(ctx context.Context, fqdn string) (string, error) {
+	if p.HostedZoneID != "" {
+		return strings.TrimPrefix(p.HostedZoneID, "/hostedzone/"), nil
+	}
+	return p.zones.find(ctx, fqdn, func(ctx context.Context, zone string) (string, error) {
+		var resp struct {
+			HostedZones []struct {
+				ID          string `xml:"Id"`
+				Name        string `xml:"Name"`
+				PrivateZone bool   `xml:"Config>PrivateZone"`
+			} `xml:"HostedZones>HostedZone"`
+		}
+		q := url.Values{"dnsname": {zone}, "maxitems": {"10"}}
+		if err := p.do(ctx, "GET", "/hostedzonesbyname", q, nil, &resp); err != nil {
+			return "", err
+		}
+		// the hosted zones are listed from zone onwards
+		for _, z := range resp.HostedZones {
+			if strings.EqualFold(z.Name, zone) && !z.PrivateZone {
+				return strings.TrimPrefix(z.ID, "/hostedzone/"), nil
+			}
+		}
+		return "", nil
+	})
+}
+
+// do calls the API with the XML encoding of in as the body, unless in is nil,
+// and decodes the XML response into out.
+func (p *Route53) do(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	var body []byte
+	if in != nil {
+		b, err := xml.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = append([]byte(xml.Header), b...)
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = defaultRoute53Endpoint
+	}
+	u := strings.TrimSuffix(endpoint, "/") + route53Version + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	creds, err := p.credentials()
+	if err != nil {
+		return err
+	}
+	creds.sign(req, body, p.region(), "route53", time.Now())
+
+	client := p.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		herr := newHTTPError(req, resp)
+		var e route53Error
+		if xml.Unmarshal(herr.body, &e) == nil && e.Code != "" {
+			return fmt.Errorf("dnsprovider: Route53 %s %s: %s: %s", method, path, e.Code, e.Message)
+		}
+		return herr
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("dnsprovider: Route53 %s %s: invalid response: %v", method, path, err)
+	}
+	return nil
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (p *Route53) credentials() (*sigV4Credentials, error) {
+	c := &sigV4Credentials{
+		accessKeyID:     p.AccessKeyID,
+		secretAccessKey: p.SecretAccessKey,
+		sessionToken:    p.SessionToken,
+	}
+	if c.accessKeyID == "" {
+		c.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if c.accessKeyID == "" || c.secretAccessKey == "" {
+		return nil, errors.New("dnsprovider: no AWS credentials for Route53")
+	}
+	return c, nil
+}
+
+func (p *Route53) region() string {
+	if p.Region != "" {
+		return p.Region
+	}
+	return defaultRoute53Region
+}
+
+func (p *Route53) ttl() time.Duration {
+	if p.TTL > 0 {
+		return p.TTL
+	}
+	return defaultTTL
+}
@@ -0,0 +1,296 @@
+package dnsprovider
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/For-ACGN/autocert/certmgr"
+)
+
+var _ certmgr.DNSProvider = (*Route53)(nil)
+
+var testRoute53Credentials = sigV4Credentials{
+	accessKeyID:     "AKIDEXAMPLE",
+	secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+type route53Zone struct {
+	id, name string
+	private  bool
+}
+
+// route53Server imitates the hosted zone, record set and change
+// endpoints of the Route53 API.
+type route53Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	zones   []route53Zone
+	sets    map[string]route53RecordSet // by zone ID and name
+	changes map[string]int              // remaining polls by change ID
+	polls   int
+	stuck   bool // the changes never get in sync
+}
+
+func startRoute53Server(t *testing.T) *route53Server {
+	s := &route53Server{
+		zones: []route53Zone{
+			{"PRIVATE", "example.org.", true},
+			{"Z1", "example.org.", false},
+			{"Z2", "sub.example.org.", false},
+		},
+		sets:    make(map[string]route53RecordSet),
+		changes: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *route53Server) fail(w http.ResponseWriter, code int, errCode, msg string) {
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<ErrorResponse xmlns="%s"><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error></ErrorResponse>`,
+		route53Namespace, errCode, msg)
+}
+
+func (s *route53Server) reply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "text/xml")
+	b, _ := xml.Marshal(v)
+	w.Write(b)
+}
+
+func (s *route53Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+
+	// sign the request again with the credentials at the same time
+	date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		s.fail(w, http.StatusForbidden, "MissingAuthenticationToken", "missing date")
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	signed := r.Clone(context.Background())
+	testRoute53Credentials.sign(signed, body, "us-east-1", "route53", date)
+	if auth != signed.Header.Get("Authorization") {
+		s.fail(w, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+		return
+	}
+
+	path, ok := strings.CutPrefix(r.URL.Path, route53Version+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(path, "/")
+	switch {
+	case r.Method == "GET" && path == "hostedzonesbyname":
+		type zone struct {
+			ID          string `xml:"Id"`
+			Name        string `xml:"Name"`
+			PrivateZone bool   `xml:"Config>PrivateZone"`
+		}
+		resp := struct {
+			XMLName xml.Name `xml:"ListHostedZonesByNameResponse"`
+			Zones   []zone   `xml:"HostedZones>HostedZone"`
+		}{}
+		// the zones are listed from dnsname onwards
+		for _, z := range s.zones {
+			if z.name >= r.URL.Query().Get("dnsname") {
+				resp.Zones = append(resp.Zones, zone{"/hostedzone/" + z.id, z.name, z.private})
+			}
+		}
+		s.reply(w, resp)
+	case len(parts) == 3 && parts[0] == "hostedzone" && parts[2] == "rrset":
+		if r.Method == "GET" {
+			resp := struct {
+				XMLName xml.Name           `xml:"ListResourceRecordSetsResponse"`
+				Sets    []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+			}{}
+			if set, ok := s.sets[parts[1]+" "+r.URL.Query().Get("name")]; ok {
+				resp.Sets = append(resp.Sets, set)
+			} else {
+				// the next record set
+				resp.Sets = append(resp.Sets, route53RecordSet{Name: "zzz.example.org.", Type: "TXT", TTL: 300})
+			}
+			s.reply(w, resp)
+			return
+		}
+		var req route53ChangeRequest
+		if err := xml.Unmarshal(body, &req); err != nil || req.XMLNS != route53Namespace || len(req.Changes) != 1 {
+			s.fail(w, http.StatusBadRequest, "InvalidInput", "invalid request")
+			return
+		}
+		c := req.Changes[0]
+		key := parts[1] + " " + c.ResourceRecordSet.Name
+		switch c.Action {
+		case "UPSERT":
+			s.sets[key] = c.ResourceRecordSet
+		case "DELETE":
+			if !reflect.DeepEqual(s.sets[key], c.ResourceRecordSet) {
+				s.fail(w, http.StatusBadRequest, "InvalidChangeBatch",
+					"Tried to delete resource record set but it was not found or the values do not match")
+				return
+			}
+			delete(s.sets, key)
+		}
+		id := fmt.Sprintf("C%d", len(s.changes)+1)
+		s.changes[id] = 1
+		s.reply(w, struct {
+			XMLName    xml.Name          `xml:"ChangeResourceRecordSetsResponse"`
+			ChangeInfo route53ChangeInfo `xml:"ChangeInfo"`
+		}{ChangeInfo: route53ChangeInfo{"/change/" + id, "PENDING"}})
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "change":
+		n, ok := s.changes[parts[1]]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "NoSuchChange", "no change "+parts[1])
+			return
+		}
+		s.polls++
+		status := "INSYNC"
+		if n > 0 || s.stuck {
+			status = "PENDING"
+			s.changes[parts[1]] = n - 1
+		}
+		s.reply(w, struct {
+			XMLName    xml.Name          `xml:"GetChangeResponse"`
+			ChangeInfo route53ChangeInfo `xml:"ChangeInfo"`
+		}{ChangeInfo: route53ChangeInfo{"/change/" + parts[1], status}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *route53Server) values(zone, name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var v []string
+	for _, rr := range s.sets[zone+" "+name].ResourceRecords {
+		v = append(v, rr.Value)
+	}
+	return v
+}
+
+func newTestRoute53(s *route53Server) *Route53 {
+	return &Route53{
+		AccessKeyID:     testRoute53Credentials.accessKeyID,
+		SecretAccessKey: testRoute53Credentials.secretAccessKey,
+		Endpoint:        s.URL,
+		PollInterval:    time.Millisecond,
+	}
+}
+
+func TestRoute53(t *testing.T) {
+	s := startRoute53Server(t)
+	p := newTestRoute53(s)
+	ctx := context.Background()
+
+	const fqdn = "_acme-challenge.example.org."
+	for _, v := range []string{"v1", "v2", "v2"} {
+		if err := p.Present(ctx, fqdn, v); err != nil {
+			t.Fatalf("Present(%q): %v", v, err)
+		}
+	}
+	if got, want := s.values("Z1", fqdn), []string{`"v1"`, `"v2"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q; want %q", got, want)
+	}
+	s.mu.Lock()
+	if s.polls != 6 {
+		t.Errorf("%d change polls; want 6", s.polls)
+	}
+	s.mu.Unlock()
+
+	if err := p.CleanUp(ctx, fqdn, "v1"); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	if got, want := s.values("Z1", fqdn), []string{`"v2"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q; want %q", got, want)
+	}
+	if err := p.CleanUp(ctx, fqdn, "v2"); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	if err := p.CleanUp(ctx, fqdn, "v2"); err != nil {
+		t.Fatalf("CleanUp of a removed record: %v", err)
+	}
+	if got := s.values("Z1", fqdn); got != nil {
+		t.Errorf("records = %q; want none", got)
+	}
+
+	// the closest enclosing zone is used
+	if err := p.Present(ctx, "_acme-challenge.www.sub.example.org.", "v3"); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if got := s.values("Z2", "_acme-challenge.www.sub.example.org."); len(got) != 1 {
+		t.Errorf("records = %q; want 1", got)
+	}
+}
+
+func TestRoute53Errors(t *testing.T) {
+	s := startRoute53Server(t)
+	ctx := context.Background()
+
+	p := newTestRoute53(s)
+	p.SecretAccessKey = "wrong"
+	err := p.Present(ctx, "_acme-challenge.example.org.", "v")
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("Present: %v; want signature error", err)
+	}
+
+	p = newTestRoute53(s)
+	err = p.Present(ctx, "_acme-challenge.example.com.", "v")
+	if err == nil || !strings.Contains(err.Error(), "no zone found") {
+		t.Errorf("Present: %v; want zone error", err)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	p = &Route53{Endpoint: s.URL}
+	if err := p.Present(ctx, "_acme-challenge.example.org.", "v"); err == nil {
+		t.Error("Present: expected error without credentials")
+	}
+
+	s.mu.Lock()
+	s.stuck = true
+	s.mu.Unlock()
+	p = newTestRoute53(s)
+	p.WaitTimeout = 50 * time.Millisecond
+	err = p.Present(ctx, "_acme-challenge.example.org.", "v")
+	if err == nil || !strings.Contains(err.Error(), "still PENDING") {
+		t.Errorf("Present: %v; want wait error", err)
+	}
+}
+
+// TestSigV4 checks the signatures of the get-vanilla tests
+// of the AWS Signature Version 4 test suite.
+func TestSigV4(t *testing.T) {
+	tt := []struct{ url, want string }{
+		{
+			"https://example.amazonaws.com/",
+			"5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			"https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			"b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	for _, test := range tt {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		testRoute53Credentials.sign(req, nil, "us-east-1", "service", now)
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=" + test.want
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s: Authorization = %q; want %q", test.url, got, want)
+		}
+	}
+}
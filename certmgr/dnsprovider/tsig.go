@@ -0,0 +1,348 @@
+package dnsprovider
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/For-ACGN/autocert/certmgr/internal/dnsutil"
+)
+
+// TSIG algorithms supported by RFC2136.
+const (
+	HMACSHA256 = "hmac-sha256."
+	HMACSHA512 = "hmac-sha512."
+)
+
+const (
+	typeTSIG = 250
+	classANY = 255
+
+	// tsigFudge is the number of seconds of clock skew allowed
+	// between the signer and the verifier.
+	tsigFudge = 300
+)
+
+// tsigKey is a TSIG key (RFC 8945).
+type tsigKey struct {
+	name      string // canonical, with a trailing dot
+	algorithm string // canonical, with a trailing dot
+	secret    []byte
+}
+
+// newTSIGKey returns the TSIG key with the given name, algorithm
+// and base64 encoded secret.
+func newTSIGKey(name, algorithm, secret string) (*tsigKey, error) {
+	if algorithm == "" {
+		algorithm = HMACSHA256
+	}
+	algorithm = canonicalName(algorithm)
+	if algorithm != HMACSHA256 && algorithm != HMACSHA512 {
+		return nil, fmt.Errorf("dnsprovider: unsupported TSIG algorithm %q", algorithm)
+	}
+	b, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("dnsprovider: invalid TSIG secret: %v", err)
+	}
+	if len(b) == 0 {
+		return nil, errors.New("dnsprovider: empty TSIG secret")
+	}
+	return &tsigKey{name: canonicalName(name), algorithm: algorithm, secret: b}, nil
+}
+
+func (k *tsigKey) hash() func() hash.Hash {
+	if k.algorithm == HMACSHA512 {
+		return sha512.New
+	}
+	return sha256.New
+}
+
+// tsigRecord is the data of a TSIG record.
+type tsigRecord struct {
+	algorithm  string
+	timeSigned uint64 // 48 bits
+	fudge      uint16
+	mac        []byte
+	origID     uint16
+	error      uint16
+	other      []byte
+}
+
+// sign appends a TSIG record to the DNS message msg and returns the signed
+// message along with its MAC. The requestMAC is the MAC of the request
+// when signing a response, or nil.
+func (k *tsigKey) sign(msg, requestMAC []byte, now time.Time) (signed, mac []byte) {
+	t := &tsigRecord{
+		algorithm:  k.algorithm,
+		timeSigned: uint64(now.Unix()),
+		fudge:      tsigFudge,
+		origID:     binary.BigEndian.Uint16(msg),
+	}
+	t.mac = k.mac(msg, requestMAC, t)
+	return k.appendRecord(msg, t), t.mac
+}
+
+// appendRecord appends the TSIG record t to msg, updating its header.
+func (k *tsigKey) appendRecord(msg []byte, t *tsigRecord) []byte {
+	var rdata []byte
+	rdata = appendName(rdata, t.algorithm)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(t.timeSigned>>32))
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(t.timeSigned))
+	rdata = binary.BigEndian.AppendUint16(rdata, t.fudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(t.mac)))
+	rdata = append(rdata, t.mac...)
+	rdata = binary.BigEndian.AppendUint16(rdata, t.origID)
+	rdata = binary.BigEndian.AppendUint16(rdata, t.error)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(t.other)))
+	rdata = append(rdata, t.other...)
+
+	b := slices.Clone(msg)
+	b = appendName(b, k.name)
+	b = binary.BigEndian.AppendUint16(b, typeTSIG)
+	b = binary.BigEndian.AppendUint16(b, classANY)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	b = append(b, rdata...)
+	binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])+1)
+	return b
+}
+
+// mac computes the MAC of the DNS message msg, which doesn't include
+// the TSIG record t, as specified in RFC 8945, Section 4.3.
+func (k *tsigKey) mac(msg, requestMAC []byte, t *tsigRecord) []byte {
+	h := hmac.New(k.hash(), k.secret)
+	if requestMAC != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+		h.Write(requestMAC)
+	}
+	h.Write(msg)
+	var b []byte
+	b = appendName(b, k.name)
+	b = binary.BigEndian.AppendUint16(b, classANY)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = appendName(b, t.algorithm)
+	b = binary.BigEndian.AppendUint16(b, uint16(t.timeSigned>>32))
+	b = binary.BigEndian.AppendUint32(b, uint32(t.timeSigned))
+	b = binary.BigEndian.AppendUint16(b, t.fudge)
+	b = binary.BigEndian.AppendUint16(b, t.error)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.other)))
+	b = append(b, t.other...)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// verify checks the TSIG record of the signed DNS message msg.
+// The requestMAC is the MAC of the request when verifying a response, or nil.
+func (k *tsigKey) verify(msg, requestMAC []byte, now time.Time) (*tsigRecord, error) {
+	name, t, off, err := parseTSIG(msg)
+	if err != nil {
+		return nil, err
+	}
+	if name != k.name || t.algorithm != k.algorithm {
+		return nil, fmt.Errorf("dnsprovider: message signed with unexpected TSIG key %q (%s)", name, t.algorithm)
+	}
+	if t.error != 0 {
+		return nil, fmt.Errorf("dnsprovider: TSIG error %s", dnsutil.RCodeName(t.error))
+	}
+	// The MAC covers the message without the TSIG record
+	// and with its original ID.
+	unsigned := slices.Clone(msg[:off])
+	binary.BigEndian.PutUint16(unsigned, t.origID)
+	binary.BigEndian.PutUint16(unsigned[10:], binary.BigEndian.Uint16(unsigned[10:])-1)
+	if !hmac.Equal(k.mac(unsigned, requestMAC, t), t.mac) {
+		return nil, errors.New("dnsprovider: bad TSIG signature")
+	}
+	signed := time.Unix(int64(t.timeSigned), 0)
+	if d := now.Sub(signed).Abs(); d > time.Duration(t.fudge)*time.Second {
+		return nil, fmt.Errorf("dnsprovider: TSIG time %v out of range", signed)
+	}
+	return t, nil
+}
+
+// parseTSIG parses the TSIG record of the DNS message msg, which is its last
+// additional record. It returns the key name, the record and its offset in msg.
+func parseTSIG(msg []byte) (name string, t *tsigRecord, off int, err error) {
+	errUnsigned := errors.New("dnsprovider: message not signed with TSIG")
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[10:]) == 0 {
+		return "", nil, 0, errUnsigned
+	}
+	off, err = lastRecordOffset(msg)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	name, i, err := readName(msg, off)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	r := reader{b: msg, off: i}
+	typ, _, _, rdlen := r.uint16(), r.uint16(), r.uint32(), int(r.uint16())
+	if r.err != nil {
+		return "", nil, 0, r.err
+	}
+	if typ != typeTSIG {
+		return "", nil, 0, errUnsigned
+	}
+	end := r.off + rdlen
+	t = new(tsigRecord)
+	t.algorithm, r.off, err = readName(msg, r.off)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	t.timeSigned = uint64(r.uint16())<<32 | uint64(r.uint32())
+	t.fudge = r.uint16()
+	t.mac = r.bytes(int(r.uint16()))
+	t.origID = r.uint16()
+	t.error = r.uint16()
+	t.other = r.bytes(int(r.uint16()))
+	if r.err != nil || r.off != end || end != len(msg) {
+		return "", nil, 0, errors.New("dnsprovider: malformed TSIG record")
+	}
+	return name, t, off, nil
+}
+
+// lastRecordOffset returns the offset of the last resource record
+// of the DNS message msg.
+func lastRecordOffset(msg []byte) (int, error) {
+	r := reader{b: msg}
+	qd := int(r.uint16At(4))
+	n := int(r.uint16At(6)) + int(r.uint16At(8)) + int(r.uint16At(10))
+	if r.err != nil || n == 0 {
+		return 0, errors.New("dnsprovider: malformed message")
+	}
+	off := 12
+	for i := 0; i < qd; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return 0, err
+		}
+		off = next + 4
+	}
+	for i := 0; i < n-1; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return 0, err
+		}
+		r.off = next + 8 // type, class and TTL
+		rdlen := int(r.uint16())
+		off = r.off + rdlen
+		if r.err != nil {
+			return 0, r.err
+		}
+	}
+	if off >= len(msg) {
+		return 0, errors.New("dnsprovider: malformed message")
+	}
+	return off, nil
+}
+
+// readName reads the possibly compressed domain name at offset off
+// of the DNS message msg. It returns the name in canonical form
+// and the offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	var (
+		sb   strings.Builder
+		next = -1
+	)
+	for ptrs := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("dnsprovider: malformed domain name")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			if sb.Len() == 0 {
+				sb.WriteByte('.')
+			}
+			return strings.ToLower(sb.String()), next, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) || ptrs > 32 {
+				return "", 0, errors.New("dnsprovider: malformed domain name")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			ptrs++
+		case l&0xC0 != 0 || off+1+l > len(msg):
+			return "", 0, errors.New("dnsprovider: malformed domain name")
+		default:
+			sb.Write(msg[off+1 : off+1+l])
+			sb.WriteByte('.')
+			off += 1 + l
+		}
+	}
+}
+
+// appendName appends the uncompressed wire form of the domain name
+// to b, in lower case as required by the TSIG MAC computation.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, strings.ToLower(label)...)
+	}
+	return append(b, 0)
+}
+
+// canonicalName returns name in lower case with a trailing dot.
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// reader reads big-endian integers from b, remembering the first error.
+type reader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || r.off+n > len(r.b) {
+		r.err = errors.New("dnsprovider: malformed message")
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *reader) uint16At(off int) uint16 {
+	if r.err != nil || off+2 > len(r.b) {
+		r.err = errors.New("dnsprovider: malformed message")
+		return 0
+	}
+	return binary.BigEndian.Uint16(r.b[off:])
+}
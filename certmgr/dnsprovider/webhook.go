@@ -0,0 +1,60 @@
+package dnsprovider
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Webhook presents the dns-01 records by POSTing a JSON payload to a URL,
+// such as an endpoint of an internal DNS system.
+//
+// The payload is an object with the members "action", which is ActionPresent
+// or ActionCleanUp, "fqdn", the fully qualified name of the record, and
+// "value", its value. The webhook must respond with a 2xx status code
+// once it's done.
+type Webhook struct {
+	// URL is the URL of the webhook.
+	URL string
+
+	// Header optionally specifies headers added to the requests,
+	// such as an Authorization header.
+	Header http.Header
+
+	// HTTPClient optionally specifies the client used to call the webhook.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Timeout is the maximum amount of time waiting for each
+	// response of the webhook. If zero, 10 seconds is used.
+	Timeout time.Duration
+}
+
+// WebhookPayload is the JSON payload POSTed by the Webhook provider.
+type WebhookPayload struct {
+	Action string `json:"action"`
+	FQDN   string `json:"fqdn"`
+	Value  string `json:"value"`
+}
+
+// Present calls the webhook with ActionPresent.
+func (p *Webhook) Present(ctx context.Context, fqdn, value string) error {
+	return p.call(ctx, ActionPresent, fqdn, value)
+}
+
+// CleanUp calls the webhook with ActionCleanUp.
+func (p *Webhook) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.call(ctx, ActionCleanUp, fqdn, value)
+}
+
+func (p *Webhook) call(ctx context.Context, action, fqdn, value string) error {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	header := func(h http.Header) {
+		for k, v := range p.Header {
+			h[k] = v
+		}
+	}
+	payload := &WebhookPayload{Action: action, FQDN: fqdn, Value: value}
+	return doJSON(ctx, p.HTTPClient, "POST", p.URL, header, payload, nil)
+}
@@ -0,0 +1,77 @@
+package dnsprovider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/For-ACGN/autocert/certmgr"
+)
+
+var _ certmgr.DNSProvider = (*Webhook)(nil)
+
+func TestWebhook(t *testing.T) {
+	var got []WebhookPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s request with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "missing token", http.StatusUnauthorized)
+			return
+		}
+		var p WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got = append(got, p)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	p := &Webhook{
+		URL:    ts.URL,
+		Header: http.Header{"Authorization": {"Bearer token"}},
+	}
+	ctx := context.Background()
+	if err := p.Present(ctx, "_acme-challenge.example.org.", "value"); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if err := p.CleanUp(ctx, "_acme-challenge.example.org.", "value"); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	want := []WebhookPayload{
+		{ActionPresent, "_acme-challenge.example.org.", "value"},
+		{ActionCleanUp, "_acme-challenge.example.org.", "value"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("payloads = %+v; want %+v", got, want)
+	}
+
+	p.Header = nil
+	err := p.Present(ctx, "_acme-challenge.example.org.", "value")
+	if err == nil || !strings.Contains(err.Error(), "missing token") {
+		t.Errorf("Present: %v; want error with the response body", err)
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	p := &Webhook{URL: ts.URL, Timeout: 100 * time.Millisecond}
+	err := p.Present(context.Background(), "_acme-challenge.example.org.", "value")
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("Present: %v; want timeout error", err)
+	}
+}
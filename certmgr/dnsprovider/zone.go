@@ -0,0 +1,46 @@
+package dnsprovider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// zoneCache finds and remembers the zones of the record names
+// for the providers calling the API of a DNS hosting service.
+type zoneCache struct {
+	mu    sync.Mutex
+	zones map[string]string // zone ID by lower case record name
+}
+
+// find returns the ID of the zone of the record name fqdn. It calls lookup
+// with each enclosing domain name, from fqdn itself to the second level,
+// until lookup returns the ID of a zone with this name.
+func (c *zoneCache) find(ctx context.Context, fqdn string, lookup func(ctx context.Context, zone string) (id string, err error)) (string, error) {
+	name := strings.ToLower(strings.TrimSuffix(fqdn, ".")) + "."
+	c.mu.Lock()
+	id, ok := c.zones[name]
+	c.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	for zone := name; strings.Count(zone, ".") > 1; zone = zone[strings.Index(zone, ".")+1:] {
+		id, err := lookup(ctx, zone)
+		if err != nil {
+			return "", err
+		}
+		if id == "" {
+			continue
+		}
+		c.mu.Lock()
+		if c.zones == nil {
+			c.zones = make(map[string]string)
+		}
+		c.zones[name] = id
+		c.mu.Unlock()
+		return id, nil
+	}
+	return "", fmt.Errorf("dnsprovider: no zone found for %s", fqdn)
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/For-ACGN/autocert/acme"
 	"github.com/For-ACGN/autocert/certmgr"
 )
 
@@ -33,3 +34,28 @@ func ExampleManager() {
 	}
 	s.ListenAndServeTLS("", "")
 }
+
+func ExampleManager_issuers() {
+	m := &certmgr.Manager{
+		Cache:      certmgr.DirCache("secret-dir"),
+		Prompt:     certmgr.AcceptTOS,
+		HostPolicy: certmgr.HostWhitelist("example.org"),
+		// Fall back to ZeroSSL when Let's Encrypt fails.
+		Issuers: []certmgr.Issuer{
+			&certmgr.ACMEIssuer{Email: "example@example.org"},
+			&certmgr.ACMEIssuer{
+				Client: &acme.Client{DirectoryURL: "https://acme.zerossl.com/v2/DV90"},
+				Email:  "example@example.org",
+				ExternalAccountBinding: &acme.ExternalAccountBinding{
+					KID: "kid",
+					Key: []byte("secret"),
+				},
+			},
+		},
+	}
+	s := &http.Server{
+		Addr:      ":https",
+		TLSConfig: m.TLSConfig(),
+	}
+	s.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,266 @@
+// Package dnstest provides an in-process DNS server for testing
+// the dns-01 code of certmgr and its DNS providers.
+package dnstest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/For-ACGN/autocert/certmgr/internal/dnsutil"
+)
+
+// Server is a DNS server answering from the records added to it,
+// over UDP on the loopback interface.
+//
+// It also implements the methods of certmgr.DNSProvider, so the TXT
+// records of dns-01 challenges can be provisioned into it.
+type Server struct {
+	t    *testing.T
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	records map[recordKey][]dnsmessage.ResourceBody
+	queries int
+}
+
+type recordKey struct {
+	name string // canonical, with a trailing dot
+	typ  dnsmessage.Type
+}
+
+// NewServer starts a new Server, which is stopped at the end of the test.
+func NewServer(t *testing.T) *Server {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		t:       t,
+		conn:    conn,
+		records: make(map[recordKey][]dnsmessage.ResourceBody),
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+// Addr returns the address of the server, such as "127.0.0.1:5353".
+func (s *Server) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+// Dial connects to the server whatever the address, so the server can stand
+// for any nameserver. It has the signature of net.Dialer.DialContext.
+func (s *Server) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "udp", s.Addr())
+}
+
+// Resolver returns a resolver which sends all its queries to the server.
+func (s *Server) Resolver() *net.Resolver {
+	return &net.Resolver{PreferGo: true, Dial: s.Dial}
+}
+
+// Queries returns the number of queries received so far.
+func (s *Server) Queries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+// Add adds the record with the given body at name.
+// The body is one of *dnsmessage.AResource, *dnsmessage.AAAAResource,
+// *dnsmessage.CNAMEResource, *dnsmessage.NSResource, *dnsmessage.SOAResource,
+// *dnsmessage.TXTResource or *dnsmessage.UnknownResource.
+func (s *Server) Add(name string, body dnsmessage.ResourceBody) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := recordKey{canonical(name), bodyType(body)}
+	s.records[k] = append(s.records[k], body)
+}
+
+// Remove removes the record with the given body at name.
+func (s *Server) Remove(name string, body dnsmessage.ResourceBody) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := recordKey{canonical(name), bodyType(body)}
+	s.records[k] = slices.DeleteFunc(s.records[k], func(b dnsmessage.ResourceBody) bool {
+		return reflect.DeepEqual(b, body)
+	})
+	if len(s.records[k]) == 0 {
+		delete(s.records, k)
+	}
+}
+
+// AddNS adds an NS record for the zone pointing to host,
+// and an A record with the given IP address for host.
+func (s *Server) AddNS(zone, host, ip string) {
+	s.Add(zone, &dnsmessage.NSResource{NS: dnsmessage.MustNewName(canonical(host))})
+	s.Add(host, &dnsmessage.AResource{A: [4]byte(net.ParseIP(ip).To4())})
+}
+
+// AddCNAME adds a CNAME record at name pointing to target.
+func (s *Server) AddCNAME(name, target string) {
+	s.Add(name, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(canonical(target))})
+}
+
+// AddCAA adds a CAA record (RFC 8659) at name.
+func (s *Server) AddCAA(name string, flags uint8, tag, value string) {
+	data := append([]byte{flags, byte(len(tag))}, tag...)
+	s.Add(name, &dnsmessage.UnknownResource{Type: dnsutil.TypeCAA, Data: append(data, value...)})
+}
+
+// Present adds a TXT record with the given value at fqdn.
+func (s *Server) Present(ctx context.Context, fqdn, value string) error {
+	s.Add(fqdn, &dnsmessage.TXTResource{TXT: []string{value}})
+	return nil
+}
+
+// CleanUp removes the TXT record with the given value at fqdn.
+func (s *Server) CleanUp(ctx context.Context, fqdn, value string) error {
+	s.Remove(fqdn, &dnsmessage.TXTResource{TXT: []string{value}})
+	return nil
+}
+
+// LookupTXT returns the values of the TXT records at name, following
+// CNAME records like a resolver.
+// It has the signature expected by acmetest.CAServer.LookupTXT.
+func (s *Server) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var values []string
+	answers, _ := s.lookup(canonical(name), dnsmessage.TypeTXT)
+	for _, rr := range answers {
+		if txt, ok := rr.Body.(*dnsmessage.TXTResource); ok {
+			values = append(values, strings.Join(txt.TXT, ""))
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no TXT records at %q", name)
+	}
+	return values, nil
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var req dnsmessage.Message
+		if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+			continue
+		}
+		resp, err := s.answer(&req).Pack()
+		if err != nil {
+			s.t.Errorf("dnstest: pack response: %v", err)
+			continue
+		}
+		s.conn.WriteTo(resp, addr)
+	}
+}
+
+// answer returns the response to req.
+func (s *Server) answer(req *dnsmessage.Message) *dnsmessage.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries++
+
+	q := req.Questions[0]
+	resp := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               req.ID,
+			Response:         true,
+			Authoritative:    true,
+			RecursionDesired: req.RecursionDesired,
+		},
+		Questions: req.Questions,
+	}
+	var exists bool
+	resp.Answers, exists = s.lookup(canonical(q.Name.String()), q.Type)
+	if !exists {
+		resp.RCode = dnsmessage.RCodeNameError
+	}
+	return resp
+}
+
+// lookup returns the records of type typ at name, following CNAME records,
+// and reports whether the final name exists.
+func (s *Server) lookup(name string, typ dnsmessage.Type) ([]dnsmessage.Resource, bool) {
+	var answers []dnsmessage.Resource
+	for range 16 {
+		if bodies, ok := s.records[recordKey{name, typ}]; ok {
+			return append(answers, s.resources(name, bodies)...), true
+		}
+		cname, ok := s.records[recordKey{name, dnsmessage.TypeCNAME}]
+		if !ok || typ == dnsmessage.TypeCNAME {
+			break
+		}
+		answers = append(answers, s.resources(name, cname)...)
+		name = canonical(cname[0].(*dnsmessage.CNAMEResource).CNAME.String())
+	}
+	return answers, len(answers) > 0 || s.exists(name)
+}
+
+// exists reports whether there's any record at name or below it.
+func (s *Server) exists(name string) bool {
+	for k := range s.records {
+		if k.name == name || strings.HasSuffix(k.name, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) resources(name string, bodies []dnsmessage.ResourceBody) []dnsmessage.Resource {
+	var rrs []dnsmessage.Resource
+	for _, b := range bodies {
+		rrs = append(rrs, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName(name),
+				Type:  bodyType(b),
+				Class: dnsmessage.ClassINET,
+				TTL:   60,
+			},
+			Body: b,
+		})
+	}
+	return rrs
+}
+
+func bodyType(b dnsmessage.ResourceBody) dnsmessage.Type {
+	switch b := b.(type) {
+	case *dnsmessage.AResource:
+		return dnsmessage.TypeA
+	case *dnsmessage.AAAAResource:
+		return dnsmessage.TypeAAAA
+	case *dnsmessage.CNAMEResource:
+		return dnsmessage.TypeCNAME
+	case *dnsmessage.NSResource:
+		return dnsmessage.TypeNS
+	case *dnsmessage.SOAResource:
+		return dnsmessage.TypeSOA
+	case *dnsmessage.TXTResource:
+		return dnsmessage.TypeTXT
+	case *dnsmessage.UnknownResource:
+		return b.Type
+	}
+	panic(fmt.Sprintf("dnstest: unsupported record type %T", b))
+}
+
+func canonical(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
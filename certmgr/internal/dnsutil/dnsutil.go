@@ -0,0 +1,194 @@
+// Package dnsutil implements the DNS queries shared by the dns-01 code
+// of certmgr and its DNS providers.
+package dnsutil
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TypeCAA is the type of CAA records (RFC 8659), which dnsmessage doesn't define.
+const TypeCAA = dnsmessage.Type(257)
+
+// DialFunc dials a connection to a DNS server, like net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Exchange sends the DNS message msg to the server at addr and returns
+// the response, over UDP and then over TCP if the response is truncated.
+// If dial is nil, a net.Dialer is used.
+func Exchange(ctx context.Context, dial DialFunc, addr string, msg []byte) ([]byte, error) {
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	resp, err := exchange(ctx, dial, "udp", addr, msg)
+	if err == nil && resp[2]&0x02 != 0 {
+		resp, err = exchange(ctx, dial, "tcp", addr, msg)
+	}
+	return resp, err
+}
+
+func exchange(ctx context.Context, dial DialFunc, network, addr string, msg []byte) ([]byte, error) {
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if network == "tcp" {
+		b := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+		if _, err := conn.Write(append(b, msg...)); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(b))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		if len(resp) < 12 || resp[0] != msg[0] || resp[1] != msg[1] {
+			return nil, errors.New("dns: mismatched response ID")
+		}
+		return resp, nil
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams.
+		if n >= 12 && buf[0] == msg[0] && buf[1] == msg[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// NewID returns a random DNS message ID.
+func NewID() uint16 {
+	return uint16(rand.Uint32())
+}
+
+// Query asks the server at addr for the records of type typ at name.
+// The rd argument sets the Recursion Desired bit, which is needed
+// to query recursive resolvers rather than authoritative servers.
+func Query(ctx context.Context, dial DialFunc, addr, name string, typ dnsmessage.Type, rd bool) (*dnsmessage.Message, error) {
+	n, err := dnsmessage.NewName(Fqdn(name))
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: NewID(), RecursionDesired: rd})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: n, Type: typ, Class: dnsmessage.ClassINET})
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := Exchange(ctx, dial, addr, msg)
+	if err != nil {
+		return nil, err
+	}
+	m := new(dnsmessage.Message)
+	if err := m.Unpack(resp); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// resolvConf is the configuration file of the system resolver.
+var resolvConf = "/etc/resolv.conf"
+
+// SystemNameservers returns the addresses of the recursive resolvers
+// configured in /etc/resolv.conf, with port 53. It returns nil if the file
+// doesn't exist, such as on Windows.
+func SystemNameservers() []string {
+	data, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return nil
+	}
+	var addrs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "nameserver" {
+			continue
+		}
+		// keep the zone of link-local IPv6 addresses, which is required to
+		// reach them, but validate the address without it
+		host, _, _ := strings.Cut(f[1], "%")
+		if net.ParseIP(host) == nil {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(f[1], "53"))
+	}
+	return addrs
+}
+
+// TXT returns the values of the TXT records at name in the answer
+// section of m. The strings of each record are concatenated.
+func TXT(m *dnsmessage.Message, name string) []string {
+	var values []string
+	for _, rr := range m.Answers {
+		txt, ok := rr.Body.(*dnsmessage.TXTResource)
+		if ok && EqualNames(rr.Header.Name.String(), name) {
+			values = append(values, strings.Join(txt.TXT, ""))
+		}
+	}
+	return values
+}
+
+// Fqdn returns name with a trailing dot.
+func Fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// EqualNames reports whether the domain names a and b are equal,
+// ignoring case and trailing dots.
+func EqualNames(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
+
+// RCodeName returns the mnemonic of a DNS RCODE, including
+// the extended ones used by TSIG.
+func RCodeName(rcode uint16) string {
+	if s, ok := rcodeNames[rcode]; ok {
+		return s
+	}
+	return "RCODE" + strconv.Itoa(int(rcode))
+}
+
+var rcodeNames = map[uint16]string{
+	0:  "NOERROR",
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+	16: "BADSIG",
+	17: "BADKEY",
+	18: "BADTIME",
+	22: "BADTRUNC",
+}
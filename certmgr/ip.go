@@ -0,0 +1,98 @@
+package certmgr
+
+import (
+	"crypto/tls"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// parseIP reports whether name is an IP address and returns its canonical
+// form, without zone and with IPv4-mapped IPv6 addresses unmapped.
+func parseIP(name string) (string, bool) {
+	addr, err := netip.ParseAddr(name)
+	if err != nil {
+		return "", false
+	}
+	return addr.WithZone("").Unmap().String(), true
+}
+
+// localIP returns the canonical IP address on which the connection
+// of hello was accepted, or an empty string if it is unknown.
+//
+// Clients don't send IP addresses as server names (RFC 6066, Section 3),
+// so the local address is the only hint of the certificate they want.
+func localIP(hello *tls.ClientHelloInfo) string {
+	if hello.Conn == nil || hello.Conn.LocalAddr() == nil {
+		return ""
+	}
+	ap, err := netip.ParseAddrPort(hello.Conn.LocalAddr().String())
+	if err != nil {
+		return ""
+	}
+	ip, _ := parseIP(ap.Addr().String())
+	return ip
+}
+
+// reverseName returns the reverse DNS name of the IP address,
+// the inverse of reverseNameIP.
+func reverseName(addr netip.Addr) string {
+	var b strings.Builder
+	if addr.Is4() || addr.Is4In6() {
+		ip := addr.Unmap().As4()
+		for i := len(ip) - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(ip[i])) + ".")
+		}
+		return b.String() + "in-addr.arpa"
+	}
+	const hex = "0123456789abcdef"
+	ip := addr.As16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	return b.String() + "ip6.arpa"
+}
+
+// reverseNameIP returns the IP address of a reverse DNS name, such as
+// "1.0.0.127.in-addr.arpa", which CAs use as the server name when
+// validating IP addresses with tls-alpn-01 (RFC 8738, Section 6).
+func reverseNameIP(name string) (string, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if s, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		labels := strings.Split(s, ".")
+		if len(labels) != 4 {
+			return "", false
+		}
+		slices.Reverse(labels)
+		addr, err := netip.ParseAddr(strings.Join(labels, "."))
+		if err != nil {
+			return "", false
+		}
+		return addr.String(), true
+	}
+	if s, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		labels := strings.Split(s, ".")
+		if len(labels) != 32 {
+			return "", false
+		}
+		var b [16]byte
+		for i, label := range labels {
+			if len(label) != 1 {
+				return "", false
+			}
+			n, err := strconv.ParseUint(label, 16, 8)
+			if err != nil {
+				return "", false
+			}
+			// The first label is the least significant nibble.
+			nibble := 31 - i
+			b[nibble/2] |= byte(n) << (4 * (1 - nibble%2))
+		}
+		return netip.AddrFrom16(b).String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,140 @@
+package certmgr
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/acme/acmetest"
+)
+
+// localAddrConn is a net.Conn which only knows its local address.
+type localAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c localAddrConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func TestParseIP(t *testing.T) {
+	tt := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"127.0.0.1", "127.0.0.1", true},
+		{"2001:DB8::1", "2001:db8::1", true},
+		{"fe80::1%eth0", "fe80::1", true},
+		{"::ffff:192.0.2.1", "192.0.2.1", true},
+		{"example.org", "", false},
+		{"[::1]", "", false},
+	}
+	for _, test := range tt {
+		got, ok := parseIP(test.name)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseIP(%q) = %q, %v; want %q, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestReverseNameIP(t *testing.T) {
+	tt := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"1.2.0.192.in-addr.arpa", "192.0.2.1", true},
+		{"1.2.0.192.IN-ADDR.ARPA.", "192.0.2.1", true},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", "2001:db8::1", true},
+		{"2.0.192.in-addr.arpa", "", false},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.ip6.arpa", "", false},
+		{"x.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", "", false},
+		{"example.org", "", false},
+	}
+	for _, test := range tt {
+		got, ok := reverseNameIP(test.name)
+		if got != test.want || ok != test.ok {
+			t.Errorf("reverseNameIP(%q) = %q, %v; want %q, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	for _, ip := range []string{"192.0.2.1", "::ffff:192.0.2.1", "2001:db8::1"} {
+		addr := netip.MustParseAddr(ip)
+		name := reverseName(addr)
+		got, ok := reverseNameIP(name)
+		if want := addr.Unmap().String(); got != want || !ok {
+			t.Errorf("reverseNameIP(reverseName(%q) = %q) = %q, %v; want %q", ip, name, got, ok, want)
+		}
+	}
+}
+
+func TestCertKeyStringIP(t *testing.T) {
+	tt := []struct {
+		ck   certKey
+		want string
+	}{
+		{certKey{domain: "192.0.2.1", isIP: true}, "192.0.2.1"},
+		{certKey{domain: "2001:db8::1", isIP: true}, "2001-db8--1"},
+		{certKey{domain: "2001:db8::1", isIP: true, isRSA: true}, "2001-db8--1+rsa"},
+		{certKey{domain: "2001:db8::1", isToken: true}, "2001-db8--1+token"},
+	}
+	for _, test := range tt {
+		if got := test.ck.String(); got != test.want {
+			t.Errorf("%#v.String() = %q; want %q", test.ck, got, test.want)
+		}
+	}
+}
+
+func TestCertRequestIP(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := certRequest(key, []string{"2001:db8::1"}, nil)
+	if err != nil {
+		t.Fatalf("certRequest: %v", err)
+	}
+	r, err := x509.ParseCertificateRequest(b)
+	if err != nil {
+		t.Fatalf("ParseCertificateRequest: %v", err)
+	}
+	if r.Subject.CommonName != "" {
+		t.Errorf("CommonName = %q; want empty", r.Subject.CommonName)
+	}
+	if len(r.DNSNames) != 0 {
+		t.Errorf("DNSNames = %q; want none", r.DNSNames)
+	}
+	if len(r.IPAddresses) != 1 || !r.IPAddresses[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("IPAddresses = %v; want [2001:db8::1]", r.IPAddresses)
+	}
+}
+
+func TestGetCertificateIPv6WithoutSNI(t *testing.T) {
+	const ip = "2001:db8::1"
+	man := testManager(t)
+	ca := acmetest.NewCAServer(t)
+	ca.ResolveGetCertificate(ip, man.GetCertificate)
+	ca.Start()
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+
+	hello := clientHelloInfo("", algECDSA)
+	hello.Conn = localAddrConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 443, Zone: "eth0"}}
+	cert, err := man.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if err := cert.Leaf.VerifyHostname(ip); err != nil {
+		t.Error(err)
+	}
+	if _, err := man.Cache.Get(context.Background(), "2001-db8--1"); err != nil {
+		t.Errorf("certificate not cached under a safe key: %v", err)
+	}
+}
@@ -0,0 +1,363 @@
+package certmgr
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+)
+
+// accountKeyName is the key at which the account key of the ACME CA
+// configured by the Manager's Client field is stored in its Cache.
+const accountKeyName = "acme_account"
+
+// Issuer issues the certificates of a Manager.
+//
+// The Manager tries its issuers in order, and falls back to the next one
+// when an issuer fails, such as when a CA is down or rate-limiting the
+// Manager. The ID of the issuer of each certificate is stored in the
+// Cache next to the certificate.
+type Issuer interface {
+	// ID returns a stable string identifying the issuer,
+	// such as the directory URL of an ACME CA.
+	// The issuers of a Manager must have distinct IDs.
+	ID() string
+
+	// Issue returns the DER-encoded chain of a new certificate
+	// for the request, starting with the leaf.
+	Issue(ctx context.Context, req *IssueRequest) ([][]byte, error)
+}
+
+// IssueRequest is a request for a new certificate passed to Issuer.Issue.
+type IssueRequest struct {
+	// Names are the DNS names and IP addresses of the certificate.
+	Names []string
+
+	// CSR is the DER-encoded certificate request for Names, signed with
+	// the certificate private key. It carries the Manager's ExtraExtensions.
+	CSR []byte
+
+	// Replaces is the certificate being renewed, if it was issued
+	// by the same issuer, or nil.
+	Replaces *x509.Certificate
+
+	m  *Manager
+	ck certKey
+}
+
+// ACMEIssuer issues certificates from an ACME CA, solving the challenges
+// with the Manager it is used by. Each ACMEIssuer has an account of its own.
+type ACMEIssuer struct {
+	// Name optionally distinguishes the issuers using the same CA,
+	// such as with the accounts of several organizations.
+	// It is part of the ID of the issuer and of the cache key of its account key.
+	Name string
+
+	// Client is used to perform the low-level operations with the CA.
+	//
+	// If Client is nil, a zero-value acme.Client is used with DefaultACMEDirectory
+	// as the directory endpoint.
+	// If the Client.Key is nil, a new ECDSA P-256 key is generated and,
+	// if the Manager's Cache is not nil, stored in cache under a name
+	// derived from the ID of the issuer.
+	//
+	// Mutating the field after the first certificate request will have no effect.
+	Client *acme.Client
+
+	// Email optionally specifies a contact email address of the account.
+	Email string
+
+	// ExternalAccountBinding optionally binds the account to an account
+	// of the CA, as required by CAs such as ZeroSSL or Google.
+	// See RFC 8555, Section 7.3.4 for more details.
+	ExternalAccountBinding *acme.ExternalAccountBinding
+
+	// Prompt optionally accepts the Terms of Service of the CA.
+	// If nil, the Manager's Prompt is used.
+	Prompt func(tosURL string) bool
+
+	// keyName optionally overrides the cache key of the account key.
+	keyName string
+
+	mu     sync.Mutex
+	client *acme.Client // initialized by acmeClient method
+	anon   *acme.Client // initialized by anonClient method
+}
+
+// ID returns the directory URL of the CA, followed by the key identifier
+// of the ExternalAccountBinding and the Name of the issuer, if any,
+// each preceded by '#'.
+func (a *ACMEIssuer) ID() string {
+	id := a.directoryURL()
+	if a.ExternalAccountBinding != nil {
+		id += "#" + a.ExternalAccountBinding.KID
+	}
+	if a.Name != "" {
+		id += "#" + a.Name
+	}
+	return id
+}
+
+// directoryURL returns the directory URL of the CA.
+func (a *ACMEIssuer) directoryURL() string {
+	if a.Client == nil || a.Client.DirectoryURL == "" {
+		return DefaultACMEDirectory
+	}
+	return a.Client.DirectoryURL
+}
+
+// Issue orders a certificate from the CA. It can only be called
+// by the Manager, which solves the challenges.
+func (a *ACMEIssuer) Issue(ctx context.Context, req *IssueRequest) ([][]byte, error) {
+	if req.m == nil {
+		return nil, errors.New("acme/autocert: ACMEIssuer can only issue certificates for a Manager")
+	}
+	client, err := a.acmeClient(ctx, req.m)
+	if err != nil {
+		return nil, err
+	}
+	return req.m.orderCert(ctx, client, req)
+}
+
+// acmeClient returns the client of the CA, registering the account
+// on first use.
+func (a *ACMEIssuer) acmeClient(ctx context.Context, m *Manager) (*acme.Client, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client != nil {
+		return a.client, nil
+	}
+
+	client := a.Client
+	if client == nil {
+		client = &acme.Client{DirectoryURL: DefaultACMEDirectory}
+	}
+	if client.Key == nil {
+		keyName := a.keyName
+		if keyName == "" {
+			keyName = issuerAccountKeyName(a.ID())
+		}
+		var err error
+		client.Key, err = m.accountKey(ctx, keyName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if client.UserAgent == "" {
+		client.UserAgent = "autocert"
+	}
+	var contact []string
+	if a.Email != "" {
+		contact = []string{"mailto:" + a.Email}
+	}
+	prompt := a.Prompt
+	if prompt == nil {
+		prompt = m.Prompt
+	}
+	acct := &acme.Account{Contact: contact, ExternalAccountBinding: a.ExternalAccountBinding}
+	_, err := client.Register(ctx, acct, prompt)
+	if err == nil || isAccountAlreadyExist(err) {
+		a.client = client
+		err = nil
+	}
+	return a.client, err
+}
+
+// anonClient returns a client of the CA without account, for the
+// requests which aren't authenticated, such as the renewal information.
+func (a *ACMEIssuer) anonClient() *acme.Client {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.anon != nil {
+		return a.anon
+	}
+	a.anon = &acme.Client{DirectoryURL: a.directoryURL(), UserAgent: "autocert"}
+	if c := a.Client; c != nil {
+		a.anon.HTTPClient = c.HTTPClient
+		a.anon.RetryBackoff = c.RetryBackoff
+		if c.UserAgent != "" {
+			a.anon.UserAgent = c.UserAgent
+		}
+	}
+	return a.anon
+}
+
+// issuerAccountKeyName returns the cache key of the account key
+// of the ACMEIssuer identified by id.
+func issuerAccountKeyName(id string) string {
+	if id == DefaultACMEDirectory {
+		return accountKeyName
+	}
+	sum := sha256.Sum256([]byte(id))
+	return accountKeyName + "+" + hex.EncodeToString(sum[:8])
+}
+
+// ID returns "local:" followed by the common name of the CA certificate.
+func (ca *LocalCA) ID() string {
+	switch {
+	case ca.Cert != nil:
+		return "local:" + ca.Cert.Subject.CommonName
+	case ca.Name != "":
+		return "local:" + ca.Name
+	}
+	return "local:" + defaultLocalCAName
+}
+
+// Issue signs a certificate for the request. When it is used by a Manager,
+// the generated root is stored in the Manager's Cache.
+func (ca *LocalCA) Issue(ctx context.Context, req *IssueRequest) ([][]byte, error) {
+	csr, err := x509.ParseCertificateRequest(req.CSR)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	var cache Cache
+	now := time.Now()
+	if req.m != nil {
+		cache, now = req.m.Cache, req.m.now()
+	}
+	return ca.issue(ctx, cache, csr, now)
+}
+
+// issuers returns the issuers of the Manager, in order of preference.
+func (m *Manager) issuers() []Issuer {
+	if len(m.Issuers) > 0 {
+		return m.Issuers
+	}
+	if m.LocalCA != nil {
+		return []Issuer{m.LocalCA}
+	}
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	if m.acmeIssuer == nil {
+		m.acmeIssuer = &ACMEIssuer{
+			Client:                 m.Client,
+			Email:                  m.Email,
+			ExternalAccountBinding: m.ExternalAccountBinding,
+			keyName:                accountKeyName,
+		}
+	}
+	return []Issuer{m.acmeIssuer}
+}
+
+// checkIssuers reports an error if the issuers of the Manager are misconfigured.
+func (m *Manager) checkIssuers() error {
+	m.issuersOnce.Do(func() {
+		seen := make(map[string]bool)
+		for _, iss := range m.issuers() {
+			id := iss.ID()
+			if seen[id] {
+				m.issuersErr = fmt.Errorf("acme/autocert: duplicate issuer ID %q", id)
+				return
+			}
+			seen[id] = true
+		}
+	})
+	return m.issuersErr
+}
+
+// issuer returns the issuer of the Manager identified by id, if any.
+func (m *Manager) issuer(id string) (Issuer, bool) {
+	for _, iss := range m.issuers() {
+		if iss.ID() == id {
+			return iss, true
+		}
+	}
+	return nil, false
+}
+
+// acmeClient returns the client of the first ACME CA among the issuers.
+func (m *Manager) acmeClient(ctx context.Context) (*acme.Client, error) {
+	for _, iss := range m.issuers() {
+		if a, ok := iss.(*ACMEIssuer); ok {
+			return a.acmeClient(ctx, m)
+		}
+	}
+	return nil, errors.New("acme/autocert: no ACME issuer configured")
+}
+
+// issue requests a new certificate for ck, whose private key is key,
+// from each issuer in turn until one of them issues a valid one.
+// The replaces certificate, if not nil, is only passed to the issuer
+// identified by replacesIssuer.
+// It returns the ID of the issuer of the certificate.
+func (m *Manager) issue(ctx context.Context, key crypto.Signer, ck certKey, csr []byte, replaces *x509.Certificate, replacesIssuer string) ([][]byte, *x509.Certificate, string, error) {
+	if err := m.checkIssuers(); err != nil {
+		return nil, nil, "", err
+	}
+	issuers := m.issuers()
+	var errs []error
+	for _, iss := range issuers {
+		req := &IssueRequest{
+			Names: ck.names(),
+			CSR:   csr,
+			m:     m,
+			ck:    ck,
+		}
+		if iss.ID() == replacesIssuer {
+			req.Replaces = replaces
+		}
+		chain, err := iss.Issue(ctx, req)
+		var leaf *x509.Certificate
+		if err == nil {
+			leaf, err = validCert(ck, chain, key, m.now())
+		}
+		if err == nil {
+			return chain, leaf, iss.ID(), nil
+		}
+		if len(issuers) == 1 {
+			return nil, nil, "", err
+		}
+		errs = append(errs, fmt.Errorf("acme/autocert: issuer %s: %w", iss.ID(), err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, nil, "", errors.Join(errs...)
+}
+
+// certIssuerCacheKey returns the key at which the ID of the issuer
+// of the ck certificate is stored in the Manager's optional Cache.
+func certIssuerCacheKey(ck certKey) string {
+	return ck.String() + "+issuer"
+}
+
+// certIssuer returns the ID of the issuer of the current ck certificate,
+// as stored in the cache or, without cache, in the Manager's state.
+// Certificates cached before the issuer was recorded are assumed to
+// come from the first issuer.
+func (m *Manager) certIssuer(ctx context.Context, ck certKey) string {
+	if m.Cache != nil {
+		if data, err := m.Cache.Get(ctx, certIssuerCacheKey(ck)); err == nil {
+			return string(data)
+		}
+	}
+	m.stateMu.Lock()
+	s, ok := m.state[ck]
+	m.stateMu.Unlock()
+	if ok {
+		s.RLock()
+		defer s.RUnlock()
+		if s.issuer != "" {
+			return s.issuer
+		}
+	}
+	return m.issuers()[0].ID()
+}
+
+// putCertIssuer stores the ID of the issuer of the ck certificate in the cache.
+func (m *Manager) putCertIssuer(ctx context.Context, ck certKey, id string) error {
+	if m.Cache == nil {
+		return nil
+	}
+	return m.Cache.Put(ctx, certIssuerCacheKey(ck), []byte(id))
+}
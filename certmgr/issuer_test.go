@@ -0,0 +1,222 @@
+package certmgr
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/acme/acmetest"
+)
+
+// testIssuer issues certificates from a LocalCA, or fails with err,
+// and records the requests.
+type testIssuer struct {
+	id  string
+	err error
+	ca  LocalCA
+
+	mu   sync.Mutex
+	reqs []*IssueRequest
+}
+
+func (iss *testIssuer) ID() string { return iss.id }
+
+func (iss *testIssuer) Issue(ctx context.Context, req *IssueRequest) ([][]byte, error) {
+	iss.mu.Lock()
+	iss.reqs = append(iss.reqs, req)
+	iss.mu.Unlock()
+	if iss.err != nil {
+		return nil, iss.err
+	}
+	return iss.ca.Issue(ctx, req)
+}
+
+func TestIssuersFallback(t *testing.T) {
+	man := testManager(t)
+	ca1 := acmetest.NewCAServer(t).InvalidOrders(1)
+	ca1.ResolveGetCertificate(exampleDomain, man.GetCertificate)
+	ca1.Start()
+	ca2 := acmetest.NewCAServer(t)
+	ca2.ResolveGetCertificate(exampleDomain, man.GetCertificate)
+	ca2.Start()
+	man.Issuers = []Issuer{
+		&ACMEIssuer{Client: &acme.Client{DirectoryURL: ca1.URL()}},
+		&ACMEIssuer{Client: &acme.Client{DirectoryURL: ca2.URL()}, Email: "admin@example.org"},
+	}
+
+	if _, err := man.GetCertificate(clientHelloInfo(exampleDomain, algECDSA)); err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if n := len(ca1.IssuedCerts()); n != 0 {
+		t.Errorf("first CA issued %d certs; want 0", n)
+	}
+	if n := len(ca2.IssuedCerts()); n != 1 {
+		t.Errorf("second CA issued %d certs; want 1", n)
+	}
+	id, err := man.Cache.Get(context.Background(), certIssuerCacheKey(exampleCertKey))
+	if err != nil {
+		t.Fatalf("issuer of the cert: %v", err)
+	}
+	if string(id) != ca2.URL() {
+		t.Errorf("issuer of the cert = %q; want %q", id, ca2.URL())
+	}
+
+	// Each CA has an account of its own.
+	k1, err := man.Cache.Get(context.Background(), issuerAccountKeyName(ca1.URL()))
+	if err != nil {
+		t.Fatalf("account key of the first CA: %v", err)
+	}
+	k2, err := man.Cache.Get(context.Background(), issuerAccountKeyName(ca2.URL()))
+	if err != nil {
+		t.Fatalf("account key of the second CA: %v", err)
+	}
+	if string(k1) == string(k2) {
+		t.Error("the CAs share an account key")
+	}
+}
+
+func TestIssuersAllFail(t *testing.T) {
+	man := testManager(t)
+	man.Issuers = []Issuer{
+		&testIssuer{id: "a", err: errors.New("down")},
+		&testIssuer{id: "b", err: errors.New("rate limited")},
+	}
+	_, err := man.GetCertificate(clientHelloInfo(exampleDomain, algECDSA))
+	if err == nil {
+		t.Fatal("GetCertificate succeeded")
+	}
+	for _, s := range []string{"issuer a: down", "issuer b: rate limited"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error %q doesn't contain %q", err, s)
+		}
+	}
+}
+
+func TestACMEIssuerID(t *testing.T) {
+	const dir = "https://ca.example.org/directory"
+	eab := &acme.ExternalAccountBinding{KID: "kid", Key: []byte("key")}
+	tt := []struct {
+		iss  *ACMEIssuer
+		want string
+	}{
+		{&ACMEIssuer{}, DefaultACMEDirectory},
+		{&ACMEIssuer{Client: &acme.Client{DirectoryURL: dir}}, dir},
+		{&ACMEIssuer{Client: &acme.Client{DirectoryURL: dir}, ExternalAccountBinding: eab}, dir + "#kid"},
+		{&ACMEIssuer{Client: &acme.Client{DirectoryURL: dir}, Name: "org"}, dir + "#org"},
+		{&ACMEIssuer{ExternalAccountBinding: eab, Name: "org"}, DefaultACMEDirectory + "#kid#org"},
+	}
+	keys := make(map[string]bool)
+	for _, test := range tt {
+		id := test.iss.ID()
+		if id != test.want {
+			t.Errorf("ID() = %q; want %q", id, test.want)
+		}
+		keys[issuerAccountKeyName(id)] = true
+	}
+	if len(keys) != len(tt) {
+		t.Errorf("issuers share account keys: %v", keys)
+	}
+}
+
+func TestIssuersDuplicateID(t *testing.T) {
+	man := testManager(t)
+	man.Issuers = []Issuer{
+		&ACMEIssuer{Client: &acme.Client{DirectoryURL: "https://ca.example.org/directory"}},
+		&ACMEIssuer{Client: &acme.Client{DirectoryURL: "https://ca.example.org/directory"}, Email: "admin@example.org"},
+	}
+	_, err := man.GetCertificate(clientHelloInfo(exampleDomain, algECDSA))
+	if err == nil || !strings.Contains(err.Error(), "duplicate issuer ID") {
+		t.Errorf("GetCertificate: %v; want duplicate issuer ID error", err)
+	}
+}
+
+func TestIssuersRenewReplaces(t *testing.T) {
+	man := testManager(t)
+	down := &testIssuer{id: "down", err: errors.New("down")}
+	up := &testIssuer{id: "up"}
+	man.Issuers = []Issuer{down, up}
+	man.state = make(map[certKey]*certState)
+
+	key, err := generateKey(exampleCertKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, leaf, issuer, err := man.authorizedCert(context.Background(), key, exampleCertKey, nil)
+	if err != nil {
+		t.Fatalf("authorizedCert: %v", err)
+	}
+	if issuer != "up" {
+		t.Errorf("issuer = %q; want %q", issuer, "up")
+	}
+	s := &certState{key: key, cert: der, leaf: leaf}
+	tlscert, err := s.tlscert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := man.cachePut(context.Background(), exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+	if err := man.putCertIssuer(context.Background(), exampleCertKey, issuer); err != nil {
+		t.Fatal(err)
+	}
+
+	// The renewal is only marked as a replacement for the issuer of the cert.
+	if _, _, _, err := man.authorizedCert(context.Background(), key, exampleCertKey, leaf); err != nil {
+		t.Fatalf("authorizedCert: %v", err)
+	}
+	if r := down.reqs[len(down.reqs)-1].Replaces; r != nil {
+		t.Errorf("down: Replaces = %v; want nil", r.SerialNumber)
+	}
+	if r := up.reqs[len(up.reqs)-1].Replaces; r != leaf {
+		t.Errorf("up: Replaces = %v; want the renewed cert", r)
+	}
+}
+
+func TestIssuersLegacyAccountKey(t *testing.T) {
+	ca := acmetest.NewCAServer(t).Start()
+	man := testManager(t)
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+	client, err := man.acmeClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The CA configured by the Manager's fields keeps the account key
+	// stored before the issuers were introduced.
+	key, err := man.accountKey(context.Background(), accountKeyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !publicKeysEqual(client.Key.Public(), key.Public()) {
+		t.Error("account key is not stored under acme_account")
+	}
+	if got := issuerAccountKeyName(DefaultACMEDirectory); got != accountKeyName {
+		t.Errorf("issuerAccountKeyName(DefaultACMEDirectory) = %q; want %q", got, accountKeyName)
+	}
+}
+
+func TestLocalCAIssueRequest(t *testing.T) {
+	key, err := generateKey(exampleCertKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := certRequest(key, []string{exampleDomain, "192.0.2.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &LocalCA{}
+	chain, err := ca.Issue(context.Background(), &IssueRequest{CSR: csr})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	leaf, err := validCert(certKey{domain: exampleDomain, group: exampleDomain + ",192.0.2.1"}, chain, key, time.Now())
+	if err != nil {
+		t.Fatalf("validCert: %v", err)
+	}
+	if leaf.Subject.CommonName != exampleDomain {
+		t.Errorf("CommonName = %q; want %q", leaf.Subject.CommonName, exampleDomain)
+	}
+}
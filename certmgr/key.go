@@ -0,0 +1,146 @@
+package certmgr
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// KeyPolicy specifies the types and sizes of certificate private keys.
+//
+// The zero value uses ECDSA P-256 keys, and 2048-bit RSA keys
+// for clients which don't support ECDSA.
+type KeyPolicy struct {
+	// Curve is the curve of ECDSA keys, which is one of
+	// elliptic.P256, elliptic.P384 or elliptic.P521.
+	// If nil, elliptic.P256 is used.
+	Curve elliptic.Curve
+
+	// RSABits is the size of RSA keys, at least 2048.
+	// If zero, 2048 is used.
+	RSABits int
+}
+
+// keySize returns the size in bits of the ECDSA or RSA keys specified
+// by the policy, or zero if the size is the default one.
+// Keeping the default sizes at zero keeps their cache keys unchanged.
+func (p KeyPolicy) keySize(isRSA bool) (int, error) {
+	if isRSA {
+		switch {
+		case p.RSABits == 0 || p.RSABits == 2048:
+			return 0, nil
+		case p.RSABits < 2048:
+			return 0, fmt.Errorf("acme/autocert: RSA key size %d is too small", p.RSABits)
+		}
+		return p.RSABits, nil
+	}
+	switch p.Curve {
+	case nil, elliptic.P256():
+		return 0, nil
+	case elliptic.P384():
+		return 384, nil
+	case elliptic.P521():
+		return 521, nil
+	}
+	return 0, fmt.Errorf("acme/autocert: unsupported ECDSA curve %s", p.Curve.Params().Name)
+}
+
+// generateKey generates a new certificate private key of the type and size
+// specified by ck.
+func generateKey(ck certKey) (crypto.Signer, error) {
+	if ck.isRSA {
+		bits := ck.keySize
+		if bits == 0 {
+			bits = 2048
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	}
+	curve := elliptic.P256()
+	switch ck.keySize {
+	case 384:
+		curve = elliptic.P384()
+	case 521:
+		curve = elliptic.P521()
+	}
+	return ecdsa.GenerateKey(curve, rand.Reader)
+}
+
+// KeyRotation specifies when certificate private keys are replaced
+// with new ones upon renewal. A key is rotated as soon as any of
+// the conditions is met.
+//
+// The zero value never rotates keys.
+type KeyRotation struct {
+	// Always rotates the key on every renewal.
+	Always bool
+
+	// Renewals rotates the key every that many renewals.
+	Renewals int
+
+	// MaxAge rotates the key once it is older than MaxAge.
+	MaxAge time.Duration
+}
+
+// due reports whether the key described by info must be rotated
+// by the renewal happening at now.
+func (r KeyRotation) due(info *keyInfo, now time.Time) bool {
+	switch {
+	case r.Always:
+		return true
+	case r.Renewals > 0 && info.Renewals+1 >= r.Renewals:
+		return true
+	case r.MaxAge > 0 && now.Sub(info.Created) >= r.MaxAge:
+		return true
+	}
+	return false
+}
+
+// keyInfo describes the lifecycle of a certificate private key.
+// It is stored in the cache next to the certificate, so the
+// rotation policy keeps working across restarts.
+type keyInfo struct {
+	Created  time.Time `json:"created"`
+	Renewals int       `json:"renewals"` // renewals since the key was created
+}
+
+// keyInfoCacheKey returns the key at which the lifecycle of the private
+// key of the ck certificate is stored in the Manager's optional Cache.
+func keyInfoCacheKey(ck certKey) string {
+	return ck.String() + "+key"
+}
+
+// keyInfo retrieves the lifecycle of the private key of the ck certificate
+// from the cache. It returns ErrCacheMiss if it is not found.
+func (m *Manager) keyInfo(ctx context.Context, ck certKey) (*keyInfo, error) {
+	if m.Cache == nil {
+		return nil, ErrCacheMiss
+	}
+	data, err := m.Cache.Get(ctx, keyInfoCacheKey(ck))
+	if err != nil {
+		return nil, err
+	}
+	info := new(keyInfo)
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, ErrCacheMiss
+	}
+	return info, nil
+}
+
+// putKeyInfo stores the lifecycle of the private key of the ck certificate
+// in the cache.
+func (m *Manager) putKeyInfo(ctx context.Context, ck certKey, info *keyInfo) error {
+	if m.Cache == nil {
+		return nil
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return m.Cache.Put(ctx, keyInfoCacheKey(ck), data)
+}
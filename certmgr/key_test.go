@@ -0,0 +1,155 @@
+package certmgr
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/acme/acmetest"
+)
+
+func TestKeyPolicyKeySize(t *testing.T) {
+	tt := []struct {
+		policy KeyPolicy
+		isRSA  bool
+		want   int
+		ok     bool
+	}{
+		{KeyPolicy{}, false, 0, true},
+		{KeyPolicy{}, true, 0, true},
+		{KeyPolicy{Curve: elliptic.P256(), RSABits: 2048}, false, 0, true},
+		{KeyPolicy{Curve: elliptic.P256(), RSABits: 2048}, true, 0, true},
+		{KeyPolicy{Curve: elliptic.P384()}, false, 384, true},
+		{KeyPolicy{Curve: elliptic.P521()}, false, 521, true},
+		{KeyPolicy{RSABits: 4096}, true, 4096, true},
+		{KeyPolicy{Curve: elliptic.P224()}, false, 0, false},
+		{KeyPolicy{RSABits: 1024}, true, 0, false},
+	}
+	for i, test := range tt {
+		got, err := test.policy.keySize(test.isRSA)
+		if got != test.want || (err == nil) != test.ok {
+			t.Errorf("%d: keySize = %d, %v; want %d, ok = %v", i, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	key, err := generateKey(certKey{domain: "example.org", keySize: 521})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := key.(*ecdsa.PrivateKey); !ok || k.Curve != elliptic.P521() {
+		t.Errorf("key = %T; want a P-521 ECDSA key", key)
+	}
+	key, err = generateKey(certKey{domain: "example.org", isRSA: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := key.(*rsa.PrivateKey); !ok || k.N.BitLen() != 2048 {
+		t.Errorf("key = %T; want a 2048-bit RSA key", key)
+	}
+}
+
+func TestCertKeyStringKeySize(t *testing.T) {
+	tt := []struct {
+		ck   certKey
+		want string
+	}{
+		{certKey{domain: "example.org"}, "example.org"},
+		{certKey{domain: "example.org", keySize: 384}, "example.org+p384"},
+		{certKey{domain: "example.org", isRSA: true}, "example.org+rsa"},
+		{certKey{domain: "example.org", isRSA: true, keySize: 4096}, "example.org+rsa4096"},
+		{certKey{domain: "*.example.org", keySize: 384}, "_wildcard.example.org+p384"},
+	}
+	for _, test := range tt {
+		if got := test.ck.String(); got != test.want {
+			t.Errorf("%#v.String() = %q; want %q", test.ck, got, test.want)
+		}
+	}
+}
+
+func TestKeyRotationDue(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	tt := []struct {
+		rotation KeyRotation
+		info     keyInfo
+		want     bool
+	}{
+		{KeyRotation{}, keyInfo{Created: now.Add(-365 * day), Renewals: 100}, false},
+		{KeyRotation{Always: true}, keyInfo{Created: now}, true},
+		{KeyRotation{Renewals: 1}, keyInfo{Created: now}, true},
+		{KeyRotation{Renewals: 3}, keyInfo{Created: now, Renewals: 1}, false},
+		{KeyRotation{Renewals: 3}, keyInfo{Created: now, Renewals: 2}, true},
+		{KeyRotation{MaxAge: 30 * day}, keyInfo{Created: now.Add(-29 * day)}, false},
+		{KeyRotation{MaxAge: 30 * day}, keyInfo{Created: now.Add(-30 * day)}, true},
+		{KeyRotation{Renewals: 5, MaxAge: 30 * day}, keyInfo{Created: now.Add(-60 * day)}, true},
+	}
+	for i, test := range tt {
+		if got := test.rotation.due(&test.info, now); got != test.want {
+			t.Errorf("%d: due = %v; want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestRenewRotateKey(t *testing.T) {
+	man := testManager(t)
+	man.KeyRotation = KeyRotation{Renewals: 2}
+	var rotated []string
+	man.OnRotateKey = func(name string, cert *tls.Certificate) {
+		rotated = append(rotated, name)
+	}
+	ca := acmetest.NewCAServer(t).Start()
+	ca.ResolveGetCertificate(exampleDomain, man.GetCertificate)
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+	man.state = make(map[certKey]*certState)
+
+	// cache an almost expired cert whose key went through one renewal
+	now := time.Now()
+	c := ca.LeafCert(exampleDomain, "ECDSA", now.Add(-2*time.Hour), now.Add(time.Minute))
+	if err := man.cachePut(context.Background(), exampleCertKey, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := man.putKeyInfo(context.Background(), exampleCertKey, &keyInfo{Created: now, Renewals: 1}); err != nil {
+		t.Fatal(err)
+	}
+	key := c.PrivateKey.(crypto.Signer)
+	dr := &domainRenewal{m: man, ck: exampleCertKey, key: key}
+	if _, err := dr.do(context.Background()); err != nil {
+		t.Fatalf("dr.do: %v", err)
+	}
+	if dr.key.Public().(*ecdsa.PublicKey).Equal(key.Public()) {
+		t.Error("key was not rotated")
+	}
+	if len(rotated) != 1 || rotated[0] != exampleDomain {
+		t.Errorf("OnRotateKey calls = %q; want [%q]", rotated, exampleDomain)
+	}
+	info, err := man.keyInfo(context.Background(), exampleCertKey)
+	if err != nil {
+		t.Fatalf("man.keyInfo: %v", err)
+	}
+	if info.Renewals != 0 {
+		t.Errorf("info.Renewals = %d; want 0", info.Renewals)
+	}
+
+	// The next renewal keeps the new key, the one after rotates it again.
+	next, info, rotate, err := dr.nextKey(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotate || next != dr.key || info.Renewals != 1 {
+		t.Errorf("nextKey: rotate = %v, renewals = %d; want false, 1", rotate, info.Renewals)
+	}
+	if err := man.putKeyInfo(context.Background(), exampleCertKey, info); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, rotate, _ := dr.nextKey(context.Background(), nil); !rotate {
+		t.Error("nextKey: key was not rotated after 2 renewals")
+	}
+}
@@ -0,0 +1,267 @@
+package certmgr
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localCACacheKey is the key at which the root generated by LocalCA
+// is stored in the Manager's optional Cache.
+const localCACacheKey = "local_ca"
+
+// oidSubjectAltName is the OID of the subject alternative name extension.
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// Defaults of the LocalCA configuration.
+const (
+	defaultLocalCAName         = "certmgr local CA"
+	defaultLocalCAValidity     = 30 * 24 * time.Hour
+	defaultLocalCARootValidity = 10 * 365 * 24 * time.Hour
+)
+
+// LocalCA issues certificates from a local certificate authority instead of
+// ordering them from an ACME CA, for development machines and air-gapped
+// hosts. The certificates are only trusted by the clients which have the
+// CA certificate, as returned by Manager.LocalCARoot, in their trust store.
+//
+// The certificates are cached and renewed like the ones issued by ACME CAs.
+type LocalCA struct {
+	// Cert and Key optionally specify the CA certificate and its private key,
+	// such as a root or an intermediate of an existing internal PKI.
+	//
+	// If both are nil, a self-signed root is generated on first use and
+	// stored in the Manager's Cache, so that it persists across restarts.
+	// Without a Cache, a new root is generated for the lifetime of the Manager.
+	Cert *x509.Certificate
+	Key  crypto.Signer
+
+	// Name is the common name of the generated root.
+	// If empty, "certmgr local CA" is used.
+	Name string
+
+	// Validity is the validity period of the issued certificates,
+	// which don't outlive the CA certificate. If zero, 30 days is used.
+	Validity time.Duration
+
+	// RootValidity is the validity period of the generated root.
+	// If zero, 10 years is used.
+	RootValidity time.Duration
+
+	mu   sync.Mutex
+	cert *x509.Certificate // initialized by load method
+	key  crypto.Signer
+}
+
+// load returns the CA certificate and key, from the configuration or
+// the cache, generating a new root if there is none yet.
+func (ca *LocalCA) load(ctx context.Context, cache Cache, now time.Time) (*x509.Certificate, crypto.Signer, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if ca.cert != nil {
+		return ca.cert, ca.key, nil
+	}
+
+	switch {
+	case ca.Cert != nil && ca.Key != nil:
+		if !publicKeysEqual(ca.Cert.PublicKey, ca.Key.Public()) {
+			return nil, nil, errors.New("acme/autocert: local CA key does not match its certificate")
+		}
+		if !ca.Cert.IsCA {
+			return nil, nil, errors.New("acme/autocert: local CA certificate is not a CA")
+		}
+		ca.cert, ca.key = ca.Cert, ca.Key
+		return ca.cert, ca.key, nil
+	case ca.Cert != nil || ca.Key != nil:
+		return nil, nil, errors.New("acme/autocert: local CA requires both Cert and Key")
+	}
+
+	if cache != nil {
+		data, err := cache.Get(ctx, localCACacheKey)
+		switch {
+		case err == nil:
+			cert, key, err := parseLocalCA(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			ca.cert, ca.key = cert, key
+			return cert, key, nil
+		case err != ErrCacheMiss:
+			return nil, nil, err
+		}
+	}
+
+	cert, key, err := ca.generateRoot(now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cache != nil {
+		var buf bytes.Buffer
+		if err := encodeECDSAKey(&buf, key); err != nil {
+			return nil, nil, err
+		}
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return nil, nil, err
+		}
+		if err := cache.Put(ctx, localCACacheKey, buf.Bytes()); err != nil {
+			return nil, nil, err
+		}
+	}
+	ca.cert, ca.key = cert, key
+	return cert, key, nil
+}
+
+// parseLocalCA parses a root stored in the cache by LocalCA.load.
+func parseLocalCA(data []byte) (*x509.Certificate, crypto.Signer, error) {
+	priv, rest := pem.Decode(data)
+	if priv == nil || !strings.Contains(priv.Type, "PRIVATE") {
+		return nil, nil, errors.New("acme/autocert: invalid local CA key found in cache")
+	}
+	key, err := parsePrivateKey(priv.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, _ := pem.Decode(rest)
+	if pub == nil || pub.Type != "CERTIFICATE" {
+		return nil, nil, errors.New("acme/autocert: invalid local CA certificate found in cache")
+	}
+	cert, err := x509.ParseCertificate(pub.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !publicKeysEqual(cert.PublicKey, key.Public()) {
+		return nil, nil, errors.New("acme/autocert: local CA key does not match its certificate")
+	}
+	return cert, key, nil
+}
+
+// generateRoot generates a new self-signed root with an ECDSA P-256 key.
+func (ca *LocalCA) generateRoot(now time.Time) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	name := ca.Name
+	if name == "" {
+		name = defaultLocalCAName
+	}
+	validity := ca.RootValidity
+	if validity <= 0 {
+		validity = defaultLocalCARootValidity
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// issue signs a certificate for the CSR with the CA and returns
+// the chain, without the CA certificate if it is a self-signed root.
+func (ca *LocalCA) issue(ctx context.Context, cache Cache, csr *x509.CertificateRequest, now time.Time) ([][]byte, error) {
+	caCert, caKey, err := ca.load(ctx, cache, now)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	validity := ca.Validity
+	if validity <= 0 {
+		validity = defaultLocalCAValidity
+	}
+	notAfter := now.Add(validity)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		// Leave some leeway for the clocks of the clients.
+		NotBefore:   now.Add(-5 * time.Minute),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	// Copy the extra extensions, such as the TLS Feature, but the
+	// subject alternative names which are built from the fields above.
+	for _, ext := range csr.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, ext)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, csr.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(caCert.RawIssuer, caCert.RawSubject) {
+		return [][]byte{der}, nil
+	}
+	return [][]byte{der, caCert.Raw}, nil
+}
+
+// LocalCARoot returns the PEM-encoded certificate of the first LocalCA
+// among the issuers of the Manager, to be installed in the trust stores of the clients.
+// The root is generated if it doesn't exist yet.
+func (m *Manager) LocalCARoot(ctx context.Context) ([]byte, error) {
+	for _, iss := range m.issuers() {
+		ca, ok := iss.(*LocalCA)
+		if !ok {
+			continue
+		}
+		cert, _, err := ca.load(ctx, m.Cache, m.now())
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), nil
+	}
+	return nil, errors.New("acme/autocert: no local CA configured")
+}
+
+// newSerialNumber returns a random 128-bit certificate serial number.
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// publicKeysEqual reports whether the public keys a and b are equal.
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
@@ -0,0 +1,164 @@
+package certmgr
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func TestLocalCA(t *testing.T) {
+	man := testManager(t)
+	man.LocalCA = &LocalCA{Validity: 24 * time.Hour}
+
+	for _, alg := range []algorithmSupport{algECDSA, algRSA} {
+		cert, err := man.GetCertificate(clientHelloInfo(exampleDomain, alg))
+		if err != nil {
+			t.Fatalf("GetCertificate: %v", err)
+		}
+		if len(cert.Certificate) != 1 {
+			t.Errorf("chain length = %d; want 1", len(cert.Certificate))
+		}
+		if d := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore); d > 24*time.Hour+5*time.Minute {
+			t.Errorf("validity = %v; want at most 24h5m", d)
+		}
+	}
+
+	root, err := man.LocalCARoot(context.Background())
+	if err != nil {
+		t.Fatalf("LocalCARoot: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(root) {
+		t.Fatalf("invalid root PEM:\n%s", root)
+	}
+	cert, err := man.GetCertificate(clientHelloInfo(exampleDomain, algECDSA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := x509.VerifyOptions{DNSName: exampleDomain, Roots: pool}
+	if _, err := cert.Leaf.Verify(opts); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if man.Cache.(*memCache).numCerts() != 2 {
+		t.Errorf("cached certs = %d; want 2", man.Cache.(*memCache).numCerts())
+	}
+
+	// The root is persisted in the cache.
+	man2 := testManager(t)
+	man2.Cache = man.Cache
+	man2.LocalCA = &LocalCA{}
+	root2, err := man2.LocalCARoot(context.Background())
+	if err != nil {
+		t.Fatalf("LocalCARoot: %v", err)
+	}
+	if string(root2) != string(root) {
+		t.Error("root was not loaded from the cache")
+	}
+}
+
+func TestLocalCAIntermediate(t *testing.T) {
+	newCA := func(name string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          randomSerial(),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	root, rootKey := newCA("root", nil, nil)
+	inter, interKey := newCA("intermediate", root, rootKey)
+
+	man := testManager(t)
+	man.LocalCA = &LocalCA{Cert: inter, Key: rootKey}
+	if _, err := man.GetCertificate(clientHelloInfo(exampleDomain, algECDSA)); err == nil {
+		t.Error("GetCertificate succeeded with a mismatched CA key")
+	}
+
+	man = testManager(t)
+	man.LocalCA = &LocalCA{Cert: inter, Key: interKey}
+	cert, err := man.GetCertificate(clientHelloInfo(exampleDomain, algECDSA))
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	// The leaf outlives neither the intermediate nor the configured validity.
+	if cert.Leaf.NotAfter.After(inter.NotAfter) {
+		t.Errorf("NotAfter = %v; want at most %v", cert.Leaf.NotAfter, inter.NotAfter)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Fatalf("chain length = %d; want 2", len(cert.Certificate))
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(inter)
+	opts := x509.VerifyOptions{DNSName: exampleDomain, Roots: roots, Intermediates: intermediates}
+	if _, err := cert.Leaf.Verify(opts); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if _, err := man.Cache.Get(context.Background(), localCACacheKey); err != ErrCacheMiss {
+		t.Errorf("configured CA was stored in the cache: %v", err)
+	}
+}
+
+func TestLocalCARenew(t *testing.T) {
+	man := testManager(t)
+	man.LocalCA = &LocalCA{}
+	man.state = make(map[certKey]*certState)
+
+	key, err := generateKey(exampleCertKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An almost expired certificate is renewed with the local CA.
+	man.nowFunc = func() time.Time { return time.Now().Add(-30 * 24 * time.Hour) }
+	der, leaf, _, err := man.authorizedCert(context.Background(), key, exampleCertKey, nil)
+	if err != nil {
+		t.Fatalf("authorizedCert: %v", err)
+	}
+	man.nowFunc = nil
+	s := &certState{key: key, cert: der, leaf: leaf}
+	tlscert, err := s.tlscert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := man.cachePut(context.Background(), exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+
+	dr := &domainRenewal{m: man, ck: exampleCertKey, key: key}
+	if _, err := dr.do(context.Background()); err != nil {
+		t.Fatalf("dr.do: %v", err)
+	}
+	renewed, err := man.cacheGet(context.Background(), exampleCertKey)
+	if err != nil {
+		t.Fatalf("cacheGet: %v", err)
+	}
+	if !renewed.Leaf.NotAfter.After(leaf.NotAfter) {
+		t.Errorf("NotAfter = %v; want after %v", renewed.Leaf.NotAfter, leaf.NotAfter)
+	}
+}
@@ -0,0 +1,238 @@
+package certmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/certmgr/internal/dnsutil"
+)
+
+const (
+	// defaultPropagationTimeout is the maximum amount of time waiting for
+	// a dns-01 challenge record to propagate, unless configured otherwise.
+	defaultPropagationTimeout = 2 * time.Minute
+
+	// defaultPropagationInterval is the time between two queries
+	// to a nameserver, unless configured otherwise.
+	defaultPropagationInterval = 2 * time.Second
+
+	// dnsQueryTimeout is the maximum amount of time waiting for
+	// the response to a single DNS query.
+	dnsQueryTimeout = 5 * time.Second
+)
+
+// DNSPropagation configures the check that the TXT record of a dns-01
+// challenge is served by the nameservers before the CA is asked to validate
+// it. Otherwise the CA may query a nameserver which is not up to date yet,
+// and the failed authorization counts against the rate limits.
+//
+// Once enabled, the check queries the authoritative nameservers of the zone
+// directly by default, every 2 seconds for up to 2 minutes.
+type DNSPropagation struct {
+	// Enable enables the check, which is disabled by default:
+	// the challenges are accepted as soon as the records are presented.
+	Enable bool
+
+	// Nameservers optionally lists the addresses of the DNS servers
+	// to query instead of the authoritative nameservers of the zone,
+	// such as "192.0.2.53:53". They may be recursive resolvers.
+	Nameservers []string
+
+	// Resolver optionally specifies the resolver used to find the
+	// authoritative nameservers of the zone and their addresses.
+	// If nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+
+	// Dial optionally specifies the dial function used to connect
+	// to the nameservers. If nil, a net.Dialer is used.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Timeout is the maximum amount of time waiting for the record
+	// to propagate. If zero, 2 minutes is used.
+	Timeout time.Duration
+
+	// Interval is the time between two queries to a nameserver
+	// which doesn't serve the record yet. If zero, 2 seconds is used.
+	Interval time.Duration
+}
+
+// nameserver is a DNS server queried by the propagation check.
+type nameserver struct {
+	name  string   // host name of an authoritative nameserver, if known
+	addrs []string // it's up to date as soon as any of them is
+	rd    bool     // whether to ask for recursion
+}
+
+func (ns *nameserver) String() string {
+	if ns.name == "" {
+		return strings.Join(ns.addrs, ", ")
+	}
+	return ns.name + " (" + strings.Join(ns.addrs, ", ") + ")"
+}
+
+// checkPropagation waits until the TXT record provisioned for the dns-01
+// challenge chal of the identifier is served, as configured by m.DNSPropagation.
+func (m *Manager) checkPropagation(ctx context.Context, client *acme.Client, chal *acme.Challenge, identifier string) error {
+	if !m.DNSPropagation.Enable {
+		return nil
+	}
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn, err := m.dns01Target(ctx, identifier)
+	if err != nil {
+		return err
+	}
+	return m.DNSPropagation.wait(ctx, fqdn, value)
+}
+
+// wait waits until every nameserver serves the TXT record with the given
+// value at fqdn. If the timeout expires, the error lists the stale ones.
+func (p *DNSPropagation) wait(ctx context.Context, fqdn, value string) error {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = defaultPropagationTimeout
+	}
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultPropagationInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	servers, err := p.nameservers(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	errs := make(map[*nameserver]error)
+	for {
+		servers = slices.DeleteFunc(servers, func(ns *nameserver) bool {
+			errs[ns] = p.check(ctx, ns, fqdn, value)
+			return errs[ns] == nil
+		})
+		if len(servers) == 0 {
+			return nil
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			stale := make([]string, len(servers))
+			for i, ns := range servers {
+				stale[i] = fmt.Sprintf("%s: %v", ns, errs[ns])
+			}
+			return fmt.Errorf("acme/autocert: TXT record at %s not propagated to nameservers %s", fqdn, strings.Join(stale, "; "))
+		case <-t.C:
+		}
+	}
+}
+
+// check reports whether ns serves the TXT record with the given value at fqdn.
+func (p *DNSPropagation) check(ctx context.Context, ns *nameserver, fqdn, value string) error {
+	var err error
+	for _, addr := range ns.addrs {
+		qctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+		var resp *dnsmessage.Message
+		resp, err = dnsutil.Query(qctx, p.Dial, addr, fqdn, dnsmessage.TypeTXT, ns.rd)
+		cancel()
+		if err != nil {
+			continue
+		}
+		if slices.Contains(dnsutil.TXT(resp, fqdn), value) {
+			return nil
+		}
+		err = fmt.Errorf("record not found (%s)", dnsutil.RCodeName(uint16(resp.RCode)))
+	}
+	return err
+}
+
+// lookupCNAME returns the target of the CNAME record at name in canonical
+// form, or an empty string if there's none or name doesn't exist. It asks the same nameservers
+// as the propagation check, so the answer is not stale.
+func (p *DNSPropagation) lookupCNAME(ctx context.Context, name string) (string, error) {
+	servers, err := p.nameservers(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	for _, ns := range servers {
+		for _, addr := range ns.addrs {
+			qctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+			var resp *dnsmessage.Message
+			resp, err = dnsutil.Query(qctx, p.Dial, addr, name, dnsmessage.TypeCNAME, ns.rd)
+			cancel()
+			if err != nil {
+				continue
+			}
+			if rc := resp.Header.RCode; rc != dnsmessage.RCodeSuccess && rc != dnsmessage.RCodeNameError {
+				err = fmt.Errorf("%s answered %s", addr, rc)
+				continue
+			}
+			for _, rr := range resp.Answers {
+				cname, ok := rr.Body.(*dnsmessage.CNAMEResource)
+				if ok && dnsutil.EqualNames(rr.Header.Name.String(), name) {
+					return strings.ToLower(cname.CNAME.String()), nil
+				}
+			}
+			return "", nil
+		}
+	}
+	return "", err
+}
+
+// nameservers returns the nameservers to query for the record at fqdn:
+// either p.Nameservers or the authoritative nameservers of the zone,
+// which is found by looking up the NS records of fqdn and its parents.
+func (p *DNSPropagation) nameservers(ctx context.Context, fqdn string) ([]*nameserver, error) {
+	var servers []*nameserver
+	if len(p.Nameservers) > 0 {
+		for _, addr := range p.Nameservers {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "53")
+			}
+			servers = append(servers, &nameserver{addrs: []string{addr}, rd: true})
+		}
+		return servers, nil
+	}
+
+	r := p.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	err := errors.New("no NS records")
+	for name := strings.TrimSuffix(fqdn, "."); name != ""; _, name, _ = strings.Cut(name, ".") {
+		var nss []*net.NS
+		nss, err = r.LookupNS(ctx, name)
+		if err != nil || len(nss) == 0 {
+			continue
+		}
+		if cname, err := r.LookupCNAME(ctx, name); err == nil && !dnsutil.EqualNames(cname, name) {
+			// An alias can't have NS records: they are those of its target.
+			continue
+		}
+		for _, ns := range nss {
+			addrs, err := r.LookupHost(ctx, ns.Host)
+			if err != nil {
+				// The CA can't use it either.
+				continue
+			}
+			for i, a := range addrs {
+				addrs[i] = net.JoinHostPort(a, "53")
+			}
+			servers = append(servers, &nameserver{name: ns.Host, addrs: addrs})
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("acme/autocert: no address found for the nameservers of %s", name)
+		}
+		return servers, nil
+	}
+	return nil, fmt.Errorf("acme/autocert: no nameservers found for %s: %v", fqdn, err)
+}
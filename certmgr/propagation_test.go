@@ -0,0 +1,96 @@
+package certmgr
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/For-ACGN/autocert/certmgr/internal/dnstest"
+)
+
+const testFQDN = "_acme-challenge.example.org."
+
+func TestDNSPropagationNameservers(t *testing.T) {
+	ns1 := dnstest.NewServer(t)
+	ns2 := dnstest.NewServer(t)
+	ns1.Present(context.Background(), testFQDN, "value")
+	p := &DNSPropagation{
+		Nameservers: []string{ns1.Addr(), ns2.Addr()},
+		Timeout:     200 * time.Millisecond,
+		Interval:    10 * time.Millisecond,
+	}
+
+	err := p.wait(context.Background(), testFQDN, "value")
+	if err == nil {
+		t.Fatal("wait: expected error for stale nameserver")
+	}
+	if msg := err.Error(); !strings.Contains(msg, ns2.Addr()) || strings.Contains(msg, ns1.Addr()) {
+		t.Errorf("wait: %v; want error naming only %s", err, ns2.Addr())
+	}
+
+	// The record shows up while waiting.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ns2.Present(context.Background(), testFQDN, "value")
+	}()
+	p.Timeout = 10 * time.Second
+	if err := p.wait(context.Background(), testFQDN, "value"); err != nil {
+		t.Errorf("wait: %v", err)
+	}
+}
+
+func TestDNSPropagationAuthoritative(t *testing.T) {
+	// The resolver knows the delegation of the zone,
+	// which is served by ns1 and ns2.
+	resolver := dnstest.NewServer(t)
+	resolver.AddNS("example.org", "ns1.example.org", "192.0.2.1")
+	resolver.AddNS("example.org", "ns2.example.org", "192.0.2.2")
+	ns1 := dnstest.NewServer(t)
+	ns2 := dnstest.NewServer(t)
+	ns1.Present(context.Background(), testFQDN, "value")
+	ns2.Present(context.Background(), testFQDN, "stale")
+
+	p := &DNSPropagation{
+		Resolver: resolver.Resolver(),
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			switch address {
+			case "192.0.2.1:53":
+				return ns1.Dial(ctx, network, address)
+			case "192.0.2.2:53":
+				return ns2.Dial(ctx, network, address)
+			}
+			t.Errorf("unexpected nameserver address %q", address)
+			return nil, net.UnknownNetworkError(address)
+		},
+		Timeout:  200 * time.Millisecond,
+		Interval: 10 * time.Millisecond,
+	}
+	err := p.wait(context.Background(), testFQDN, "value")
+	if err == nil {
+		t.Fatal("wait: expected error for stale nameserver")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "ns2.example.org. (192.0.2.2:53)") || strings.Contains(msg, "ns1") {
+		t.Errorf("wait: %v; want error naming only ns2.example.org", err)
+	}
+
+	ns2.CleanUp(context.Background(), testFQDN, "stale")
+	ns2.Present(context.Background(), testFQDN, "value")
+	if err := p.wait(context.Background(), testFQDN, "value"); err != nil {
+		t.Errorf("wait: %v", err)
+	}
+	if ns1.Queries() == 0 || ns2.Queries() == 0 {
+		t.Error("the nameservers were not queried directly")
+	}
+}
+
+func TestDNSPropagationNoNameservers(t *testing.T) {
+	p := &DNSPropagation{
+		Resolver: dnstest.NewServer(t).Resolver(),
+		Timeout:  time.Second,
+	}
+	if err := p.wait(context.Background(), testFQDN, "value"); err == nil {
+		t.Error("wait: expected error for missing nameservers")
+	}
+}
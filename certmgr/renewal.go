@@ -7,13 +7,28 @@ package certmgr
 import (
 	"context"
 	"crypto"
+	"crypto/x509"
 	"sync"
 	"time"
+
+	"github.com/For-ACGN/autocert/acme"
 )
 
 // renewJitter is the maximum deviation from Manager.RenewBefore.
 const renewJitter = time.Hour
 
+// defaultRenewalRatio is the fraction of the validity period of certificates
+// which remains when they are renewed, unless configured otherwise.
+const defaultRenewalRatio = 1.0 / 3
+
+// renewalInfoDelay is the maximum delay before the renewal information
+// of a newly tracked certificate is polled for the first time.
+const renewalInfoDelay = time.Hour
+
+// renewalInfoRetry is how long to wait before polling the renewal information
+// again when the CA doesn't specify a Retry-After or the request failed.
+const renewalInfoRetry = 6 * time.Hour
+
 // domainRenewal tracks the state used by the periodic timers
 // renewing a single domain's cert.
 type domainRenewal struct {
@@ -24,19 +39,31 @@ type domainRenewal struct {
 	timerMu    sync.Mutex
 	timer      *time.Timer
 	timerClose chan struct{} // if non-nil, renew closes this channel (and nils out the timer fields) instead of running
+
+	// The following fields are guarded by timerMu.
+	poll      bool               // the timer fires only to poll the renewal information
+	ariWindow acme.RenewalWindow // last renewal window suggested by the CA
+	ariTime   time.Time          // renewal time selected within ariWindow
+	keyInfo   *keyInfo           // lifecycle of key, in case there's no cache
 }
 
 // start starts a cert renewal timer at the time
-// defined by the certificate expiration time exp.
+// defined by the validity period of the certificate leaf.
 //
 // If the timer is already started, calling start is a noop.
-func (dr *domainRenewal) start(exp time.Time) {
+func (dr *domainRenewal) start(leaf *x509.Certificate) {
 	dr.timerMu.Lock()
 	defer dr.timerMu.Unlock()
 	if dr.timer != nil {
 		return
 	}
-	dr.timer = time.AfterFunc(dr.next(exp), dr.renew)
+	next := dr.next(leaf)
+	// Poll the renewal information soon, since the CA may want
+	// the certificate to be renewed well before the usual deadline.
+	if d := time.Duration(pseudoRand.int63n(int64(renewalInfoDelay))); d < next {
+		next, dr.poll = d, true
+	}
+	dr.timer = time.AfterFunc(next, dr.renew)
 }
 
 // stop stops the cert renewal timer and waits for any in-flight calls to renew
@@ -76,7 +103,6 @@ func (dr *domainRenewal) renew() {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
-	// TODO: rotate dr.key at some point?
 	next, err := dr.do(ctx)
 	if err != nil {
 		next = renewJitter / 2
@@ -100,15 +126,19 @@ func (dr *domainRenewal) updateState(state *certState) {
 // replaces dr.m.state item with a new one and updates cache for the given domain.
 //
 // It may lock and update the Manager.state if the expiration date of the currently
-// cached cert is far enough in the future.
+// cached cert is far enough in the future, or if the CA doesn't want it renewed yet.
 //
 // The returned value is a time interval after which the renewal should occur again.
 func (dr *domainRenewal) do(ctx context.Context) (time.Duration, error) {
+	poll := dr.poll
+	dr.poll = false
+
 	// a race is likely unavoidable in a distributed environment
 	// but we try nonetheless
+	var replaces *x509.Certificate
 	if tlscert, err := dr.m.cacheGet(ctx, dr.ck); err == nil {
-		next := dr.next(tlscert.Leaf.NotAfter)
-		if next > dr.m.renewBefore()+renewJitter {
+		replaces = tlscert.Leaf
+		if next, due := dr.schedule(ctx, tlscert.Leaf, poll); !due {
 			signer, ok := tlscert.PrivateKey.(crypto.Signer)
 			if ok {
 				state := &certState{
@@ -120,16 +150,26 @@ func (dr *domainRenewal) do(ctx context.Context) (time.Duration, error) {
 				return next, nil
 			}
 		}
+	} else if leaf := dr.leaf(); leaf != nil {
+		replaces = leaf
+		if next, due := dr.schedule(ctx, leaf, poll); !due {
+			return next, nil
+		}
 	}
 
-	der, leaf, err := dr.m.authorizedCert(ctx, dr.key, dr.ck)
+	key, info, rotate, err := dr.nextKey(ctx, replaces)
+	if err != nil {
+		return 0, err
+	}
+	der, leaf, issuer, err := dr.m.authorizedCert(ctx, key, dr.ck, replaces)
 	if err != nil {
 		return 0, err
 	}
 	state := &certState{
-		key:  dr.key,
-		cert: der,
-		leaf: leaf,
+		key:    key,
+		cert:   der,
+		leaf:   leaf,
+		issuer: issuer,
 	}
 	tlscert, err := state.tlscert()
 	if err != nil {
@@ -138,12 +178,141 @@ func (dr *domainRenewal) do(ctx context.Context) (time.Duration, error) {
 	if err := dr.m.cachePut(ctx, dr.ck, tlscert); err != nil {
 		return 0, err
 	}
+	dr.keyInfo = info
+	dr.m.putKeyInfo(ctx, dr.ck, info)
+	dr.m.putCertIssuer(ctx, dr.ck, issuer)
 	dr.updateState(state)
-	return dr.next(leaf.NotAfter), nil
+	if rotate && dr.m.OnRotateKey != nil {
+		dr.m.OnRotateKey(dr.ck.domain, tlscert)
+	}
+	next, due := dr.schedule(ctx, leaf, false)
+	if due {
+		// Don't hammer the CA if it wants a brand new certificate
+		// to be renewed right away.
+		dr.poll = false
+		next = dr.next(leaf)
+	}
+	return next, nil
+}
+
+// nextKey returns the private key to use for the renewal of the current
+// certificate, and the lifecycle of that key after the renewal.
+// The rotate result reports whether it is a new key, according to
+// the Manager's KeyRotation policy.
+func (dr *domainRenewal) nextKey(ctx context.Context, current *x509.Certificate) (key crypto.Signer, info *keyInfo, rotate bool, err error) {
+	info, err = dr.m.keyInfo(ctx, dr.ck)
+	switch {
+	case err == nil:
+	case dr.keyInfo != nil:
+		info = dr.keyInfo
+	case current != nil:
+		// The key is at least as old as the certificate.
+		info = &keyInfo{Created: current.NotBefore}
+	default:
+		info = &keyInfo{Created: dr.m.now()}
+	}
+
+	now := dr.m.now()
+	if !dr.m.KeyRotation.due(info, now) {
+		return dr.key, &keyInfo{Created: info.Created, Renewals: info.Renewals + 1}, false, nil
+	}
+	key, err = generateKey(dr.ck)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return key, &keyInfo{Created: now}, true, nil
+}
+
+// leaf returns the certificate currently served for dr.ck, if any.
+func (dr *domainRenewal) leaf() *x509.Certificate {
+	dr.m.stateMu.Lock()
+	s, ok := dr.m.state[dr.ck]
+	dr.m.stateMu.Unlock()
+	if !ok {
+		return nil
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return s.leaf
+}
+
+// schedule returns a time interval after which the renewal timer of leaf
+// should fire, and reports whether leaf is due for renewal now.
+//
+// If the CA provides ACME Renewal Information, the renewal is due at a random
+// time within the window suggested by the CA, and the timer fires earlier
+// if the CA wants the window to be polled again in the meantime.
+// Otherwise, the renewal is due as computed by dr.next, unless poll is true
+// which means the timer fired only to poll the renewal information.
+func (dr *domainRenewal) schedule(ctx context.Context, leaf *x509.Certificate, poll bool) (time.Duration, bool) {
+	next := dr.next(leaf)
+	due := !poll && next <= renewJitter
+
+	ri, supported, err := dr.renewalInfo(ctx, leaf)
+	if !supported {
+		return next, due
+	}
+	if err != nil {
+		// Try again later without delaying the usual renewal.
+		if !due && renewalInfoRetry < next {
+			next, dr.poll = renewalInfoRetry, true
+		}
+		return next, due
+	}
+
+	d := dr.renewalTime(ri.SuggestedWindow).Sub(dr.m.now())
+	if d <= 0 {
+		return 0, true
+	}
+	retry := ri.RetryAfter
+	if retry <= 0 {
+		retry = renewalInfoRetry
+	}
+	if retry < d {
+		d, dr.poll = retry, true
+	}
+	return d, false
+}
+
+// renewalInfo fetches the ACME Renewal Information of leaf from its issuer.
+// The supported result reports whether the CA is known to provide it.
+func (dr *domainRenewal) renewalInfo(ctx context.Context, leaf *x509.Certificate) (ri *acme.RenewalInfo, supported bool, err error) {
+	iss, ok := dr.m.issuer(dr.m.certIssuer(ctx, dr.ck))
+	if !ok {
+		return nil, false, nil
+	}
+	a, ok := iss.(*ACMEIssuer)
+	if !ok {
+		return nil, false, nil
+	}
+	client := a.anonClient()
+	dir, err := client.Discover(ctx)
+	if err != nil || dir.RenewalInfoURL == "" {
+		return nil, false, err
+	}
+	ri, err = client.GetRenewalInfo(ctx, leaf)
+	return ri, true, err
+}
+
+// renewalTime returns a random time within the suggested renewal window w.
+// The time is selected once per window, so polling the renewal information
+// again doesn't move the renewal unless the CA changes the window.
+func (dr *domainRenewal) renewalTime(w acme.RenewalWindow) time.Time {
+	if w.Start.Equal(dr.ariWindow.Start) && w.End.Equal(dr.ariWindow.End) && !dr.ariTime.IsZero() {
+		return dr.ariTime
+	}
+	t := w.Start
+	if d := w.End.Sub(w.Start); d > 0 {
+		t = t.Add(time.Duration(pseudoRand.int63n(int64(d))))
+	}
+	dr.ariWindow, dr.ariTime = w, t
+	return t
 }
 
-func (dr *domainRenewal) next(expiry time.Time) time.Duration {
-	d := expiry.Sub(dr.m.now()) - dr.m.renewBefore()
+// next returns the time interval after which the leaf should be renewed,
+// which is Manager.renewBefore its expiration minus a random jitter.
+func (dr *domainRenewal) next(leaf *x509.Certificate) time.Duration {
+	d := leaf.NotAfter.Sub(dr.m.now()) - dr.m.renewBefore(leaf)
 	// add a bit of randomness to renew deadline
 	n := pseudoRand.int63n(int64(renewJitter))
 	d -= time.Duration(n)
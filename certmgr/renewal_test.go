@@ -8,11 +8,12 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/x509"
 	"testing"
 	"time"
 
 	"github.com/For-ACGN/autocert/acme"
-	"github.com/For-ACGN/autocert/certmgr/internal/acmetest"
+	"github.com/For-ACGN/autocert/acme/acmetest"
 )
 
 func TestRenewalNext(t *testing.T) {
@@ -34,13 +35,55 @@ func TestRenewalNext(t *testing.T) {
 
 	dr := &domainRenewal{m: man}
 	for i, test := range tt {
-		next := dr.next(test.expiry)
+		leaf := &x509.Certificate{NotBefore: now.Add(-time.Hour), NotAfter: test.expiry}
+		next := dr.next(leaf)
 		if next < test.min || test.max < next {
 			t.Errorf("%d: next = %v; want between %v and %v", i, next, test.min, test.max)
 		}
 	}
 }
 
+func TestRenewalNextRatio(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	tt := []struct {
+		ratio     float64
+		notBefore time.Time
+		notAfter  time.Time
+		min, max  time.Duration
+	}{
+		// a third of the validity period by default
+		{0, now, now.Add(90 * day), 60*day - renewJitter, 60 * day},
+		{0, now, now.Add(6 * day), 4*day - renewJitter, 4 * day},
+		{0, now.Add(-3 * day), now.Add(3 * day), day - renewJitter, day},
+		{0.5, now, now.Add(6 * day), 3*day - renewJitter, 3 * day},
+		{2, now, now.Add(90 * day), 60*day - renewJitter, 60 * day},
+		{0, now.Add(-5 * day), now.Add(day), 0, 1},
+	}
+	for i, test := range tt {
+		man := &Manager{
+			RenewalRatio: test.ratio,
+			nowFunc:      func() time.Time { return now },
+		}
+		dr := &domainRenewal{m: man}
+		next := dr.next(&x509.Certificate{NotBefore: test.notBefore, NotAfter: test.notAfter})
+		if next < test.min || test.max < next {
+			t.Errorf("%d: next = %v; want between %v and %v", i, next, test.min, test.max)
+		}
+	}
+
+	// RenewBefore overrides the ratio.
+	man := &Manager{
+		RenewBefore:  7 * day,
+		RenewalRatio: 0.5,
+		nowFunc:      func() time.Time { return now },
+	}
+	leaf := &x509.Certificate{NotBefore: now, NotAfter: now.Add(90 * day)}
+	if got := man.renewBefore(leaf); got != 7*day {
+		t.Errorf("renewBefore = %v; want %v", got, 7*day)
+	}
+}
+
 func TestRenewFromCache(t *testing.T) {
 	man := testManager(t)
 	man.RenewBefore = 24 * time.Hour
@@ -126,6 +169,33 @@ func TestRenewFromCache(t *testing.T) {
 	<-renewed
 }
 
+func TestRenewFreshCertRatio(t *testing.T) {
+	ca := acmetest.NewCAServer(t).Start()
+	man := testManager(t)
+	man.RenewalRatio = 0.5
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+	man.state = make(map[certKey]*certState)
+
+	// cache a fresh cert, renewed in about 45 days
+	now := time.Now()
+	c := ca.LeafCert(exampleDomain, "ECDSA", now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	if err := man.cachePut(context.Background(), exampleCertKey, c); err != nil {
+		t.Fatal(err)
+	}
+
+	dr := &domainRenewal{m: man, ck: exampleCertKey, key: c.PrivateKey.(crypto.Signer)}
+	next, err := dr.do(context.Background())
+	if err != nil {
+		t.Fatalf("dr.do: %v", err)
+	}
+	if n := len(ca.IssuedCerts()); n != 0 {
+		t.Errorf("CA issued %d certs; want 0", n)
+	}
+	if min := 44 * 24 * time.Hour; next < min {
+		t.Errorf("next = %v; want >= %v", next, min)
+	}
+}
+
 func TestRenewFromCacheAlreadyRenewed(t *testing.T) {
 	ca := acmetest.NewCAServer(t).Start()
 	man := testManager(t)
@@ -239,7 +309,7 @@ func TestRenewFromCacheAlreadyRenewed(t *testing.T) {
 	}
 
 	// trigger renew
-	man.startRenew(exampleCertKey, s.key, s.leaf.NotAfter)
+	man.startRenew(exampleCertKey, s.key, s.leaf)
 	<-renewed
 	func() {
 		man.renewalMu.Lock()
@@ -267,3 +337,91 @@ func TestRenewFromCacheAlreadyRenewed(t *testing.T) {
 		t.Errorf("state leaf.NotAfter = %v; want == %v", tlscert.Leaf.NotAfter, newLeaf.NotAfter)
 	}
 }
+
+func TestRenewFromRenewalInfo(t *testing.T) {
+	now := time.Now()
+	ca := acmetest.NewCAServer(t).RenewalWindow(now.Add(-2*time.Hour), now.Add(-time.Hour)).Start()
+	man := testManager(t)
+	man.Client = &acme.Client{
+		DirectoryURL: ca.URL(),
+	}
+	ca.ResolveGetCertificate(exampleDomain, man.GetCertificate)
+
+	// cache a cert which is far from expiring but the CA wants it renewed
+	c := ca.LeafCert(exampleDomain, "ECDSA", now.Add(-2*time.Hour), now.Add(90*24*time.Hour))
+	if err := man.cachePut(context.Background(), exampleCertKey, c); err != nil {
+		t.Fatal(err)
+	}
+	oldLeaf, err := validCert(exampleCertKey, c.Certificate, c.PrivateKey.(crypto.Signer), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certID, err := acme.RenewalInfoCertID(oldLeaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	man.state = make(map[certKey]*certState)
+	dr := &domainRenewal{m: man, ck: exampleCertKey, key: c.PrivateKey.(crypto.Signer)}
+	next, err := dr.do(context.Background())
+	if err != nil {
+		t.Fatalf("dr.do: %v", err)
+	}
+	// The window of the new cert has passed as well,
+	// so the next renewal falls back to a third of its validity.
+	future := 59 * 24 * time.Hour
+	if next < future {
+		t.Errorf("next = %v; want >= %v", next, future)
+	}
+	if replaces := ca.Replaces(); len(replaces) != 1 || replaces[0] != certID {
+		t.Errorf("replaces = %q; want [%q]", replaces, certID)
+	}
+	tlscert, err := man.cacheGet(context.Background(), exampleCertKey)
+	if err != nil {
+		t.Fatalf("man.cacheGet: %v", err)
+	}
+	if tlscert.Leaf.SerialNumber.Cmp(oldLeaf.SerialNumber) == 0 {
+		t.Error("cached cert was not renewed")
+	}
+}
+
+func TestRenewalInfoWindow(t *testing.T) {
+	now := time.Now()
+	start, end := now.Add(time.Hour), now.Add(2*time.Hour)
+	ca := acmetest.NewCAServer(t).RenewalWindow(start, end).Start()
+	man := testManager(t)
+	man.Client = &acme.Client{
+		DirectoryURL: ca.URL(),
+	}
+
+	c := ca.LeafCert(exampleDomain, "ECDSA", now.Add(-2*time.Hour), now.Add(90*24*time.Hour))
+	if err := man.cachePut(context.Background(), exampleCertKey, c); err != nil {
+		t.Fatal(err)
+	}
+
+	man.state = make(map[certKey]*certState)
+	dr := &domainRenewal{m: man, ck: exampleCertKey, key: c.PrivateKey.(crypto.Signer)}
+	next, err := dr.do(context.Background())
+	if err != nil {
+		t.Fatalf("dr.do: %v", err)
+	}
+	if next <= 0 || 2*time.Hour < next {
+		t.Errorf("next = %v; want within the suggested window", next)
+	}
+	if dr.ariTime.Before(start) || dr.ariTime.After(end) {
+		t.Errorf("renewal time %v is not within %v - %v", dr.ariTime, start, end)
+	}
+	if replaces := ca.Replaces(); len(replaces) != 0 {
+		t.Errorf("replaces = %q; want none", replaces)
+	}
+	// The renewal information doesn't require an account.
+	if _, err := man.Cache.Get(context.Background(), accountKeyName); err != ErrCacheMiss {
+		t.Errorf("account key cached while polling the renewal information: %v", err)
+	}
+
+	// Polling the same window again must not move the renewal time.
+	at := dr.ariTime
+	if got := dr.renewalTime(dr.ariWindow); !got.Equal(at) {
+		t.Errorf("renewalTime = %v; want %v", got, at)
+	}
+}
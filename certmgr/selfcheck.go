@@ -0,0 +1,238 @@
+package certmgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+)
+
+// defaultSelfCheckTimeout is the maximum amount of time spent checking
+// the response to a challenge, unless configured otherwise.
+const defaultSelfCheckTimeout = 10 * time.Second
+
+// maxSelfCheckRedirects is the number of redirects followed by the http-01
+// self-check, the same as Let's Encrypt.
+const maxSelfCheckRedirects = 10
+
+// idPeACMEIdentifier is the OID of the acmeIdentifier extension of the
+// tls-alpn-01 challenge certificates, see RFC 8737, Section 6.1.
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// SelfCheck configures the check that the responses to the http-01 and
+// tls-alpn-01 challenges are reachable at the addresses of the identifier
+// before the CA is asked to validate them. If port 80 or 443 isn't
+// reachable, because of NAT or a firewall for instance, the Manager moves
+// on to the next challenge type instead of creating a failed authorization.
+//
+// The check succeeds if any of the addresses serves the expected response.
+// It runs from the host itself, which may reach addresses the CA can't,
+// so it only catches the most common misconfigurations.
+type SelfCheck struct {
+	// Enable enables the check, which is disabled by default.
+	Enable bool
+
+	// Resolver optionally specifies the resolver used to find the
+	// addresses of the domains. If nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+
+	// Dial optionally specifies the dial function used to connect
+	// to the addresses. If nil, a net.Dialer is used.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Timeout is the maximum amount of time spent checking the response
+	// to a challenge. If zero, 10 seconds is used.
+	Timeout time.Duration
+}
+
+// selfCheck checks that the response to the challenge chal of the identifier
+// is reachable, as configured by m.SelfCheck. Other challenge types than
+// http-01 and tls-alpn-01 are not checked.
+func (m *Manager) selfCheck(ctx context.Context, client *acme.Client, chal *acme.Challenge, identifier string) error {
+	c := &m.SelfCheck
+	if !c.Enable || (chal.Type != "http-01" && chal.Type != "tls-alpn-01") {
+		return nil
+	}
+	keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultSelfCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var addrs []string
+	if ip, ok := parseIP(identifier); ok {
+		addrs = []string{ip}
+	} else {
+		addrs, err = c.resolver().LookupHost(ctx, identifier)
+		if err != nil {
+			return fmt.Errorf("acme/autocert: %s self-check failed for %s: %v", chal.Type, identifier, err)
+		}
+	}
+	var errs []string
+	for _, addr := range addrs {
+		if chal.Type == "http-01" {
+			err = c.checkHTTP01(ctx, addr, identifier, client.HTTP01ChallengePath(chal.Token), keyAuth)
+		} else {
+			err = c.checkTLSALPN01(ctx, addr, identifier, keyAuth)
+		}
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, addr+": "+err.Error())
+	}
+	return fmt.Errorf("acme/autocert: %s self-check failed for %s: %s", chal.Type, identifier, strings.Join(errs, "; "))
+}
+
+// checkHTTP01 fetches the response to the http-01 challenge from the
+// address addr of the identifier and compares it to keyAuth.
+// Redirects are followed as RFC 8555, Section 8.3 allows, only to http
+// on port 80 and https on port 443, without verifying certificates.
+func (c *SelfCheck) checkHTTP01(ctx context.Context, addr, identifier, path, keyAuth string) error {
+	host := identifier
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	dial := c.dialer()
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// connect to addr rather than any address of the identifier
+			if address == net.JoinHostPort(identifier, "80") {
+				address = net.JoinHostPort(addr, "80")
+			}
+			return dial(ctx, network, address)
+		},
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}
+	defer tr.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+host+path, nil)
+	if err != nil {
+		return err
+	}
+	hc := &http.Client{
+		Transport: tr,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxSelfCheckRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxSelfCheckRedirects)
+			}
+			return checkSelfCheckRedirect(req.URL)
+		},
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if err != nil {
+		return err
+	}
+	if got := strings.TrimSpace(string(body)); got != keyAuth {
+		return fmt.Errorf("unexpected response %q", got)
+	}
+	return nil
+}
+
+// checkSelfCheckRedirect reports an error if the http-01 self-check
+// can't be redirected to u, which a CA wouldn't follow.
+func checkSelfCheckRedirect(u *url.URL) error {
+	var want string
+	switch u.Scheme {
+	case "http":
+		want = "80"
+	case "https":
+		want = "443"
+	default:
+		return fmt.Errorf("redirect to unsupported scheme %q", u.Scheme)
+	}
+	if p := u.Port(); p != "" && p != want {
+		return fmt.Errorf("redirect to unsupported port %s", p)
+	}
+	return nil
+}
+
+// checkTLSALPN01 connects to the address addr of the identifier with the
+// acme-tls/1 protocol and checks the challenge certificate against keyAuth.
+func (c *SelfCheck) checkTLSALPN01(ctx context.Context, addr, identifier, keyAuth string) error {
+	serverName := identifier
+	ip, err := netip.ParseAddr(identifier)
+	isIP := err == nil
+	if isIP {
+		serverName = reverseName(ip)
+	}
+	conn, err := c.dialer()(ctx, "tcp", net.JoinHostPort(addr, "443"))
+	if err != nil {
+		return err
+	}
+	tc := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         []string{acme.ALPNProto},
+		InsecureSkipVerify: true, // the challenge certificate is self-signed
+	})
+	defer tc.Close()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	cs := tc.ConnectionState()
+	if cs.NegotiatedProtocol != acme.ALPNProto {
+		return fmt.Errorf("%s protocol not negotiated", acme.ALPNProto)
+	}
+	cert := cs.PeerCertificates[0]
+	if isIP {
+		if !slices.ContainsFunc(cert.IPAddresses, func(a net.IP) bool { return a.Equal(ip.AsSlice()) }) {
+			return errors.New("challenge certificate not for " + identifier)
+		}
+	} else if !slices.Contains(cert.DNSNames, identifier) {
+		return errors.New("challenge certificate not for " + identifier)
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	want, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return err
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(idPeACMEIdentifier) {
+			if !bytes.Equal(ext.Value, want) {
+				return errors.New("unexpected key authorization in the challenge certificate")
+			}
+			return nil
+		}
+	}
+	return errors.New("no acmeIdentifier extension in the challenge certificate")
+}
+
+func (c *SelfCheck) resolver() *net.Resolver {
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (c *SelfCheck) dialer() func(ctx context.Context, network, address string) (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial
+	}
+	d := &net.Dialer{Resolver: c.Resolver}
+	return d.DialContext
+}
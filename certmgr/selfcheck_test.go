@@ -0,0 +1,201 @@
+package certmgr
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/acme/acmetest"
+	"github.com/For-ACGN/autocert/certmgr/internal/dnstest"
+)
+
+// selfCheckHost serves the responses to the challenges of a Manager
+// on its own listeners, reachable by SelfCheck.Dial at 192.0.2.1.
+type selfCheckHost struct {
+	http, tls string // listener addresses, empty if unreachable
+
+	mu    sync.Mutex
+	dials []string
+}
+
+func startSelfCheckHost(t *testing.T, man *Manager, http, tls bool) *selfCheckHost {
+	h := new(selfCheckHost)
+	if http {
+		s := httptest.NewServer(man.HTTPHandler(nil))
+		t.Cleanup(s.Close)
+		h.http = s.Listener.Addr().String()
+	}
+	if tls {
+		s := httptest.NewUnstartedServer(nil)
+		s.TLS = man.TLSConfig()
+		s.StartTLS()
+		t.Cleanup(s.Close)
+		h.tls = s.Listener.Addr().String()
+	}
+	return h
+}
+
+func (h *selfCheckHost) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	h.mu.Lock()
+	h.dials = append(h.dials, address)
+	h.mu.Unlock()
+	var addr string
+	switch address {
+	case "192.0.2.1:80":
+		addr = h.http
+	case "192.0.2.1:443":
+		addr = h.tls
+	}
+	if addr == "" {
+		return nil, errors.New("connection refused")
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func (h *selfCheckHost) dialed(port string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, addr := range h.dials {
+		if strings.HasSuffix(addr, ":"+port) {
+			return true
+		}
+	}
+	return false
+}
+
+func testSelfCheckDNS(t *testing.T) *dnstest.Server {
+	dns := dnstest.NewServer(t)
+	dns.Add("example.org", &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	return dns
+}
+
+func TestSelfCheck(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{Key: key}
+	dns := testSelfCheckDNS(t)
+
+	tt := []struct {
+		name       string
+		typ        string
+		identifier string
+		http, tls  bool
+		present    bool // the response to the challenge
+		wantErr    string
+	}{
+		{name: "http-01", typ: "http-01", identifier: "example.org", http: true, present: true},
+		{name: "http-01 IP", typ: "http-01", identifier: "192.0.2.1", http: true, present: true},
+		{name: "http-01 missing", typ: "http-01", identifier: "example.org", http: true, wantErr: "404 Not Found"},
+		{name: "http-01 unreachable", typ: "http-01", identifier: "example.org", tls: true, present: true, wantErr: "connection refused"},
+		{name: "tls-alpn-01", typ: "tls-alpn-01", identifier: "example.org", tls: true, present: true},
+		{name: "tls-alpn-01 IP", typ: "tls-alpn-01", identifier: "192.0.2.1", tls: true, present: true},
+		{name: "tls-alpn-01 missing", typ: "tls-alpn-01", identifier: "example.org", tls: true, wantErr: "192.0.2.1: "},
+		{name: "tls-alpn-01 unreachable", typ: "tls-alpn-01", identifier: "example.org", http: true, present: true, wantErr: "connection refused"},
+		{name: "unresolved", typ: "http-01", identifier: "www.example.org", http: true, present: true, wantErr: "self-check failed for www.example.org"},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			man := testManager(t)
+			host := startSelfCheckHost(t, man, test.http, test.tls)
+			man.SelfCheck = SelfCheck{Enable: true, Resolver: dns.Resolver(), Dial: host.dial}
+			chal := &acme.Challenge{Type: test.typ, Token: "token"}
+			if test.present {
+				cleanup, err := man.fulfill(context.Background(), client, chal, test.identifier)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer cleanup()
+			}
+			err := man.selfCheck(context.Background(), client, chal, test.identifier)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("selfCheck: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("selfCheck: %v; want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+
+	// The check is disabled by default, and not done for dns-01.
+	man := testManager(t)
+	chal := &acme.Challenge{Type: "http-01", Token: "token"}
+	if err := man.selfCheck(context.Background(), client, chal, "example.org"); err != nil {
+		t.Errorf("selfCheck: %v", err)
+	}
+	man.SelfCheck.Enable = true
+	chal.Type = "dns-01"
+	if err := man.selfCheck(context.Background(), client, chal, "example.org"); err != nil {
+		t.Errorf("selfCheck: %v", err)
+	}
+}
+
+func TestCheckSelfCheckRedirect(t *testing.T) {
+	tt := []struct {
+		url string
+		ok  bool
+	}{
+		{"http://example.org/.well-known/acme-challenge/token", true},
+		{"http://example.org:80/.well-known/acme-challenge/token", true},
+		{"https://example.org/.well-known/acme-challenge/token", true},
+		{"https://example.org:443/.well-known/acme-challenge/token", true},
+		{"http://example.org:8080/.well-known/acme-challenge/token", false},
+		{"https://example.org:80/.well-known/acme-challenge/token", false},
+		{"http://example.org:443/.well-known/acme-challenge/token", false},
+		{"ftp://example.org/.well-known/acme-challenge/token", false},
+	}
+	for _, test := range tt {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkSelfCheckRedirect(u); (err == nil) != test.ok {
+			t.Errorf("checkSelfCheckRedirect(%s): %v; want ok = %v", test.url, err, test.ok)
+		}
+	}
+}
+
+func TestGetCertificateSelfCheck(t *testing.T) {
+	ca := acmetest.NewCAServer(t).Start()
+	man := testManager(t)
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+	// Port 443 isn't reachable, so tls-alpn-01 is skipped for http-01.
+	host := startSelfCheckHost(t, man, true, false)
+	man.SelfCheck = SelfCheck{Enable: true, Resolver: testSelfCheckDNS(t).Resolver(), Dial: host.dial}
+	ca.ResolveHandler("example.org", man.HTTPHandler(nil))
+
+	if _, err := man.GetCertificate(clientHelloInfo("example.org", algECDSA)); err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if !host.dialed("443") || !host.dialed("80") {
+		t.Errorf("dials = %q; want both ports", host.dials)
+	}
+
+	// Without any reachable port, the CA isn't asked to validate anything.
+	ca = acmetest.NewCAServer(t).Start()
+	man = testManager(t)
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+	man.HTTPHandler(nil)
+	host = startSelfCheckHost(t, man, false, false)
+	man.SelfCheck = SelfCheck{Enable: true, Resolver: testSelfCheckDNS(t).Resolver(), Dial: host.dial}
+	_, err := man.GetCertificate(clientHelloInfo("example.org", algECDSA))
+	if err == nil || !strings.Contains(err.Error(), "self-check failed") {
+		t.Fatalf("GetCertificate: %v; want self-check error", err)
+	}
+}
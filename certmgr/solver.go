@@ -0,0 +1,157 @@
+package certmgr
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+)
+
+// ChallengeSolver provisions the responses to the ACME challenges of one type,
+// such as "http-01". See RFC 8555, Section 8 for more details.
+//
+// The client passed to the methods is the one of the Manager, which holds
+// the account key needed to compute the responses, for instance with
+// Client.HTTP01ChallengeResponse.
+//
+// Implementations must be safe for concurrent use, since the Manager
+// may authorize several identifiers at the same time.
+type ChallengeSolver interface {
+	// Present makes the response to chal available to the CA.
+	// The identifier is the domain name or the IP address being authorized.
+	// The identifier of a wildcard authorization is the base domain,
+	// without the "*." prefix.
+	Present(ctx context.Context, client *acme.Client, identifier string, chal *acme.Challenge) error
+
+	// CleanUp removes the response previously provisioned by Present,
+	// once the authorization is done.
+	CleanUp(ctx context.Context, client *acme.Client, identifier string, chal *acme.Challenge) error
+}
+
+// challengeCleanupTimeout is the maximum amount of time spent removing
+// the response to a challenge after the authorization is done.
+const challengeCleanupTimeout = time.Minute
+
+// challengeTypeOrder is the order of preference of the well-known
+// challenge types. Other types are tried after them.
+var challengeTypeOrder = []string{"dns-01", "tls-alpn-01", "http-01"}
+
+// solver returns the ChallengeSolver for the challenge type typ,
+// or nil if there's none.
+// The solvers in m.ChallengeSolvers take precedence over the default ones.
+func (m *Manager) solver(typ string) ChallengeSolver {
+	if s, ok := m.ChallengeSolvers[typ]; ok {
+		return s
+	}
+	switch typ {
+	case "tls-alpn-01":
+		return tlsALPN01Solver{m}
+	case "http-01":
+		return http01Solver{m}
+	case "dns-01":
+		if m.DNSProvider != nil {
+			return dns01Solver{m}
+		}
+	}
+	return nil
+}
+
+// supportedChallengeTypes returns the challenge types for which a solver
+// is available, in order of preference.
+//
+// The types of m.ChallengeSolvers come first: the user went out of their way
+// to configure them, most likely because the default ones can't work.
+// The same goes for DNSProvider.
+func (m *Manager) supportedChallengeTypes() []string {
+	m.challengeMu.RLock()
+	defer m.challengeMu.RUnlock()
+	var typ []string
+	for _, t := range challengeTypeOrder {
+		if _, ok := m.ChallengeSolvers[t]; ok {
+			typ = append(typ, t)
+		}
+	}
+	var other []string
+	for t := range m.ChallengeSolvers {
+		if !slices.Contains(challengeTypeOrder, t) {
+			other = append(other, t)
+		}
+	}
+	slices.Sort(other)
+	typ = append(typ, other...)
+
+	if m.DNSProvider != nil && !slices.Contains(typ, "dns-01") {
+		typ = append(typ, "dns-01")
+	}
+	if !slices.Contains(typ, "tls-alpn-01") {
+		typ = append(typ, "tls-alpn-01")
+	}
+	if m.tryHTTP01 && !slices.Contains(typ, "http-01") {
+		typ = append(typ, "http-01")
+	}
+	return typ
+}
+
+// fulfill provisions a response to the challenge chal with the solver
+// of its type. The cleanup is non-nil only if provisioning succeeded.
+func (m *Manager) fulfill(ctx context.Context, client *acme.Client, chal *acme.Challenge, identifier string) (cleanup func(), err error) {
+	s := m.solver(chal.Type)
+	if s == nil {
+		return nil, fmt.Errorf("acme/autocert: no solver for challenge type %q", chal.Type)
+	}
+	if err := s.Present(ctx, client, identifier, chal); err != nil {
+		return nil, err
+	}
+	return func() { go m.cleanupChallenge(s, client, identifier, chal) }, nil
+}
+
+// cleanupChallenge removes the response to chal provisioned by s.
+// It is run in its own goroutine once the authorization is done,
+// so it doesn't use the context of the authorization flow.
+func (m *Manager) cleanupChallenge(s ChallengeSolver, client *acme.Client, identifier string, chal *acme.Challenge) {
+	ctx, cancel := context.WithTimeout(context.Background(), challengeCleanupTimeout)
+	defer cancel()
+	_ = s.CleanUp(ctx, client, identifier, chal)
+}
+
+// tlsALPN01Solver is the default solver of the tls-alpn-01 challenge type.
+// The Manager's GetCertificate serves the challenge certificates.
+type tlsALPN01Solver struct {
+	m *Manager
+}
+
+func (s tlsALPN01Solver) Present(ctx context.Context, client *acme.Client, identifier string, chal *acme.Challenge) error {
+	cert, err := client.TLSALPN01ChallengeCert(chal.Token, identifier)
+	if err != nil {
+		return err
+	}
+	s.m.putCertToken(ctx, identifier, &cert)
+	return nil
+}
+
+func (s tlsALPN01Solver) CleanUp(ctx context.Context, client *acme.Client, identifier string, chal *acme.Challenge) error {
+	s.m.deleteCertToken(identifier)
+	return nil
+}
+
+// http01Solver is the default solver of the http-01 challenge type.
+// The Manager's HTTPHandler serves the challenge responses.
+type http01Solver struct {
+	m *Manager
+}
+
+func (s http01Solver) Present(ctx context.Context, client *acme.Client, identifier string, chal *acme.Challenge) error {
+	resp, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	s.m.putHTTPToken(ctx, client.HTTP01ChallengePath(chal.Token), resp)
+	return nil
+}
+
+func (s http01Solver) CleanUp(ctx context.Context, client *acme.Client, identifier string, chal *acme.Challenge) error {
+	s.m.deleteHTTPToken(client.HTTP01ChallengePath(chal.Token))
+	return nil
+}
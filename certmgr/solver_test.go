@@ -0,0 +1,148 @@
+package certmgr
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/acme/acmetest"
+)
+
+// recordingSolver is a dns-01 ChallengeSolver which provisions the records
+// with a fakeDNS and records the identifiers it is called with.
+type recordingSolver struct {
+	dns *fakeDNS
+
+	mu      sync.Mutex
+	present []string
+	cleanup chan string
+}
+
+func (s *recordingSolver) Present(ctx context.Context, client *acme.Client, identifier string, chal *acme.Challenge) error {
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.present = append(s.present, identifier)
+	s.mu.Unlock()
+	return s.dns.Present(ctx, dns01ChallengeFQDN(identifier), value)
+}
+
+func (s *recordingSolver) CleanUp(ctx context.Context, client *acme.Client, identifier string, chal *acme.Challenge) error {
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	defer func() { s.cleanup <- identifier }()
+	return s.dns.CleanUp(ctx, dns01ChallengeFQDN(identifier), value)
+}
+
+type nopSolver struct{}
+
+func (nopSolver) Present(context.Context, *acme.Client, string, *acme.Challenge) error {
+	return nil
+}
+
+func (nopSolver) CleanUp(context.Context, *acme.Client, string, *acme.Challenge) error {
+	return nil
+}
+
+func TestSupportedChallengeTypesSolvers(t *testing.T) {
+	tt := []struct {
+		name   string
+		man    *Manager
+		http01 bool
+		want   []string
+	}{
+		{"default", &Manager{}, false, []string{"tls-alpn-01"}},
+		{"http01", &Manager{}, true, []string{"tls-alpn-01", "http-01"}},
+		{
+			"customHTTP01",
+			&Manager{ChallengeSolvers: map[string]ChallengeSolver{"http-01": nopSolver{}}},
+			false,
+			[]string{"http-01", "tls-alpn-01"},
+		},
+		{
+			"customOrder",
+			&Manager{
+				DNSProvider: newFakeDNS(),
+				ChallengeSolvers: map[string]ChallengeSolver{
+					"tls-alpn-01": nopSolver{},
+					"b-01":        nopSolver{},
+					"a-01":        nopSolver{},
+				},
+			},
+			true,
+			[]string{"tls-alpn-01", "a-01", "b-01", "dns-01", "http-01"},
+		},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			if test.http01 {
+				test.man.HTTPHandler(nil)
+			}
+			if got := test.man.supportedChallengeTypes(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("supportedChallengeTypes = %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSolver(t *testing.T) {
+	man := &Manager{DNSProvider: newFakeDNS()}
+	if _, ok := man.solver("tls-alpn-01").(tlsALPN01Solver); !ok {
+		t.Error("tls-alpn-01: not the default solver")
+	}
+	if _, ok := man.solver("http-01").(http01Solver); !ok {
+		t.Error("http-01: not the default solver")
+	}
+	if _, ok := man.solver("dns-01").(dns01Solver); !ok {
+		t.Error("dns-01: not the DNSProvider solver")
+	}
+	if s := man.solver("unknown-01"); s != nil {
+		t.Errorf("unknown-01: solver = %T; want nil", s)
+	}
+	man.ChallengeSolvers = map[string]ChallengeSolver{"http-01": nopSolver{}}
+	if _, ok := man.solver("http-01").(nopSolver); !ok {
+		t.Error("http-01: custom solver doesn't replace the default one")
+	}
+	if s := (&Manager{}).solver("dns-01"); s != nil {
+		t.Errorf("dns-01 without DNSProvider: solver = %T; want nil", s)
+	}
+}
+
+func TestGetCertificateChallengeSolver(t *testing.T) {
+	dns := newFakeDNS()
+	ca := acmetest.NewCAServer(t).ChallengeTypes("tls-alpn-01", "dns-01")
+	ca.LookupTXT(dns.LookupTXT)
+	ca.Start()
+
+	solver := &recordingSolver{dns: dns, cleanup: make(chan string, 1)}
+	man := testManager(t)
+	man.Client = &acme.Client{DirectoryURL: ca.URL()}
+	man.ChallengeSolvers = map[string]ChallengeSolver{"dns-01": solver}
+
+	// The CA can't reach the host with tls-alpn-01,
+	// so only the custom solver can obtain the certificate.
+	if _, err := man.GetCertificate(clientHelloInfo(exampleDomain, algECDSA)); err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	solver.mu.Lock()
+	present := solver.present
+	solver.mu.Unlock()
+	if want := []string{exampleDomain}; !reflect.DeepEqual(present, want) {
+		t.Errorf("Present identifiers = %q; want %q", present, want)
+	}
+	select {
+	case id := <-solver.cleanup:
+		if id != exampleDomain {
+			t.Errorf("CleanUp identifier = %q; want %q", id, exampleDomain)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("CleanUp was not called")
+	}
+}
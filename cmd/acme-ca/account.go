@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/internal/jose"
+)
+
+// accountResponse returns the RFC 8555 representation of a.
+func (srv *server) accountResponse(a *account) any {
+	return struct {
+		Status  string   `json:"status"`
+		Contact []string `json:"contact,omitempty"`
+		Orders  string   `json:"orders"`
+	}{a.Status, a.Contact, srv.url("/account/%s/orders", a.ID)}
+}
+
+// accountByKey returns the account of the key with the given JWK
+// thumbprint, or nil if there's none. It requires srv.mu to be locked.
+func (srv *server) accountByKey(thumbprint string) (*account, error) {
+	var id string
+	if err := srv.store.get(kindKey, thumbprint, &id); err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	a := new(account)
+	if err := srv.store.get(kindAccount, id, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// currentAccount returns the account of req as currently stored, since
+// it may have changed after the request was authenticated.
+// It requires srv.mu to be locked.
+func (srv *server) currentAccount(req *request) (*account, *problem) {
+	a := new(account)
+	if err := srv.store.get(kindAccount, req.account.ID, a); err != nil {
+		return nil, serverInternal(err)
+	}
+	if a.Status != acme.StatusValid || a.Thumbprint != req.account.Thumbprint {
+		return nil, newProblem(http.StatusUnauthorized, "unauthorized", "the account has changed")
+	}
+	return a, nil
+}
+
+// handleNewAccount registers the key of req, or finds its account.
+// See RFC 8555, Section 7.3.
+func (srv *server) handleNewAccount(w http.ResponseWriter, req *request) *problem {
+	var payload struct {
+		Contact                []string        `json:"contact"`
+		OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+		ExternalAccountBinding json.RawMessage `json:"externalAccountBinding"`
+	}
+	if p := req.decode(&payload, false); p != nil {
+		return p
+	}
+	thumbprint, err := acme.JWKThumbprint(req.key)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badPublicKey", "%v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	a, err := srv.accountByKey(thumbprint)
+	if err != nil {
+		return serverInternal(err)
+	}
+	if a != nil {
+		w.Header().Set("Location", srv.url("/account/%s", a.ID))
+		writeJSON(w, http.StatusOK, srv.accountResponse(a))
+		return nil
+	}
+	if payload.OnlyReturnExisting {
+		return newProblem(http.StatusBadRequest, "accountDoesNotExist", "no account for the key")
+	}
+	if p := checkContact(payload.Contact); p != nil {
+		return p
+	}
+	var eabKeyID string
+	if len(srv.cfg.eabKeys) > 0 {
+		if len(payload.ExternalAccountBinding) == 0 {
+			return newProblem(http.StatusBadRequest, "externalAccountRequired", "an external account binding is required")
+		}
+		if eabKeyID, err = srv.verifyEAB(payload.ExternalAccountBinding, req); err != nil {
+			return newProblem(http.StatusUnauthorized, "unauthorized", "invalid external account binding: %v", err)
+		}
+	}
+
+	a = &account{
+		ID:         newID(),
+		Status:     acme.StatusValid,
+		Contact:    payload.Contact,
+		Key:        req.header.JWK,
+		Thumbprint: thumbprint,
+		EABKeyID:   eabKeyID,
+		CreatedAt:  srv.now(),
+	}
+	if err := srv.store.put(kindAccount, a.ID, a); err != nil {
+		return serverInternal(err)
+	}
+	if err := srv.store.put(kindKey, thumbprint, a.ID); err != nil {
+		return serverInternal(err)
+	}
+	w.Header().Set("Location", srv.url("/account/%s", a.ID))
+	writeJSON(w, http.StatusCreated, srv.accountResponse(a))
+	return nil
+}
+
+// verifyEAB verifies the external account binding of a new-account
+// request and returns its key ID. See RFC 8555, Section 7.3.4.
+func (srv *server) verifyEAB(raw json.RawMessage, req *request) (string, error) {
+	jws, header, payload, err := jose.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	key, ok := srv.cfg.eabKeys[header.KID]
+	if !ok {
+		return "", errors.New("unknown key ID")
+	}
+	if header.URL != req.header.URL {
+		return "", errors.New("url doesn't match the request URL")
+	}
+	if err := jws.VerifyMAC(header.Alg, key); err != nil {
+		return "", err
+	}
+	// The binding signs the account key.
+	bound, err := jose.ParseJWK(payload)
+	if err != nil {
+		return "", err
+	}
+	if !publicKeysEqual(bound, req.key) {
+		return "", errors.New("the bound key isn't the account key")
+	}
+	return header.KID, nil
+}
+
+// checkContact checks the contact URLs of an account.
+func checkContact(contact []string) *problem {
+	for _, c := range contact {
+		u, err := url.Parse(c)
+		if err != nil || u.Scheme != "mailto" || !strings.Contains(u.Opaque, "@") {
+			return newProblem(http.StatusBadRequest, "invalidContact", "invalid contact %q", c)
+		}
+	}
+	return nil
+}
+
+// handleAccount updates or deactivates the account of the request,
+// or returns it for POST-as-GET requests. See RFC 8555, Section 7.3.2.
+func (srv *server) handleAccount(w http.ResponseWriter, req *request) *problem {
+	var payload struct {
+		Contact []string `json:"contact"`
+		Status  string   `json:"status"`
+	}
+	if p := req.decode(&payload, true); p != nil {
+		return p
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	a, p := srv.currentAccount(req)
+	if p != nil {
+		return p
+	}
+	if req.r.PathValue("id") != a.ID {
+		return newProblem(http.StatusForbidden, "unauthorized", "the account belongs to another key")
+	}
+	switch payload.Status {
+	case "":
+	case acme.StatusDeactivated:
+		a.Status = acme.StatusDeactivated
+	default:
+		return newProblem(http.StatusBadRequest, "malformed", "invalid account status %q", payload.Status)
+	}
+	if payload.Contact != nil {
+		if p := checkContact(payload.Contact); p != nil {
+			return p
+		}
+		a.Contact = payload.Contact
+	}
+	if len(req.payload) > 0 {
+		if err := srv.store.put(kindAccount, a.ID, a); err != nil {
+			return serverInternal(err)
+		}
+	}
+	w.Header().Set("Location", srv.url("/account/%s", a.ID))
+	writeJSON(w, http.StatusOK, srv.accountResponse(a))
+	return nil
+}
+
+// handleAccountOrders lists the orders of the account of the request.
+// See RFC 8555, Section 7.1.2.1.
+func (srv *server) handleAccountOrders(w http.ResponseWriter, req *request) *problem {
+	srv.mu.Lock()
+	a, p := srv.currentAccount(req)
+	srv.mu.Unlock()
+	if p != nil {
+		return p
+	}
+	if req.r.PathValue("id") != a.ID {
+		return newProblem(http.StatusForbidden, "unauthorized", "the account belongs to another key")
+	}
+	resp := struct {
+		Orders []string `json:"orders"`
+	}{Orders: []string{}}
+	for _, id := range a.Orders {
+		resp.Orders = append(resp.Orders, srv.url("/order/%s", id))
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+// handleKeyChange rolls the key of the account of req over to the key
+// which signed the inner JWS of the request. See RFC 8555, Section 7.3.5.
+func (srv *server) handleKeyChange(w http.ResponseWriter, req *request) *problem {
+	jws, header, payload, err := jose.Parse(req.payload)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", "inner %v", err)
+	}
+	if len(header.JWK) == 0 || header.KID != "" {
+		return newProblem(http.StatusBadRequest, "malformed", "inner JWS must be signed with a JWK")
+	}
+	if header.URL != req.header.URL {
+		return newProblem(http.StatusBadRequest, "malformed", "inner JWS url %q doesn't match the outer one", header.URL)
+	}
+	newKey, err := jose.ParseJWK(header.JWK)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badPublicKey", "%v", err)
+	}
+	if err := jws.Verify(header.Alg, newKey); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", "inner %v", err)
+	}
+	var p struct {
+		Account string          `json:"account"`
+		OldKey  json.RawMessage `json:"oldKey"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", "inner JWS payload: %v", err)
+	}
+	oldKey, err := jose.ParseJWK(p.OldKey)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", "oldKey: %v", err)
+	}
+	newThumbprint, err := acme.JWKThumbprint(newKey)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badPublicKey", "%v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	a, prob := srv.currentAccount(req)
+	if prob != nil {
+		return prob
+	}
+	if p.Account != srv.url("/account/%s", a.ID) || !publicKeysEqual(oldKey, req.key) {
+		return newProblem(http.StatusUnauthorized, "unauthorized", "account and oldKey don't match the signer of the request")
+	}
+	other, err := srv.accountByKey(newThumbprint)
+	if err != nil {
+		return serverInternal(err)
+	}
+	if other != nil {
+		w.Header().Set("Location", srv.url("/account/%s", other.ID))
+		return newProblem(http.StatusConflict, "malformed", "the new key is already in use")
+	}
+	oldThumbprint := a.Thumbprint
+	a.Key, a.Thumbprint = header.JWK, newThumbprint
+	if err := srv.store.put(kindKey, newThumbprint, a.ID); err != nil {
+		return serverInternal(err)
+	}
+	if err := srv.store.put(kindAccount, a.ID, a); err != nil {
+		return serverInternal(err)
+	}
+	if err := srv.store.delete(kindKey, oldThumbprint); err != nil {
+		return serverInternal(err)
+	}
+	writeJSON(w, http.StatusOK, srv.accountResponse(a))
+	return nil
+}
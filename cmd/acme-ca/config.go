@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of the CA, read from a JSON file.
+type Config struct {
+	// Listen is the address the ACME server listens on, such as ":14000".
+	Listen string `json:"listen"`
+
+	// BaseURL is the external URL of the ACME server, such as
+	// "https://ca.internal:14000", used in the directory, the resource
+	// URLs and the CRL distribution point of the certificates.
+	BaseURL string `json:"base_url"`
+
+	// TLSCert and TLSKey are the PEM files of the certificate of the
+	// ACME server. If empty, the server is served over plain HTTP,
+	// such as behind a TLS-terminating proxy.
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	// DataDir is the directory where the accounts, orders, authorizations,
+	// certificates and CRL are persisted.
+	DataDir string `json:"data_dir"`
+
+	// RootCert and RootKey are the PEM files of the root certificate and key.
+	// The root key is only needed by the init command to sign the
+	// intermediate, and can be kept offline afterwards.
+	RootCert string `json:"root_cert"`
+	RootKey  string `json:"root_key"`
+
+	// IntermediateCert and IntermediateKey are the PEM files of the
+	// intermediate certificate and key which sign the issued certificates
+	// and the CRL.
+	IntermediateCert string `json:"intermediate_cert"`
+	IntermediateKey  string `json:"intermediate_key"`
+
+	// KeyType is the type of the keys generated by the init command:
+	// "ecdsa-p256" (the default), "ecdsa-p384", "rsa-2048" or "rsa-4096".
+	KeyType string `json:"key_type"`
+
+	// Organization is the organization name of the generated root
+	// and intermediate certificates.
+	Organization string `json:"organization"`
+
+	// CertValidity is the validity period of the issued certificates.
+	// It defaults to 90 days.
+	CertValidity Duration `json:"cert_validity"`
+
+	// CRLValidity is the period between the thisUpdate and nextUpdate of the
+	// published CRL, which is regenerated halfway through and on every
+	// revocation. It defaults to 24 hours.
+	CRLValidity Duration `json:"crl_validity"`
+
+	// Challenges lists the enabled challenge types, amongst "http-01",
+	// "tls-alpn-01" and "dns-01". It defaults to all of them.
+	Challenges []string `json:"challenges"`
+
+	// HTTPPort and TLSPort are the ports the http-01 and tls-alpn-01
+	// challenges are validated on. They default to 80 and 443.
+	HTTPPort int `json:"http_port"`
+	TLSPort  int `json:"tls_port"`
+
+	// DNSServer is the "host:port" address of the DNS server used to
+	// resolve the identifiers and the dns-01 records. If empty,
+	// the system resolver is used.
+	DNSServer string `json:"dns_server"`
+
+	// ValidationTimeout bounds the validation of a challenge.
+	// It defaults to 30 seconds.
+	ValidationTimeout Duration `json:"validation_timeout"`
+
+	// EAB maps the key IDs of external account bindings to their
+	// base64url-encoded HMAC keys. If not empty, new accounts must be
+	// bound to one of them.
+	EAB map[string]string `json:"eab"`
+
+	eabKeys map[string][]byte // decoded EAB
+}
+
+// Duration is a time.Duration encoded in JSON as a string such as "2160h".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var challengeTypes = []string{"http-01", "tls-alpn-01", "dns-01"}
+
+// loadConfig reads the configuration file at name.
+func loadConfig(name string) (*Config, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("acme-ca: invalid config %s: %v", name, err)
+	}
+	if err := cfg.init(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// init sets the defaults of cfg and checks its values.
+func (cfg *Config) init() error {
+	if cfg.Listen == "" {
+		cfg.Listen = ":14000"
+	}
+	u, err := url.Parse(cfg.BaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("acme-ca: invalid base_url %q", cfg.BaseURL)
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return errors.New("acme-ca: tls_cert and tls_key must be set together")
+	}
+	if cfg.DataDir == "" {
+		return errors.New("acme-ca: data_dir is required")
+	}
+	if cfg.RootCert == "" || cfg.IntermediateCert == "" || cfg.IntermediateKey == "" {
+		return errors.New("acme-ca: root_cert, intermediate_cert and intermediate_key are required")
+	}
+	if cfg.KeyType == "" {
+		cfg.KeyType = "ecdsa-p256"
+	}
+	if cfg.Organization == "" {
+		cfg.Organization = "ACME CA"
+	}
+	if cfg.CertValidity <= 0 {
+		cfg.CertValidity = Duration(90 * 24 * time.Hour)
+	}
+	if cfg.CRLValidity <= 0 {
+		cfg.CRLValidity = Duration(24 * time.Hour)
+	}
+	if len(cfg.Challenges) == 0 {
+		cfg.Challenges = challengeTypes
+	}
+	for _, typ := range cfg.Challenges {
+		if !slices.Contains(challengeTypes, typ) {
+			return fmt.Errorf("acme-ca: unsupported challenge type %q", typ)
+		}
+	}
+	if cfg.HTTPPort == 0 {
+		cfg.HTTPPort = 80
+	}
+	if cfg.TLSPort == 0 {
+		cfg.TLSPort = 443
+	}
+	if cfg.ValidationTimeout <= 0 {
+		cfg.ValidationTimeout = Duration(30 * time.Second)
+	}
+	cfg.eabKeys = make(map[string][]byte, len(cfg.EAB))
+	for kid, v := range cfg.EAB {
+		key, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || len(key) == 0 {
+			return fmt.Errorf("acme-ca: invalid EAB key %q", kid)
+		}
+		cfg.eabKeys[kid] = key
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// crlFile is the file of the data directory the CRL is published to,
+// besides the /crl endpoint.
+const crlFile = "crl.der"
+
+// handleRevokeCert revokes a certificate on behalf of the account which
+// ordered it or of the holder of its key. See RFC 8555, Section 7.6.
+func (srv *server) handleRevokeCert(w http.ResponseWriter, req *request) *problem {
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if p := req.decode(&payload, false); p != nil {
+		return p
+	}
+	// The reason codes of RFC 5280, Section 5.3.1, but removeFromCRL.
+	if payload.Reason < 0 || payload.Reason > 10 || payload.Reason == 7 {
+		return newProblem(http.StatusBadRequest, "badRevocationReason", "invalid revocation reason %d", payload.Reason)
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", "invalid certificate encoding: %v", err)
+	}
+	x, err := x509.ParseCertificate(der)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", "invalid certificate: %v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	cert := new(certificate)
+	err = srv.store.get(kindCert, fmt.Sprintf("%x", x.SerialNumber), cert)
+	if errors.Is(err, errNotFound) || (err == nil && !bytes.Equal(cert.DER, der)) {
+		return newProblem(http.StatusNotFound, "malformed", "the certificate wasn't issued by this CA")
+	}
+	if err != nil {
+		return serverInternal(err)
+	}
+	if req.account != nil {
+		if cert.Account != req.account.ID {
+			return newProblem(http.StatusForbidden, "unauthorized", "the certificate was ordered by another account")
+		}
+	} else if !publicKeysEqual(x.PublicKey, req.key) {
+		return newProblem(http.StatusForbidden, "unauthorized", "the request isn't signed with the key of the certificate")
+	}
+	if cert.Revoked {
+		return newProblem(http.StatusBadRequest, "alreadyRevoked", "the certificate is already revoked")
+	}
+	cert.Revoked = true
+	cert.RevokedAt = srv.now()
+	cert.Reason = payload.Reason
+	// Index the revocation first, so that the certificate is never
+	// marked as revoked without being in the CRL.
+	if err := srv.updateCRL(cert); err != nil {
+		return serverInternal(err)
+	}
+	if err := srv.store.put(kindCert, cert.ID, cert); err != nil {
+		return serverInternal(err)
+	}
+	log.Printf("revoked certificate %s with reason %d", cert.ID, cert.Reason)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// updateCRL generates a new CRL of the revoked certificates which
+// haven't expired yet, and publishes it. See RFC 5280, Section 5.
+// The revoked certificate, if not nil, is added to the CRL.
+// It requires srv.mu to be locked.
+func (srv *server) updateCRL(revoked *certificate) error {
+	now := srv.now()
+	var state crlState
+	if err := srv.store.get(kindState, "crl", &state); err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	if revoked != nil {
+		state.Revoked = slices.DeleteFunc(state.Revoked, func(r revokedCert) bool { return r.ID == revoked.ID })
+		state.Revoked = append(state.Revoked, revokedCert{
+			ID:        revoked.ID,
+			NotAfter:  revoked.NotAfter,
+			RevokedAt: revoked.RevokedAt,
+			Reason:    revoked.Reason,
+		})
+	}
+	state.Revoked = slices.DeleteFunc(state.Revoked, func(r revokedCert) bool { return now.After(r.NotAfter) })
+	var entries []x509.RevocationListEntry
+	for _, r := range state.Revoked {
+		serial, ok := new(big.Int).SetString(r.ID, 16)
+		if !ok {
+			return fmt.Errorf("acme-ca: invalid serial number %q", r.ID)
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: r.RevokedAt,
+			ReasonCode:     r.Reason,
+		})
+	}
+
+	state.Number++
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(state.Number),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(time.Duration(srv.cfg.CRLValidity)),
+		RevokedCertificateEntries: entries,
+	}, srv.issuer.cert, srv.issuer.key)
+	if err != nil {
+		return fmt.Errorf("acme-ca: CRL: %v", err)
+	}
+	if err := srv.store.put(kindState, "crl", &state); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(srv.store.dir, crlFile), der); err != nil {
+		return err
+	}
+	srv.crl = der
+	return nil
+}
+
+// publishCRL regenerates the CRL halfway through its validity,
+// until ctx is done.
+func (srv *server) publishCRL(ctx context.Context) {
+	t := time.NewTicker(time.Duration(srv.cfg.CRLValidity) / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		srv.mu.Lock()
+		err := srv.updateCRL(nil)
+		srv.mu.Unlock()
+		if err != nil {
+			log.Printf("publishing the CRL: %v", err)
+		}
+	}
+}
+
+func (srv *server) handleCRL(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	crl := srv.crl
+	srv.mu.Unlock()
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+func (srv *server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: srv.issuer.root.Raw})
+}
+
+func (srv *server) handleIntermediate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/pkix-cert")
+	w.Write(srv.issuer.cert.Raw)
+}
@@ -0,0 +1,110 @@
+// Command acme-ca is a minimal ACME CA for internal PKIs, which issues
+// certificates from a private root to the ACME clients of the services,
+// such as certmgr.Manager with its DirectoryURL set to the directory of
+// the CA, BaseURL + "/directory".
+//
+// Usage:
+//
+//	acme-ca -config ca.json -init   # generate the missing root and intermediate
+//	acme-ca -config ca.json         # serve the ACME server
+//
+// The configuration file is a JSON object with the fields of Config.
+// A minimal configuration is:
+//
+//	{
+//		"base_url": "https://ca.internal:14000",
+//		"tls_cert": "tls.crt",
+//		"tls_key": "tls.key",
+//		"data_dir": "data",
+//		"root_cert": "root.crt",
+//		"root_key": "root.key",
+//		"intermediate_cert": "intermediate.crt",
+//		"intermediate_key": "intermediate.key",
+//		"eab": {"team-a": "<base64url HMAC key>"}
+//	}
+//
+// The accounts, orders, authorizations and certificates are persisted in
+// the data directory. The challenges are validated against the network,
+// and the CRL of the revoked certificates is published at BaseURL + "/crl"
+// and in the data directory. The root certificate to distribute to the
+// clients is served at BaseURL + "/root".
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	config := flag.String("config", "acme-ca.json", "configuration file")
+	initialize := flag.Bool("init", false, "generate the missing root and intermediate keys and certificates, and exit")
+	flag.Parse()
+
+	if err := run(*config, *initialize); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(config string, initialize bool) error {
+	cfg, err := loadConfig(config)
+	if err != nil {
+		return err
+	}
+	if initialize {
+		return initPKI(cfg)
+	}
+	iss, err := loadIssuer(cfg)
+	if err != nil {
+		return err
+	}
+	st, err := openStore(cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	srv, err := newServer(cfg, iss, st)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go srv.publishCRL(ctx)
+
+	hs := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           srv,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("serving %s/directory on %s", cfg.BaseURL, cfg.Listen)
+		if cfg.TLSCert != "" {
+			errCh <- hs.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			errCh <- hs.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = hs.Shutdown(shutdownCtx)
+	// Let the running validations record their outcome.
+	srv.validations.Wait()
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
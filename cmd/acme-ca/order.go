@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+)
+
+// orderResponse returns the RFC 8555 representation of o.
+func (srv *server) orderResponse(o *order) any {
+	resp := struct {
+		Status         string       `json:"status"`
+		Expires        time.Time    `json:"expires"`
+		Identifiers    []identifier `json:"identifiers"`
+		Authorizations []string     `json:"authorizations"`
+		Finalize       string       `json:"finalize"`
+		Certificate    string       `json:"certificate,omitempty"`
+		Error          *problem     `json:"error,omitempty"`
+	}{
+		Status:      o.Status,
+		Expires:     o.Expires,
+		Identifiers: o.Identifiers,
+		Finalize:    srv.url("/order/%s/finalize", o.ID),
+		Error:       o.Error,
+	}
+	for _, id := range o.Authzs {
+		resp.Authorizations = append(resp.Authorizations, srv.url("/authz/%s", id))
+	}
+	if o.Cert != "" {
+		resp.Certificate = srv.url("/cert/%s", o.Cert)
+	}
+	return resp
+}
+
+// authzResponse returns the RFC 8555 representation of z.
+func (srv *server) authzResponse(z *authz) any {
+	resp := struct {
+		Identifier identifier `json:"identifier"`
+		Status     string     `json:"status"`
+		Expires    time.Time  `json:"expires"`
+		Challenges []any      `json:"challenges"`
+		Wildcard   bool       `json:"wildcard,omitempty"`
+	}{
+		Identifier: z.Identifier,
+		Status:     z.Status,
+		Expires:    z.Expires,
+		Challenges: []any{},
+		Wildcard:   z.Wildcard,
+	}
+	for _, c := range z.Challenges {
+		resp.Challenges = append(resp.Challenges, srv.challengeResponse(z, c))
+	}
+	return resp
+}
+
+// challengeResponse returns the RFC 8555 representation of the challenge c of z.
+func (srv *server) challengeResponse(z *authz, c *challenge) any {
+	return struct {
+		Type      string    `json:"type"`
+		URL       string    `json:"url"`
+		Token     string    `json:"token"`
+		Status    string    `json:"status"`
+		Validated time.Time `json:"validated,omitzero"`
+		Error     *problem  `json:"error,omitempty"`
+	}{c.Type, srv.url("/chall/%s/%s", z.ID, c.Type), c.Token, c.Status, c.Validated, c.Error}
+}
+
+// checkIdentifier checks and normalizes an identifier of a new order.
+// DNS identifiers may have a wildcard as their leftmost label.
+func checkIdentifier(id identifier) (identifier, *problem) {
+	rejected := func(format string, a ...any) (identifier, *problem) {
+		p := newProblem(http.StatusBadRequest, "rejectedIdentifier", format, a...)
+		return id, p
+	}
+	switch id.Type {
+	case "dns":
+		name := strings.ToLower(id.Value)
+		labels := strings.Split(strings.TrimPrefix(name, "*."), ".")
+		if len(name) > 253 || net.ParseIP(name) != nil {
+			return rejected("invalid DNS name %q", id.Value)
+		}
+		for _, l := range labels {
+			if len(l) == 0 || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' ||
+				strings.Trim(l, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+				return rejected("invalid DNS name %q", id.Value)
+			}
+		}
+		return identifier{Type: "dns", Value: name}, nil
+	case "ip":
+		ip := net.ParseIP(id.Value)
+		if ip == nil {
+			return rejected("invalid IP address %q", id.Value)
+		}
+		return identifier{Type: "ip", Value: ip.String()}, nil
+	}
+	return id, newProblem(http.StatusBadRequest, "unsupportedIdentifier", "unsupported identifier type %q", id.Type)
+}
+
+// newToken returns a new random challenge token, see RFC 8555, Section 8.1.
+func newToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// handleNewOrder creates an order and its authorizations.
+// See RFC 8555, Section 7.4.
+func (srv *server) handleNewOrder(w http.ResponseWriter, req *request) *problem {
+	var payload struct {
+		Identifiers []identifier `json:"identifiers"`
+	}
+	if p := req.decode(&payload, false); p != nil {
+		return p
+	}
+	if len(payload.Identifiers) == 0 || len(payload.Identifiers) > 100 {
+		return newProblem(http.StatusBadRequest, "malformed", "an order must have between 1 and 100 identifiers")
+	}
+	now := srv.now()
+	o := &order{
+		ID:      newID(),
+		Account: req.account.ID,
+		Status:  acme.StatusPending,
+		Expires: now.Add(orderLifetime),
+	}
+	var authzs []*authz
+	for _, id := range payload.Identifiers {
+		id, p := checkIdentifier(id)
+		if p != nil {
+			return p
+		}
+		if slices.Contains(o.Identifiers, id) {
+			continue
+		}
+		o.Identifiers = append(o.Identifiers, id)
+		z := &authz{
+			ID:         newID(),
+			Account:    req.account.ID,
+			Status:     acme.StatusPending,
+			Expires:    o.Expires,
+			Identifier: id,
+		}
+		// Wildcard authorizations are for the base domain and can only
+		// be satisfied with dns-01. IP addresses can't use dns-01.
+		if base, ok := strings.CutPrefix(id.Value, "*."); ok {
+			z.Identifier.Value, z.Wildcard = base, true
+		}
+		for _, typ := range srv.cfg.Challenges {
+			if (z.Wildcard && typ != "dns-01") || (id.Type == "ip" && typ == "dns-01") {
+				continue
+			}
+			z.Challenges = append(z.Challenges, &challenge{Type: typ, Token: newToken(), Status: acme.StatusPending})
+		}
+		if len(z.Challenges) == 0 {
+			return newProblem(http.StatusBadRequest, "rejectedIdentifier", "no enabled challenge can validate %q", id.Value)
+		}
+		authzs = append(authzs, z)
+		o.Authzs = append(o.Authzs, z.ID)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	a, p := srv.currentAccount(req)
+	if p != nil {
+		return p
+	}
+	for _, z := range authzs {
+		if err := srv.store.put(kindAuthz, z.ID, z); err != nil {
+			return serverInternal(err)
+		}
+	}
+	if err := srv.store.put(kindOrder, o.ID, o); err != nil {
+		return serverInternal(err)
+	}
+	a.Orders = append(a.Orders, o.ID)
+	if err := srv.store.put(kindAccount, a.ID, a); err != nil {
+		return serverInternal(err)
+	}
+	w.Header().Set("Location", srv.url("/order/%s", o.ID))
+	writeJSON(w, http.StatusCreated, srv.orderResponse(o))
+	return nil
+}
+
+// getOrder returns the order id of the account of req, with its
+// status brought up to date. It requires srv.mu to be locked.
+func (srv *server) getOrder(req *request, id string) (*order, *problem) {
+	o := new(order)
+	if p := srv.get(req, kindOrder, id, o, &o.Account); p != nil {
+		return nil, p
+	}
+	if err := srv.updateOrder(o); err != nil {
+		return nil, serverInternal(err)
+	}
+	return o, nil
+}
+
+// getAuthz returns the authorization id of the account of req, with its
+// status brought up to date. It requires srv.mu to be locked.
+func (srv *server) getAuthz(req *request, id string) (*authz, *problem) {
+	z := new(authz)
+	if p := srv.get(req, kindAuthz, id, z, &z.Account); p != nil {
+		return nil, p
+	}
+	if (z.Status == acme.StatusPending || z.Status == acme.StatusValid) && srv.now().After(z.Expires) {
+		z.Status = acme.StatusExpired
+		if err := srv.store.put(kindAuthz, z.ID, z); err != nil {
+			return nil, serverInternal(err)
+		}
+	}
+	return z, nil
+}
+
+// get decodes the object id of the given kind into v and checks that its
+// owner, decoded into the account field, is the account of req.
+// It requires srv.mu to be locked.
+func (srv *server) get(req *request, kind, id string, v any, account *string) *problem {
+	err := srv.store.get(kind, id, v)
+	if errors.Is(err, errNotFound) {
+		return newProblem(http.StatusNotFound, "malformed", "no such resource")
+	}
+	if err != nil {
+		return serverInternal(err)
+	}
+	if *account != req.account.ID {
+		return newProblem(http.StatusForbidden, "unauthorized", "the resource belongs to another account")
+	}
+	return nil
+}
+
+// updateOrder updates the status of o from the status of its authorizations.
+// See RFC 8555, Section 7.1.6. It requires srv.mu to be locked.
+func (srv *server) updateOrder(o *order) error {
+	status := o.Status
+	switch {
+	case (o.Status == acme.StatusPending || o.Status == acme.StatusReady) && srv.now().After(o.Expires):
+		status = acme.StatusInvalid
+		o.Error = newProblem(http.StatusForbidden, "unauthorized", "the order has expired")
+	case o.Status == acme.StatusPending:
+		valid := 0
+		for _, id := range o.Authzs {
+			z := new(authz)
+			if err := srv.store.get(kindAuthz, id, z); err != nil {
+				return err
+			}
+			switch {
+			case z.Status == acme.StatusValid && !srv.now().After(z.Expires):
+				valid++
+			case z.Status != acme.StatusPending:
+				status = acme.StatusInvalid
+				o.Error = newProblem(http.StatusForbidden, "unauthorized", "authorization for %s is %s", z.Identifier.Value, z.Status)
+			}
+		}
+		if status == acme.StatusPending && valid == len(o.Authzs) {
+			status = acme.StatusReady
+		}
+	}
+	if status == o.Status {
+		return nil
+	}
+	o.Status = status
+	return srv.store.put(kindOrder, o.ID, o)
+}
+
+// handleOrder returns an order. See RFC 8555, Section 7.1.3.
+func (srv *server) handleOrder(w http.ResponseWriter, req *request) *problem {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	o, p := srv.getOrder(req, req.r.PathValue("id"))
+	if p != nil {
+		return p
+	}
+	writeJSON(w, http.StatusOK, srv.orderResponse(o))
+	return nil
+}
+
+// handleAuthz returns or deactivates an authorization.
+// See RFC 8555, Sections 7.5 and 7.5.2.
+func (srv *server) handleAuthz(w http.ResponseWriter, req *request) *problem {
+	var payload struct {
+		Status string `json:"status"`
+	}
+	if p := req.decode(&payload, true); p != nil {
+		return p
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	z, p := srv.getAuthz(req, req.r.PathValue("id"))
+	if p != nil {
+		return p
+	}
+	switch payload.Status {
+	case "":
+	case acme.StatusDeactivated:
+		if z.Status != acme.StatusPending && z.Status != acme.StatusValid {
+			return newProblem(http.StatusBadRequest, "malformed", "the authorization is %s", z.Status)
+		}
+		z.Status = acme.StatusDeactivated
+		if err := srv.store.put(kindAuthz, z.ID, z); err != nil {
+			return serverInternal(err)
+		}
+	default:
+		return newProblem(http.StatusBadRequest, "malformed", "invalid authorization status %q", payload.Status)
+	}
+	writeJSON(w, http.StatusOK, srv.authzResponse(z))
+	return nil
+}
+
+// handleChallenge starts the validation of a challenge, which proceeds
+// in the background. See RFC 8555, Section 7.5.1.
+func (srv *server) handleChallenge(w http.ResponseWriter, req *request) *problem {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	z, p := srv.getAuthz(req, req.r.PathValue("id"))
+	if p != nil {
+		return p
+	}
+	i := slices.IndexFunc(z.Challenges, func(c *challenge) bool { return c.Type == req.r.PathValue("type") })
+	if i < 0 {
+		return newProblem(http.StatusNotFound, "malformed", "no such challenge")
+	}
+	c := z.Challenges[i]
+	// Requests for challenges already processed or of
+	// finalized authorizations return them unchanged.
+	if len(req.payload) > 0 && c.Status == acme.StatusPending && z.Status == acme.StatusPending {
+		a, p := srv.currentAccount(req)
+		if p != nil {
+			return p
+		}
+		c.Status = acme.StatusProcessing
+		if err := srv.store.put(kindAuthz, z.ID, z); err != nil {
+			return serverInternal(err)
+		}
+		keyAuth := c.Token + "." + a.Thumbprint
+		chal, ident := *c, z.Identifier
+		srv.validations.Add(1)
+		go func() {
+			defer srv.validations.Done()
+			srv.validate(z.ID, chal, ident, keyAuth)
+		}()
+	}
+	w.Header().Add("Link", link(srv.url("/authz/%s", z.ID), "up"))
+	writeJSON(w, http.StatusOK, srv.challengeResponse(z, c))
+	return nil
+}
+
+// validate validates the challenge c of the authorization id,
+// and records the outcome.
+func (srv *server) validate(id string, c challenge, ident identifier, keyAuth string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(srv.cfg.ValidationTimeout))
+	defer cancel()
+	vp := srv.validator.validate(ctx, c.Type, ident, keyAuth)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	z := new(authz)
+	if err := srv.store.get(kindAuthz, id, z); err != nil {
+		log.Printf("validation of authorization %s: %v", id, err)
+		return
+	}
+	i := slices.IndexFunc(z.Challenges, func(x *challenge) bool { return x.Type == c.Type })
+	if i < 0 || z.Challenges[i].Status != acme.StatusProcessing || z.Status != acme.StatusPending {
+		return // deactivated meanwhile
+	}
+	if vp != nil {
+		z.Challenges[i].Status = acme.StatusInvalid
+		z.Challenges[i].Error = vp
+		z.Status = acme.StatusInvalid
+	} else {
+		now := srv.now()
+		z.Challenges[i].Status = acme.StatusValid
+		z.Challenges[i].Validated = now
+		z.Status = acme.StatusValid
+		z.Expires = now.Add(authzLifetime)
+	}
+	if err := srv.store.put(kindAuthz, id, z); err != nil {
+		log.Printf("validation of authorization %s: %v", id, err)
+	}
+}
+
+// handleFinalize issues the certificate of a ready order.
+// See RFC 8555, Section 7.4.
+func (srv *server) handleFinalize(w http.ResponseWriter, req *request) *problem {
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if p := req.decode(&payload, false); p != nil {
+		return p
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badCSR", "invalid CSR encoding: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(b)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badCSR", "invalid CSR: %v", err)
+	}
+	if p := checkCSRKey(csr, req.key); p != nil {
+		return p
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	o, p := srv.getOrder(req, req.r.PathValue("id"))
+	if p != nil {
+		return p
+	}
+	if o.Status != acme.StatusReady {
+		return newProblem(http.StatusForbidden, "orderNotReady", "the order is %s", o.Status)
+	}
+	if p := checkCSRNames(csr, o.Identifiers); p != nil {
+		return p
+	}
+	cert, err := srv.issue(csr, o)
+	if err != nil {
+		return serverInternal(err)
+	}
+	o.Status = acme.StatusValid
+	o.Cert = cert.ID
+	if err := srv.store.put(kindOrder, o.ID, o); err != nil {
+		return serverInternal(err)
+	}
+	w.Header().Set("Location", srv.url("/order/%s", o.ID))
+	writeJSON(w, http.StatusOK, srv.orderResponse(o))
+	return nil
+}
+
+// checkCSRKey checks the strength of the key of csr,
+// which must not be the account key.
+func checkCSRKey(csr *x509.CertificateRequest, accountKey any) *problem {
+	switch k := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return newProblem(http.StatusBadRequest, "badCSR", "RSA keys must have at least 2048 bits")
+		}
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() && k.Curve != elliptic.P384() {
+			return newProblem(http.StatusBadRequest, "badCSR", "ECDSA keys must use P-256 or P-384")
+		}
+	default:
+		return newProblem(http.StatusBadRequest, "badCSR", "unsupported key type %T", k)
+	}
+	if publicKeysEqual(csr.PublicKey, accountKey) {
+		return newProblem(http.StatusBadRequest, "badCSR", "the certificate key must not be the account key")
+	}
+	return nil
+}
+
+// checkCSRNames checks that the names of csr are the identifiers of the order.
+// The common name, if any, must be one of them.
+func checkCSRNames(csr *x509.CertificateRequest, ids []identifier) *problem {
+	var names []identifier
+	for _, name := range csr.DNSNames {
+		names = append(names, identifier{"dns", strings.ToLower(name)})
+	}
+	for _, ip := range csr.IPAddresses {
+		names = append(names, identifier{"ip", ip.String()})
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" &&
+		!slices.Contains(names, identifier{"dns", cn}) && !slices.Contains(names, identifier{"ip", cn}) {
+		return newProblem(http.StatusBadRequest, "badCSR", "the common name %q is not a subject alternative name", csr.Subject.CommonName)
+	}
+	for _, id := range ids {
+		if !slices.Contains(names, id) {
+			return newProblem(http.StatusBadRequest, "badCSR", "the CSR doesn't have the identifier %q", id.Value)
+		}
+	}
+	for _, n := range names {
+		if !slices.Contains(ids, n) {
+			return newProblem(http.StatusBadRequest, "badCSR", "the CSR has the unauthorized identifier %q", n.Value)
+		}
+	}
+	return nil
+}
+
+// issue signs and stores the certificate of csr for the order o.
+// It requires srv.mu to be locked.
+func (srv *server) issue(csr *x509.CertificateRequest, o *order) (*certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := srv.now()
+	notAfter := now.Add(time.Duration(srv.cfg.CertValidity))
+	if notAfter.After(srv.issuer.cert.NotAfter) {
+		notAfter = srv.issuer.cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
+		CRLDistributionPoints: []string{srv.url("/crl")},
+		IssuingCertificateURL: []string{srv.url("/intermediate")},
+	}
+	if len(csr.DNSNames) > 0 && len(csr.DNSNames[0]) <= 64 {
+		tmpl.Subject = pkix.Name{CommonName: csr.DNSNames[0]}
+	}
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, srv.issuer.cert, csr.PublicKey, srv.issuer.key)
+	if err != nil {
+		return nil, err
+	}
+	cert := &certificate{
+		ID:       fmt.Sprintf("%x", serial),
+		Account:  o.Account,
+		Order:    o.ID,
+		DER:      der,
+		NotAfter: tmpl.NotAfter,
+	}
+	if err := srv.store.put(kindCert, cert.ID, cert); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// handleCert returns the chain of an issued certificate, without the root.
+// See RFC 8555, Section 7.4.2.
+func (srv *server) handleCert(w http.ResponseWriter, req *request) *problem {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	cert := new(certificate)
+	if p := srv.get(req, kindCert, req.r.PathValue("id"), cert, &cert.Account); p != nil {
+		return p
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.DER})
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: srv.issuer.cert.Raw})
+	return nil
+}
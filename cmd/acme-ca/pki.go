@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"time"
+)
+
+// Validity periods of the certificates generated by the init command.
+const (
+	rootValidity         = 20 * 365 * 24 * time.Hour
+	intermediateValidity = 5 * 365 * 24 * time.Hour
+)
+
+// issuer is the intermediate which signs the certificates and the CRL.
+type issuer struct {
+	root *x509.Certificate
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// loadIssuer loads the root, the intermediate and its key.
+func loadIssuer(cfg *Config) (*issuer, error) {
+	root, err := readCert(cfg.RootCert)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := readCert(cfg.IntermediateCert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readKey(cfg.IntermediateKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := cert.CheckSignatureFrom(root); err != nil {
+		return nil, fmt.Errorf("acme-ca: intermediate is not signed by the root: %v", err)
+	}
+	if !publicKeysEqual(cert.PublicKey, key.Public()) {
+		return nil, errors.New("acme-ca: intermediate key doesn't match the intermediate certificate")
+	}
+	return &issuer{root: root, cert: cert, key: key}, nil
+}
+
+// initPKI generates the root and intermediate keys and certificates
+// which don't exist yet. Existing files are kept, so that a new
+// intermediate can be signed by an existing root. The key of an existing
+// certificate must exist and match it, it is never generated.
+func initPKI(cfg *Config) error {
+	if cfg.RootKey == "" {
+		return errors.New("acme-ca: root_key is required to initialize the PKI")
+	}
+	root, rootKey, err := readCertAndKey(cfg.RootCert, cfg.RootKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		rootKey, err = readOrGenerateKey(cfg.RootKey, cfg.KeyType)
+		if err != nil {
+			return err
+		}
+		tmpl := &x509.Certificate{
+			Subject: pkix.Name{
+				Organization: []string{cfg.Organization},
+				CommonName:   cfg.Organization + " Root CA",
+			},
+			NotAfter:              time.Now().Add(rootValidity),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		root, err = createCert(cfg.RootCert, tmpl, nil, rootKey.Public(), rootKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, _, err = readCertAndKey(cfg.IntermediateCert, cfg.IntermediateKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := readOrGenerateKey(cfg.IntermediateKey, cfg.KeyType)
+		if err != nil {
+			return err
+		}
+		notAfter := time.Now().Add(intermediateValidity)
+		if notAfter.After(root.NotAfter) {
+			notAfter = root.NotAfter
+		}
+		tmpl := &x509.Certificate{
+			Subject: pkix.Name{
+				Organization: []string{cfg.Organization},
+				CommonName:   cfg.Organization + " Intermediate CA",
+			},
+			NotAfter:              notAfter,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}
+		_, err = createCert(cfg.IntermediateCert, tmpl, root, key.Public(), rootKey)
+		return err
+	}
+	return err
+}
+
+// readCertAndKey reads the certificate in the file certName and its key
+// in the file keyName, and checks that they match.
+func readCertAndKey(certName, keyName string) (*x509.Certificate, crypto.Signer, error) {
+	cert, err := readCert(certName)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := readKey(keyName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("acme-ca: %s exists but its key %s doesn't", certName, keyName)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !publicKeysEqual(cert.PublicKey, key.Public()) {
+		return nil, nil, fmt.Errorf("acme-ca: key %s doesn't match the certificate %s", keyName, certName)
+	}
+	return cert, key, nil
+}
+
+// createCert creates the certificate of tmpl signed by parent, or
+// self-signed if parent is nil, and writes it to the file name.
+func createCert(name string, tmpl, parent *x509.Certificate, pub crypto.PublicKey, priv crypto.Signer) (*x509.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, priv)
+	if err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(name, b, 0644); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// randomSerial returns a random positive 128-bit serial number.
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+func readCert(name string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("acme-ca: no certificate in %s", name)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readKey(name string) (crypto.Signer, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("acme-ca: no private key in %s", name)
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("acme-ca: unsupported private key type %q in %s", block.Type, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("acme-ca: invalid private key in %s: %v", name, err)
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("acme-ca: unsupported private key %T in %s", key, name)
+}
+
+// readOrGenerateKey reads the key in the file name, or generates
+// a key of type typ and writes it if the file doesn't exist.
+func readOrGenerateKey(name, typ string) (crypto.Signer, error) {
+	key, err := readKey(name)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return key, err
+	}
+	key, err = generateKey(typ)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(name, b, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// generateKey generates a key of type typ, see Config.KeyType.
+func generateKey(typ string) (crypto.Signer, error) {
+	switch typ {
+	case "ecdsa-p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ecdsa-p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "rsa-2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa-4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, fmt.Errorf("acme-ca: unsupported key type %q", typ)
+}
+
+// publicKeysEqual reports whether the public keys a and b are equal.
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitPKIExistingRoot(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		BaseURL:          "http://127.0.0.1",
+		DataDir:          filepath.Join(dir, "data"),
+		RootCert:         filepath.Join(dir, "root.crt"),
+		RootKey:          filepath.Join(dir, "root.key"),
+		IntermediateCert: filepath.Join(dir, "intermediate.crt"),
+		IntermediateKey:  filepath.Join(dir, "intermediate.key"),
+	}
+	if err := cfg.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := initPKI(cfg); err != nil {
+		t.Fatalf("initPKI: %v", err)
+	}
+	// A new intermediate is signed by the existing root.
+	if err := os.Remove(cfg.IntermediateCert); err != nil {
+		t.Fatal(err)
+	}
+	if err := initPKI(cfg); err != nil {
+		t.Fatalf("initPKI with an existing root: %v", err)
+	}
+	if _, err := loadIssuer(cfg); err != nil {
+		t.Fatalf("loadIssuer: %v", err)
+	}
+
+	// The key of an existing root is never generated.
+	if err := os.Remove(cfg.RootKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(cfg.IntermediateCert); err != nil {
+		t.Fatal(err)
+	}
+	if err := initPKI(cfg); err == nil {
+		t.Error("initPKI succeeded without the root key")
+	}
+	if _, err := os.Stat(cfg.RootKey); !os.IsNotExist(err) {
+		t.Errorf("root key was generated: %v", err)
+	}
+
+	// Nor does a mismatched key sign the intermediate.
+	if err := os.Rename(cfg.IntermediateKey, cfg.RootKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := initPKI(cfg); err == nil {
+		t.Error("initPKI succeeded with a mismatched root key")
+	}
+}
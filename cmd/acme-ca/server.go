@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+	"github.com/For-ACGN/autocert/internal/jose"
+)
+
+// Limits of the server.
+const (
+	maxRequestSize = 1 << 20
+	maxNonces      = 1 << 16
+	nonceLifetime  = time.Hour
+	orderLifetime  = 7 * 24 * time.Hour
+	authzLifetime  = 30 * 24 * time.Hour
+)
+
+// server is the ACME server of the CA, see RFC 8555.
+type server struct {
+	cfg       *Config
+	issuer    *issuer
+	store     *store
+	validator *validator
+	mux       *http.ServeMux
+
+	// mu serializes the accesses to the store, so that the
+	// read-modify-write sequences of the handlers are atomic.
+	mu  sync.Mutex
+	crl []byte // DER encoding of the current CRL
+
+	validations sync.WaitGroup // running challenge validations
+
+	noncesMu sync.Mutex
+	nonces   map[string]time.Time // issued nonces and their expiry
+
+	now func() time.Time // for tests
+}
+
+func newServer(cfg *Config, iss *issuer, st *store) (*server, error) {
+	srv := &server{
+		cfg:       cfg,
+		issuer:    iss,
+		store:     st,
+		validator: newValidator(cfg),
+		nonces:    make(map[string]time.Time),
+		now:       time.Now,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", srv.handleDirectory)
+	mux.HandleFunc("HEAD /new-nonce", srv.handleNewNonce)
+	mux.HandleFunc("GET /new-nonce", srv.handleNewNonce)
+	mux.HandleFunc("GET /crl", srv.handleCRL)
+	mux.HandleFunc("GET /root", srv.handleRoot)
+	mux.HandleFunc("GET /intermediate", srv.handleIntermediate)
+	mux.Handle("POST /new-account", srv.post(srv.handleNewAccount))
+	mux.Handle("POST /key-change", srv.post(srv.handleKeyChange))
+	mux.Handle("POST /account/{id}", srv.post(srv.handleAccount))
+	mux.Handle("POST /account/{id}/orders", srv.post(srv.handleAccountOrders))
+	mux.Handle("POST /new-order", srv.post(srv.handleNewOrder))
+	mux.Handle("POST /order/{id}", srv.post(srv.handleOrder))
+	mux.Handle("POST /order/{id}/finalize", srv.post(srv.handleFinalize))
+	mux.Handle("POST /authz/{id}", srv.post(srv.handleAuthz))
+	mux.Handle("POST /chall/{id}/{type}", srv.post(srv.handleChallenge))
+	mux.Handle("POST /cert/{id}", srv.post(srv.handleCert))
+	mux.Handle("POST /revoke-cert", srv.post(srv.handleRevokeCert))
+	srv.mux = mux
+
+	if err := srv.updateCRL(nil); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+func (srv *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Path != "/directory" {
+		w.Header().Add("Link", link(srv.url("/directory"), "index"))
+	}
+	srv.mux.ServeHTTP(w, r)
+}
+
+// url returns the external URL of path.
+func (srv *server) url(path string, a ...any) string {
+	return srv.cfg.BaseURL + fmt.Sprintf(path, a...)
+}
+
+func link(url, rel string) string {
+	return fmt.Sprintf("<%s>;rel=%q", url, rel)
+}
+
+func (srv *server) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"newNonce":   srv.url("/new-nonce"),
+		"newAccount": srv.url("/new-account"),
+		"newOrder":   srv.url("/new-order"),
+		"revokeCert": srv.url("/revoke-cert"),
+		"keyChange":  srv.url("/key-change"),
+		"meta": map[string]any{
+			"externalAccountRequired": len(srv.cfg.eabKeys) > 0,
+		},
+	})
+}
+
+func (srv *server) handleNewNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", srv.newNonce())
+	if r.Method == "GET" {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// newNonce returns a new anti-replay nonce, see RFC 8555, Section 6.5.
+// The nonces are only kept in memory: clients retry the requests
+// whose nonce is rejected after a restart.
+func (srv *server) newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	now := srv.now()
+	srv.noncesMu.Lock()
+	defer srv.noncesMu.Unlock()
+	if len(srv.nonces) >= maxNonces {
+		for n, exp := range srv.nonces {
+			if now.After(exp) || len(srv.nonces) >= maxNonces {
+				delete(srv.nonces, n)
+			}
+		}
+	}
+	srv.nonces[nonce] = now.Add(nonceLifetime)
+	return nonce
+}
+
+// useNonce reports whether nonce was issued and not used yet.
+func (srv *server) useNonce(nonce string) bool {
+	srv.noncesMu.Lock()
+	defer srv.noncesMu.Unlock()
+	exp, ok := srv.nonces[nonce]
+	delete(srv.nonces, nonce)
+	return ok && !srv.now().After(exp)
+}
+
+// problem is an ACME error response, see RFC 8555, Section 6.7.
+type problem struct {
+	Type        string       `json:"type"`
+	Detail      string       `json:"detail"`
+	Status      int          `json:"status,omitempty"`
+	Subproblems []subproblem `json:"subproblems,omitempty"`
+}
+
+// subproblem is a problem specific to one identifier of a request,
+// see RFC 8555, Section 6.7.1.
+type subproblem struct {
+	Type       string     `json:"type"`
+	Detail     string     `json:"detail"`
+	Identifier identifier `json:"identifier"`
+}
+
+// newProblem returns a problem with the given status code and the
+// ACME error type typ, such as "malformed".
+func newProblem(status int, typ, format string, a ...any) *problem {
+	return &problem{
+		Type:   "urn:ietf:params:acme:error:" + typ,
+		Detail: fmt.Sprintf(format, a...),
+		Status: status,
+	}
+}
+
+func (p *problem) Error() string {
+	return fmt.Sprintf("%d %s: %s", p.Status, p.Type, p.Detail)
+}
+
+func writeProblem(w http.ResponseWriter, p *problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// request is a POST request authenticated by its JWS signature.
+type request struct {
+	r       *http.Request
+	header  *jose.Header
+	payload []byte           // empty for POST-as-GET requests
+	key     crypto.PublicKey // key which signed the request
+	account *account         // nil if signed with a JWK
+}
+
+// decode decodes the JSON payload of the request into v. It returns
+// a malformed problem for POST-as-GET requests unless empty is true.
+func (r *request) decode(v any, empty bool) *problem {
+	if len(r.payload) == 0 {
+		if empty {
+			return nil
+		}
+		return newProblem(http.StatusBadRequest, "malformed", "the request has no payload")
+	}
+	if err := json.Unmarshal(r.payload, v); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", "invalid payload: %v", err)
+	}
+	return nil
+}
+
+// handlerFunc handles an authenticated request. Returning a problem
+// writes it as the response.
+type handlerFunc func(w http.ResponseWriter, req *request) *problem
+
+// post returns the handler of authenticated POST requests. Only
+// new-account requests, and revocation requests authorized by the key of
+// the certificate, are signed with a JWK rather than by an account.
+func (srv *server) post(h handlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", srv.newNonce())
+		req, p := srv.verifyRequest(r)
+		if p == nil {
+			jwk := r.URL.Path == "/new-account" || r.URL.Path == "/revoke-cert"
+			switch {
+			case r.URL.Path == "/new-account" && req.account != nil:
+				p = newProblem(http.StatusBadRequest, "malformed", "new-account requests must be signed with a JWK")
+			case !jwk && req.account == nil:
+				p = newProblem(http.StatusBadRequest, "malformed", "requests must be signed with the key ID of an account")
+			}
+		}
+		if p == nil {
+			p = h(w, req)
+		}
+		if p != nil {
+			if p.Status >= http.StatusInternalServerError {
+				log.Printf("%s %s: %s", r.Method, r.URL.Path, p.Detail)
+			}
+			writeProblem(w, p)
+		}
+	})
+}
+
+// verifyRequest authenticates the JWS of the POST request r,
+// signed either with a JWK or by an account. See RFC 8555, Section 6.2.
+func (srv *server) verifyRequest(r *http.Request) (*request, *problem) {
+	if typ, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); typ != "application/jose+json" {
+		return nil, newProblem(http.StatusUnsupportedMediaType, "malformed", "invalid content type %q", typ)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxRequestSize))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "%v", err)
+	}
+	jws, header, payload, err := jose.Parse(body)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "%v", err)
+	}
+	if !srv.useNonce(header.Nonce) {
+		return nil, newProblem(http.StatusBadRequest, "badNonce", "JWS has an invalid anti-replay nonce")
+	}
+	if header.URL != srv.url("%s", r.URL.Path) {
+		return nil, newProblem(http.StatusUnauthorized, "unauthorized", "JWS url %q doesn't match the request URL", header.URL)
+	}
+	req := &request{r: r, header: header, payload: payload}
+	switch {
+	case len(header.JWK) > 0 && header.KID != "":
+		return nil, newProblem(http.StatusBadRequest, "malformed", "JWS has both jwk and kid")
+	case len(header.JWK) > 0:
+		req.key, err = jose.ParseJWK(header.JWK)
+		if err != nil {
+			return nil, newProblem(http.StatusBadRequest, "badPublicKey", "%v", err)
+		}
+	case header.KID != "":
+		id, ok := cutPrefix(header.KID, srv.url("/account/"))
+		a := new(account)
+		if ok {
+			srv.mu.Lock()
+			err = srv.store.get(kindAccount, id, a)
+			srv.mu.Unlock()
+		}
+		if !ok || errors.Is(err, errNotFound) {
+			return nil, newProblem(http.StatusBadRequest, "accountDoesNotExist", "no account %s", header.KID)
+		}
+		if err != nil {
+			return nil, serverInternal(err)
+		}
+		if a.Status != acme.StatusValid {
+			return nil, newProblem(http.StatusUnauthorized, "unauthorized", "account %s is %s", header.KID, a.Status)
+		}
+		if req.key, err = jose.ParseJWK(a.Key); err != nil {
+			return nil, serverInternal(err)
+		}
+		req.account = a
+	default:
+		return nil, newProblem(http.StatusBadRequest, "malformed", "JWS has neither jwk nor kid")
+	}
+	if err := jws.Verify(header.Alg, req.key); err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "%v", err)
+	}
+	return req, nil
+}
+
+// serverInternal returns the problem of an unexpected error,
+// such as a failure of the store.
+func serverInternal(err error) *problem {
+	return newProblem(http.StatusInternalServerError, "serverInternal", "%v", err)
+}
+
+// cutPrefix returns s without prefix, and reports whether it had
+// the prefix and what remains is not empty.
+func cutPrefix(s, prefix string) (string, bool) {
+	after, ok := strings.CutPrefix(s, prefix)
+	return after, ok && after != ""
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/For-ACGN/autocert/acme"
+)
+
+// testCA is a CA served for the tests, with a fresh PKI.
+type testCA struct {
+	*server
+	cfg *Config
+	url string
+}
+
+// newTestCA starts a CA whose configuration is adjusted by configure,
+// if not nil. The data directory of dir is reused if not empty.
+func newTestCA(t *testing.T, dir string, configure func(cfg *Config)) *testCA {
+	if dir == "" {
+		dir = t.TempDir()
+	}
+	ts := httptest.NewUnstartedServer(nil)
+	cfg := &Config{
+		BaseURL:          "http://" + ts.Listener.Addr().String(),
+		DataDir:          filepath.Join(dir, "data"),
+		RootCert:         filepath.Join(dir, "root.crt"),
+		RootKey:          filepath.Join(dir, "root.key"),
+		IntermediateCert: filepath.Join(dir, "intermediate.crt"),
+		IntermediateKey:  filepath.Join(dir, "intermediate.key"),
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := cfg.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := initPKI(cfg); err != nil {
+		t.Fatalf("initPKI: %v", err)
+	}
+	iss, err := loadIssuer(cfg)
+	if err != nil {
+		t.Fatalf("loadIssuer: %v", err)
+	}
+	st, err := openStore(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := newServer(cfg, iss, st)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	ts.Config.Handler = srv
+	ts.Start()
+	t.Cleanup(func() {
+		ts.Close()
+		srv.validations.Wait()
+	})
+	return &testCA{server: srv, cfg: cfg, url: cfg.BaseURL + "/directory"}
+}
+
+// verify verifies the leaf of chain for the name against the root of the CA.
+func (ca *testCA) verify(t *testing.T, chain [][]byte, name string) *x509.Certificate {
+	t.Helper()
+	if len(chain) != 2 {
+		t.Fatalf("chain of %d certificates; want 2", len(chain))
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediates := x509.NewCertPool()
+	inter, err := x509.ParseCertificate(chain[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediates.AddCert(inter)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.issuer.root)
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: name})
+	if err != nil {
+		t.Errorf("verifying the certificate of %s: %v", name, err)
+	}
+	return leaf
+}
+
+func newKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func register(t *testing.T, ca *testCA, key crypto.Signer) *acme.Client {
+	client := &acme.Client{Key: key, DirectoryURL: ca.url}
+	if _, err := client.Register(context.Background(), &acme.Account{}, acme.AcceptTOS); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	return client
+}
+
+// issue orders a certificate for ids, solving the challenges of type typ
+// with solve, and returns the issued chain and the certificate key.
+func issue(t *testing.T, client *acme.Client, ids []acme.AuthzID, typ string, solve func(z *acme.Authorization, c *acme.Challenge)) ([][]byte, crypto.Signer) {
+	t.Helper()
+	ctx := context.Background()
+	o, err := client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		t.Fatalf("AuthorizeOrder: %v", err)
+	}
+	for _, u := range o.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			t.Fatalf("GetAuthorization: %v", err)
+		}
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == typ {
+				chal = c
+			}
+		}
+		if chal == nil {
+			t.Fatalf("no %s challenge for %s", typ, z.Identifier.Value)
+		}
+		solve(z, chal)
+		if _, err := client.Accept(ctx, chal); err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		if _, err := client.WaitAuthorization(ctx, z.URI); err != nil {
+			t.Fatalf("WaitAuthorization: %v", err)
+		}
+	}
+	if _, err := client.WaitOrder(ctx, o.URI); err != nil {
+		t.Fatalf("WaitOrder: %v", err)
+	}
+	key := newKey(t)
+	tmpl := &x509.CertificateRequest{}
+	for _, id := range ids {
+		if id.Type == "ip" {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(id.Value))
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, id.Value)
+		}
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if err != nil {
+		t.Fatalf("CreateOrderCert: %v", err)
+	}
+	return chain, key
+}
+
+// txtRecords answers the dns-01 lookups of the validator.
+type txtRecords struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func (r *txtRecords) add(name, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.records == nil {
+		r.records = make(map[string][]string)
+	}
+	r.records[name] = append(r.records[name], value)
+}
+
+func (r *txtRecords) lookup(ctx context.Context, name string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.records[name], nil
+}
+
+// solveDNS01 returns the solver of the dns-01 challenges of client.
+func solveDNS01(t *testing.T, client *acme.Client, records *txtRecords) func(z *acme.Authorization, c *acme.Challenge) {
+	return func(z *acme.Authorization, c *acme.Challenge) {
+		v, err := client.DNS01ChallengeRecord(c.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records.add("_acme-challenge."+z.Identifier.Value+".", v)
+	}
+}
+
+func TestHTTP01(t *testing.T) {
+	var responses sync.Map
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := responses.Load(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, v.(string))
+	}))
+	defer hs.Close()
+	_, port, _ := net.SplitHostPort(hs.Listener.Addr().String())
+
+	ca := newTestCA(t, "", func(cfg *Config) {
+		cfg.Challenges = []string{"http-01"}
+		cfg.HTTPPort, _ = strconv.Atoi(port)
+	})
+	client := register(t, ca, newKey(t))
+	chain, _ := issue(t, client, acme.IPIDs("127.0.0.1"), "http-01", func(z *acme.Authorization, c *acme.Challenge) {
+		v, err := client.HTTP01ChallengeResponse(c.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses.Store(client.HTTP01ChallengePath(c.Token), v)
+	})
+	leaf := ca.verify(t, chain, "127.0.0.1")
+	if got := leaf.CRLDistributionPoints; len(got) != 1 || got[0] != ca.cfg.BaseURL+"/crl" {
+		t.Errorf("CRLDistributionPoints = %q; want the CRL of the CA", got)
+	}
+
+	// The challenge fails without the response.
+	ctx := context.Background()
+	o, err := client.AuthorizeOrder(ctx, acme.IPIDs("127.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := client.GetAuthorization(ctx, o.AuthzURLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Accept(ctx, z.Challenges[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WaitAuthorization(ctx, z.URI); err == nil {
+		t.Error("WaitAuthorization: authorization is valid without a challenge response")
+	}
+	if _, err := client.WaitOrder(ctx, o.URI); err == nil {
+		t.Error("WaitOrder: order is valid without a challenge response")
+	}
+}
+
+func TestTLSALPN01(t *testing.T) {
+	var certs sync.Map
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		NextProtos: []string{acme.ALPNProto},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if c, ok := certs.Load(hello.ServerName); ok {
+				return c.(*tls.Certificate), nil
+			}
+			return nil, errors.New("no certificate")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	ca := newTestCA(t, "", func(cfg *Config) {
+		cfg.Challenges = []string{"tls-alpn-01"}
+		cfg.TLSPort, _ = strconv.Atoi(port)
+	})
+	client := register(t, ca, newKey(t))
+	chain, _ := issue(t, client, acme.IPIDs("127.0.0.1"), "tls-alpn-01", func(z *acme.Authorization, c *acme.Challenge) {
+		cert, err := client.TLSALPN01ChallengeCert(c.Token, z.Identifier.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs.Store(reverseName(net.ParseIP(z.Identifier.Value)), &cert)
+	})
+	ca.verify(t, chain, "127.0.0.1")
+}
+
+func TestDNS01(t *testing.T) {
+	ca := newTestCA(t, "", nil)
+	records := new(txtRecords)
+	ca.validator.lookupTXT = records.lookup
+	client := register(t, ca, newKey(t))
+
+	// Wildcards can only be validated with dns-01.
+	ctx := context.Background()
+	o, err := client.AuthorizeOrder(ctx, acme.DomainIDs("*.example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := client.GetAuthorization(ctx, o.AuthzURLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(z.Challenges) != 1 || z.Challenges[0].Type != "dns-01" || !z.Wildcard {
+		t.Errorf("challenges of *.example.org = %+v; want dns-01 only", z.Challenges)
+	}
+
+	chain, _ := issue(t, client, acme.DomainIDs("example.org", "*.example.org"), "dns-01", solveDNS01(t, client, records))
+	leaf := ca.verify(t, chain, "www.example.org")
+	if leaf.Subject.CommonName != "example.org" {
+		t.Errorf("CommonName = %q; want example.org", leaf.Subject.CommonName)
+	}
+}
+
+func TestFinalize(t *testing.T) {
+	ca := newTestCA(t, "", nil)
+	records := new(txtRecords)
+	ca.validator.lookupTXT = records.lookup
+	client := register(t, ca, newKey(t))
+	ctx := context.Background()
+
+	o, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := func(names ...string) []byte {
+		b, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, newKey(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	var e *acme.Error
+	_, _, err = client.CreateOrderCert(ctx, o.FinalizeURL, csr("example.org"), true)
+	if !errors.As(err, &e) || e.ProblemType != "urn:ietf:params:acme:error:orderNotReady" {
+		t.Errorf("CreateOrderCert of a pending order: %v; want orderNotReady error", err)
+	}
+
+	z, err := client.GetAuthorization(ctx, o.AuthzURLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			solveDNS01(t, client, records)(z, c)
+			if _, err := client.Accept(ctx, c); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := client.WaitOrder(ctx, o.URI); err != nil {
+		t.Fatal(err)
+	}
+	for _, names := range [][]string{{"example.org", "example.com"}, {"example.com"}} {
+		_, _, err = client.CreateOrderCert(ctx, o.FinalizeURL, csr(names...), true)
+		if !errors.As(err, &e) || e.ProblemType != "urn:ietf:params:acme:error:badCSR" {
+			t.Errorf("CreateOrderCert for %q: %v; want badCSR error", names, err)
+		}
+	}
+	// The account key can't be the certificate key.
+	b, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"example.org"}}, client.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.CreateOrderCert(ctx, o.FinalizeURL, b, true)
+	if !errors.As(err, &e) || e.ProblemType != "urn:ietf:params:acme:error:badCSR" {
+		t.Errorf("CreateOrderCert with the account key: %v; want badCSR error", err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, csr("EXAMPLE.org"), true)
+	if err != nil {
+		t.Fatalf("CreateOrderCert: %v", err)
+	}
+	ca.verify(t, chain, "example.org")
+}
+
+func TestEAB(t *testing.T) {
+	hmacKey := []byte("0123456789abcdef0123456789abcdef")
+	ca := newTestCA(t, "", func(cfg *Config) {
+		cfg.EAB = map[string]string{"team-a": base64.RawURLEncoding.EncodeToString(hmacKey)}
+	})
+	ctx := context.Background()
+
+	var e *acme.Error
+	for _, eab := range []*acme.ExternalAccountBinding{
+		nil,
+		{KID: "team-b", Key: hmacKey},
+		{KID: "team-a", Key: []byte("wrong")},
+	} {
+		client := &acme.Client{Key: newKey(t), DirectoryURL: ca.url}
+		_, err := client.Register(ctx, &acme.Account{ExternalAccountBinding: eab}, acme.AcceptTOS)
+		if !errors.As(err, &e) || (e.StatusCode != http.StatusBadRequest && e.StatusCode != http.StatusUnauthorized) {
+			t.Errorf("Register with EAB %+v: %v; want an error", eab, err)
+		}
+	}
+
+	client := &acme.Client{Key: newKey(t), DirectoryURL: ca.url}
+	eab := &acme.ExternalAccountBinding{KID: "team-a", Key: hmacKey}
+	if _, err := client.Register(ctx, &acme.Account{ExternalAccountBinding: eab}, acme.AcceptTOS); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	thumbprint, err := acme.JWKThumbprint(client.Key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := ca.accountByKey(thumbprint)
+	if err != nil || a == nil || a.EABKeyID != "team-a" {
+		t.Errorf("account = %+v, %v; want account bound to team-a", a, err)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, nil)
+	records := new(txtRecords)
+	ca.validator.lookupTXT = records.lookup
+	ctx := context.Background()
+
+	client := register(t, ca, newKey(t))
+	a, err := client.UpdateReg(ctx, &acme.Account{Contact: []string{"mailto:admin@example.org"}})
+	if err != nil || len(a.Contact) != 1 {
+		t.Fatalf("UpdateReg = %+v, %v", a, err)
+	}
+	if _, err := client.UpdateReg(ctx, &acme.Account{Contact: []string{"http://example.org"}}); err == nil {
+		t.Error("UpdateReg: invalid contact accepted")
+	}
+	issue(t, client, acme.DomainIDs("example.org"), "dns-01", solveDNS01(t, client, records))
+
+	// The state is persisted across restarts.
+	ca = newTestCA(t, dir, nil)
+	client = &acme.Client{Key: client.Key, DirectoryURL: ca.url}
+	got, err := client.GetReg(ctx, "")
+	if err != nil {
+		t.Fatalf("GetReg after restart: %v", err)
+	}
+	if len(got.Contact) != 1 || got.Contact[0] != "mailto:admin@example.org" {
+		t.Errorf("Contact after restart = %q", got.Contact)
+	}
+	orders := ca.accountOrders(t, got)
+	if len(orders) != 1 {
+		t.Errorf("%d orders after restart; want 1", len(orders))
+	}
+
+	// The key rolls over to the new one.
+	if err := client.AccountKeyRollover(ctx, newKey(t)); err != nil {
+		t.Fatalf("AccountKeyRollover: %v", err)
+	}
+	if a, err := (&acme.Client{Key: client.Key, DirectoryURL: ca.url}).GetReg(ctx, ""); err != nil || a.URI != got.URI {
+		t.Errorf("GetReg with the new key = %v, %v; want %s", a, err, got.URI)
+	}
+
+	if err := client.DeactivateReg(ctx); err != nil {
+		t.Fatalf("DeactivateReg: %v", err)
+	}
+	_, err = client.AuthorizeOrder(ctx, acme.DomainIDs("example.org"))
+	var e *acme.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("AuthorizeOrder with a deactivated account: %v; want 401 error", err)
+	}
+}
+
+// accountOrders returns the orders of the account a, from the store
+// since the acme package has no method for the orders list.
+func (ca *testCA) accountOrders(t *testing.T, a *acme.Account) []string {
+	id, ok := strings.CutPrefix(a.URI, ca.cfg.BaseURL+"/account/")
+	if !ok || a.OrdersURL != a.URI+"/orders" {
+		t.Fatalf("account %s has orders at %s", a.URI, a.OrdersURL)
+	}
+	var stored account
+	if err := ca.store.get(kindAccount, id, &stored); err != nil {
+		t.Fatal(err)
+	}
+	return stored.Orders
+}
+
+func TestRevokeCert(t *testing.T) {
+	ca := newTestCA(t, "", nil)
+	records := new(txtRecords)
+	ca.validator.lookupTXT = records.lookup
+	ctx := context.Background()
+	client := register(t, ca, newKey(t))
+	other := register(t, ca, newKey(t))
+
+	chain1, _ := issue(t, client, acme.DomainIDs("example.org"), "dns-01", solveDNS01(t, client, records))
+	chain2, key := issue(t, client, acme.DomainIDs("example.com"), "dns-01", solveDNS01(t, client, records))
+	var e *acme.Error
+	err := other.RevokeCert(ctx, nil, chain1[0], acme.CRLReasonKeyCompromise)
+	if !errors.As(err, &e) || e.StatusCode != http.StatusForbidden {
+		t.Errorf("RevokeCert by another account: %v; want 403 error", err)
+	}
+	if err := client.RevokeCert(ctx, nil, chain1[0], acme.CRLReasonKeyCompromise); err != nil {
+		t.Fatalf("RevokeCert: %v", err)
+	}
+	if err := other.RevokeCert(ctx, key, chain2[0], acme.CRLReasonSuperseded); err != nil {
+		t.Fatalf("RevokeCert with the certificate key: %v", err)
+	}
+
+	res, err := http.Get(ca.cfg.BaseURL + "/crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	der, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("ParseRevocationList: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(ca.issuer.cert); err != nil {
+		t.Errorf("CRL signature: %v", err)
+	}
+	// One CRL at startup, and one per revocation.
+	if crl.Number.Int64() != 3 {
+		t.Errorf("CRL number = %d; want 3", crl.Number)
+	}
+	reasons := make(map[string]int)
+	for _, entry := range crl.RevokedCertificateEntries {
+		reasons[entry.SerialNumber.String()] = entry.ReasonCode
+	}
+	for _, c := range []struct {
+		chain  [][]byte
+		reason int
+	}{{chain1, 1}, {chain2, 4}} {
+		leaf, err := x509.ParseCertificate(c.chain[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := reasons[leaf.SerialNumber.String()]; !ok || got != c.reason {
+			t.Errorf("CRL entry of %s = %d, %v; want reason %d", leaf.DNSNames, got, ok, c.reason)
+		}
+	}
+	published, err := os.ReadFile(filepath.Join(ca.cfg.DataDir, crlFile))
+	if err != nil || !bytes.Equal(published, der) {
+		t.Errorf("published CRL differs from the served one: %v", err)
+	}
+
+	// The expired certificates are dropped from the CRL and its index.
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.server.now = func() time.Time { return time.Now().Add(100 * 24 * time.Hour) }
+	if err := ca.updateCRL(nil); err != nil {
+		t.Fatalf("updateCRL: %v", err)
+	}
+	var state crlState
+	if err := ca.store.get(kindState, "crl", &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Revoked) != 0 {
+		t.Errorf("revoked index = %v; want empty", state.Revoked)
+	}
+	crl, err = x509.ParseRevocationList(ca.crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(crl.RevokedCertificateEntries); n != 0 {
+		t.Errorf("CRL has %d entries after the certificates expired; want 0", n)
+	}
+}
+
+func TestNonces(t *testing.T) {
+	ca := newTestCA(t, "", nil)
+	nonce := ca.newNonce()
+	if !ca.useNonce(nonce) {
+		t.Error("useNonce: fresh nonce rejected")
+	}
+	if ca.useNonce(nonce) {
+		t.Error("useNonce: nonce accepted twice")
+	}
+	if ca.useNonce("unknown") {
+		t.Error("useNonce: unknown nonce accepted")
+	}
+}
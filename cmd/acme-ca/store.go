@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// errNotFound is returned by the store for missing objects.
+var errNotFound = errors.New("acme-ca: not found")
+
+// Kinds of the objects in the store, which are also the names of
+// the subdirectories of the data directory.
+const (
+	kindAccount = "accounts"
+	kindKey     = "keys" // account IDs by JWK thumbprint of their key
+	kindOrder   = "orders"
+	kindAuthz   = "authzs"
+	kindCert    = "certs"
+	kindState   = "state"
+)
+
+// store persists the objects of the CA as JSON files in a directory,
+// one file per object. It is not safe for concurrent use: the server
+// serializes the accesses.
+type store struct {
+	dir string
+}
+
+func openStore(dir string) (*store, error) {
+	for _, kind := range []string{kindAccount, kindKey, kindOrder, kindAuthz, kindCert, kindState} {
+		if err := os.MkdirAll(filepath.Join(dir, kind), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &store{dir: dir}, nil
+}
+
+// path returns the file of the object id of the given kind.
+// IDs come from request URLs, so they are restricted to
+// the base64url alphabet to stay within the directory.
+func (s *store) path(kind, id string) (string, error) {
+	if id == "" || strings.Trim(id, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		return "", errNotFound
+	}
+	return filepath.Join(s.dir, kind, id+".json"), nil
+}
+
+// get decodes the object id of the given kind into v.
+func (s *store) get(kind, id string, v any) error {
+	name, err := s.path(kind, id)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("acme-ca: corrupted %s: %v", name, err)
+	}
+	return nil
+}
+
+// put writes the object v as id of the given kind.
+func (s *store) put(kind, id string, v any) error {
+	name, err := s.path(kind, id)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(name, b)
+}
+
+// writeFile replaces the file name with the data b atomically, so that
+// a crash doesn't leave a partial file behind.
+func writeFile(name string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// delete removes the object id of the given kind, if it exists.
+func (s *store) delete(kind, id string) error {
+	name, err := s.path(kind, id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// list returns the IDs of the objects of the given kind.
+func (s *store) list(kind string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, kind))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if id, ok := strings.CutSuffix(e.Name(), ".json"); ok && e.Type().IsRegular() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// newID returns a new random object ID.
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The objects of the store. Their RFC 8555 representations are built
+// by the accountResponse, orderResponse and authzResponse methods.
+
+type account struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"`
+	Contact    []string        `json:"contact,omitempty"`
+	Key        json.RawMessage `json:"key"` // JWK
+	Thumbprint string          `json:"thumbprint"`
+	EABKeyID   string          `json:"eab_key_id,omitempty"`
+	Orders     []string        `json:"orders,omitempty"` // IDs
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	ID          string       `json:"id"`
+	Account     string       `json:"account"`
+	Status      string       `json:"status"`
+	Expires     time.Time    `json:"expires"`
+	Identifiers []identifier `json:"identifiers"`
+	Authzs      []string     `json:"authzs"`         // IDs
+	Cert        string       `json:"cert,omitempty"` // ID of the issued cert
+	Error       *problem     `json:"error,omitempty"`
+}
+
+type authz struct {
+	ID         string       `json:"id"`
+	Account    string       `json:"account"`
+	Status     string       `json:"status"`
+	Expires    time.Time    `json:"expires"`
+	Identifier identifier   `json:"identifier"`
+	Wildcard   bool         `json:"wildcard,omitempty"`
+	Challenges []*challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type      string    `json:"type"`
+	Token     string    `json:"token"`
+	Status    string    `json:"status"`
+	Validated time.Time `json:"validated,omitzero"`
+	Error     *problem  `json:"error,omitempty"`
+}
+
+type certificate struct {
+	ID        string    `json:"id"` // serial number in hex
+	Account   string    `json:"account"`
+	Order     string    `json:"order"`
+	DER       []byte    `json:"der"`
+	NotAfter  time.Time `json:"not_after"`
+	Revoked   bool      `json:"revoked,omitempty"`
+	RevokedAt time.Time `json:"revoked_at,omitzero"`
+	Reason    int       `json:"reason,omitempty"`
+}
+
+// crlState is the persisted state of the CRL publication.
+// Revoked indexes the revoked certificates which haven't expired yet,
+// so that the CRL is built without reading every certificate.
+type crlState struct {
+	Number  int64         `json:"number"`
+	Revoked []revokedCert `json:"revoked,omitempty"`
+}
+
+type revokedCert struct {
+	ID        string    `json:"id"` // serial number in hex
+	NotAfter  time.Time `json:"not_after"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    int       `json:"reason,omitempty"`
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := &order{ID: newID(), Status: "pending", Identifiers: []identifier{{"dns", "example.org"}}}
+	if err := s.put(kindOrder, in.ID, in); err != nil {
+		t.Fatal(err)
+	}
+	out := new(order)
+	if err := s.get(kindOrder, in.ID, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Status != in.Status || len(out.Identifiers) != 1 || out.Identifiers[0] != in.Identifiers[0] {
+		t.Errorf("get = %+v; want %+v", out, in)
+	}
+	if ids, err := s.list(kindOrder); err != nil || len(ids) != 1 || ids[0] != in.ID {
+		t.Errorf("list = %q, %v; want [%s]", ids, err, in.ID)
+	}
+	if err := s.delete(kindOrder, in.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.get(kindOrder, in.ID, out); !errors.Is(err, errNotFound) {
+		t.Errorf("get after delete: %v; want errNotFound", err)
+	}
+
+	// IDs from URLs can't escape the directory.
+	for _, id := range []string{"", "../state/crl", "a/b", "."} {
+		if err := s.get(kindOrder, id, out); !errors.Is(err, errNotFound) {
+			t.Errorf("get(%q): %v; want errNotFound", id, err)
+		}
+	}
+}
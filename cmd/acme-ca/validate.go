@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxRedirects is the number of redirects followed by http-01 validations,
+// the same as Let's Encrypt.
+const maxRedirects = 10
+
+// idPeACMEIdentifier is the OID of the extension of the certificates
+// of tls-alpn-01 challenges, see RFC 8737, Section 6.1.
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// validator validates challenges against the network.
+type validator struct {
+	httpPort int
+	tlsPort  int
+	resolver *net.Resolver
+
+	// lookupTXT resolves the records of dns-01 challenges.
+	// It is resolver.LookupTXT, but in tests.
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+func newValidator(cfg *Config) *validator {
+	resolver := net.DefaultResolver
+	if cfg.DNSServer != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, cfg.DNSServer)
+			},
+		}
+	}
+	return &validator{
+		httpPort:  cfg.HTTPPort,
+		tlsPort:   cfg.TLSPort,
+		resolver:  resolver,
+		lookupTXT: resolver.LookupTXT,
+	}
+}
+
+// validate validates the challenge of type typ for the identifier id,
+// whose expected key authorization is keyAuth. It returns the problem
+// recorded in the challenge if the validation fails.
+func (v *validator) validate(ctx context.Context, typ string, id identifier, keyAuth string) *problem {
+	var err error
+	switch typ {
+	case "http-01":
+		err = v.validateHTTP01(ctx, id, keyAuth)
+	case "tls-alpn-01":
+		err = v.validateTLSALPN01(ctx, id, keyAuth)
+	case "dns-01":
+		err = v.validateDNS01(ctx, id, keyAuth)
+	default:
+		err = fmt.Errorf("unsupported challenge type %q", typ)
+	}
+	if err == nil {
+		return nil
+	}
+	var p *problem
+	if errors.As(err, &p) {
+		return p
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return newProblem(http.StatusBadRequest, "dns", "%s validation of %s: %v", typ, id.Value, err)
+	}
+	return newProblem(http.StatusBadRequest, "connection", "%s validation of %s: %v", typ, id.Value, err)
+}
+
+func unauthorized(format string, a ...any) error {
+	return newProblem(http.StatusForbidden, "unauthorized", format, a...)
+}
+
+func (v *validator) dialer() *net.Dialer {
+	return &net.Dialer{Resolver: v.resolver}
+}
+
+// validateHTTP01 fetches the key authorization from the identifier over HTTP.
+// See RFC 8555, Section 8.3.
+func (v *validator) validateHTTP01(ctx context.Context, id identifier, keyAuth string) error {
+	token, _, _ := strings.Cut(keyAuth, ".")
+	host := net.JoinHostPort(id.Value, strconv.Itoa(v.httpPort))
+	url := "http://" + host + "/.well-known/acme-challenge/" + token
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       v.dialer().DialContext,
+			DisableKeepAlives: true,
+			// Redirects to HTTPS are followed, with any certificate.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return v.checkRedirect(req.URL)
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return unauthorized("http-01 validation of %s: %s returned %s", id.Value, url, res.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<12))
+	if err != nil {
+		return err
+	}
+	if got := strings.TrimSpace(string(b)); got != keyAuth {
+		return unauthorized("http-01 validation of %s: key authorization %q doesn't match %q", id.Value, got, keyAuth)
+	}
+	return nil
+}
+
+// checkRedirect reports whether the http-01 validation may follow a
+// redirect to u. Like Let's Encrypt, only the http and https schemes are
+// followed, on the ports of the http-01 and tls-alpn-01 validations,
+// so that the redirects can't reach the other services of the host.
+func (v *validator) checkRedirect(u *url.URL) error {
+	var port, want string
+	switch u.Scheme {
+	case "http":
+		port, want = "80", strconv.Itoa(v.httpPort)
+	case "https":
+		port, want = "443", strconv.Itoa(v.tlsPort)
+	default:
+		return fmt.Errorf("redirect to unsupported scheme %q", u.Scheme)
+	}
+	if p := u.Port(); p != "" {
+		port = p
+	}
+	if port != want {
+		return fmt.Errorf("redirect to unsupported port %s", port)
+	}
+	return nil
+}
+
+// validateTLSALPN01 checks the challenge certificate served for the
+// acme-tls/1 protocol by the identifier. See RFC 8737, Section 3.
+func (v *validator) validateTLSALPN01(ctx context.Context, id identifier, keyAuth string) error {
+	const proto = "acme-tls/1"
+	serverName := id.Value
+	if id.Type == "ip" {
+		serverName = reverseName(net.ParseIP(id.Value)) // RFC 8738, Section 6
+	}
+	d := &tls.Dialer{
+		NetDialer: v.dialer(),
+		Config: &tls.Config{
+			ServerName:         serverName,
+			NextProtos:         []string{proto},
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS12,
+		},
+	}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(id.Value, strconv.Itoa(v.tlsPort)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.(*tls.Conn).ConnectionState()
+	if state.NegotiatedProtocol != proto {
+		return unauthorized("tls-alpn-01 validation of %s: negotiated protocol %q; want %q", id.Value, state.NegotiatedProtocol, proto)
+	}
+	if len(state.PeerCertificates) != 1 {
+		return unauthorized("tls-alpn-01 validation of %s: %d certificates; want 1", id.Value, len(state.PeerCertificates))
+	}
+	return checkTLSALPN01Cert(state.PeerCertificates[0], id, keyAuth)
+}
+
+// checkTLSALPN01Cert checks that cert only has the identifier as subject
+// alternative name and carries the digest of the key authorization.
+func checkTLSALPN01Cert(cert *x509.Certificate, id identifier, keyAuth string) error {
+	var ok bool
+	switch id.Type {
+	case "dns":
+		ok = len(cert.IPAddresses) == 0 && len(cert.DNSNames) == 1 && strings.EqualFold(cert.DNSNames[0], id.Value)
+	case "ip":
+		ok = len(cert.DNSNames) == 0 && len(cert.IPAddresses) == 1 && cert.IPAddresses[0].Equal(net.ParseIP(id.Value))
+	}
+	if !ok {
+		return unauthorized("tls-alpn-01 validation of %s: the certificate isn't for the identifier only", id.Value)
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	want, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return err
+	}
+	for _, x := range cert.Extensions {
+		if !x.Id.Equal(idPeACMEIdentifier) {
+			continue
+		}
+		if !x.Critical || !bytes.Equal(x.Value, want) {
+			return unauthorized("tls-alpn-01 validation of %s: invalid acmeIdentifier extension", id.Value)
+		}
+		return nil
+	}
+	return unauthorized("tls-alpn-01 validation of %s: no acmeIdentifier extension", id.Value)
+}
+
+// validateDNS01 looks the digest of the key authorization up in the
+// TXT records of the identifier. See RFC 8555, Section 8.4.
+func (v *validator) validateDNS01(ctx context.Context, id identifier, keyAuth string) error {
+	name := "_acme-challenge." + id.Value + "."
+	records, err := v.lookupTXT(ctx, name)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	if !slices.Contains(records, base64.RawURLEncoding.EncodeToString(sum[:])) {
+		return unauthorized("dns-01 validation of %s: no matching TXT record at %s", id.Value, name)
+	}
+	return nil
+}
+
+// reverseName returns the reverse DNS name of ip.
+func reverseName(ip net.IP) string {
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip4[i])
+		}
+		return b.String() + "in-addr.arpa"
+	}
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[i]&0xf, ip[i]>>4)
+	}
+	return b.String() + "ip6.arpa"
+}
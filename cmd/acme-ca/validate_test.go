@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/For-ACGN/autocert/acme"
+)
+
+func TestValidateDNS01(t *testing.T) {
+	v := &validator{lookupTXT: func(ctx context.Context, name string) ([]string, error) {
+		if name != "_acme-challenge.example.org." {
+			return nil, nil
+		}
+		sum := sha256.Sum256([]byte("token.thumbprint"))
+		return []string{"other", base64.RawURLEncoding.EncodeToString(sum[:])}, nil
+	}}
+	id := identifier{Type: "dns", Value: "example.org"}
+	if p := v.validate(context.Background(), "dns-01", id, "token.thumbprint"); p != nil {
+		t.Errorf("validate: %v", p)
+	}
+	if p := v.validate(context.Background(), "dns-01", id, "token.other"); p == nil || p.Type != "urn:ietf:params:acme:error:unauthorized" {
+		t.Errorf("validate with another key authorization: %v; want unauthorized problem", p)
+	}
+}
+
+func TestCheckTLSALPN01Cert(t *testing.T) {
+	client := &acme.Client{Key: newKey(t)}
+	keyAuth, err := client.HTTP01ChallengeResponse("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func(token, name string) *x509.Certificate {
+		c, err := client.TLSALPN01ChallengeCert(token, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	tests := []struct {
+		cert *x509.Certificate
+		id   identifier
+		ok   bool
+	}{
+		{parse("token", "example.org"), identifier{"dns", "example.org"}, true},
+		{parse("token", "192.0.2.1"), identifier{"ip", "192.0.2.1"}, true},
+		{parse("token", "example.com"), identifier{"dns", "example.org"}, false},
+		{parse("token", "192.0.2.2"), identifier{"ip", "192.0.2.1"}, false},
+		{parse("other", "example.org"), identifier{"dns", "example.org"}, false},
+	}
+	for i, tt := range tests {
+		err := checkTLSALPN01Cert(tt.cert, tt.id, keyAuth)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d: checkTLSALPN01Cert(%s) = %v; want ok %v", i, tt.id.Value, err, tt.ok)
+		}
+	}
+}
+
+func TestValidateHTTP01Redirect(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "other.thumbprint")
+	}))
+	defer other.Close()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/acme-challenge/token":
+			http.Redirect(w, r, srv.URL+"/moved", http.StatusFound)
+		case "/.well-known/acme-challenge/other":
+			http.Redirect(w, r, other.URL+"/moved", http.StatusFound)
+		case "/.well-known/acme-challenge/loop":
+			http.Redirect(w, r, r.URL.Path, http.StatusFound)
+		case "/moved":
+			io.WriteString(w, "token.thumbprint")
+		}
+	}))
+	defer srv.Close()
+	v := &validator{httpPort: srv.Listener.Addr().(*net.TCPAddr).Port, tlsPort: 443}
+	id := identifier{Type: "ip", Value: "127.0.0.1"}
+
+	if p := v.validate(context.Background(), "http-01", id, "token.thumbprint"); p != nil {
+		t.Errorf("validate: %v", p)
+	}
+	// Redirects to other ports and redirect loops are not followed.
+	for _, keyAuth := range []string{"other.thumbprint", "loop.thumbprint"} {
+		if p := v.validate(context.Background(), "http-01", id, keyAuth); p == nil {
+			t.Errorf("validate(%q) succeeded", keyAuth)
+		}
+	}
+}
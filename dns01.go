@@ -0,0 +1,333 @@
+package autocert
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dns01TTL is the TTL in seconds of the TXT records served by dns01.
+	dns01TTL = 60
+
+	// dns01UDPSize is the maximum size of the responses sent over UDP
+	// to the resolvers without EDNS(0), larger ones are truncated so
+	// that the resolver retries over TCP.
+	dns01UDPSize = 512
+
+	// dns01EDNSSize is the maximum size of the responses sent over UDP
+	// to the resolvers with EDNS(0), which announce the size they accept.
+	dns01EDNSSize = 1232
+
+	// dns01TCPTimeout is the maximum amount of time a TCP connection
+	// of dns01 may stay idle.
+	dns01TCPTimeout = 10 * time.Second
+)
+
+// dns01 is a tiny authoritative DNS server answering the queries of the
+// dns-01 challenges with the TXT records presented by the Manager.
+// The challenge names must be delegated to it with NS records.
+//
+// Start and Stop are reference counted, since the Manager may verify
+// several certificates at the same time.
+type dns01 struct {
+	addr   string
+	lookup func(fqdn string) []string
+
+	mu       sync.Mutex
+	refs     int
+	conn     net.PacketConn
+	listener net.Listener
+}
+
+func newDNS01(addr string, lookup func(fqdn string) []string) *dns01 {
+	return &dns01{addr: addr, lookup: lookup}
+}
+
+func (d *dns01) Start(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refs > 0 {
+		d.refs++
+		return nil
+	}
+	var lc net.ListenConfig
+	conn, err := lc.ListenPacket(ctx, "udp", d.addr)
+	if err != nil {
+		return err
+	}
+	// use the port of the UDP socket, in case addr has port 0
+	listener, err := listenContext(ctx, "tcp", conn.LocalAddr().String())
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	d.conn = conn
+	d.listener = listener
+	d.refs = 1
+	go d.serveUDP(conn)
+	go d.serveTCP(listener)
+	return nil
+}
+
+func (d *dns01) Stop() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refs == 0 {
+		return nil
+	}
+	d.refs--
+	if d.refs > 0 {
+		return nil
+	}
+	err := d.conn.Close()
+	lErr := d.listener.Close()
+	if err == nil {
+		err = lErr
+	}
+	d.conn = nil
+	d.listener = nil
+	return err
+}
+
+func (d *dns01) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		resp := d.answer(buf[:n], true)
+		if resp != nil {
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (d *dns01) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go d.handleTCP(conn)
+	}
+}
+
+func (d *dns01) handleTCP(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	for {
+		_ = conn.SetDeadline(time.Now().Add(dns01TCPTimeout))
+		b := make([]byte, 2)
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint16(b))
+		_, err = io.ReadFull(conn, req)
+		if err != nil {
+			return
+		}
+		resp := d.answer(req, false)
+		if resp == nil {
+			return
+		}
+		b = binary.BigEndian.AppendUint16(b[:0], uint16(len(resp)))
+		_, err = conn.Write(append(b, resp...))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the response to the DNS query req, received over UDP
+// if udp is true, or nil if req must be ignored.
+//
+// The server is authoritative for the challenge names delegated to it,
+// as the apexes of their zones. It answers NOERROR for every name, with
+// the presented records if any, or else with the SOA record of the name
+// in the authority section.
+func (d *dns01) answer(req []byte, udp bool) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil || h.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	resp := &dns01Response{
+		header: dnsmessage.Header{
+			ID:               h.ID,
+			Response:         true,
+			OpCode:           h.OpCode,
+			RecursionDesired: h.RecursionDesired,
+		},
+		question: q,
+	}
+	maxSize := 65535
+	if udp {
+		maxSize = dns01UDPSize
+	}
+	if size, ok := ednsSize(&p); ok {
+		resp.edns = true
+		if udp && size > maxSize {
+			maxSize = min(size, dns01EDNSSize)
+		}
+	}
+	switch {
+	case h.OpCode != 0:
+		resp.header.RCode = dnsmessage.RCodeNotImplemented
+	case q.Class != dnsmessage.ClassINET && q.Class != dnsmessage.ClassANY:
+		resp.header.RCode = dnsmessage.RCodeRefused
+	default:
+		resp.header.Authoritative = true
+		if q.Type == dnsmessage.TypeTXT || q.Type == dnsmessage.TypeALL {
+			resp.txt = d.lookup(q.Name.String())
+		}
+		resp.soa = q.Type == dnsmessage.TypeSOA || q.Type == dnsmessage.TypeALL
+		resp.noData = len(resp.txt) == 0 && !resp.soa
+	}
+
+	b, err := resp.build()
+	if err != nil {
+		return nil
+	}
+	if len(b) > maxSize {
+		resp.header.Truncated = true
+		resp.txt, resp.soa, resp.noData = nil, false, false
+		b, err = resp.build()
+		if err != nil {
+			return nil
+		}
+	}
+	return b
+}
+
+// ednsSize returns the UDP payload size of the OPT record of the query
+// parsed by p, positioned after the question, if it has one.
+func ednsSize(p *dnsmessage.Parser) (int, bool) {
+	err := p.SkipAllQuestions()
+	if err == nil {
+		err = p.SkipAllAnswers()
+	}
+	if err == nil {
+		err = p.SkipAllAuthorities()
+	}
+	for err == nil {
+		var rh dnsmessage.ResourceHeader
+		rh, err = p.AdditionalHeader()
+		if err != nil {
+			break
+		}
+		if rh.Type == dnsmessage.TypeOPT {
+			return int(rh.Class), true
+		}
+		err = p.SkipAdditional()
+	}
+	return 0, false
+}
+
+// dns01Response is a response of dns01.
+type dns01Response struct {
+	header   dnsmessage.Header
+	question dnsmessage.Question
+	txt      []string // TXT records of the answer
+	soa      bool     // whether the answer is the SOA record of the name
+	noData   bool     // whether the SOA record is in the authority section
+	edns     bool     // whether to add an OPT record
+}
+
+func (r *dns01Response) build() ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, r.header)
+	b.EnableCompression()
+	err := b.StartQuestions()
+	if err != nil {
+		return nil, err
+	}
+	err = b.Question(r.question)
+	if err != nil {
+		return nil, err
+	}
+	err = b.StartAnswers()
+	if err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{
+		Name:  r.question.Name,
+		Class: dnsmessage.ClassINET,
+		TTL:   dns01TTL,
+	}
+	for _, v := range r.txt {
+		err = b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{v}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.soa {
+		err = b.SOAResource(rh, r.soaResource())
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = b.StartAuthorities()
+	if err != nil {
+		return nil, err
+	}
+	if r.noData {
+		// The records are presented shortly before the validation,
+		// so their absence must not be cached.
+		rh.TTL = 0
+		err = b.SOAResource(rh, r.soaResource())
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = b.StartAdditionals()
+	if err != nil {
+		return nil, err
+	}
+	if r.edns {
+		var opt dnsmessage.ResourceHeader
+		err = opt.SetEDNS0(dns01EDNSSize, dnsmessage.RCodeSuccess, false)
+		if err != nil {
+			return nil, err
+		}
+		err = b.OPTResource(opt, dnsmessage.OPTResource{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// soaResource returns the SOA record of the queried name.
+func (r *dns01Response) soaResource() dnsmessage.SOAResource {
+	name := r.question.Name
+	mbox, err := dnsmessage.NewName("hostmaster." + name.String())
+	if err != nil {
+		mbox = name
+	}
+	return dnsmessage.SOAResource{
+		NS:      name,
+		MBox:    mbox,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		MinTTL:  0,
+	}
+}
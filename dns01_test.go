@@ -0,0 +1,165 @@
+package autocert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/For-ACGN/autocert/certmgr"
+)
+
+// dns01Resolver returns a resolver sending its queries to the server
+// of dns01 over the given network.
+func dns01Resolver(dns01 *dns01, network string) *net.Resolver {
+	addr := dns01.conn.LocalAddr().String()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func TestDNS01(t *testing.T) {
+	manager := &certmgr.Manager{}
+	provider := manager.LocalDNSProvider()
+	dns01 := newDNS01("127.0.0.1:0", manager.DNSToken)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := dns01.Start(ctx)
+	require.NoError(t, err)
+	// started again by a concurrent verification
+	err = dns01.Start(ctx)
+	require.NoError(t, err)
+
+	err = provider.Present(ctx, "_acme-challenge.example.com.", "value1")
+	require.NoError(t, err)
+	err = provider.Present(ctx, "_acme-challenge.example.com.", "value2")
+	require.NoError(t, err)
+
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			resolver := dns01Resolver(dns01, network)
+
+			txt, err := resolver.LookupTXT(ctx, "_acme-challenge.EXAMPLE.com.")
+			require.NoError(t, err)
+			require.ElementsMatch(t, []string{"value1", "value2"}, txt)
+
+			_, err = resolver.LookupTXT(ctx, "_acme-challenge.example.net.")
+			var dnsErr *net.DNSError
+			require.True(t, errors.As(err, &dnsErr))
+			require.True(t, dnsErr.IsNotFound)
+		})
+	}
+
+	// more records than a UDP response without EDNS(0) can hold
+	for i := 0; i < 20; i++ {
+		err = provider.Present(ctx, "_acme-challenge.example.org.", fmt.Sprintf("value%02d-%s", i, strings.Repeat("x", 32)))
+		require.NoError(t, err)
+	}
+	resolver := dns01Resolver(dns01, "udp")
+	txt, err := resolver.LookupTXT(ctx, "_acme-challenge.example.org.")
+	require.NoError(t, err)
+	require.Len(t, txt, 20)
+
+	// too many records for a UDP response
+	for i := 20; i < 40; i++ {
+		err = provider.Present(ctx, "_acme-challenge.example.org.", fmt.Sprintf("value%02d-%s", i, strings.Repeat("x", 32)))
+		require.NoError(t, err)
+	}
+	_, err = resolver.LookupTXT(ctx, "_acme-challenge.example.org.")
+	require.Error(t, err)
+	resolver = dns01Resolver(dns01, "tcp")
+	txt, err = resolver.LookupTXT(ctx, "_acme-challenge.example.org.")
+	require.NoError(t, err)
+	require.Len(t, txt, 40)
+
+	err = dns01.Stop()
+	require.NoError(t, err)
+	require.NotNil(t, dns01.conn)
+	err = dns01.Stop()
+	require.NoError(t, err)
+	require.Nil(t, dns01.conn)
+}
+
+func TestDNS01Answer(t *testing.T) {
+	manager := &certmgr.Manager{}
+	provider := manager.LocalDNSProvider()
+	dns01 := newDNS01("127.0.0.1:0", manager.DNSToken)
+	for i := 0; i < 20; i++ {
+		err := provider.Present(context.Background(), "_acme-challenge.example.org.", fmt.Sprintf("value%02d-%s", i, strings.Repeat("x", 32)))
+		require.NoError(t, err)
+	}
+
+	query := func(name string, typ dnsmessage.Type, edns, udp bool) *dnsmessage.Message {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1})
+		require.NoError(t, b.StartQuestions())
+		require.NoError(t, b.Question(dnsmessage.Question{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		}))
+		if edns {
+			require.NoError(t, b.StartAdditionals())
+			var opt dnsmessage.ResourceHeader
+			require.NoError(t, opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false))
+			require.NoError(t, b.OPTResource(opt, dnsmessage.OPTResource{}))
+		}
+		req, err := b.Finish()
+		require.NoError(t, err)
+		resp := dns01.answer(req, udp)
+		if udp && !edns {
+			require.LessOrEqual(t, len(resp), dns01UDPSize)
+		}
+		var msg dnsmessage.Message
+		require.NoError(t, msg.Unpack(resp))
+		require.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+		require.True(t, msg.Authoritative)
+		return &msg
+	}
+
+	// The size announced with EDNS(0) is honored over UDP.
+	msg := query("_acme-challenge.example.org.", dnsmessage.TypeTXT, false, true)
+	require.True(t, msg.Truncated)
+	require.Empty(t, msg.Answers)
+	msg = query("_acme-challenge.example.org.", dnsmessage.TypeTXT, true, true)
+	require.False(t, msg.Truncated)
+	require.Len(t, msg.Answers, 20)
+	require.Len(t, msg.Additionals, 1)
+	require.Equal(t, dnsmessage.TypeOPT, msg.Additionals[0].Header.Type)
+	msg = query("_acme-challenge.example.org.", dnsmessage.TypeTXT, false, false)
+	require.False(t, msg.Truncated)
+	require.Len(t, msg.Answers, 20)
+
+	// The names without records, including the apex, answer NODATA
+	// with an SOA record in the authority section.
+	for _, q := range []struct {
+		name string
+		typ  dnsmessage.Type
+	}{
+		{"_acme-challenge.example.net.", dnsmessage.TypeTXT},
+		{"_acme-challenge.example.org.", dnsmessage.TypeA},
+		{"_acme-challenge.example.org.", dnsmessage.TypeNS},
+	} {
+		msg = query(q.name, q.typ, false, true)
+		require.Empty(t, msg.Answers)
+		require.Len(t, msg.Authorities, 1)
+		require.Equal(t, dnsmessage.TypeSOA, msg.Authorities[0].Header.Type)
+		require.Equal(t, q.name, msg.Authorities[0].Header.Name.String())
+	}
+
+	// The apex of the delegated zone has an SOA record.
+	msg = query("_acme-challenge.example.net.", dnsmessage.TypeSOA, false, true)
+	require.Len(t, msg.Answers, 1)
+	require.Equal(t, dnsmessage.TypeSOA, msg.Answers[0].Header.Type)
+	require.Empty(t, msg.Authorities)
+}
@@ -0,0 +1,188 @@
+// Package jose parses and verifies the JSON Web Signatures of ACME requests,
+// on the server side. It is shared by the test and standalone ACME CAs.
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // for crypto.SHA384 and crypto.SHA512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JSONWebSignature is a JWS in the flattened JSON serialization,
+// see RFC 7515, Section 7.2.2.
+type JSONWebSignature struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// Header is the protected header of the JWS of ACME requests,
+// see RFC 8555, Section 6.2.
+type Header struct {
+	Alg   string          `json:"alg"`
+	JWK   json.RawMessage `json:"jwk"`
+	KID   string          `json:"kid"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+}
+
+// Parse decodes the protected header and the payload of the JWS in body,
+// without verifying its signature.
+func Parse(body []byte) (jws *JSONWebSignature, header *Header, payload []byte, err error) {
+	jws = new(JSONWebSignature)
+	if err := json.Unmarshal(body, jws); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid JWS: %v", err)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid JWS protected header: %v", err)
+	}
+	header = new(Header)
+	if err := json.Unmarshal(b, header); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid JWS protected header: %v", err)
+	}
+	payload, err = base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid JWS payload: %v", err)
+	}
+	return jws, header, payload, nil
+}
+
+// Verify verifies the signature of the JWS with the algorithm alg and key.
+func (jws *JSONWebSignature) Verify(alg string, key crypto.PublicKey) error {
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid JWS signature: %v", err)
+	}
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "ES384":
+		hash = crypto.SHA384
+	case "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported JWS algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(jws.Protected + "." + jws.Payload))
+	digest := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" || rsa.VerifyPKCS1v15(key, hash, digest, sig) != nil {
+			return errors.New("invalid JWS signature")
+		}
+	case *ecdsa.PublicKey:
+		// the algorithm is bound to the curve, see RFC 7518, Section 3.4
+		var want string
+		switch key.Curve {
+		case elliptic.P256():
+			want = "ES256"
+		case elliptic.P384():
+			want = "ES384"
+		case elliptic.P521():
+			want = "ES512"
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg != want || len(sig) != 2*size {
+			return errors.New("invalid JWS signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid JWS signature")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
+
+// VerifyMAC verifies the HMAC-SHA256 signature of the JWS with the
+// symmetric key, as used by external account bindings.
+// See RFC 8555, Section 7.3.4.
+func (jws *JSONWebSignature) VerifyMAC(alg string, key []byte) error {
+	if alg != "HS256" {
+		return fmt.Errorf("unsupported JWS MAC algorithm %q", alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid JWS signature: %v", err)
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(jws.Protected + "." + jws.Payload))
+	if !hmac.Equal(h.Sum(nil), sig) {
+		return errors.New("invalid JWS signature")
+	}
+	return nil
+}
+
+// ParseJWK parses the RSA or ECDSA public key of a JWK, see RFC 7518, Section 6.
+func ParseJWK(raw json.RawMessage) (crypto.PublicKey, error) {
+	var jwk struct {
+		Kty  string `json:"kty"`
+		Crv  string `json:"crv"`
+		X, Y string
+		N, E string
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return nil, fmt.Errorf("invalid JWK: %v", err)
+	}
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid JWK parameter %q", s)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := num(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid JWK exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported JWK curve %q", jwk.Crv)
+		}
+		x, err := num(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid JWK: point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported JWK key type %q", jwk.Kty)
+}
@@ -0,0 +1,235 @@
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// sign returns a JWS of the payload signed with key and the algorithm
+// alg, which is one of RS256, ES256, ES384, ES512 or HS256.
+func sign(t *testing.T, alg string, key any, payload string) *JSONWebSignature {
+	t.Helper()
+	jws := &JSONWebSignature{
+		Protected: base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `"}`)),
+		Payload:   base64.RawURLEncoding.EncodeToString([]byte(payload)),
+	}
+	input := []byte(jws.Protected + "." + jws.Payload)
+	hash := crypto.SHA256
+	switch alg {
+	case "ES384":
+		hash = crypto.SHA384
+	case "ES512":
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(input)
+		sig = mac.Sum(nil)
+	default:
+		t.Fatalf("unsupported key type %T", key)
+	}
+	jws.Signature = base64.RawURLEncoding.EncodeToString(sig)
+	return jws
+}
+
+// resign replaces the signature of jws with the result of f.
+func resign(jws *JSONWebSignature, f func(sig []byte) []byte) *JSONWebSignature {
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	out := *jws
+	out.Signature = base64.RawURLEncoding.EncodeToString(f(sig))
+	return &out
+}
+
+func mustGenerateECDSA(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerify(t *testing.T) {
+	p256 := mustGenerateECDSA(t, elliptic.P256())
+	p384 := mustGenerateECDSA(t, elliptic.P384())
+	p521 := mustGenerateECDSA(t, elliptic.P521())
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es256 := sign(t, "ES256", p256, "{}")
+
+	tt := []struct {
+		name    string
+		jws     *JSONWebSignature
+		alg     string
+		key     crypto.PublicKey
+		wantErr string
+	}{
+		{"ES256", es256, "ES256", &p256.PublicKey, ""},
+		{"ES384", sign(t, "ES384", p384, "{}"), "ES384", &p384.PublicKey, ""},
+		{"ES512", sign(t, "ES512", p521, "{}"), "ES512", &p521.PublicKey, ""},
+		{"RS256", sign(t, "RS256", rsaKey, "{}"), "RS256", &rsaKey.PublicKey, ""},
+
+		// wrong algorithm for the key
+		{"ES256 with P-384 key", sign(t, "ES256", p384, "{}"), "ES256", &p384.PublicKey, "invalid JWS signature"},
+		{"ES384 with P-256 key", es256, "ES384", &p256.PublicKey, "invalid JWS signature"},
+		{"RS256 with ECDSA key", es256, "RS256", &p256.PublicKey, "invalid JWS signature"},
+		{"ES256 with RSA key", sign(t, "RS256", rsaKey, "{}"), "ES256", &rsaKey.PublicKey, "invalid JWS signature"},
+		{"HS256", es256, "HS256", &p256.PublicKey, "unsupported JWS algorithm"},
+		{"none", es256, "none", &p256.PublicKey, "unsupported JWS algorithm"},
+
+		// wrong ECDSA signature length
+		{"short signature", resign(es256, func(sig []byte) []byte { return sig[:len(sig)-1] }), "ES256", &p256.PublicKey, "invalid JWS signature"},
+		{"long signature", resign(es256, func(sig []byte) []byte { return append([]byte{0}, sig...) }), "ES256", &p256.PublicKey, "invalid JWS signature"},
+		{"empty signature", resign(es256, func(sig []byte) []byte { return nil }), "ES256", &p256.PublicKey, "invalid JWS signature"},
+
+		{"other key", es256, "ES256", &mustGenerateECDSA(t, elliptic.P256()).PublicKey, "invalid JWS signature"},
+		{"tampered payload", &JSONWebSignature{Protected: es256.Protected, Payload: "e30x", Signature: es256.Signature}, "ES256", &p256.PublicKey, "invalid JWS signature"},
+		{"signature not base64url", &JSONWebSignature{Protected: es256.Protected, Payload: es256.Payload, Signature: "a+b/"}, "ES256", &p256.PublicKey, "invalid JWS signature"},
+		{"unsupported key", es256, "ES256", edKey, "unsupported key type"},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.jws.Verify(test.alg, test.key)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("Verify: %v; want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyMAC(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	hs256 := sign(t, "HS256", key, "{}")
+
+	tt := []struct {
+		name    string
+		jws     *JSONWebSignature
+		alg     string
+		key     []byte
+		wantErr string
+	}{
+		{"HS256", hs256, "HS256", key, ""},
+		{"bad HMAC", resign(hs256, func(sig []byte) []byte { sig[0] ^= 1; return sig }), "HS256", key, "invalid JWS signature"},
+		{"truncated HMAC", resign(hs256, func(sig []byte) []byte { return sig[:16] }), "HS256", key, "invalid JWS signature"},
+		{"other key", hs256, "HS256", []byte("another key"), "invalid JWS signature"},
+		{"tampered payload", &JSONWebSignature{Protected: hs256.Protected, Payload: "e30x", Signature: hs256.Signature}, "HS256", key, "invalid JWS signature"},
+		{"HS512", hs256, "HS512", key, "unsupported JWS MAC algorithm"},
+		{"ES256", hs256, "ES256", key, "unsupported JWS MAC algorithm"},
+		{"signature not base64url", &JSONWebSignature{Protected: hs256.Protected, Payload: hs256.Payload, Signature: "a+b/"}, "HS256", key, "invalid JWS signature"},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.jws.VerifyMAC(test.alg, test.key)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("VerifyMAC: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("VerifyMAC: %v; want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// ecJWK returns the JWK of an ECDSA public key on the named curve.
+func ecJWK(crv string, x, y *big.Int) json.RawMessage {
+	enc := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	return json.RawMessage(fmt.Sprintf(`{"kty":"EC","crv":%q,"x":%q,"y":%q}`, crv, enc(x), enc(y)))
+}
+
+func TestParseJWK(t *testing.T) {
+	p256 := mustGenerateECDSA(t, elliptic.P256())
+	p384 := mustGenerateECDSA(t, elliptic.P384())
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes())
+	offCurve := new(big.Int).Add(p256.Y, big.NewInt(1))
+
+	tt := []struct {
+		name    string
+		jwk     string
+		want    crypto.PublicKey
+		wantErr string
+	}{
+		{"P-256", string(ecJWK("P-256", p256.X, p256.Y)), &p256.PublicKey, ""},
+		{"P-384", string(ecJWK("P-384", p384.X, p384.Y)), &p384.PublicKey, ""},
+		{"RSA", `{"kty":"RSA","n":"` + n + `","e":"AQAB"}`, &rsaKey.PublicKey, ""},
+
+		{"point not on the curve", string(ecJWK("P-256", p256.X, offCurve)), nil, "point not on curve"},
+		{"point on another curve", string(ecJWK("P-256", p384.X, p384.Y)), nil, "point not on curve"},
+		{"unsupported curve", string(ecJWK("P-224", p256.X, p256.Y)), nil, "unsupported JWK curve"},
+		{"missing coordinate", `{"kty":"EC","crv":"P-256","x":"AQ"}`, nil, "invalid JWK parameter"},
+		{"coordinate not base64url", `{"kty":"EC","crv":"P-256","x":"a+b/","y":"AQ"}`, nil, "invalid JWK parameter"},
+		{"missing modulus", `{"kty":"RSA","e":"AQAB"}`, nil, "invalid JWK parameter"},
+		{"large exponent", `{"kty":"RSA","n":"` + n + `","e":"AQAAAAAB"}`, nil, "invalid JWK exponent"},
+		{"unsupported key type", `{"kty":"OKP","crv":"Ed25519","x":"AQ"}`, nil, "unsupported JWK key type"},
+		{"symmetric key", `{"kty":"oct","k":"AQ"}`, nil, "unsupported JWK key type"},
+		{"not JSON", `"kty"`, nil, "invalid JWK"},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := ParseJWK(json.RawMessage(test.jwk))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ParseJWK: %v; want error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseJWK: %v", err)
+			}
+			if k, ok := key.(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(test.want) {
+				t.Errorf("ParseJWK = %v; want %v", key, test.want)
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,14 +22,35 @@ type Config struct {
 	Domains []string
 	IPAddrs []string
 
+	// Groups declares named certificate groups, see certmgr.Manager.Groups.
+	Groups map[string][]string
+
+	// RenewBefore and RenewalRatio control when certificates are renewed,
+	// see certmgr.Manager for details.
+	RenewBefore  time.Duration
+	RenewalRatio float64
+
+	// KeyPolicy specifies the certificate key types and sizes,
+	// and KeyRotation when the keys are replaced upon renewal.
+	KeyPolicy   certmgr.KeyPolicy
+	KeyRotation certmgr.KeyRotation
+
 	ForceALPN bool
 	ForceHTTP bool
 
+	// DNS01Addr optionally is the address, such as ":53", of a built-in
+	// authoritative DNS server answering the dns-01 challenges, which is
+	// started during the verification like the servers of the other
+	// challenge types. The "_acme-challenge" name of each domain must be
+	// delegated to this host with NS records.
+	DNS01Addr string
+
 	Cache     certmgr.Cache
 	Client    *acme.Client
 	TLSConfig *tls.Config
 
 	OnCreateCert func(cert *tls.Certificate)
+	OnRotateKey  func(name string, cert *tls.Certificate)
 }
 
 // Listener is the ACME listener, it will wrap the connection.
@@ -41,6 +63,7 @@ type Listener struct {
 
 	tls01  *tls01
 	http01 *http01
+	dns01  *dns01
 
 	mu     sync.Mutex
 	ctx    context.Context
@@ -71,8 +94,15 @@ func NewListener(ctx context.Context, listener net.Listener, config *Config) (*L
 	var allowList []string
 	allowList = append(allowList, config.Domains...)
 	allowList = append(allowList, config.IPAddrs...)
-	if len(allowList) < 1 {
-		return nil, errors.New("must provide at least one domain or ip address")
+	if len(allowList) < 1 && len(config.Groups) < 1 {
+		return nil, errors.New("must provide at least one domain, ip address or group")
+	}
+	// one name is enough to provision the certificate of a group
+	hosts := slices.Clone(allowList)
+	for _, names := range config.Groups {
+		if host := groupHost(names); host != "" {
+			hosts = append(hosts, host)
+		}
 	}
 	// prepare certificate cache directory
 	cache := config.Cache
@@ -87,7 +117,7 @@ func NewListener(ctx context.Context, listener net.Listener, config *Config) (*L
 		tlsConfig = &tls.Config{}
 	}
 	tl := &Listener{
-		hosts:     allowList,
+		hosts:     hosts,
 		listener:  listener,
 		tlsConfig: tlsConfig.Clone(),
 	}
@@ -95,13 +125,23 @@ func NewListener(ctx context.Context, listener net.Listener, config *Config) (*L
 	manager := &certmgr.Manager{
 		Prompt:       certmgr.AcceptTOS,
 		HostPolicy:   certmgr.HostWhitelist(allowList...),
+		Groups:       config.Groups,
+		RenewBefore:  config.RenewBefore,
+		RenewalRatio: config.RenewalRatio,
+		KeyPolicy:    config.KeyPolicy,
+		KeyRotation:  config.KeyRotation,
 		Cache:        cache,
 		Client:       config.Client,
 		BeforeVerify: tl.startChallenge,
 		AfterVerify:  tl.stopChallenge,
 		OnCreateCert: config.OnCreateCert,
+		OnRotateKey:  config.OnRotateKey,
 	}
 	tl.manager = manager
+	if config.DNS01Addr != "" {
+		manager.DNSProvider = manager.LocalDNSProvider()
+		tl.dns01 = newDNS01(config.DNS01Addr, manager.DNSToken)
+	}
 	tl.tlsConfig.GetCertificate = manager.GetCertificate
 	// process force mode
 	switch {
@@ -148,6 +188,11 @@ func NewListener(ctx context.Context, listener net.Listener, config *Config) (*L
 		go tl.trigger()
 		return tl, nil
 	}
+	// dns-01 doesn't need port 443 or 80
+	if tl.dns01 != nil {
+		go tl.trigger()
+		return tl, nil
+	}
 	return nil, errors.New("failed to bind port 443 or 80 for ACME")
 }
 
@@ -209,23 +254,41 @@ func (l *Listener) adjustNextProtos() {
 }
 
 func (l *Listener) startChallenge(ctx context.Context) error {
+	if l.dns01 != nil {
+		err := l.dns01.Start(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	var err error
 	switch {
 	case l.tls01 != nil:
-		return l.tls01.Start(ctx)
+		err = l.tls01.Start(ctx)
 	case l.http01 != nil:
-		return l.http01.Start(ctx)
+		err = l.http01.Start(ctx)
+	}
+	// AfterVerify is not called if BeforeVerify failed
+	if err != nil && l.dns01 != nil {
+		_ = l.dns01.Stop()
 	}
-	return nil
+	return err
 }
 
 func (l *Listener) stopChallenge(ctx context.Context) error {
+	var err error
 	switch {
 	case l.tls01 != nil:
-		return l.tls01.Stop()
+		err = l.tls01.Stop()
 	case l.http01 != nil:
-		return l.http01.Stop(ctx)
+		err = l.http01.Stop(ctx)
+	}
+	if l.dns01 != nil {
+		dErr := l.dns01.Stop()
+		if err == nil {
+			err = dErr
+		}
 	}
-	return nil
+	return err
 }
 
 func (l *Listener) trigger() {
@@ -243,6 +306,21 @@ func (l *Listener) trigger() {
 	}
 }
 
+// groupHost returns the server name used to provision the certificate
+// of the group of names: its first non-wildcard name or, if there is
+// none, a name matched by its first wildcard name.
+func groupHost(names []string) string {
+	for _, name := range names {
+		if !strings.HasPrefix(name, "*.") {
+			return name
+		}
+	}
+	if len(names) > 0 {
+		return "autocert" + strings.TrimPrefix(names[0], "*")
+	}
+	return ""
+}
+
 func (l *Listener) preprovision() {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -49,3 +49,18 @@ func TestListen(t *testing.T) {
 		require.NoError(t, err)
 	})
 }
+
+func TestGroupHost(t *testing.T) {
+	for _, tt := range []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"example.com", "*.example.com"}, "example.com"},
+		{[]string{"*.example.com", "example.com"}, "example.com"},
+		{[]string{"*.example.com", "*.example.org"}, "autocert.example.com"},
+		{[]string{"*.example.com", "1.1.1.1"}, "1.1.1.1"},
+		{nil, ""},
+	} {
+		require.Equal(t, tt.want, groupHost(tt.names), "names: %v", tt.names)
+	}
+}